@@ -0,0 +1,111 @@
+package oz
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Capabilities maps the names of the capabilities of linux/capability.h to
+// their numbers
+var Capabilities = map[string]int{
+	"CAP_CHOWN":              0,
+	"CAP_DAC_OVERRIDE":       1,
+	"CAP_DAC_READ_SEARCH":    2,
+	"CAP_FOWNER":             3,
+	"CAP_FSETID":             4,
+	"CAP_KILL":               5,
+	"CAP_SETGID":             6,
+	"CAP_SETUID":             7,
+	"CAP_SETPCAP":            8,
+	"CAP_LINUX_IMMUTABLE":    9,
+	"CAP_NET_BIND_SERVICE":   10,
+	"CAP_NET_BROADCAST":      11,
+	"CAP_NET_ADMIN":          12,
+	"CAP_NET_RAW":            13,
+	"CAP_IPC_LOCK":           14,
+	"CAP_IPC_OWNER":          15,
+	"CAP_SYS_MODULE":         16,
+	"CAP_SYS_RAWIO":          17,
+	"CAP_SYS_CHROOT":         18,
+	"CAP_SYS_PTRACE":         19,
+	"CAP_SYS_PACCT":          20,
+	"CAP_SYS_ADMIN":          21,
+	"CAP_SYS_BOOT":           22,
+	"CAP_SYS_NICE":           23,
+	"CAP_SYS_RESOURCE":       24,
+	"CAP_SYS_TIME":           25,
+	"CAP_SYS_TTY_CONFIG":     26,
+	"CAP_MKNOD":              27,
+	"CAP_LEASE":              28,
+	"CAP_AUDIT_WRITE":        29,
+	"CAP_AUDIT_CONTROL":      30,
+	"CAP_SETFCAP":            31,
+	"CAP_MAC_OVERRIDE":       32,
+	"CAP_MAC_ADMIN":          33,
+	"CAP_SYSLOG":             34,
+	"CAP_WAKE_ALARM":         35,
+	"CAP_BLOCK_SUSPEND":      36,
+	"CAP_AUDIT_READ":         37,
+	"CAP_PERFMON":            38,
+	"CAP_BPF":                39,
+	"CAP_CHECKPOINT_RESTORE": 40,
+}
+
+// LastCapability returns the number of the last capability known to the
+// running kernel, or the last one of Capabilities if it cannot be read.
+func LastCapability() int {
+	last := 0
+	for _, c := range Capabilities {
+		if c > last {
+			last = c
+		}
+	}
+	bs, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return last
+	}
+	if n, err := strconv.Atoi(strings.TrimSpace(string(bs))); err == nil {
+		return n
+	}
+	return last
+}
+
+// BoundingCapsDrop returns the numbers of the capabilities to drop from the
+// bounding set of launched programs, up to the capability last: those of
+// drop_caps, or all but those of keep_caps.
+func (p *Profile) BoundingCapsDrop(last int) []int {
+	var caps []int
+	if len(p.KeepCaps) > 0 {
+		keep := make(map[int]bool)
+		for _, name := range p.KeepCaps {
+			keep[Capabilities[name]] = true
+		}
+		for c := 0; c <= last; c++ {
+			if !keep[c] {
+				caps = append(caps, c)
+			}
+		}
+		return caps
+	}
+	for _, name := range p.DropCaps {
+		if c := Capabilities[name]; c <= last {
+			caps = append(caps, c)
+		}
+	}
+	return caps
+}
+
+// validateCapabilities checks the capability names of drop_caps and keep_caps
+func (p *Profile) validateCapabilities() error {
+	if len(p.DropCaps) > 0 && len(p.KeepCaps) > 0 {
+		return fmt.Errorf("drop_caps and keep_caps cannot be used together")
+	}
+	for _, name := range append(append([]string{}, p.DropCaps...), p.KeepCaps...) {
+		if _, ok := Capabilities[name]; !ok {
+			return fmt.Errorf("unknown capability '%s'", name)
+		}
+	}
+	return nil
+}
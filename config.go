@@ -2,35 +2,65 @@ package oz
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"regexp"
 )
 
 type Config struct {
-	ProfileDir       string   `json:"profile_dir" desc:"Directory containing the sandbox profiles"`
-	ShellPath        string   `json:"shell_path" desc:"Path of the shell used when entering a sandbox"`
-	PrefixPath       string   `json:"prefix_path" desc:"Prefix path containing the oz executables"`
-	EtcPrefix        string   `json:"etc_prefix" desc:"Prefix for configuration files"`
-	SandboxPath      string   `json:"sandbox_path" desc:"Path of the sandboxes base"`
-	OpenVPNRunPath   string   `json:"openvpn_run_path" desc: "Path for OpenVPN run state"`
-	OpenVPNConfDir   string   `json:"openvpn_conf_dir" desc: "Path for OpenVPN conf files"`
-	OpenVPNGroup     string   `json:"openvpn_group" desc: "GID for OpenVPN process"`
-	RouteTableBase   int      `json:"route_table_base" desc: "Base for routing table"`
-	DivertSuffix     string   `json:"divert_suffix" desc:"Suffix using for dpkg-divert of application executables, can be left empty when using a divert path"`
-	DivertPath       bool     `json:"divert_path" desc:"Whether the diverted executable should be moved out of the path"`
-	NMIgnoreFile     string   `json:"nm_ignore_file" desc:"Path to the NetworkManager ignore config file, disables the warning if empty"`
-	UseFullDev       bool     `json:"use_full_dev" desc:"Give sandboxes full access to devices instead of a restricted set"`
-	AllowRootShell   bool     `json:"allow_root_shell" desc:"Allow entering a sandbox shell as root"`
-	LogXpra          bool     `json:"log_xpra" desc:"Log output of Xpra"`
-	EnableEphemerals bool     `json:"enable_ephemerals" desc:"Enable prompting to launch sandbox in ephemeral mode"`
-	EnvironmentVars  []string `json:"environment_vars" desc:"Default environment variables passed to sandboxes"`
-	DefaultGroups    []string `json:"default_groups" desc:"List of default group names that can be used inside the sandbox"`
-	EtcIncludes      []string `json:"etc_includes" desc:"Elements to include in the etc directory in the sandbox"`
+	ProfileDir           string   `json:"profile_dir" desc:"Directory containing the sandbox profiles"`
+	ShellPath            string   `json:"shell_path" desc:"Path of the shell used when entering a sandbox"`
+	PrefixPath           string   `json:"prefix_path" desc:"Prefix path containing the oz executables"`
+	EtcPrefix            string   `json:"etc_prefix" desc:"Prefix for configuration files"`
+	SandboxPath          string   `json:"sandbox_path" desc:"Path of the sandboxes base"`
+	OpenVPNRunPath       string   `json:"openvpn_run_path" desc: "Path for OpenVPN run state"`
+	OpenVPNConfDir       string   `json:"openvpn_conf_dir" desc: "Path for OpenVPN conf files"`
+	OpenVPNGroup         string   `json:"openvpn_group" desc: "GID for OpenVPN process"`
+	RouteTableBase       int      `json:"route_table_base" desc: "Base for routing table"`
+	CoreCollectPath      string   `json:"core_collect_path" desc:"Host directory where the core dumps of sandboxes with collect_cores are written"`
+	OpenVPNManagement    bool     `json:"openvpn_management" desc:"Enable the OpenVPN management interface on a root-only unix socket for status queries with oz vpnstatus"`
+	DivertSuffix         string   `json:"divert_suffix" desc:"Suffix using for dpkg-divert of application executables, can be left empty when using a divert path"`
+	DivertPath           bool     `json:"divert_path" desc:"Whether the diverted executable should be moved out of the path"`
+	NMIgnoreFile         string   `json:"nm_ignore_file" desc:"Path to the NetworkManager ignore config file, disables the warning if empty"`
+	UseFullDev           bool     `json:"use_full_dev" desc:"Give sandboxes full access to devices instead of a restricted set"`
+	AllowRootShell       bool     `json:"allow_root_shell" desc:"Allow entering a sandbox shell as root"`
+	LogXpra              bool     `json:"log_xpra" desc:"Log output of Xpra"`
+	EnableEphemerals     bool     `json:"enable_ephemerals" desc:"Enable prompting to launch sandbox in ephemeral mode"`
+	DisplayOverride      string   `json:"display_override" desc:"Display spec (:N or host:N) set as DISPLAY for sandboxed programs instead of the sandbox display, for debugging against another X server"`
+	BindTimezone         bool     `json:"bind_timezone" desc:"Give sandboxes the timezone of the host, takes precedence over a TZ environment variable"`
+	SetXdgRuntimeDir     bool     `json:"set_xdg_runtime_dir" desc:"Set XDG_RUNTIME_DIR to the runtime directory of the sandbox user, created if missing"`
+	PassHostLocale       bool     `json:"pass_host_locale" desc:"Pass the LANG of the launching user to sandboxes whose profile sets no locale"`
+	WhitelistBestEffort  bool     `json:"whitelist_best_effort" desc:"Launch sandboxes even if some whitelist items fail to bind, listing the failures in the logs"`
+	AllowSeccompOverride bool     `json:"allow_seccomp_override" desc:"Allow the seccomp mode of a profile to be replaced for a single launch, for debugging only"`
+	PutFilePrefix        string   `json:"put_file_prefix" desc:"Sandbox directory (variables allowed) outside of which files cannot be written with PutFile"`
+	ReadOnlyRoot         bool     `json:"read_only_root" desc:"Make the sandbox root read-only, only tmpfs items and whitelist binds stay writable"`
+	RunAsUsers           []string `json:"run_as_users" desc:"Service users which profiles may run their sandboxes as with run_as_user, none if empty"`
+	MaxSandboxes         int      `json:"max_sandboxes" desc:"Maximum number of sandboxes running at the same time, 0 for no limit"`
+	ShutdownSignals      []string `json:"shutdown_signals" desc:"Signals which make oz-init shut the sandbox down, must include SIGINT for oz kill to work"`
+	ForwardSignals       []string `json:"forward_signals" desc:"Signals which oz-init forwards to the sandboxed processes"`
+	XpraReadyPatterns    []string `json:"xpra_ready_patterns" desc:"Xpra server output lines signalling that the server is ready"`
+	RequireSocketChown   bool     `json:"require_socket_chown" desc:"Abort sandbox startup if the init control socket cannot be chowned to the sandbox user"`
+	ParentReadyTimeout   int      `json:"parent_ready_timeout" desc:"Seconds oz-init waits for the daemon to signal it is ready before exiting"`
+	XpraStopTimeout      int      `json:"xpra_stop_timeout" desc:"Seconds oz-init waits for xpra stop at shutdown before killing the xpra server"`
+	MaxLogLines          int      `json:"max_log_lines" desc:"Number of log lines of each sandbox kept by the daemon, the oldest being dropped"`
+	AggregateForwarders  bool     `json:"aggregate_forwarders" desc:"Accept the connections of all the tcp forwarders of a sandbox from a single listener loop instead of one per forwarder"`
+	MaxLogLineBytes      int      `json:"max_log_line_bytes" desc:"Length from which the lines of output of sandboxed programs are truncated in the logs"`
+	MinimalPasswd        bool     `json:"minimal_passwd" desc:"Give sandboxes an /etc/passwd and /etc/group listing only root, nobody and the sandbox user instead of those of the host"`
+	BindFonts            bool     `json:"bind_fonts" desc:"Give sandboxes read-only access to the fonts and fontconfig cache of the host and of the sandbox user"`
+	BindCACerts          bool     `json:"bind_ca_certs" desc:"Give sandboxes read-only access to the CA certificates of the host, in the Debian and RedHat locations found"`
+	ReadyHook            string   `json:"ready_hook" desc:"Command run by the daemon with root privileges once a sandbox is ready, with the sandbox id and profile name as arguments"`
+	EnvironmentVars      []string `json:"environment_vars" desc:"Default environment variables passed to sandboxes"`
+	DefaultGroups        []string `json:"default_groups" desc:"List of default group names that can be used inside the sandbox"`
+	EtcIncludes          []string `json:"etc_includes" desc:"Elements to include in the etc directory in the sandbox"`
 }
 
 const OzVersion = "0.0.1"
 
+// DefaultMaxLogLineBytes is the max_log_line_bytes used when not configured
+const DefaultMaxLogLineBytes = 1024 * 1024
+
 var DefaultConfigPath = "/etc/oz/oz.conf"
 
 func CheckSettingsOverRide() {
@@ -86,22 +116,39 @@ var DefaultEtcIncludes = []string{
 
 func NewDefaultConfig() *Config {
 	return &Config{
-		ProfileDir:       "/var/lib/oz/cells.d",
-		ShellPath:        "/bin/bash",
-		PrefixPath:       "/usr/local",
-		EtcPrefix:        "/etc/oz",
-		SandboxPath:      "/srv/oz",
-		OpenVPNRunPath:   "/var/run/openvpn",
-		OpenVPNConfDir:   "/var/lib/oz/openvpn",
-		OpenVPNGroup:     "oz-openvpn",
-		RouteTableBase:   8000,
-		DivertPath:       true,
-		NMIgnoreFile:     "/etc/NetworkManager/conf.d/oz.conf",
-		DivertSuffix:     "",
-		UseFullDev:       false,
-		AllowRootShell:   false,
-		LogXpra:          true,
-		EnableEphemerals: false,
+		ProfileDir:         "/var/lib/oz/cells.d",
+		ShellPath:          "/bin/bash",
+		PrefixPath:         "/usr/local",
+		EtcPrefix:          "/etc/oz",
+		SandboxPath:        "/srv/oz",
+		OpenVPNRunPath:     "/var/run/openvpn",
+		OpenVPNConfDir:     "/var/lib/oz/openvpn",
+		OpenVPNGroup:       "oz-openvpn",
+		RouteTableBase:     8000,
+		CoreCollectPath:    "/var/lib/oz/cores",
+		DivertPath:         true,
+		NMIgnoreFile:       "/etc/NetworkManager/conf.d/oz.conf",
+		DivertSuffix:       "",
+		UseFullDev:         false,
+		AllowRootShell:     false,
+		LogXpra:            true,
+		EnableEphemerals:   false,
+		RequireSocketChown: true,
+		ParentReadyTimeout: 30,
+		XpraStopTimeout:    10,
+		MaxLogLines:        1000,
+		MaxLogLineBytes:    DefaultMaxLogLineBytes,
+		BindTimezone:       true,
+		SetXdgRuntimeDir:   true,
+		BindCACerts:        true,
+		PutFilePrefix:      "${HOME}",
+		ShutdownSignals:    []string{"SIGTERM", "SIGINT"},
+		ForwardSignals:     []string{},
+		XpraReadyPatterns: []string{
+			"xpra is ready.",
+			"xpra X11 seamless server is ready",
+			"xpra X11 server is ready",
+		},
 		EnvironmentVars: []string{
 			"USER", "USERNAME", "LOGNAME",
 			"LANG", "LANGUAGE", "_", "TZ=UTC",
@@ -131,6 +178,20 @@ func LoadConfig(cpath string) (*Config, error) {
 		return nil, err
 	}
 
+	if c.DisplayOverride != "" && !IsValidDisplay(c.DisplayOverride) {
+		return nil, fmt.Errorf("invalid display_override '%s'", c.DisplayOverride)
+	}
+
+	if c.ReadyHook != "" {
+		if !path.IsAbs(c.ReadyHook) {
+			return nil, fmt.Errorf("ready_hook '%s' is not an absolute path", c.ReadyHook)
+		}
+		// The hook is run as root by the daemon
+		if err := CheckRootExecutable(c.ReadyHook); err != nil {
+			return nil, fmt.Errorf("invalid ready_hook: %v", err)
+		}
+	}
+
 	if c.DivertSuffix == "" && c.DivertPath == false {
 		c.DivertSuffix = "unsafe"
 	}
@@ -146,3 +207,10 @@ func LoadConfig(cpath string) (*Config, error) {
 	}
 	return c, nil
 }
+
+var displayRegexp = regexp.MustCompile(`^[a-zA-Z0-9.-]*:[0-9]+(\.[0-9]+)?$`)
+
+// IsValidDisplay checks that d is an X11 display spec of the [host]:N[.screen] form
+func IsValidDisplay(d string) bool {
+	return displayRegexp.MatchString(d)
+}
@@ -0,0 +1,64 @@
+package oz
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestIsValidDisplay(t *testing.T) {
+	for d, expected := range map[string]bool{
+		":0":             true,
+		":10.0":          true,
+		"localhost:1":    true,
+		"unix:2":         true,
+		"10.0.0.1:0":     true,
+		"":               false,
+		"0":              false,
+		":":              false,
+		"host:":          false,
+		":1 ":            false,
+		":1;xterm":       false,
+		"host:1:2":       false,
+		"/tmp/.X11-unix": false,
+	} {
+		if IsValidDisplay(d) != expected {
+			t.Errorf("expected IsValidDisplay(%q) to be %v", d, expected)
+		}
+	}
+}
+
+func TestLoadConfigReadyHook(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root to own the configuration")
+	}
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hook := path.Join(dir, "hook")
+	if err := ioutil.WriteFile(hook, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cpath := path.Join(dir, "oz.conf")
+	if err := ioutil.WriteFile(cpath, []byte(`{"ready_hook": "`+hook+`"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(cpath); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := os.Chown(hook, 65534, 65534); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(cpath); err == nil {
+		t.Error("expected a hook not owned by root to be rejected")
+	}
+	os.Chown(hook, 0, 0)
+	os.Chmod(hook, 0777)
+	if _, err := LoadConfig(cpath); err == nil {
+		t.Error("expected a hook writable by others to be rejected")
+	}
+}
@@ -0,0 +1,38 @@
+package oz
+
+// ErrorCode is the kind of failure carried by the ErrorMsg responses of the
+// daemon and init IPC protocols.
+type ErrorCode int
+
+const (
+	// Unexpected failure, also the code of responses which do not set one
+	ErrInternal ErrorCode = iota
+	// The requested profile, sandbox, listener... does not exist
+	ErrNotFound
+	// The requesting user is not allowed to perform the operation
+	ErrPermission
+	// The sandbox for the profile is already running
+	ErrAlreadyRunning
+	// The request arguments are invalid or ambiguous
+	ErrInvalid
+	// A limit set in the configuration has been reached
+	ErrLimit
+	// The sandbox shut down before the request completed
+	ErrShutdown
+)
+
+// Error is returned by the IPC client helpers when an ErrorMsg is received.
+type Error struct {
+	Code ErrorCode
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+// IsErrorCode returns whether err is an IPC error with the given code.
+func IsErrorCode(err error, code ErrorCode) bool {
+	e, ok := err.(*Error)
+	return ok && e.Code == code
+}
@@ -102,8 +102,103 @@ const (
 	BindForce
 	BindNoFollow
 	BindAllowSetuid
+	BindNoExec
+	// Skip the bind when its source does not exist, unlike BindIgnore other
+	// errors are still returned
+	BindOptional
 )
 
+// BindPair is a source path and the path it is bound to inside the sandbox
+type BindPair struct {
+	Source string
+	Target string
+}
+
+// BindFromRoot binds like BindTo but takes the sources under root, an
+// absent target being the source path without root. The sources cannot
+// escape root, neither with .. components nor through symlinks.
+func (fs *Filesystem) BindFromRoot(root, from, to string, flags int, display int) error {
+	pairs, err := fs.ResolveBind(root, from, to, display)
+	if err != nil {
+		return err
+	}
+	for _, p := range pairs {
+		if err := checkSourceRoot(root, p.Source); err != nil {
+			return err
+		}
+		if err := fs.bind(p.Source, p.Target, flags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResolveBind returns the binds BindFromRoot would make for from and to, or
+// BindTo when root is empty, the symlinks of the sources being left
+// unresolved.
+func (fs *Filesystem) ResolveBind(root, from, to string, display int) ([]BindPair, error) {
+	if (to == "") || (from == to) {
+		f, err := resolveVars(from, display, fs.user, fs.xdgDirs, fs.profile)
+		if err != nil {
+			return nil, err
+		}
+		ps, err := resolveGlob(rootedPath(root, f))
+		if err != nil {
+			return nil, err
+		}
+		pairs := make([]BindPair, len(ps))
+		for i, p := range ps {
+			pairs[i] = BindPair{Source: p, Target: unrootedPath(root, p)}
+		}
+		return pairs, nil
+	}
+	if isGlobbed(to) || isGlobbed(from) {
+		return nil, fmt.Errorf("bind (%s -> %s) cannot have globbed path with separate target path", from, to)
+	}
+	t, err := resolveVars(to, display, fs.user, fs.xdgDirs, fs.profile)
+	if err != nil {
+		return nil, err
+	}
+	f, err := resolveVars(from, display, fs.user, fs.xdgDirs, fs.profile)
+	if err != nil {
+		return nil, err
+	}
+	return []BindPair{{Source: rootedPath(root, f), Target: t}}, nil
+}
+
+// rootedPath returns p under root, its .. components stopping at root.
+func rootedPath(root, p string) string {
+	if root == "" {
+		return p
+	}
+	return path.Join(root, path.Clean("/"+p))
+}
+
+// unrootedPath returns the path under root rootedPath resolved to p.
+func unrootedPath(root, p string) string {
+	if root == "" {
+		return p
+	}
+	return path.Clean("/" + strings.TrimPrefix(p, path.Clean(root)))
+}
+
+// checkSourceRoot returns an error if src resolves outside of root through
+// a symlink, a missing source being left to the bind flags.
+func checkSourceRoot(root, src string) error {
+	r, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return fmt.Errorf("error resolving source root (%s): %v", root, err)
+	}
+	s, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return nil
+	}
+	if s != r && !strings.HasPrefix(s, r+"/") && r != "/" {
+		return fmt.Errorf("bind source (%s) resolves outside of its source root (%s) to %s", src, root, s)
+	}
+	return nil
+}
+
 func (fs *Filesystem) bindResolve(from string, to string, flags int, display int) error {
 	if (to == "") || (from == to) {
 		return fs.bindSame(from, flags, display)
@@ -143,17 +238,24 @@ func (fs *Filesystem) bind(from string, to string, flags int) error {
 	ii := flags&BindIgnore != 0
 	ff := flags&BindForce != 0
 	nf := flags&BindNoFollow != 0
+	oo := flags&BindOptional != 0
 	var src string
 	var err error
 	if !nf {
 		src, err = filepath.EvalSymlinks(from)
-		if err != nil && !cc && !ii {
+		if err != nil && !cc && !ii && !(oo && os.IsNotExist(err)) {
 			return fmt.Errorf("error resolving symlinks for path (%s): %v", from, err)
 		}
 	}
 	if src == "" {
 		src = from
 	}
+	if oo && !cc {
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			fs.log.Info("Optional bind source (%s) missing, skipped", src)
+			return nil
+		}
+	}
 	sinfo, err := readSourceInfo(src, cc, fs)
 	if err != nil {
 		if !ii {
@@ -208,7 +310,12 @@ func (fs *Filesystem) bind(from string, to string, flags int) error {
 	} else {
 		mntflags |= syscall.MS_NOSUID
 	}
-	fs.log.Info("bind mounting %s%s%s -> %s", rolog, sulog, src, to)
+	nxlog := " "
+	if flags&BindNoExec != 0 {
+		mntflags |= syscall.MS_NOEXEC
+		nxlog = "(noexec) "
+	}
+	fs.log.Info("bind mounting %s%s%s%s -> %s", rolog, sulog, nxlog, src, to)
 	return bindMount(src, to, mntflags)
 }
 
@@ -323,18 +430,32 @@ func (fs *Filesystem) Chroot() error {
 	return nil
 }
 
+// MountProc mounts /proc with the kernel interfaces which can alter the host
+// bound read-only. With ReadOnlyProcSys in the profile all of /proc/sys is
+// read-only, the rest of /proc staying writable for programs which write to
+// their own /proc/self entries, and ProcHidePid hides the processes of other
+// users.
 func (fs *Filesystem) MountProc() error {
-	err := fs.mountSpecial("/proc", "proc", 0, "")
+	args := ""
+	if fs.profile != nil && fs.profile.ProcHidePid {
+		args = "hidepid=2"
+	}
+	err := fs.mountSpecial("/proc", "proc", 0, args)
 	if err != nil {
 		return err
 	}
+	// Read-only in every sandbox, whatever the profile
 	roMounts := []string{
 		"sysrq-trigger",
 		"bus",
 		"irq",
 		"sys/kernel/hotplug",
 	}
+	if fs.profile != nil && fs.profile.ReadOnlyProcSys {
+		roMounts = append(roMounts, "sys")
+	}
 	for _, rom := range roMounts {
+		rom = path.Join("/proc", rom)
 		if _, err := os.Stat(rom); err == nil {
 			if err := bindMount(rom, rom, syscall.MS_RDONLY); err != nil {
 				return fmt.Errorf("remount RO of %s failed: %v", rom, err)
@@ -348,6 +469,49 @@ func (fs *Filesystem) MountFullDev() error {
 	return fs.mountSpecial("/dev", "devtmpfs", 0, "")
 }
 
+// BindDevice binds the device node devpath of the host at the same path in
+// the sandbox /dev, block devices being refused unless allowBlock is set. It
+// returns the group owning the node.
+func (fs *Filesystem) BindDevice(devpath string, allowBlock bool) (uint32, error) {
+	fi, err := os.Stat(devpath)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkDevice(fi, allowBlock); err != nil {
+		return 0, fmt.Errorf("%s: %v", devpath, err)
+	}
+	to := fs.absPath(devpath)
+	if _, err := os.Lstat(to); err == nil {
+		return 0, fmt.Errorf("%s already exists in the sandbox", devpath)
+	}
+	if err := os.MkdirAll(path.Dir(to), 0755); err != nil {
+		return 0, err
+	}
+	if err := createEmptyFile(to, 0600); err != nil {
+		return 0, err
+	}
+	fs.log.Info("bind mounting device %s", devpath)
+	if err := bindMount(devpath, to, syscall.MS_NOSUID|syscall.MS_NOEXEC); err != nil {
+		return 0, err
+	}
+	return fi.Sys().(*syscall.Stat_t).Gid, nil
+}
+
+// checkDevice returns an error if fi is not a character device, or a block
+// device when allowBlock is set
+func checkDevice(fi os.FileInfo, allowBlock bool) error {
+	mode := fi.Mode()
+	switch {
+	case mode&os.ModeCharDevice != 0:
+		return nil
+	case mode&os.ModeDevice != 0 && allowBlock:
+		return nil
+	case mode&os.ModeDevice != 0:
+		return fmt.Errorf("block devices are not allowed")
+	}
+	return fmt.Errorf("not a device node")
+}
+
 func (fs *Filesystem) MountSys() error {
 	return fs.mountSpecial("/sys", "sysfs", syscall.MS_RDONLY, "")
 }
@@ -378,6 +542,125 @@ func (fs *Filesystem) mountSpecial(path, mtype string, flags int, args string) e
 	return syscall.Mount("", path, mtype, mountFlags, args)
 }
 
+// MountTmpfs mounts a tmpfs limited to sizeMB megabytes at target, owned by
+// uid and gid. As it lives in the sandbox mount namespace its content is
+// discarded when the sandbox exits.
+func (fs *Filesystem) MountTmpfs(target string, sizeMB int, mode os.FileMode, uid, gid int) error {
+	p := fs.absPath(target)
+	if err := os.MkdirAll(p, 0755); err != nil {
+		return fmt.Errorf("failed to create tmpfs mount point (%s): %v", target, err)
+	}
+	args := fmt.Sprintf("size=%dm,mode=%o,uid=%d,gid=%d", sizeMB, mode.Perm(), uid, gid)
+	fs.log.Info("mounting tmpfs (%s) at %s", args, target)
+	if err := syscall.Mount("tmpfs", p, "tmpfs", syscall.MS_NODEV|syscall.MS_NOSUID, args); err != nil {
+		return fmt.Errorf("failed to mount tmpfs at %s: %v", target, err)
+	}
+	return nil
+}
+
+// MountHomeOverlay mounts at home an overlay of the host directory home,
+// left untouched as the lower layer, with an upper layer on a tmpfs owned by
+// uid and gid. The layers live outside the sandbox root, the changes made in
+// home being discarded when the sandbox exits.
+func (fs *Filesystem) MountHomeOverlay(home string, uid, gid int) error {
+	fi, err := os.Stat(home)
+	if err != nil {
+		return fmt.Errorf("home overlay: %v", err)
+	}
+	layers := path.Join(fs.base, "home-overlay")
+	if err := os.MkdirAll(layers, 0700); err != nil {
+		return fmt.Errorf("failed to create home overlay directory: %v", err)
+	}
+	if err := syscall.Mount("tmpfs", layers, "tmpfs", syscall.MS_NODEV|syscall.MS_NOSUID, "mode=700"); err != nil {
+		return fmt.Errorf("failed to mount tmpfs for home overlay: %v", err)
+	}
+	upper := path.Join(layers, "upper")
+	work := path.Join(layers, "work")
+	for _, d := range []string{upper, work} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			return err
+		}
+	}
+	// The root of the overlay takes the ownership and mode of the upper layer
+	if err := os.Chmod(upper, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Chown(upper, uid, gid); err != nil {
+		return err
+	}
+	opts, err := overlayOptions(home, upper, work)
+	if err != nil {
+		return err
+	}
+	target := fs.absPath(home)
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("failed to create home overlay mount point: %v", err)
+	}
+	fs.log.Info("mounting overlay of %s with changes discarded on exit", home)
+	if err := syscall.Mount("overlay", target, "overlay", syscall.MS_NODEV|syscall.MS_NOSUID, opts); err != nil {
+		return fmt.Errorf("failed to mount overlay at %s (is overlayfs supported by the kernel?): %v", home, err)
+	}
+	return nil
+}
+
+// overlayOptions returns the mount options of an overlay of the layers,
+// which cannot contain the separators of the options.
+func overlayOptions(lower, upper, work string) (string, error) {
+	for _, p := range []string{lower, upper, work} {
+		if strings.ContainsAny(p, ",:") {
+			return "", fmt.Errorf("overlay layer path %s contains ',' or ':'", p)
+		}
+	}
+	return fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work), nil
+}
+
+// RemountRootReadOnly makes the tmpfs holding the sandbox root read-only.
+// Anything mounted on top of it, like binds, /tmp and tmpfs items, keeps its
+// own flags, so it must be called once they are in place and before Chroot().
+func (fs *Filesystem) RemountRootReadOnly() error {
+	if fs.chroot {
+		return fmt.Errorf("cannot remount root read-only after Chroot() is called")
+	}
+	fs.log.Info("Remounting sandbox root %s read-only", fs.Root())
+	flags := uintptr(syscall.MS_REMOUNT | syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NODEV)
+	if err := syscall.Mount("", fs.Root(), "tmpfs", flags, "mode=755,gid=0"); err != nil {
+		return fmt.Errorf("failed to remount %s read-only: %v", fs.Root(), err)
+	}
+	return nil
+}
+
+// MountWritableFiles keeps the files names of the directory dir writable
+// once the root is remounted read-only. They are created empty on a tmpfs
+// mounted at store, and each is bound over its file in dir, created when
+// missing. It must be called before RemountRootReadOnly() and Chroot().
+func (fs *Filesystem) MountWritableFiles(store, dir string, names []string) error {
+	if fs.chroot {
+		return fmt.Errorf("cannot mount writable files after Chroot() is called")
+	}
+	if err := fs.MountTmpfs(store, 1, 0755, 0, 0); err != nil {
+		return err
+	}
+	for _, name := range names {
+		src := path.Join(fs.absPath(store), name)
+		target := path.Join(fs.absPath(dir), name)
+		if err := createEmptyFile(src, 0644); err != nil {
+			return err
+		}
+		// An existing file may be a bind of a host file, never truncated
+		if _, err := os.Stat(target); os.IsNotExist(err) {
+			if err := createEmptyFile(target, 0644); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+		if err := bindMount(src, target, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func bindMount(source, target string, flags int) error {
 	if err := syscall.Mount(source, target, "", syscall.MS_BIND, ""); err != nil {
 		return fmt.Errorf("bind mount of %s -> %s failed: %v", source, target, err)
@@ -0,0 +1,232 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/op/go-logging"
+
+	"github.com/subgraph/oz"
+)
+
+func TestBindNoExec(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("bind mounting requires root")
+	}
+	// The mount namespace is private to this thread, which is never
+	// unlocked so that it exits with the test goroutine
+	runtime.LockOSThread()
+	if err := syscall.Unshare(syscall.CLONE_NEWNS); err != nil {
+		t.Skipf("unable to create a mount namespace: %v", err)
+	}
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		t.Fatalf("failed to make mounts private: %v", err)
+	}
+
+	base, err := ioutil.TempDir("", "oz-fs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	src := path.Join(base, "data")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	prog := path.Join(src, "prog")
+	if err := ioutil.WriteFile(prog, []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command(prog).Run(); err != nil {
+		t.Skipf("test program cannot be executed from its source directory: %v", err)
+	}
+
+	fs := NewFilesystem(&oz.Config{SandboxPath: base}, logging.MustGetLogger("oz-test"), nil, &oz.Profile{})
+	for _, c := range []struct {
+		target string
+		flags  int
+	}{
+		{"/noexec", BindNoExec},
+		{"/noexec-ro", BindNoExec | BindReadOnly},
+	} {
+		if err := fs.BindTo(src, c.target, c.flags, -1); err != nil {
+			t.Fatalf("failed to bind %s: %v", c.target, err)
+		}
+		target := path.Join(fs.Root(), c.target)
+		defer syscall.Unmount(target, 0)
+		err := exec.Command(path.Join(target, "prog")).Run()
+		if err == nil {
+			t.Errorf("program in %s was executed", c.target)
+		} else if !os.IsPermission(err) {
+			t.Errorf("unexpected error running program in %s: %v", c.target, err)
+		}
+	}
+}
+
+func TestMountHomeOverlay(t *testing.T) {
+	if _, err := overlayOptions("/home/a,b", "/upper", "/work"); err == nil {
+		t.Error("expected a layer path with a comma to be refused")
+	}
+	if os.Getuid() != 0 {
+		t.Skip("mounting an overlay requires root")
+	}
+	runtime.LockOSThread()
+	if err := syscall.Unshare(syscall.CLONE_NEWNS); err != nil {
+		t.Skipf("unable to create a mount namespace: %v", err)
+	}
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		t.Fatalf("failed to make mounts private: %v", err)
+	}
+
+	base, err := ioutil.TempDir("", "oz-fs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	home := path.Join(base, "home")
+	if err := os.MkdirAll(home, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(home, "file"), []byte("host"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := NewFilesystem(&oz.Config{SandboxPath: base}, logging.MustGetLogger("oz-test"), nil, &oz.Profile{})
+	if err := fs.MountHomeOverlay(home, 1000, 1000); err != nil {
+		t.Skipf("overlay not supported: %v", err)
+	}
+	merged := path.Join(fs.Root(), home)
+	defer syscall.Unmount(path.Join(base, "home-overlay"), syscall.MNT_DETACH)
+	defer syscall.Unmount(merged, 0)
+
+	if data, err := ioutil.ReadFile(path.Join(merged, "file")); err != nil || string(data) != "host" {
+		t.Fatalf("host file not visible in the overlay: %q, %v", data, err)
+	}
+	if err := ioutil.WriteFile(path.Join(merged, "file"), []byte("sandbox"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(path.Join(home, "file")); string(data) != "host" {
+		t.Errorf("write through the overlay changed the host file to %q", data)
+	}
+	fi, err := os.Stat(merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); st.Uid != 1000 || fi.Mode().Perm() != 0750 {
+		t.Errorf("overlay root has uid %d and mode %o, expected 1000 and 750", st.Uid, fi.Mode().Perm())
+	}
+}
+
+func TestCheckDevice(t *testing.T) {
+	fi, err := os.Stat("/dev/null")
+	if err != nil {
+		t.Skip(err)
+	}
+	if err := checkDevice(fi, false); err != nil {
+		t.Errorf("character device refused: %v", err)
+	}
+	if fi, err = os.Stat("/dev"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkDevice(fi, true); err == nil {
+		t.Error("expected a directory to be refused")
+	}
+	blocks, _ := filepath.Glob("/dev/loop[0-9]*")
+	for _, b := range blocks {
+		if fi, err := os.Stat(b); err == nil && fi.Mode()&os.ModeCharDevice == 0 {
+			if err := checkDevice(fi, false); err == nil {
+				t.Errorf("block device %s allowed without allowBlock", b)
+			}
+			if err := checkDevice(fi, true); err != nil {
+				t.Errorf("block device %s refused with allowBlock: %v", b, err)
+			}
+			break
+		}
+	}
+}
+
+func TestResolveBindSourceRoot(t *testing.T) {
+	fs := NewFilesystem(&oz.Config{SandboxPath: "/srv/oz"}, logging.MustGetLogger("oz-test"), nil, &oz.Profile{})
+	for _, c := range []struct {
+		from, to string
+		want     BindPair
+	}{
+		{"/etc/foo", "", BindPair{Source: "/opt/tpl/etc/foo", Target: "/etc/foo"}},
+		{"/etc/foo", "/etc/bar", BindPair{Source: "/opt/tpl/etc/foo", Target: "/etc/bar"}},
+		{"/../../etc/shadow", "/etc/shadow", BindPair{Source: "/opt/tpl/etc/shadow", Target: "/etc/shadow"}},
+		{"/etc/../../../etc/shadow", "", BindPair{Source: "/opt/tpl/etc/shadow", Target: "/etc/shadow"}},
+	} {
+		pairs, err := fs.ResolveBind("/opt/tpl/", c.from, c.to, -1)
+		if err != nil {
+			t.Errorf("ResolveBind(%s, %s) failed: %v", c.from, c.to, err)
+			continue
+		}
+		if len(pairs) != 1 || pairs[0] != c.want {
+			t.Errorf("ResolveBind(%s, %s) = %+v, want %+v", c.from, c.to, pairs, c.want)
+		}
+	}
+}
+
+func TestBindFromRootSymlinkEscape(t *testing.T) {
+	root, err := ioutil.TempDir("", "oz-fs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(path.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc/passwd", path.Join(root, "etc", "foo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(root, "etc", "bar"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("bar", path.Join(root, "etc", "baz")); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSourceRoot(root, path.Join(root, "etc", "foo")); err == nil {
+		t.Error("symlink out of the source root was accepted")
+	}
+	if err := checkSourceRoot(root, path.Join(root, "etc", "baz")); err != nil {
+		t.Errorf("symlink inside the source root was refused: %v", err)
+	}
+	if err := checkSourceRoot(root, path.Join(root, "etc", "missing")); err != nil {
+		t.Errorf("missing source was refused: %v", err)
+	}
+
+	fs := NewFilesystem(&oz.Config{SandboxPath: root}, logging.MustGetLogger("oz-test"), nil, &oz.Profile{})
+	if err := fs.BindFromRoot(root, "/etc/foo", "", 0, -1); err == nil {
+		t.Error("BindFromRoot bound a source escaping its root")
+	}
+}
+
+func TestBindOptional(t *testing.T) {
+	base, err := ioutil.TempDir("", "oz-fs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	file := path.Join(base, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := NewFilesystem(&oz.Config{SandboxPath: base}, logging.MustGetLogger("oz-test"), nil, &oz.Profile{})
+	missing := path.Join(base, "missing")
+	if err := fs.BindTo(missing, "/missing", 0, -1); err == nil {
+		t.Error("expected an error binding a missing source")
+	}
+	if err := fs.BindTo(missing, "/missing", BindOptional, -1); err != nil {
+		t.Errorf("optional missing source was not skipped: %v", err)
+	}
+	// A path under a file is an error other than a missing source
+	if err := fs.BindTo(path.Join(file, "sub"), "/sub", BindOptional, -1); err == nil {
+		t.Error("expected an error binding an invalid optional source")
+	}
+}
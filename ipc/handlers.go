@@ -15,6 +15,7 @@ type msgDispatcher struct {
 	log  *logging.Logger
 	msgs chan *Message
 	hmap handlerMap
+	hook func(*Message)
 }
 
 func createDispatcher(log *logging.Logger, handlers ...interface{}) (*msgDispatcher, error) {
@@ -49,6 +50,9 @@ func (md *msgDispatcher) logger() *logging.Logger {
 
 func (md *msgDispatcher) runDispatcher() {
 	for m := range md.msgs {
+		if md.hook != nil {
+			md.hook(m)
+		}
 		if err := md.hmap.dispatch(m); err != nil {
 			md.logger().Warning("error dispatching message: %v", err)
 		}
@@ -89,3 +89,26 @@ func TestDispatch(t *testing.T) {
 		t.Errorf("count was not incremented to 2 as expected. count = %d", count)
 	}
 }
+
+func TestDispatchHook(t *testing.T) {
+	type testStruct struct {
+		t int "tst"
+	}
+	handled := make(chan bool, 1)
+	md, err := createDispatcher(nil, func(ts *testStruct, m *Message) error {
+		handled <- true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer md.close()
+
+	var hooked string
+	md.hook = func(m *Message) { hooked = m.Type }
+	md.dispatch(&Message{Type: "tst", Body: &testStruct{}})
+	<-handled
+	if hooked != "tst" {
+		t.Errorf("dispatch hook was not called before the handler, got type %q", hooked)
+	}
+}
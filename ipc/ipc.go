@@ -66,6 +66,13 @@ func NewServer(address string, factory MsgFactory, log *logging.Logger, handlers
 	}, nil
 }
 
+// SetDispatchHook registers a function called with each received message
+// right before it is dispatched to its handler, for instance to log the
+// credentials of the sender. It must be called before Run.
+func (s *MsgServer) SetDispatchHook(hook func(*Message)) {
+	s.disp.hook = hook
+}
+
 func (s *MsgServer) Run() error {
 	for !s.isClosed {
 		conn, err := s.listener.AcceptUnix()
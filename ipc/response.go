@@ -1,6 +1,7 @@
 package ipc
 
 import (
+	"context"
 	"sync"
 	"time"
 )
@@ -10,6 +11,25 @@ type ResponseReader interface {
 	Done()
 }
 
+// WaitResponse returns the response read by rr, or the error of ctx if it is
+// done first. Either way rr is released.
+func WaitResponse(ctx context.Context, rr ResponseReader) (*Message, error) {
+	select {
+	case m := <-rr.Chan():
+		rr.Done()
+		return m, nil
+	case <-ctx.Done():
+		// A response arriving meanwhile is sent while holding the lock
+		// Done() takes, drain it so that neither blocks.
+		go func() {
+			for range rr.Chan() {
+			}
+		}()
+		rr.Done()
+		return nil, ctx.Err()
+	}
+}
+
 type responseWaiter struct {
 	rm      *responseManager
 	id      int
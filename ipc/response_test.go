@@ -1,7 +1,9 @@
 package ipc
 
 import (
+	"context"
 	"testing"
+	"time"
 )
 
 func TestRegister(t *testing.T) {
@@ -57,3 +59,34 @@ func TestHandle(t *testing.T) {
 
 	}
 }
+
+func TestWaitResponse(t *testing.T) {
+	rm := newResponseManager()
+	rr := rm.register(1)
+	go rm.handle(&Message{MsgID: 1, Type: "tst"})
+
+	m, err := WaitResponse(context.Background(), rr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.Type != "tst" {
+		t.Errorf("expected message of type tst, got %q", m.Type)
+	}
+	if len(rm.responseMap) != 0 {
+		t.Errorf("responseMap should be empty, not %d", len(rm.responseMap))
+	}
+}
+
+func TestWaitResponseTimeout(t *testing.T) {
+	rm := newResponseManager()
+	rr := rm.register(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := WaitResponse(ctx, rr); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if rm.handle(&Message{MsgID: 1}) {
+		t.Error("response arriving after the timeout should not be handled")
+	}
+}
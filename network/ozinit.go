@@ -2,9 +2,15 @@ package network
 
 import (
 	//Builtin
+	"bufio"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"syscall"
 
 	// Internal
 	//"github.com/op/go-logging"
@@ -28,6 +34,12 @@ func NetSetup() error {
 	return nil
 }
 
+// NeedsSetup reports whether NetSetup must run inside sandboxes using this
+// network type, host and none networking being left untouched
+func (t NetType) NeedsSetup() bool {
+	return t != TYPE_HOST && t != TYPE_NONE
+}
+
 func setupLoopback() error {
 	// Bring loopback interface up
 	lo, err := tenus.NewLinkFrom("lo")
@@ -43,3 +55,71 @@ func setupLoopback() error {
 
 	return nil
 }
+
+// Network configuration of a sandbox as seen from inside of it
+type NetInfo struct {
+	Nettype   NetType
+	Interface string
+	Ip        string
+	Gateway   string
+	// Routing table holding the default route, oz only uses the main one
+	Table int
+}
+
+// GetNetInfo gathers the first non-loopback interface of the current network
+// namespace and its address the same way NetPrint does, along with the
+// default gateway from /proc/net/route.
+func GetNetInfo(nettype NetType) (*NetInfo, error) {
+	info := &NetInfo{Nettype: nettype, Table: syscall.RT_TABLE_MAIN}
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list interfaces: %+v", err)
+	}
+	for _, netif := range ifs {
+		if netif.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := netif.Addrs()
+		info.Interface = netif.Name
+		if len(addrs) > 0 {
+			if ip, _, err := net.ParseCIDR(addrs[0].String()); err == nil {
+				info.Ip = ip.String()
+			}
+		}
+		break
+	}
+	gw, err := defaultGateway("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	if gw != nil {
+		info.Gateway = gw.String()
+	}
+	return info, nil
+}
+
+// defaultGateway returns the gateway of the default route, or nil if there
+// is none. Addresses in the route file are hex numbers in host byte order.
+func defaultGateway(routePath string) (net.IP, error) {
+	f, err := os.Open(routePath)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read routes: %+v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		gw, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid gateway in route file: %s", fields[2])
+		}
+		ip := make(net.IP, 4)
+		binary.LittleEndian.PutUint32(ip, uint32(gw))
+		return ip, nil
+	}
+	return nil, scanner.Err()
+}
@@ -0,0 +1,63 @@
+package network
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const testRouteFile = `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	0000A8C0	00000000	0001	0	0	0	00FFFFFF	0	0	0
+eth0	00000000	0100A8C0	0003	0	0	0	00000000	0	0	0
+`
+
+func writeRouteFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "route")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestDefaultGateway(t *testing.T) {
+	p := writeRouteFile(t, testRouteFile)
+	defer os.Remove(p)
+
+	gw, err := defaultGateway(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if gw == nil || gw.String() != "192.168.0.1" {
+		t.Errorf("expected gateway 192.168.0.1, got %v", gw)
+	}
+}
+
+func TestDefaultGatewayNoRoute(t *testing.T) {
+	p := writeRouteFile(t, "Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT\n")
+	defer os.Remove(p)
+
+	gw, err := defaultGateway(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if gw != nil {
+		t.Errorf("expected no gateway, got %v", gw)
+	}
+}
+
+func TestNeedsSetup(t *testing.T) {
+	for nt, expected := range map[NetType]bool{
+		TYPE_HOST:   false,
+		TYPE_NONE:   false,
+		TYPE_EMPTY:  true,
+		TYPE_BRIDGE: true,
+	} {
+		if nt.NeedsSetup() != expected {
+			t.Errorf("expected NeedsSetup() of %s networking to be %v", nt, expected)
+		}
+	}
+}
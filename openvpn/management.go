@@ -0,0 +1,136 @@
+package openvpn
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/subgraph/oz"
+)
+
+// Suffix of the management socket of an openvpn client in the run path
+const ManagementSocketSuffix = "-mgmt.sock"
+
+const managementTimeout = 5 * time.Second
+
+// Status of an openvpn client, as reported by its management interface
+type Status struct {
+	State          string
+	LocalIp        string
+	RemoteIp       string
+	RemotePort     string
+	TunReadBytes   int64
+	TunWriteBytes  int64
+	LinkReadBytes  int64
+	LinkWriteBytes int64
+}
+
+func ManagementSocketPath(c *oz.Config, runtoken string) string {
+	return path.Join(c.OpenVPNRunPath, runtoken+ManagementSocketSuffix)
+}
+
+// OpenVPNStatus queries the management interface of the openvpn client
+// started with runtoken for the connection state and traffic counters.
+func OpenVPNStatus(c *oz.Config, runtoken string) (*Status, error) {
+	if !c.OpenVPNManagement {
+		return nil, fmt.Errorf("openvpn management interface is not enabled")
+	}
+	conn, err := net.DialTimeout("unix", ManagementSocketPath(c, runtoken), managementTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(managementTimeout))
+
+	r := bufio.NewReader(conn)
+	st := new(Status)
+	state, err := managementCommand(conn, r, "state")
+	if err != nil {
+		return nil, err
+	}
+	parseState(state, st)
+	status, err := managementCommand(conn, r, "status")
+	if err != nil {
+		return nil, err
+	}
+	parseStatus(status, st)
+	managementCommand(conn, r, "quit")
+	return st, nil
+}
+
+// managementCommand sends cmd and returns the lines of its response up to
+// the END marker, skipping the real-time notifications.
+func managementCommand(conn net.Conn, r *bufio.Reader, cmd string) ([]string, error) {
+	if _, err := fmt.Fprintf(conn, "%s\n", cmd); err != nil {
+		return nil, err
+	}
+	if cmd == "quit" {
+		return nil, nil
+	}
+	lines := []string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s response: %v", cmd, err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, ">"):
+			continue
+		case strings.HasPrefix(line, "ERROR:"):
+			return nil, fmt.Errorf("%s command failed: %s", cmd, line)
+		case line == "END":
+			return lines, nil
+		}
+		lines = append(lines, line)
+	}
+}
+
+// parseState reads the last line of the state command output, with the
+// fields: time,state,description,local ip,remote ip,remote port,...
+func parseState(lines []string, st *Status) {
+	if len(lines) == 0 {
+		return
+	}
+	fields := strings.Split(lines[len(lines)-1], ",")
+	if len(fields) > 1 {
+		st.State = fields[1]
+	}
+	if len(fields) > 3 {
+		st.LocalIp = fields[3]
+	}
+	if len(fields) > 4 {
+		st.RemoteIp = fields[4]
+	}
+	if len(fields) > 5 {
+		st.RemotePort = fields[5]
+	}
+}
+
+// parseStatus reads the traffic counters of the client status output
+func parseStatus(lines []string, st *Status) {
+	for _, line := range lines {
+		fields := strings.SplitN(line, ",", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		n, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "TUN/TAP read bytes":
+			st.TunReadBytes = n
+		case "TUN/TAP write bytes":
+			st.TunWriteBytes = n
+		case "TCP/UDP read bytes":
+			st.LinkReadBytes = n
+		case "TCP/UDP write bytes":
+			st.LinkWriteBytes = n
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package openvpn
+
+import (
+	"testing"
+)
+
+func TestParseManagementOutput(t *testing.T) {
+	st := new(Status)
+	parseState([]string{
+		"1452703345,WAIT,,,",
+		"1452703349,CONNECTED,SUCCESS,10.8.0.6,198.51.100.7,1194,,",
+	}, st)
+	parseStatus([]string{
+		"OpenVPN STATISTICS",
+		"Updated,Wed Jan 13 16:42:29 2016",
+		"TUN/TAP read bytes,1536",
+		"TUN/TAP write bytes,2048",
+		"TCP/UDP read bytes,4096",
+		"TCP/UDP write bytes,3072",
+		"Auth read bytes,2048",
+	}, st)
+	expected := Status{
+		State:          "CONNECTED",
+		LocalIp:        "10.8.0.6",
+		RemoteIp:       "198.51.100.7",
+		RemotePort:     "1194",
+		TunReadBytes:   1536,
+		TunWriteBytes:  2048,
+		LinkReadBytes:  4096,
+		LinkWriteBytes: 3072,
+	}
+	if *st != expected {
+		t.Errorf("expected %+v, got %+v", expected, *st)
+	}
+}
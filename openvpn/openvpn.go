@@ -16,11 +16,16 @@ import (
 )
 
 func StartOpenVPN(c *oz.Config, conf string, ip *net.IP, table, dev, auth, runtoken string) (cmd *exec.Cmd, err error) {
+	defer func() {
+		if err != nil {
+			removeCredentialFiles(c, runtoken)
+		}
+	}()
 
 	confFile := path.Join(c.OpenVPNConfDir, conf)
 	cmdArgs, err := parseOpenVPNConf(c, confFile, ip, table, dev, auth, runtoken)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error %v\n", err)
 		return nil, err
 	}
 
@@ -30,12 +35,12 @@ func StartOpenVPN(c *oz.Config, conf string, ip *net.IP, table, dev, auth, runto
 
 	ovpngroup, err := user.LookupGroup(c.OpenVPNGroup)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "[FATAL] OpenVPN group: %v", err)
+		fmt.Fprintf(os.Stderr, "[FATAL] OpenVPN group: %v\n", err)
 		return nil, err
 	}
 	ovpngid, err := strconv.Atoi(ovpngroup.Gid)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "[FATAL] OpenVPN group: %v", err)
+		fmt.Fprintf(os.Stderr, "[FATAL] OpenVPN group: %v\n", err)
 		return nil, err
 	}
 	runcmd.SysProcAttr = &syscall.SysProcAttr{}
@@ -44,13 +49,27 @@ func StartOpenVPN(c *oz.Config, conf string, ip *net.IP, table, dev, auth, runto
 	}
 	err = runcmd.Start()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "[FATAL] Error (exec): %v %s\n", err, cmdArgs[0])
-		os.Exit(1)
+		return nil, fmt.Errorf("error executing %s: %v", runcmd.Path, err)
 	}
 	return runcmd, nil
 
 }
 
+// Suffixes of the files parseOpenVPNConf writes the inline certificates and
+// keys of the configuration to in the run path
+var credentialSuffixes = []string{"-cert.cert", "-ca.cert", "-key.key", "-tls-auth.key"}
+
+// removeCredentialFiles removes the credentials extracted for runtoken when
+// OpenVPN could not be started, nothing else cleaning them up then.
+func removeCredentialFiles(c *oz.Config, runtoken string) {
+	for _, suffix := range credentialSuffixes {
+		p := path.Join(c.OpenVPNRunPath, runtoken+suffix)
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Error removing %s: %v\n", p, err)
+		}
+	}
+}
+
 func parseOpenVPNConf(c *oz.Config, filename string, ip *net.IP, table, dev, auth, runtoken string) (cmdargs []string, err error) {
 
 	var cmd []string
@@ -247,6 +266,9 @@ func parseOpenVPNConf(c *oz.Config, filename string, ip *net.IP, table, dev, aut
 	}
 	extra := []string{"--writepid", pidfilepath,"--ping","10","--ping-restart","60","--daemon", "--auth-retry", "nointeract", "--route-noexec", "--route-up", "/usr/bin/oz-ovpn-route-up", "--route-pre-down", "/usr/bin/oz-ovpn-route-down", "--script-security", "2", "--setenv", "bridge_addr", ip.String(), "--setenv", "routing_table", table, "--setenv", "bridge_dev", dev}
 	cmd = append(cmd, extra...)
+	if c.OpenVPNManagement {
+		cmd = append(cmd, "--management", ManagementSocketPath(c, runtoken), "unix", "--management-client-user", "root")
+	}
 
 	for _, x := range cmd {
 		fmt.Fprintf(os.Stderr, "%s", x)
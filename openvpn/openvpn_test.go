@@ -0,0 +1,37 @@
+package openvpn
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/subgraph/oz"
+)
+
+func TestStartOpenVPNRemovesCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oz-openvpn-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := "remote vpn.example.com 1194\n<ca>\nCA\n</ca>\n<cert>\nCERT\n</cert>\n<key>\nKEY\n</key>\n<tls-auth>\nTLS\n</tls-auth>\n"
+	if err := ioutil.WriteFile(path.Join(dir, "test.conf"), []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := &oz.Config{
+		OpenVPNConfDir: dir,
+		OpenVPNRunPath: dir,
+		OpenVPNGroup:   "oz-test-no-such-group",
+	}
+	ip := net.ParseIP("10.0.3.1")
+	if _, err := StartOpenVPN(c, "test.conf", &ip, "8", "oz-test", "auth", "token"); err == nil {
+		t.Fatal("StartOpenVPN succeeded without the openvpn group")
+	}
+	for _, suffix := range credentialSuffixes {
+		if _, err := os.Stat(path.Join(dir, "token"+suffix)); !os.IsNotExist(err) {
+			t.Errorf("credential file token%s was left behind: %v", suffix, err)
+		}
+	}
+}
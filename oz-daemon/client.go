@@ -1,34 +1,64 @@
 package daemon
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"reflect"
 	"regexp"
 	"strconv"
+	"time"
+
+	"github.com/op/go-logging"
 
 	"github.com/subgraph/oz"
 	"github.com/subgraph/oz/ipc"
+	"github.com/subgraph/oz/network"
+	"github.com/subgraph/oz/openvpn"
+	"github.com/subgraph/oz/oz-init"
 )
 
 func clientConnect() (*ipc.MsgConn, error) {
 	return ipc.Connect(GetSocketName(), messageFactory, nil)
 }
 
+// How long clientSend waits for the daemon to respond, launches not being
+// timed out as starting a sandbox can take longer
+const clientTimeout = 30 * time.Second
+
 func clientSend(msg interface{}) (*ipc.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	return SendContext(ctx, msg)
+}
+
+// SendContext sends msg to the daemon and waits for the response until ctx
+// is done, the connection being closed either way. It is for callers which
+// need another timeout than the default one of the helpers, or to cancel a
+// request.
+func SendContext(ctx context.Context, msg interface{}, fds ...int) (*ipc.Message, error) {
 	c, err := clientConnect()
 	if err != nil {
 		return nil, err
 	}
+	return exchangeContext(ctx, c, msg, fds...)
+}
+
+// exchangeContext sends msg on c and waits for the response until ctx is
+// done, closing c either way.
+func exchangeContext(ctx context.Context, c *ipc.MsgConn, msg interface{}, fds ...int) (*ipc.Message, error) {
 	defer c.Close()
-	rr, err := c.ExchangeMsg(msg)
+	rr, err := c.ExchangeMsg(msg, fds...)
 	if err != nil {
 		return nil, err
 	}
-
-	resp := <-rr.Chan()
-	rr.Done()
+	resp, err := ipc.WaitResponse(ctx, rr)
+	if err != nil {
+		return nil, fmt.Errorf("no response from oz-daemon: %v", err)
+	}
 	return resp, nil
 }
 
@@ -80,6 +110,71 @@ func ListSandboxes() ([]SandboxInfo, error) {
 	return body.Sandboxes, nil
 }
 
+// ResolveSandboxId returns the id of the running sandbox of the profile
+// name, for use with the helpers taking a sandbox id.
+func ResolveSandboxId(name string) (int, error) {
+	sboxes, err := ListSandboxes()
+	if err != nil {
+		return 0, err
+	}
+	return sandboxIdByProfile(sboxes, name)
+}
+
+func sandboxIdByProfile(sboxes []SandboxInfo, name string) (int, error) {
+	var ids []int
+	for _, sb := range sboxes {
+		if sb.Profile == name {
+			ids = append(ids, sb.Id)
+		}
+	}
+	switch len(ids) {
+	case 0:
+		return 0, &oz.Error{Code: oz.ErrNotFound, Msg: fmt.Sprintf("no running sandbox for profile '%s'", name)}
+	case 1:
+		return ids[0], nil
+	default:
+		return 0, &oz.Error{Code: oz.ErrInvalid, Msg: fmt.Sprintf("%d running sandboxes for profile '%s': %v", len(ids), name, ids)}
+	}
+}
+
+// DaemonReady returns whether the daemon accepts connections and answers a
+// ping within timeout, for use in startup scripts.
+func DaemonReady(timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ready := make(chan bool, 1)
+	go func() {
+		c, err := clientConnect()
+		if err != nil {
+			ready <- false
+			return
+		}
+		resp, err := exchangeContext(ctx, c, &PingMsg{Data: "ready"})
+		if err != nil {
+			ready <- false
+			return
+		}
+		_, ok := resp.Body.(*PingMsg)
+		ready <- ok
+	}()
+	select {
+	case ok := <-ready:
+		return ok
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// MarshalList returns the indented JSON encoding of a list returned by one
+// of the List functions, an empty list being encoded as [] rather than null.
+func MarshalList(list interface{}) ([]byte, error) {
+	v := reflect.ValueOf(list)
+	if v.Kind() == reflect.Slice && v.IsNil() {
+		list = reflect.MakeSlice(v.Type(), 0, 0).Interface()
+	}
+	return json.MarshalIndent(list, "", "  ")
+}
+
 func ListBridges() ([]string, error) {
 	resp, err := clientSend(&ListBridgesMsg{})
 	if err != nil {
@@ -109,6 +204,9 @@ func GetProfile(cpath string) (*oz.Profile, error) {
 	if err != nil {
 		return nil, err
 	}
+	if body, ok := resp.Body.(*ErrorMsg); ok {
+		return nil, body.err()
+	}
 	body, ok := resp.Body.(*GetProfileResp)
 	if !ok {
 		return nil, errors.New("GetProfile response was not expected type")
@@ -140,7 +238,7 @@ func IsRunning(cpath string, args []string) (bool, error) {
 	}
 	switch body := resp.Body.(type) {
 	case *ErrorMsg:
-		return false, fmt.Errorf("%s", body.Msg)
+		return false, body.err()
 	case *OkMsg:
 		return true, nil
 	case *NotOkMsg:
@@ -151,10 +249,10 @@ func IsRunning(cpath string, args []string) (bool, error) {
 	return false, fmt.Errorf("Unexpected error occured")
 }
 
-func Launch(arg, cpath string, args []string, noexec, ephemeral bool) error {
+func newLaunchMsg(arg, cpath string, args []string, noexec, ephemeral bool, seccompMode oz.SeccompMode) (*LaunchMsg, error) {
 	idx, name, err := parseProfileArg(arg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	pwd, _ := os.Getwd()
 	groups, _ := os.Getgroups()
@@ -165,29 +263,111 @@ func Launch(arg, cpath string, args []string, noexec, ephemeral bool) error {
 			gg[i] = uint32(v)
 		}
 	}
-	resp, err := clientSend(&LaunchMsg{
-		Index:     idx,
-		Name:      name,
-		Path:      cpath,
-		Pwd:       pwd,
-		Gids:      gg,
-		Args:      args,
-		Env:       os.Environ(),
-		Noexec:    noexec,
-		Ephemeral: ephemeral,
-	})
+	return &LaunchMsg{
+		Index:               idx,
+		Name:                name,
+		Path:                cpath,
+		Pwd:                 pwd,
+		Gids:                gg,
+		Args:                args,
+		Env:                 os.Environ(),
+		Noexec:              noexec,
+		Ephemeral:           ephemeral,
+		SeccompModeOverride: seccompMode,
+	}, nil
+}
+
+// sendLaunchMsg sends msg until ctx is done, passing the descriptor of stdin
+// along to be connected to the program launched if it is not nil.
+func sendLaunchMsg(ctx context.Context, msg *LaunchMsg, stdin *os.File) (*ipc.Message, error) {
+	if stdin == nil {
+		return SendContext(ctx, msg)
+	}
+	msg.Stdin = true
+	return SendContext(ctx, msg, int(stdin.Fd()))
+}
+
+// Launch launches a program, connecting stdin to it if it is not nil. It
+// waits without timeout for a new sandbox to be ready.
+func Launch(arg, cpath string, args []string, noexec, ephemeral bool, seccompMode oz.SeccompMode, stdin *os.File) error {
+	return LaunchContext(context.Background(), arg, cpath, args, noexec, ephemeral, seccompMode, stdin)
+}
+
+// LaunchContext launches a program like Launch, but waits until ctx is done
+// for a new sandbox to be ready. If ctx is done first the launch is
+// cancelled, the sandbox being killed unless it became ready meanwhile.
+func LaunchContext(ctx context.Context, arg, cpath string, args []string, noexec, ephemeral bool, seccompMode oz.SeccompMode, stdin *os.File) error {
+	msg, err := newLaunchMsg(arg, cpath, args, noexec, ephemeral, seccompMode)
 	if err != nil {
 		return err
 	}
+	if msg.Token, err = createRunToken("launch"); err != nil {
+		return err
+	}
+	resp, err := sendLaunchMsg(ctx, msg, stdin)
+	if err != nil {
+		if ctx.Err() == nil {
+			return err
+		}
+		if cerr := sendOk(&CancelLaunchMsg{Token: msg.Token}); cerr != nil {
+			return fmt.Errorf("launch interrupted (%v), cancelling failed: %v", ctx.Err(), cerr)
+		}
+		return fmt.Errorf("launch cancelled: %v", ctx.Err())
+	}
 	switch body := resp.Body.(type) {
 	case *ErrorMsg:
-		fmt.Printf("error was %s\n", body.Msg)
+		return body.err()
 	case *OkMsg:
-		fmt.Println("ok received from application launch request")
+		return nil
 	default:
-		fmt.Printf("Unexpected message received %+v", body)
+		return fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
+// LaunchWait launches a program like Launch and waits without timeout for it
+// to exit, returning its exit status. The sandbox shutting down before the
+// program exits is reported as an error.
+func LaunchWait(arg, cpath string, args []string, ephemeral bool, seccompMode oz.SeccompMode, stdin *os.File) (int, error) {
+	msg, err := newLaunchMsg(arg, cpath, args, false, ephemeral, seccompMode)
+	if err != nil {
+		return -1, err
+	}
+	msg.Wait = true
+	resp, err := sendLaunchMsg(context.Background(), msg, stdin)
+	if err != nil {
+		return -1, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return -1, body.err()
+	case *LaunchExitMsg:
+		return body.Status, nil
+	default:
+		return -1, fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
+// LaunchBatch launches programs in order in the running sandbox id. The
+// returned slice holds the error of each program, nil if it was launched.
+func LaunchBatch(id int, specs []ozinit.ProgramSpec) ([]error, error) {
+	resp, err := clientSend(&LaunchBatchMsg{Id: id, Specs: specs})
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, body.err()
+	case *LaunchBatchResp:
+		errs := make([]error, len(body.Errors))
+		for i, e := range body.Errors {
+			if e != "" {
+				errs[i] = errors.New(e)
+			}
+		}
+		return errs, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message received %+v", body)
 	}
-	return nil
 }
 
 func KillAllSandboxes() error {
@@ -201,7 +381,7 @@ func KillSandbox(id int) error {
 	}
 	switch body := resp.Body.(type) {
 	case *ErrorMsg:
-		return errors.New(body.Msg)
+		return body.err()
 	case *OkMsg:
 		return nil
 	default:
@@ -209,14 +389,16 @@ func KillSandbox(id int) error {
 	}
 }
 
-func RelaunchXpraClient(id int) error {
-	resp, err := clientSend(&RelaunchXpraClientMsg{Id: id})
+// RelaunchXpraClient restarts the xpra client of a sandbox, with the
+// attach parameters set in opts replacing the defaults.
+func RelaunchXpraClient(id int, opts oz.XpraClientOpts) error {
+	resp, err := clientSend(&RelaunchXpraClientMsg{Id: id, Opts: opts})
 	if err != nil {
 		return err
 	}
 	switch body := resp.Body.(type) {
 	case *ErrorMsg:
-		return errors.New(body.Msg)
+		return body.err()
 	case *OkMsg:
 		return nil
 	default:
@@ -224,14 +406,20 @@ func RelaunchXpraClient(id int) error {
 	}
 }
 
-func RelaunchAllXpraClient() error {
-	return RelaunchXpraClient(-1)
+func RelaunchAllXpraClient(opts oz.XpraClientOpts) error {
+	return RelaunchXpraClient(-1, opts)
 }
 
-func MountFiles(id int, files []string, readOnly bool) error {
+// MountFiles binds files into the sandbox. If targets is not empty it must
+// have one absolute sandbox path per file, at which that file is mounted
+// instead of its own path. Files may be glob patterns, expanded on the host
+// by the daemon as root when mounting, whose matches are each mounted in the
+// directory given as their target.
+func MountFiles(id int, files, targets []string, readOnly bool) error {
 	mountFilesMsg := MountFilesMsg{
 		Id:       id,
 		Files:    files,
+		Targets:  targets,
 		ReadOnly: readOnly,
 	}
 	resp, err := clientSend(&mountFilesMsg)
@@ -240,7 +428,7 @@ func MountFiles(id int, files []string, readOnly bool) error {
 	}
 	switch body := resp.Body.(type) {
 	case *ErrorMsg:
-		return errors.New(body.Msg)
+		return body.err()
 	case *OkMsg:
 		return nil
 	default:
@@ -259,7 +447,7 @@ func UnmountFile(id int, file string) error {
 	}
 	switch body := resp.Body.(type) {
 	case *ErrorMsg:
-		return errors.New(body.Msg)
+		return body.err()
 	case *OkMsg:
 		return nil
 	default:
@@ -267,7 +455,10 @@ func UnmountFile(id int, file string) error {
 	}
 }
 
-func AskForwarder(id int, name, port string) (string, error) {
+// AskForwarder creates the external forwarder name of the sandbox id, to the
+// port of the sandbox for dynamic forwarders. It returns the address of the
+// listener and the port it is bound to, empty for unix sockets.
+func AskForwarder(id int, name, port string) (string, string, error) {
 	askForwarderMsg := AskForwarderMsg{
 		Id:   id,
 		Name: name,
@@ -275,13 +466,392 @@ func AskForwarder(id int, name, port string) (string, error) {
 	}
 	resp, err := clientSend(&askForwarderMsg)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	body, ok := resp.Body.(*ForwarderSuccessMsg)
 	if !ok {
-		return "", fmt.Errorf("Unexpected message received %+v", body)
+		return "", "", fmt.Errorf("Unexpected message received %+v", body)
 	} else {
-		return body.Addr, nil
+		return body.Addr, body.Port, nil
+	}
+}
+
+func ListMounts(id int) ([]ozinit.MountEntry, error) {
+	resp, err := clientSend(&ListMountsMsg{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, body.err()
+	case *ListMountsResp:
+		return body.Mounts, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
+func SetClipboard(id int, enabled bool) error {
+	resp, err := clientSend(&SetClipboardMsg{Id: id, Enabled: enabled})
+	if err != nil {
+		return err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return body.err()
+	case *OkMsg:
+		return nil
+	default:
+		return fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
+// PutFile writes data to the absolute path fpath of a sandbox, which must be
+// inside the put_file_prefix directory of the configuration.
+func PutFile(id int, fpath string, mode os.FileMode, data []byte) error {
+	if len(data) > ozinit.MaxPutFileSize {
+		return fmt.Errorf("file content is larger than %d bytes", ozinit.MaxPutFileSize)
+	}
+	resp, err := clientSend(&PutFileMsg{Id: id, Path: fpath, Mode: uint32(mode.Perm()), Data: data})
+	if err != nil {
+		return err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return body.err()
+	case *OkMsg:
+		return nil
+	default:
+		return fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
+func DumpSeccomp(id int) ([]string, error) {
+	resp, err := clientSend(&DumpSeccompMsg{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, body.err()
+	case *DumpSeccompResp:
+		return body.Paths, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
+// GetConfig returns the configuration the daemon is running with. The values
+// set for environment variables are redacted unless the caller is root.
+func GetConfig() (*oz.Config, error) {
+	resp, err := clientSend(&GetConfigMsg{})
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, body.err()
+	case *GetConfigResp:
+		c := new(oz.Config)
+		if err := json.Unmarshal([]byte(body.Config), c); err != nil {
+			return nil, fmt.Errorf("Unable to parse configuration: %v", err)
+		}
+		return c, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
+// SandboxStats returns the resource usage of the processes of a sandbox
+func SandboxStats(id int) (*ozinit.SandboxStats, error) {
+	resp, err := clientSend(&SandboxStatsMsg{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, body.err()
+	case *SandboxStatsResp:
+		return &body.Stats, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
+// SeccompStats returns the syscalls denied by the seccomp policies of the
+// programs of a sandbox
+func SeccompStats(id int) (*ozinit.SeccompStatsResp, error) {
+	resp, err := clientSend(&SeccompStatsMsg{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, body.err()
+	case *SeccompStatsResp:
+		return &body.Stats, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
+// StopApp terminates the programs of a sandbox, which keeps running instead
+// of being shut down once they have exited, so that programs can be
+// launched in it again.
+func StopApp(id int) error {
+	return sendOk(&StopAppMsg{Id: id})
+}
+
+// PauseSandbox stops all the processes of a sandbox until ResumeSandbox is
+// called for it. A paused sandbox can still be killed.
+func PauseSandbox(id int) error {
+	return sendOk(&PauseSandboxMsg{Id: id})
+}
+
+func ResumeSandbox(id int) error {
+	return sendOk(&ResumeSandboxMsg{Id: id})
+}
+
+// RunInteractive runs a program in the running sandbox id whose stdin stays
+// open, returning its pid for WriteStdin and CloseStdin.
+func RunInteractive(id int, cpath string, args []string) (int, error) {
+	pwd, _ := os.Getwd()
+	resp, err := clientSend(&RunInteractiveMsg{Id: id, Path: cpath, Pwd: pwd, Args: args})
+	if err != nil {
+		return 0, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return 0, body.err()
+	case *RunInteractiveResp:
+		return body.Pid, nil
+	default:
+		return 0, fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
+func WriteStdin(id, pid int, data []byte) error {
+	return sendOk(&WriteStdinMsg{Id: id, Pid: pid, Data: data})
+}
+
+func CloseStdin(id, pid int) error {
+	return sendOk(&CloseStdinMsg{Id: id, Pid: pid})
+}
+
+// DetachChild stops the child pid of sandbox id from keeping the sandbox
+// alive when it shuts down automatically.
+func DetachChild(id, pid int) error {
+	return sendOk(&DetachChildMsg{Id: id, Pid: pid})
+}
+
+func AttachChild(id, pid int) error {
+	return sendOk(&AttachChildMsg{Id: id, Pid: pid})
+}
+
+// SandboxLogs returns the last log lines of the sandbox id, up to the
+// max_log_lines of the configuration.
+func SandboxLogs(id int) ([]string, error) {
+	resp, err := clientSend(&SandboxLogsMsg{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, body.err()
+	case *SandboxLogsResp:
+		return body.Lines, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
+func ClearLogs(id int) error {
+	return sendOk(&ClearLogsMsg{Id: id})
+}
+
+// DiagnosticBundle writes to fpath the diagnostic snapshot of the sandbox as
+// indented JSON, for attaching to bug reports.
+func DiagnosticBundle(id int, fpath string) error {
+	resp, err := clientSend(&DiagnosticBundleMsg{Id: id})
+	if err != nil {
+		return err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return body.err()
+	case *DiagnosticBundleResp:
+		jdata, err := json.MarshalIndent(body.Bundle, "", "  ")
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(fpath, append(jdata, '\n'), 0600)
+	default:
+		return fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
+// RestartSandbox replaces the sandbox by a fresh one running the reloaded
+// profile under the same id, with the files mounted and the dynamic forwarders
+// set up at runtime added again. The programs running in the sandbox are lost.
+// Like LaunchWait it is waited for without a timeout, the new sandbox taking
+// as long as it needs to be ready.
+func RestartSandbox(id int) error {
+	resp, err := SendContext(context.Background(), &RestartSandboxMsg{Id: id})
+	if err != nil {
+		return err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return body.err()
+	case *OkMsg:
+		return nil
+	default:
+		return fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
+// FollowProgram calls fn with each output line of the program pid of the
+// sandbox until the program closes its output, only programs launched with
+// their output captured being followed.
+func FollowProgram(id, pid int, fn func(line string)) error {
+	c, err := clientConnect()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	rr, err := c.ExchangeMsg(&FollowProgramMsg{Id: id, Pid: pid})
+	if err != nil {
+		return err
+	}
+	defer rr.Done()
+	for resp := range rr.Chan() {
+		switch body := resp.Body.(type) {
+		case *ErrorMsg:
+			return body.err()
+		case *OkMsg:
+			return nil
+		case *ProgramOutputMsg:
+			fn(body.Line)
+		default:
+			return fmt.Errorf("Unexpected message received %+v", body)
+		}
+	}
+	return nil
+}
+
+// Notify shows a desktop notification in the sandbox through its session
+// bus, doing nothing if the profile does not enable notifications.
+func Notify(id int, summary, body string) error {
+	return sendOk(&NotifyMsg{Id: id, Summary: summary, Body: body})
+}
+
+// sendOk sends msg and waits for an OkMsg in response
+func sendOk(msg interface{}) error {
+	resp, err := clientSend(msg)
+	if err != nil {
+		return err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return body.err()
+	case *OkMsg:
+		return nil
+	default:
+		return fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
+// SetHostname changes the hostname of a running sandbox, an empty hostname
+// giving it the name of its profile followed by the sandbox id.
+func SetHostname(id int, hostname string) error {
+	resp, err := clientSend(&SetHostnameMsg{Id: id, Hostname: hostname})
+	if err != nil {
+		return err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return body.err()
+	case *OkMsg:
+		return nil
+	default:
+		return fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
+// GetLaunchEnv returns the OZ_ variables forwarded into a sandbox from the
+// environment of the daemon, with their values redacted.
+func GetLaunchEnv(id int) ([]string, error) {
+	return getLaunchEnv(id, false)
+}
+
+// GetLaunchEnvUnredacted is GetLaunchEnv with the values included, only
+// allowed for the owner of the sandbox and root.
+func GetLaunchEnvUnredacted(id int) ([]string, error) {
+	return getLaunchEnv(id, true)
+}
+
+func getLaunchEnv(id int, unredacted bool) ([]string, error) {
+	resp, err := clientSend(&GetLaunchEnvMsg{Id: id, Unredacted: unredacted})
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, body.err()
+	case *GetLaunchEnvResp:
+		return body.Env, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
+func NetworkInfo(id int) (*network.NetInfo, error) {
+	resp, err := clientSend(&NetworkInfoMsg{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, body.err()
+	case *NetworkInfoResp:
+		return &body.Info, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
+// VPNStatus returns the status of the openvpn client of the sandbox id
+func VPNStatus(id int) (*openvpn.Status, error) {
+	resp, err := clientSend(&VPNStatusMsg{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, body.err()
+	case *VPNStatusResp:
+		return &body.Status, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
+func GetProfileByName(name string) (*oz.Profile, error) {
+	resp, err := clientSend(&GetProfileByNameMsg{Name: name})
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, body.err()
+	case *GetProfileResp:
+		p := new(oz.Profile)
+		if err := json.Unmarshal([]byte(body.Profile), p); err != nil {
+			return nil, err
+		}
+		return p, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message received %+v", body)
 	}
 }
 
@@ -295,12 +865,13 @@ func parseProfileArg(arg string) (int, string, error) {
 	return 0, arg, nil
 }
 
-func Logs(count int, follow bool) (chan string, error) {
+// Logs streams the daemon logs, gzipped over the socket if compress is set.
+func Logs(count int, follow, compress bool) (chan string, error) {
 	c, err := clientConnect()
 	if err != nil {
 		return nil, err
 	}
-	rr, err := c.ExchangeMsg(&LogsMsg{Count: count, Follow: follow})
+	rr, err := c.ExchangeMsg(&LogsMsg{Count: count, Follow: follow, Compress: compress})
 	if err != nil {
 		return nil, err
 	}
@@ -317,7 +888,15 @@ func dumpLogs(out chan<- string, rr ipc.ResponseReader) {
 			close(out)
 			return
 		case *LogData:
-			for _, ll := range body.Lines {
+			lines := body.Lines
+			if len(body.Compressed) > 0 {
+				var err error
+				if lines, err = decompressLines(body.Compressed); err != nil {
+					out <- fmt.Sprintf("Failed to decompress log data: %v", err)
+					continue
+				}
+			}
+			for _, ll := range lines {
 				out <- ll
 			}
 		default:
@@ -329,24 +908,33 @@ func dumpLogs(out chan<- string, rr ipc.ResponseReader) {
 var isSocketName = regexp.MustCompile(`^@[A-Za-z0-9_-]+$`).MatchString
 var sSocketName = ""
 
+var clientLog = logging.MustGetLogger("oz")
+
+// GetSocketName returns the socket of the daemon, the one named by the
+// OZ_SOCKET_NAME environment variable if it is set to a valid name.
 func GetSocketName() string {
 	if sSocketName != "" {
 		return sSocketName
 	}
-	bSockName := os.Getenv("OZ_SOCKET_NAME")
-
-	if bSockName != "" {
-		fmt.Println("Attempting to connect on custom socket provided through environment: ", bSockName)
-		if bSockName[0:1] != "@" {
-			bSockName = "@" + bSockName
-		}
-		if !isSocketName(bSockName) {
-			fmt.Fprintf(os.Stderr, "Invalid socket name `%s`, reverting to `%s`\n", bSockName, SocketName)
-			bSockName = SocketName
-		}
-	} else {
-		bSockName = SocketName
+	name, err := socketNameFromEnv(os.Getenv("OZ_SOCKET_NAME"))
+	if err != nil {
+		clientLog.Warning("%v, reverting to `%s`", err, SocketName)
 	}
-	sSocketName = bSockName
+	sSocketName = name
 	return sSocketName
 }
+
+// socketNameFromEnv returns the socket named by the value of OZ_SOCKET_NAME,
+// the default socket when it is empty or, with an error, invalid.
+func socketNameFromEnv(env string) (string, error) {
+	if env == "" {
+		return SocketName, nil
+	}
+	if env[0:1] != "@" {
+		env = "@" + env
+	}
+	if !isSocketName(env) {
+		return SocketName, fmt.Errorf("invalid socket name `%s`", env)
+	}
+	return env, nil
+}
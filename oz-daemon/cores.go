@@ -0,0 +1,50 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/subgraph/oz"
+)
+
+// createCoreDir creates the host directory receiving the core dumps of the
+// sandbox id of p, writable by the sandbox user only.
+func (d *daemonState) createCoreDir(p *oz.Profile, id int, uid, gid uint32) (string, error) {
+	if d.config.CoreCollectPath == "" {
+		return "", fmt.Errorf("profile %s collects core dumps but no core_collect_path is configured", p.Name)
+	}
+	if err := os.MkdirAll(d.config.CoreCollectPath, 0755); err != nil {
+		return "", fmt.Errorf("failed to create core collection directory: %v", err)
+	}
+	name := fmt.Sprintf("%s-%d-%s", p.Name, id, time.Now().Format("20060102-150405"))
+	dir := path.Join(d.config.CoreCollectPath, name)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create core directory: %v", err)
+	}
+	if err := os.Chown(dir, int(uid), int(gid)); err != nil {
+		os.Remove(dir)
+		return "", fmt.Errorf("failed to chown core directory: %v", err)
+	}
+	return dir, nil
+}
+
+// collectCores logs the core dumps written by the sandbox, removing its core
+// directory when there are none.
+func (sbox *Sandbox) collectCores() {
+	log := sbox.daemon.log
+	fis, err := ioutil.ReadDir(sbox.coreDir)
+	if err != nil {
+		log.Warning("Unable to read core directory of sandbox %d: %v", sbox.id, err)
+		return
+	}
+	if len(fis) == 0 {
+		os.Remove(sbox.coreDir)
+		return
+	}
+	for _, fi := range fis {
+		log.Notice("Collected core dump of sandbox %d (%s): %s (%d bytes)", sbox.id, sbox.profile.Name, path.Join(sbox.coreDir, fi.Name()), fi.Size())
+	}
+}
@@ -12,10 +12,14 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/subgraph/oz"
 	"github.com/subgraph/oz/ipc"
 	"github.com/subgraph/oz/network"
+	"github.com/subgraph/oz/openvpn"
+	"github.com/subgraph/oz/oz-init"
+	"github.com/subgraph/oz/xpra"
 
 	"github.com/op/go-logging"
 )
@@ -41,8 +45,19 @@ type daemonState struct {
 	// openvpns     *network.OpenVPNs
 	systemGroups map[string]groupEntry
 	envOverrides []string
+	// Launches cancelled before their sandbox was registered, by token
+	cancelledLaunches map[string]cancelledLaunch
 }
 
+// A launch cancelled by uid before its sandbox was registered, forgotten
+// after cancelledLaunchExpiry if it never is
+type cancelledLaunch struct {
+	uid uint32
+	at  time.Time
+}
+
+const cancelledLaunchExpiry = time.Minute
+
 func Main() {
 	oz.CheckSettingsOverRide()
 	GetSocketName()
@@ -55,6 +70,7 @@ func Main() {
 		d.handleGetConfig,
 		d.handleListProfiles,
 		d.handleGetProfile,
+		d.handleGetProfileByName,
 		d.handleIsRunning,
 		d.handleLaunch,
 		d.handleListSandboxes,
@@ -67,6 +83,32 @@ func Main() {
 		d.handleListForwarders,
 		d.handleListBridges,
 		d.handleListProxies,
+		d.handleListMounts,
+		d.handleSetClipboard,
+		d.handleDumpSeccomp,
+		d.handleNetworkInfo,
+		d.handleVPNStatus,
+		d.handlePutFile,
+		d.handleLaunchBatch,
+		d.handleGetLaunchEnv,
+		d.handleSetHostname,
+		d.handlePauseSandbox,
+		d.handleResumeSandbox,
+		d.handleSandboxStats,
+		d.handleRunInteractive,
+		d.handleWriteStdin,
+		d.handleCloseStdin,
+		d.handleDetachChild,
+		d.handleAttachChild,
+		d.handleSandboxLogs,
+		d.handleClearLogs,
+		d.handleRestartSandbox,
+		d.handleDiagnosticBundle,
+		d.handleFollowProgram,
+		d.handleNotify,
+		d.handleCancelLaunch,
+		d.handleSeccompStats,
+		d.handleStopApp,
 	)
 	if err != nil {
 		d.log.Error("Error running server: %v", err)
@@ -215,6 +257,15 @@ func (d *daemonState) handleChildExit(pid int, wstatus syscall.WaitStatus) {
 				sbox.ovpn = nil
 			}
 
+			// Only once torn down, as a restart launches the sandbox
+			// again with the same id
+			close(sbox.exited)
+			return
+		}
+	}
+	for _, sbox := range d.sandboxes {
+		if sbox.xpraClientExited(pid, wstatus) {
+			d.Debug("xpra client of sandbox %d exited", sbox.id)
 			return
 		}
 	}
@@ -222,7 +273,7 @@ func (d *daemonState) handleChildExit(pid int, wstatus syscall.WaitStatus) {
 }
 
 func removeOpenVPNRunState(d *daemonState, runtoken string) {
-	statefiles := [...]string{"-key.key", "-cert.cert", "-ca.cert", ".pid", "-tls-auth.key"}
+	statefiles := [...]string{"-key.key", "-cert.cert", "-ca.cert", ".pid", "-tls-auth.key", openvpn.ManagementSocketSuffix}
 	for _, suffix := range statefiles {
 		statefile := path.Join(d.config.OpenVPNRunPath, runtoken+suffix)
 		if _, err := os.Stat(statefile); err == nil {
@@ -269,11 +320,29 @@ func (d *daemonState) handlePing(msg *PingMsg, m *ipc.Message) error {
 
 func (d *daemonState) handleGetConfig(msg *GetConfigMsg, m *ipc.Message) error {
 	d.Debug("received get config with data [%s]", msg.Data)
-	jdata, err := json.Marshal(d.config)
+	config := *d.config
+	if m.Ucred.Uid != 0 {
+		config.EnvironmentVars = redactEnvironmentVars(config.EnvironmentVars)
+	}
+	jdata, err := json.Marshal(&config)
 	if err != nil {
-		return m.Respond(&ErrorMsg{err.Error()})
+		return m.Respond(&ErrorMsg{err.Error(), oz.ErrInternal})
 	}
-	return m.Respond(&GetConfigMsg{string(jdata)})
+	return m.Respond(&GetConfigResp{string(jdata)})
+}
+
+// redactEnvironmentVars hides the values which the configuration gives to
+// environment variables, such as proxy URLs with credentials, keeping the
+// names of the variables passed through from the launching environment.
+func redactEnvironmentVars(vars []string) []string {
+	r := make([]string, len(vars))
+	for i, v := range vars {
+		if n := strings.Index(v, "="); n != -1 {
+			v = v[:n+1] + "<redacted>"
+		}
+		r[i] = v
+	}
+	return r
 }
 
 func (d *daemonState) handleListProfiles(msg *ListProfilesMsg, m *ipc.Message) error {
@@ -292,12 +361,36 @@ func (d *daemonState) handleGetProfile(msg *GetProfileMsg, m *ipc.Message) error
 		Path: msg.Path,
 	})
 	if err != nil {
-		return m.Respond(&ErrorMsg{err.Error()})
+		return m.Respond(&ErrorMsg{err.Error(), oz.ErrNotFound})
 	}
 
 	jdata, err := json.Marshal(p)
 	if err != nil {
-		return m.Respond(&ErrorMsg{err.Error()})
+		return m.Respond(&ErrorMsg{err.Error(), oz.ErrInternal})
+	}
+	return m.Respond(&GetProfileResp{
+		Profile: string(jdata),
+	})
+}
+
+func (d *daemonState) handleGetProfileByName(msg *GetProfileByNameMsg, m *ipc.Message) error {
+	d.Debug("Get profile by name received. Name: %s", msg.Name)
+	var matches []*oz.Profile
+	for _, p := range d.profiles {
+		if p.Name == msg.Name {
+			matches = append(matches, p)
+		}
+	}
+	if len(matches) == 0 {
+		return m.Respond(&ErrorMsg{fmt.Sprintf("no profile found with name '%s'", msg.Name), oz.ErrNotFound})
+	}
+	if len(matches) > 1 {
+		return m.Respond(&ErrorMsg{fmt.Sprintf("multiple profiles (%d) matched name '%s'", len(matches), msg.Name), oz.ErrInvalid})
+	}
+
+	jdata, err := json.Marshal(matches[0])
+	if err != nil {
+		return m.Respond(&ErrorMsg{err.Error(), oz.ErrInternal})
 	}
 	return m.Respond(&GetProfileResp{
 		Profile: string(jdata),
@@ -309,17 +402,17 @@ func (d *daemonState) handleIsRunning(msg *IsRunningMsg, m *ipc.Message) error {
 	if m.Ucred.Uid == 0 || m.Ucred.Gid == 0 {
 		errmsg := fmt.Sprintf("Rejected launch request for %s by privileged user uid %d, gid %d", msg.Path, m.Ucred.Uid, m.Ucred.Gid)
 		d.Warning(errmsg)
-		return m.Respond(&ErrorMsg{errmsg})
+		return m.Respond(&ErrorMsg{errmsg, oz.ErrPermission})
 	}
 
 	p, err := d.getProfileFromLaunchMsg(&LaunchMsg{
 		Path: msg.Path,
 	})
 	if err != nil {
-		return m.Respond(&ErrorMsg{err.Error()})
+		return m.Respond(&ErrorMsg{err.Error(), oz.ErrNotFound})
 	}
 
-	if sbox := d.getRunningSandboxByName(p.Name); sbox != nil {
+	if sbox := d.getRunningSandboxByName(p.Name); sbox != nil && sbox.matchesRunning(msg.Path, msg.Args) {
 		return m.Respond(&OkMsg{})
 	}
 	return m.Respond(&NotOkMsg{})
@@ -327,42 +420,232 @@ func (d *daemonState) handleIsRunning(msg *IsRunningMsg, m *ipc.Message) error {
 
 func (d *daemonState) handleLaunch(msg *LaunchMsg, m *ipc.Message) error {
 	d.Debug("Launch message received. Path: %s Name: %s Pwd: %s Args: %+v", msg.Path, msg.Name, msg.Pwd, msg.Args)
+	// Closes the received descriptors unless handed over as stdin
+	defer m.Free()
 
 	if m.Ucred.Uid == 0 || m.Ucred.Gid == 0 {
 		errmsg := fmt.Sprintf("Rejected launch request for %s by privileged user uid %d, gid %d", msg.Name, m.Ucred.Uid, m.Ucred.Gid)
 		d.Warning(errmsg)
-		return m.Respond(&ErrorMsg{errmsg})
+		return m.Respond(&ErrorMsg{errmsg, oz.ErrPermission})
 	}
 
 	d.log.Info("Execution request from uid %d, gid %d", m.Ucred.Uid, m.Ucred.Gid)
 
+	if msg.SeccompModeOverride != "" {
+		if !d.config.AllowSeccompOverride {
+			errmsg := fmt.Sprintf("Rejected seccomp mode override to %s by uid %d, not allowed by the configuration", msg.SeccompModeOverride, m.Ucred.Uid)
+			d.Warning(errmsg)
+			return m.Respond(&ErrorMsg{errmsg, oz.ErrPermission})
+		}
+		if !oz.IsValidSeccompMode(msg.SeccompModeOverride) {
+			return m.Respond(&ErrorMsg{fmt.Sprintf("invalid seccomp mode '%s'", msg.SeccompModeOverride), oz.ErrInvalid})
+		}
+		d.Notice("Launch requested by uid %d with seccomp mode overridden to %s", m.Ucred.Uid, msg.SeccompModeOverride)
+	}
+
 	p, err := d.getProfileFromLaunchMsg(msg)
 	if err != nil {
-		return m.Respond(&ErrorMsg{err.Error()})
+		return m.Respond(&ErrorMsg{err.Error(), oz.ErrNotFound})
+	}
+
+	if msg.Wait && msg.Noexec {
+		return m.Respond(&ErrorMsg{"cannot wait for a program with noexec set", oz.ErrInvalid})
+	}
+
+	// The descriptor was opened by the client with the permissions of the
+	// user, and is handed over to the program launched
+	var stdin *os.File
+	if msg.Stdin {
+		if len(m.Fds) != 1 || msg.Noexec {
+			return m.Respond(&ErrorMsg{"stdin must be a single descriptor passed for a program to launch", oz.ErrInvalid})
+		}
+		stdin = os.NewFile(uintptr(m.Fds[0]), "stdin")
+		m.Fds = nil
+	}
+
+	// The response is sent once the program exits
+	var onExit func(int, error)
+	if msg.Wait {
+		onExit = func(status int, err error) {
+			respondLaunchExit(m, status, err)
+		}
 	}
 
 	if sbox := d.getRunningSandboxByName(p.Name); sbox != nil {
+		// oz-init refuses launches while paused, which would otherwise be
+		// taken for a broken sandbox and destroy it
+		if sbox.paused {
+			if stdin != nil {
+				stdin.Close()
+			}
+			return m.Respond(&ErrorMsg{fmt.Sprintf("sandbox %d is paused", sbox.id), oz.ErrInvalid})
+		}
 		if msg.Noexec {
 			errmsg := "Asked to launch program but sandbox is running and noexec is set!"
 			d.Notice(errmsg)
-			return m.Respond(&ErrorMsg{errmsg})
+			return m.Respond(&ErrorMsg{errmsg, oz.ErrAlreadyRunning})
+		} else if msg.Wait {
+			d.Info("Found running sandbox for `%s`, running program there and waiting for it", p.Name)
+			lp := sbox.addLaunched(msg.Path, msg.Args)
+			go func() {
+				defer sbox.removeLaunched(lp)
+				onExit(sbox.launchProgramWait(d.config.PrefixPath, msg.Path, msg.Pwd, msg.Args, msg.SeccompModeOverride, stdin, d.log))
+			}()
+			return nil
 		} else {
 			d.Info("Found running sandbox for `%s`, running program there", p.Name)
-			sbox.launchProgram(d.config.PrefixPath, msg.Path, msg.Pwd, msg.Args, d.log)
+			lp := sbox.addLaunched(msg.Path, msg.Args)
+			go func() {
+				defer sbox.removeLaunched(lp)
+				sbox.launchProgram(d.config.PrefixPath, msg.Path, msg.Pwd, msg.Args, msg.SeccompModeOverride, stdin, d.log)
+			}()
 		}
 	} else {
+		if d.config.MaxSandboxes > 0 && len(d.sandboxes) >= d.config.MaxSandboxes {
+			errmsg := fmt.Sprintf("Rejected launch of %s by uid %d, the maximum of %d running sandboxes is reached", p.Name, m.Ucred.Uid, d.config.MaxSandboxes)
+			d.Warning(errmsg)
+			if stdin != nil {
+				stdin.Close()
+			}
+			return m.Respond(&ErrorMsg{errmsg, oz.ErrLimit})
+		}
 		d.Debug("Would launch %s (ephemeral: %b)", p.Name, msg.Ephemeral)
 		rawEnv := msg.Env
 		msg.Env = d.sanitizeEnvironment(p, rawEnv)
-		_, err = d.launch(p, msg, rawEnv, m.Ucred.Uid, m.Ucred.Gid, msg.Ephemeral, d.log)
+		sbox, err := d.launch(d.nextSboxId, p, msg, rawEnv, m.Ucred.Uid, m.Ucred.Gid, msg.Ephemeral, stdin, onExit, d.log)
 		if err != nil {
 			d.Warning("Launch of %s failed: %v", p.Name, err)
-			return m.Respond(&ErrorMsg{err.Error()})
+			if stdin != nil {
+				stdin.Close()
+			}
+			return m.Respond(&ErrorMsg{err.Error(), oz.ErrInternal})
+		}
+		if msg.Token != "" {
+			if !msg.Wait {
+				go respondLaunchReady(sbox, m)
+			}
+			return nil
+		}
+		if msg.Wait {
+			return nil
+		}
+	}
+	return m.Respond(&OkMsg{})
+}
+
+// respondLaunchReady answers a launch request made with a token once its
+// sandbox is ready, or with an error if it exits before, when cancelled.
+func respondLaunchReady(sbox *Sandbox, m *ipc.Message) error {
+	select {
+	case <-sbox.readyc:
+		return m.Respond(&OkMsg{})
+	case <-sbox.exited:
+		return m.Respond(&ErrorMsg{fmt.Sprintf("sandbox %d exited before being ready", sbox.id), oz.ErrInternal})
+	}
+}
+
+func (d *daemonState) handleSeccompStats(msg *SeccompStatsMsg, m *ipc.Message) error {
+	sbox, errmsg := d.ownedSandbox(msg.Id, m, "seccomp stats request")
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	stats, err := ozinit.SeccompStats(sbox.addr)
+	if err != nil {
+		return m.Respond(initErrorMsg("Unable to get seccomp stats", err))
+	}
+	return m.Respond(&SeccompStatsResp{Stats: *stats})
+}
+
+// handleCancelLaunch kills the oz-init of a sandbox which is not ready yet,
+// along with every process of its namespace. The sandbox is then cleaned up
+// like any sandbox whose init exited.
+func (d *daemonState) handleCancelLaunch(msg *CancelLaunchMsg, m *ipc.Message) error {
+	var found *Sandbox
+	for _, sbox := range d.sandboxes {
+		if msg.Token != "" && sbox.launchToken == msg.Token {
+			found = sbox
+			break
 		}
 	}
+	if found == nil && msg.Token != "" {
+		// The launch message may not have been handled yet
+		d.recordCancelledLaunch(msg.Token, m.Ucred.Uid)
+		d.Notice("Launch with token %s cancelled by uid %d before its sandbox was started", msg.Token, m.Ucred.Uid)
+		return m.Respond(&OkMsg{})
+	}
+	if found == nil {
+		return m.Respond(&ErrorMsg{"no sandbox being launched found for this token", oz.ErrNotFound})
+	}
+	sbox, errmsg := d.ownedSandbox(found.id, m, "launch cancellation")
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	ready, err := sbox.cancelLaunch()
+	if ready {
+		return m.Respond(&ErrorMsg{fmt.Sprintf("sandbox %d is already started", sbox.id), oz.ErrInvalid})
+	}
+	d.Notice("Launch of sandbox %d (%s) cancelled by uid %d", sbox.id, sbox.profile.Name, m.Ucred.Uid)
+	if err != nil {
+		return m.Respond(&ErrorMsg{fmt.Sprintf("failed to kill oz-init: %v", err), oz.ErrInternal})
+	}
 	return m.Respond(&OkMsg{})
 }
 
+func (d *daemonState) recordCancelledLaunch(token string, uid uint32) {
+	if d.cancelledLaunches == nil {
+		d.cancelledLaunches = make(map[string]cancelledLaunch)
+	}
+	for t, cl := range d.cancelledLaunches {
+		if time.Since(cl.at) > cancelledLaunchExpiry {
+			delete(d.cancelledLaunches, t)
+		}
+	}
+	d.cancelledLaunches[token] = cancelledLaunch{uid: uid, at: time.Now()}
+}
+
+// takeCancelledLaunch returns whether the launch with token was cancelled by
+// uid before its sandbox was registered, forgetting it.
+func (d *daemonState) takeCancelledLaunch(token string, uid uint32) bool {
+	cl, ok := d.cancelledLaunches[token]
+	if !ok || token == "" {
+		return false
+	}
+	delete(d.cancelledLaunches, token)
+	return cl.uid == uid && time.Since(cl.at) <= cancelledLaunchExpiry
+}
+
+// respondLaunchExit answers a launch request made with Wait, keeping the code
+// of an error coming from oz-init.
+func respondLaunchExit(m *ipc.Message, status int, err error) error {
+	if err != nil {
+		return m.Respond(initErrorMsg("Unable to run program", err))
+	}
+	return m.Respond(&LaunchExitMsg{status})
+}
+
+func (d *daemonState) handleLaunchBatch(msg *LaunchBatchMsg, m *ipc.Message) error {
+	if m.Ucred.Uid == 0 || m.Ucred.Gid == 0 {
+		errmsg := fmt.Sprintf("Rejected launch batch request for sandbox %d by privileged user uid %d, gid %d", msg.Id, m.Ucred.Uid, m.Ucred.Gid)
+		d.Warning(errmsg)
+		return m.Respond(&ErrorMsg{errmsg, oz.ErrPermission})
+	}
+	sbox, errmsg := d.ownedSandbox(msg.Id, m, "launch batch")
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	d.log.Info("Batch of %d programs requested in sandbox %d by uid %d, gid %d", len(msg.Specs), msg.Id, m.Ucred.Uid, m.Ucred.Gid)
+	if sbox.profile.AllowFiles {
+		for _, spec := range msg.Specs {
+			sbox.whitelistArgumentFiles(d.config.PrefixPath, spec.Pwd, spec.Args, d.log)
+		}
+	}
+	errs, err := ozinit.LaunchBatch(sbox.addr, msg.Specs)
+	if err != nil {
+		return m.Respond(initErrorMsg("Unable to launch programs", err))
+	}
+	return m.Respond(&LaunchBatchResp{Errors: errs})
+}
+
 func (d *daemonState) sanitizeEnvironment(p *oz.Profile, oldEnv []string) []string {
 	newEnv := []string{}
 
@@ -402,6 +685,17 @@ func (d *daemonState) sanitizeEnvironment(p *oz.Profile, oldEnv []string) []stri
 		}
 	}
 
+	if d.config.PassHostLocale && p.Locale == "" {
+		for _, OldItem := range oldEnv {
+			if strings.HasPrefix(OldItem, "LANG=") {
+				if lang := strings.TrimPrefix(OldItem, "LANG="); oz.IsValidLocale(lang) {
+					newEnv = append(newEnv, OldItem)
+				}
+				break
+			}
+		}
+	}
+
 	return newEnv
 }
 
@@ -409,7 +703,7 @@ func (d *daemonState) handleKillSandbox(msg *KillSandboxMsg, m *ipc.Message) err
 	if msg.Id == -1 {
 		for _, sb := range d.sandboxes {
 			if err := sb.init.Process.Signal(os.Interrupt); err != nil {
-				return m.Respond(&ErrorMsg{fmt.Sprintf("failed to send interrupt signal: %v", err)})
+				return m.Respond(&ErrorMsg{fmt.Sprintf("failed to send interrupt signal: %v", err), oz.ErrInternal})
 			}
 			if sb.ovpn != nil {
 				pidfilepath := path.Join(d.config.OpenVPNRunPath, sb.ovpn.runtoken+".pid")
@@ -429,10 +723,10 @@ func (d *daemonState) handleKillSandbox(msg *KillSandboxMsg, m *ipc.Message) err
 	} else {
 		sbox := d.sandboxById(msg.Id)
 		if sbox == nil {
-			return m.Respond(&ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id)})
+			return m.Respond(&ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id), oz.ErrNotFound})
 		}
 		if err := sbox.init.Process.Signal(os.Interrupt); err != nil {
-			return m.Respond(&ErrorMsg{fmt.Sprintf("failed to send interrupt signal: %v", err)})
+			return m.Respond(&ErrorMsg{fmt.Sprintf("failed to send interrupt signal: %v", err), oz.ErrInternal})
 		}
 		if sbox.ovpn != nil {
 			pidfilepath := path.Join(d.config.OpenVPNRunPath, sbox.ovpn.runtoken+".pid")
@@ -452,38 +746,57 @@ func (d *daemonState) handleKillSandbox(msg *KillSandboxMsg, m *ipc.Message) err
 }
 
 func (d *daemonState) handleRelaunchXpraClient(msg *RelaunchXpraClientMsg, m *ipc.Message) error {
+	if err := xpra.ValidateClientOpts(&msg.Opts); err != nil {
+		return m.Respond(&ErrorMsg{err.Error(), oz.ErrInvalid})
+	}
 	if msg.Id == -1 {
 		for _, sb := range d.sandboxes {
-			sb.startXpraClient()
+			sb.startXpraClient(&msg.Opts)
 		}
 	} else {
 		sbox := d.sandboxById(msg.Id)
 		if sbox == nil {
-			return m.Respond(&ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id)})
+			return m.Respond(&ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id), oz.ErrNotFound})
 		}
-		sbox.startXpraClient()
+		sbox.startXpraClient(&msg.Opts)
 	}
 	return m.Respond(&OkMsg{})
 }
 
 func (d *daemonState) handleMountFiles(msg *MountFilesMsg, m *ipc.Message) error {
-	sbox := d.sandboxById(msg.Id)
-	if sbox == nil {
-		return m.Respond(&ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id)})
+	sbox, errmsg := d.ownedSandbox(msg.Id, m, "file mount")
+	if errmsg != nil {
+		return m.Respond(errmsg)
 	}
-	if err := sbox.MountFiles(msg.Files, msg.ReadOnly, d.config.PrefixPath, d.log); err != nil {
-		return m.Respond(&ErrorMsg{fmt.Sprintf("Unable to mount: %v", err)})
+	if len(msg.Targets) > 0 && len(msg.Targets) != len(msg.Files) {
+		return m.Respond(&ErrorMsg{fmt.Sprintf("got %d targets for %d files", len(msg.Targets), len(msg.Files)), oz.ErrInvalid})
+	}
+	for i, t := range msg.Targets {
+		if !path.IsAbs(t) {
+			return m.Respond(&ErrorMsg{fmt.Sprintf("mount target must be an absolute path: %s", t), oz.ErrInvalid})
+		}
+		msg.Targets[i] = path.Clean(t)
+		if !oz.IsUserMountPath(msg.Targets[i], sbox.user.HomeDir) {
+			return m.Respond(&ErrorMsg{fmt.Sprintf("mount target must be inside of the user home or mounts: %s", t), oz.ErrPermission})
+		}
+	}
+	files, targets := sbox.expandMountGlobs(msg.Files, msg.Targets, d.log)
+	if len(files) == 0 {
+		return m.Respond(&OkMsg{})
+	}
+	if err := sbox.MountFiles(files, targets, msg.ReadOnly, d.config.PrefixPath, d.log); err != nil {
+		return m.Respond(&ErrorMsg{fmt.Sprintf("Unable to mount: %v", err), oz.ErrInternal})
 	}
 	return m.Respond(&OkMsg{})
 }
 
 func (d *daemonState) handleUnmountFile(msg *UnmountFileMsg, m *ipc.Message) error {
-	sbox := d.sandboxById(msg.Id)
-	if sbox == nil {
-		return m.Respond(&ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id)})
+	sbox, errmsg := d.ownedSandbox(msg.Id, m, "file unmount")
+	if errmsg != nil {
+		return m.Respond(errmsg)
 	}
 	if err := sbox.UnmountFile(msg.File, d.config.PrefixPath, d.log); err != nil {
-		return m.Respond(&ErrorMsg{fmt.Sprintf("Unable to unmount: %v", err)})
+		return m.Respond(&ErrorMsg{fmt.Sprintf("Unable to unmount: %v", err), oz.ErrInternal})
 	}
 	return m.Respond(&OkMsg{})
 }
@@ -492,10 +805,10 @@ func (d *daemonState) handleAskForwarder(msg *AskForwarderMsg, m *ipc.Message) e
 	sbox := d.sandboxById(msg.Id)
 	hasListenerName := false
 	if sbox == nil {
-		return m.Respond(&ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id)})
+		return m.Respond(&ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id), oz.ErrNotFound})
 	}
 	if len(sbox.profile.ExternalForwarders) == 0 {
-		return m.Respond(&ErrorMsg{fmt.Sprintf("no listeners configured in sandbox profile.")})
+		return m.Respond(&ErrorMsg{fmt.Sprintf("no listeners configured in sandbox profile."), oz.ErrNotFound})
 	}
 	for _, l := range sbox.profile.ExternalForwarders {
 		if l.Name == msg.Name {
@@ -503,13 +816,13 @@ func (d *daemonState) handleAskForwarder(msg *AskForwarderMsg, m *ipc.Message) e
 		}
 	}
 	if !hasListenerName {
-		return m.Respond(&ErrorMsg{fmt.Sprintf("No listener %s found.", msg.Name)})
+		return m.Respond(&ErrorMsg{fmt.Sprintf("No listener %s found.", msg.Name), oz.ErrNotFound})
 	}
-	forwarder, err := sbox.SetupDynamicForwarder(msg.Name, msg.Port, d.log)
+	forwarder, port, err := sbox.SetupDynamicForwarder(msg.Name, msg.Port, d.log)
 	if err != nil {
-		return m.Respond(&ErrorMsg{fmt.Sprintf("Unable to create forwarder: %v", err)})
+		return m.Respond(&ErrorMsg{fmt.Sprintf("Unable to create forwarder: %v", err), oz.ErrInternal})
 	}
-	return m.Respond(&ForwarderSuccessMsg{Proto: msg.Name, Addr: forwarder})
+	return m.Respond(&ForwarderSuccessMsg{Proto: msg.Name, Addr: forwarder, Port: port})
 }
 
 func (d *daemonState) sandboxById(id int) *Sandbox {
@@ -572,7 +885,7 @@ func (d *daemonState) getRunningSandboxByName(name string) *Sandbox {
 func (d *daemonState) handleListSandboxes(list *ListSandboxesMsg, msg *ipc.Message) error {
 	r := new(ListSandboxesResp)
 	for _, sb := range d.sandboxes {
-		r.Sandboxes = append(r.Sandboxes, SandboxInfo{Id: sb.id, Address: sb.addr, Mounts: sb.mountedFiles, Profile: sb.profile.Name, InitPid: sb.init.Process.Pid})
+		r.Sandboxes = append(r.Sandboxes, sb.info())
 	}
 	return msg.Respond(r)
 }
@@ -581,10 +894,28 @@ func (d *daemonState) handleListForwarders(msg *ListForwardersMsg, m *ipc.Messag
 	sbox := d.sandboxById(msg.Id)
 	r := new(ListForwardersResp)
 	if sbox == nil {
-		return m.Respond(&ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id)})
+		return m.Respond(&ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id), oz.ErrNotFound})
+	}
+	stats := make(map[string]ozinit.ForwarderStats)
+	if len(sbox.forwarders) > 0 {
+		ss, err := ozinit.ListForwarderStats(sbox.addr)
+		if err != nil {
+			d.log.Warning("Unable to fetch forwarder statistics of sandbox %d: %v", sbox.id, err)
+		}
+		for _, s := range ss {
+			stats[s.Addr] = s
+		}
 	}
 	for _, f := range sbox.forwarders {
-		r.Forwarders = append(r.Forwarders, Forwarder{Name: f.name, Target: f.dest, Desc: f.desc})
+		s := stats[f.dest]
+		r.Forwarders = append(r.Forwarders, Forwarder{
+			Name:        f.name,
+			Target:      f.dest,
+			Desc:        f.desc,
+			BytesIn:     s.BytesIn,
+			BytesOut:    s.BytesOut,
+			Connections: s.Active,
+		})
 	}
 	return m.Respond(r)
 }
@@ -603,13 +934,442 @@ func (d *daemonState) handleListProxies(msg *ListProxiesMsg, m *ipc.Message) err
 	return m.Respond(r)
 }
 
+func (d *daemonState) handleListMounts(msg *ListMountsMsg, m *ipc.Message) error {
+	sbox, errmsg := d.ownedSandbox(msg.Id, m, "mount listing")
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	mounts, err := ozinit.ListMounts(sbox.addr)
+	if err != nil {
+		return m.Respond(&ErrorMsg{fmt.Sprintf("Unable to list mounts: %v", err), oz.ErrInternal})
+	}
+	return m.Respond(&ListMountsResp{Mounts: mounts})
+}
+
+func (d *daemonState) handleSetClipboard(msg *SetClipboardMsg, m *ipc.Message) error {
+	sbox, errmsg := d.ownedSandbox(msg.Id, m, "clipboard change")
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	if err := ozinit.SetClipboard(sbox.addr, msg.Enabled); err != nil {
+		return m.Respond(initErrorMsg("Unable to set clipboard", err))
+	}
+	return m.Respond(&OkMsg{})
+}
+
+func (d *daemonState) handleNetworkInfo(msg *NetworkInfoMsg, m *ipc.Message) error {
+	sbox, errmsg := d.ownedSandbox(msg.Id, m, "network info request")
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	info, err := ozinit.NetworkInfo(sbox.addr)
+	if err != nil {
+		return m.Respond(initErrorMsg("Unable to get network info", err))
+	}
+	return m.Respond(&NetworkInfoResp{Info: *info})
+}
+
+func (d *daemonState) handleVPNStatus(msg *VPNStatusMsg, m *ipc.Message) error {
+	sbox, errmsg := d.ownedSandbox(msg.Id, m, "openvpn status request")
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	if sbox.ovpn == nil {
+		return m.Respond(&ErrorMsg{fmt.Sprintf("sandbox %d has no openvpn client", msg.Id), oz.ErrNotFound})
+	}
+	st, err := openvpn.OpenVPNStatus(d.config, sbox.ovpn.runtoken)
+	if err != nil {
+		return m.Respond(&ErrorMsg{fmt.Sprintf("Unable to get openvpn status: %v", err), oz.ErrInternal})
+	}
+	return m.Respond(&VPNStatusResp{Status: *st})
+}
+
+func (d *daemonState) handleSetHostname(msg *SetHostnameMsg, m *ipc.Message) error {
+	sbox, errmsg := d.ownedSandbox(msg.Id, m, "hostname change")
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	hostname := msg.Hostname
+	if hostname == "" {
+		hostname = fmt.Sprintf("%s-%d", sbox.profile.Name, sbox.id)
+	}
+	if err := ozinit.SetHostname(sbox.addr, hostname); err != nil {
+		return m.Respond(initErrorMsg("Unable to set hostname", err))
+	}
+	d.Info("Hostname of sandbox %d changed to %s", msg.Id, hostname)
+	return m.Respond(&OkMsg{})
+}
+
+func (d *daemonState) handleSandboxStats(msg *SandboxStatsMsg, m *ipc.Message) error {
+	sbox, errmsg := d.ownedSandbox(msg.Id, m, "stats request")
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	stats, err := ozinit.GetSandboxStats(sbox.addr)
+	if err != nil {
+		return m.Respond(initErrorMsg("Unable to get sandbox stats", err))
+	}
+	return m.Respond(&SandboxStatsResp{Stats: *stats})
+}
+
+// ownedSandbox returns the sandbox id if the sender of m owns it or is root,
+// oz-init only seeing the daemon as the sender of the relayed requests.
+func (d *daemonState) ownedSandbox(id int, m *ipc.Message, action string) (*Sandbox, *ErrorMsg) {
+	sbox := d.sandboxById(id)
+	if sbox == nil {
+		return nil, &ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", id), oz.ErrNotFound}
+	}
+	if m.Ucred.Uid != 0 && m.Ucred.Uid != sbox.cred.Uid {
+		errmsg := fmt.Sprintf("Rejected %s in sandbox %d by uid %d, not the owner", action, id, m.Ucred.Uid)
+		d.Warning(errmsg)
+		return nil, &ErrorMsg{errmsg, oz.ErrPermission}
+	}
+	return sbox, nil
+}
+
+func initErrorMsg(prefix string, err error) *ErrorMsg {
+	code := oz.ErrInternal
+	if e, ok := err.(*oz.Error); ok {
+		code = e.Code
+	}
+	return &ErrorMsg{fmt.Sprintf("%s: %v", prefix, err), code}
+}
+
+func (d *daemonState) handleRunInteractive(msg *RunInteractiveMsg, m *ipc.Message) error {
+	sbox, errmsg := d.ownedSandbox(msg.Id, m, "interactive launch")
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	if sbox.profile.AllowFiles {
+		sbox.whitelistArgumentFiles(d.config.PrefixPath, msg.Pwd, msg.Args, d.log)
+	}
+	pid, err := ozinit.RunProgramInteractive(sbox.addr, msg.Path, msg.Pwd, msg.Args)
+	if err != nil {
+		return m.Respond(initErrorMsg("Unable to run interactive program", err))
+	}
+	d.Info("Interactive program started in sandbox %d with pid %d", msg.Id, pid)
+	return m.Respond(&RunInteractiveResp{Pid: pid})
+}
+
+func (d *daemonState) handleWriteStdin(msg *WriteStdinMsg, m *ipc.Message) error {
+	sbox, errmsg := d.ownedSandbox(msg.Id, m, "stdin write")
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	if err := ozinit.WriteStdin(sbox.addr, msg.Pid, msg.Data); err != nil {
+		return m.Respond(initErrorMsg("Unable to write to stdin", err))
+	}
+	return m.Respond(&OkMsg{})
+}
+
+func (d *daemonState) handleCloseStdin(msg *CloseStdinMsg, m *ipc.Message) error {
+	sbox, errmsg := d.ownedSandbox(msg.Id, m, "stdin close")
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	if err := ozinit.CloseStdin(sbox.addr, msg.Pid); err != nil {
+		return m.Respond(initErrorMsg("Unable to close stdin", err))
+	}
+	return m.Respond(&OkMsg{})
+}
+
+func (d *daemonState) handleDetachChild(msg *DetachChildMsg, m *ipc.Message) error {
+	sbox, errmsg := d.ownedSandbox(msg.Id, m, "child detach")
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	if err := ozinit.DetachChild(sbox.addr, msg.Pid); err != nil {
+		return m.Respond(initErrorMsg("Unable to detach child", err))
+	}
+	return m.Respond(&OkMsg{})
+}
+
+func (d *daemonState) handleAttachChild(msg *AttachChildMsg, m *ipc.Message) error {
+	sbox, errmsg := d.ownedSandbox(msg.Id, m, "child attach")
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	if err := ozinit.AttachChild(sbox.addr, msg.Pid); err != nil {
+		return m.Respond(initErrorMsg("Unable to attach child", err))
+	}
+	return m.Respond(&OkMsg{})
+}
+
+func (d *daemonState) handleSandboxLogs(msg *SandboxLogsMsg, m *ipc.Message) error {
+	sbox, errmsg := d.ownedSandbox(msg.Id, m, "log request")
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	return m.Respond(&SandboxLogsResp{Lines: sbox.logs.get()})
+}
+
+// handleDiagnosticBundle collects what oz-init and the daemon know about a
+// sandbox, a failure to get one of the sections only being reported in the
+// bundle.
+func (d *daemonState) handleDiagnosticBundle(msg *DiagnosticBundleMsg, m *ipc.Message) error {
+	sbox, errmsg := d.ownedSandbox(msg.Id, m, "diagnostics")
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	diag := Diagnostics{
+		Sandbox: sbox.info(),
+		Profile: *sbox.profile,
+		Logs:    sbox.logs.get(),
+	}
+	var err error
+	if diag.Processes, err = ozinit.ListProcesses(sbox.addr); err != nil {
+		diag.Errors = append(diag.Errors, fmt.Sprintf("processes: %v", err))
+	}
+	if diag.Mounts, err = ozinit.ListMounts(sbox.addr); err != nil {
+		diag.Errors = append(diag.Errors, fmt.Sprintf("mounts: %v", err))
+	}
+	if diag.Network, err = ozinit.NetworkInfo(sbox.addr); err != nil {
+		diag.Errors = append(diag.Errors, fmt.Sprintf("network: %v", err))
+	}
+	if diag.Stats, err = ozinit.GetSandboxStats(sbox.addr); err != nil {
+		diag.Errors = append(diag.Errors, fmt.Sprintf("stats: %v", err))
+	}
+	return m.Respond(&DiagnosticBundleResp{Bundle: diag})
+}
+
+// handleFollowProgram relays the output lines of a program of the sandbox to
+// the client until the program closes its output or the client goes away.
+func (d *daemonState) handleFollowProgram(msg *FollowProgramMsg, m *ipc.Message) error {
+	sbox, errmsg := d.ownedSandbox(msg.Id, m, "program output following")
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	go func() {
+		err := ozinit.FollowProgram(sbox.addr, msg.Pid, func(line string) error {
+			return m.Respond(&ProgramOutputMsg{Line: line})
+		})
+		if err != nil {
+			m.Respond(initErrorMsg("Following program failed", err))
+			return
+		}
+		m.Respond(&OkMsg{})
+	}()
+	return nil
+}
+
+func (d *daemonState) handleNotify(msg *NotifyMsg, m *ipc.Message) error {
+	sbox, errmsg := d.ownedSandbox(msg.Id, m, "notification")
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	go func() {
+		if err := ozinit.Notify(sbox.addr, msg.Summary, msg.Body); err != nil {
+			m.Respond(initErrorMsg("Notification failed", err))
+			return
+		}
+		m.Respond(&OkMsg{})
+	}()
+	return nil
+}
+
+func (d *daemonState) handleClearLogs(msg *ClearLogsMsg, m *ipc.Message) error {
+	sbox, errmsg := d.ownedSandbox(msg.Id, m, "log clearing")
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	n := sbox.logs.clear()
+	d.Info("Cleared %d log lines of sandbox %d by uid %d", n, msg.Id, m.Ucred.Uid)
+	return m.Respond(&OkMsg{})
+}
+
+// restartTimeout is how long a restart waits for the oz-init of the sandbox
+// to exit before giving up
+const restartTimeout = 10 * time.Second
+
+// restartReadyTimeout is how long a restart waits for the new oz-init to be
+// ready before killing it
+const restartReadyTimeout = 60 * time.Second
+
+// handleRestartSandbox replaces the oz-init of a sandbox by a fresh one running
+// the profile reloaded from disk under the same id, then mounts again the files
+// and sets up again the dynamic forwarders added at runtime. Programs running
+// in the sandbox are not relaunched. The profiles of the other sandboxes and
+// of new launches are left alone, they are reloaded on SIGHUP. The restart is
+// answered once done, other requests being handled meanwhile.
+func (d *daemonState) handleRestartSandbox(msg *RestartSandboxMsg, m *ipc.Message) error {
+	sbox, errmsg := d.ownedSandbox(msg.Id, m, "restart")
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	if sbox.paused {
+		return m.Respond(&ErrorMsg{fmt.Sprintf("sandbox %d is paused", msg.Id), oz.ErrInvalid})
+	}
+	ps, err := d.loadProfiles(d.config.ProfileDir)
+	if err != nil {
+		return m.Respond(&ErrorMsg{fmt.Sprintf("Failed to reload profiles: %v", err), oz.ErrInternal})
+	}
+	p, err := ps.GetProfileByName(sbox.profile.Name)
+	if err != nil {
+		return m.Respond(&ErrorMsg{err.Error(), oz.ErrNotFound})
+	}
+
+	mounts := append([]mountedFile(nil), sbox.mountedFiles...)
+	forwarders := append([]ActiveForwarder(nil), sbox.forwarders...)
+	lmsg := &LaunchMsg{
+		Name:      p.Name,
+		Gids:      sbox.cred.Groups,
+		Noexec:    true,
+		Ephemeral: sbox.ephemeral,
+	}
+	lmsg.Env = d.sanitizeEnvironment(p, sbox.rawEnv)
+
+	d.Notice("Restarting sandbox %d (%s) for uid %d", sbox.id, p.Name, m.Ucred.Uid)
+	if err := sbox.init.Process.Signal(os.Interrupt); err != nil {
+		return m.Respond(&ErrorMsg{fmt.Sprintf("failed to send interrupt signal: %v", err), oz.ErrInternal})
+	}
+	go func() {
+		m.Respond(d.restartSandbox(sbox, p, lmsg, mounts, forwarders))
+	}()
+	return nil
+}
+
+// restartSandbox launches the new oz-init of sbox once the old one exited,
+// returning the response to the restart request.
+func (d *daemonState) restartSandbox(sbox *Sandbox, p *oz.Profile, lmsg *LaunchMsg, mounts []mountedFile, forwarders []ActiveForwarder) interface{} {
+	select {
+	case <-sbox.exited:
+	case <-time.After(restartTimeout):
+		return &ErrorMsg{fmt.Sprintf("oz-init of sandbox %d did not exit after %v", sbox.id, restartTimeout), oz.ErrInternal}
+	}
+
+	nsbox, err := d.launch(sbox.id, p, lmsg, sbox.rawEnv, sbox.cred.Uid, sbox.cred.Gid, sbox.ephemeral, nil, nil, d.log)
+	if err != nil {
+		d.Warning("Restart of sandbox %d (%s) failed: %v", sbox.id, p.Name, err)
+		return &ErrorMsg{err.Error(), oz.ErrInternal}
+	}
+	select {
+	case <-nsbox.readyc:
+	case <-nsbox.exited:
+		return &ErrorMsg{fmt.Sprintf("oz-init of sandbox %d exited during restart", nsbox.id), oz.ErrInternal}
+	case <-time.After(restartReadyTimeout):
+		d.Warning("oz-init of restarted sandbox %d not ready after %v, killing it", nsbox.id, restartReadyTimeout)
+		if err := nsbox.init.Process.Kill(); err != nil {
+			d.Warning("Failed to kill oz-init of sandbox %d: %v", nsbox.id, err)
+		}
+		return &ErrorMsg{fmt.Sprintf("oz-init of sandbox %d was not ready after %v", nsbox.id, restartReadyTimeout), oz.ErrInternal}
+	}
+	for _, mf := range mounts {
+		var targets []string
+		if mf.target != "" {
+			targets = []string{mf.target}
+		}
+		if err := nsbox.MountFiles([]string{mf.source}, targets, mf.readonly, d.config.PrefixPath, d.log); err != nil {
+			d.Warning("Unable to mount %s again in restarted sandbox %d: %v", mf.source, nsbox.id, err)
+		}
+	}
+	for _, af := range forwarders {
+		if _, _, err := nsbox.SetupDynamicForwarder(af.name, af.port, d.log); err != nil {
+			d.Warning("Unable to set up forwarder %s again in restarted sandbox %d: %v", af.name, nsbox.id, err)
+		}
+	}
+	return &OkMsg{}
+}
+
+func (d *daemonState) handleStopApp(msg *StopAppMsg, m *ipc.Message) error {
+	sbox, errmsg := d.ownedSandbox(msg.Id, m, "program stop")
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	if err := ozinit.StopApp(sbox.addr); err != nil {
+		return m.Respond(initErrorMsg("Unable to stop programs", err))
+	}
+	d.Info("Programs of sandbox %d stopped by uid %d", msg.Id, m.Ucred.Uid)
+	return m.Respond(&OkMsg{})
+}
+
+func (d *daemonState) handlePauseSandbox(msg *PauseSandboxMsg, m *ipc.Message) error {
+	return d.setSandboxPaused(msg.Id, true, m)
+}
+
+func (d *daemonState) handleResumeSandbox(msg *ResumeSandboxMsg, m *ipc.Message) error {
+	return d.setSandboxPaused(msg.Id, false, m)
+}
+
+func (d *daemonState) setSandboxPaused(id int, paused bool, m *ipc.Message) error {
+	action, send := "resume", ozinit.ResumeSandbox
+	if paused {
+		action, send = "pause", ozinit.PauseSandbox
+	}
+	sbox, errmsg := d.ownedSandbox(id, m, action)
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	if err := send(sbox.addr); err != nil {
+		return m.Respond(initErrorMsg(fmt.Sprintf("Unable to %s sandbox", action), err))
+	}
+	sbox.paused = paused
+	d.Info("Sandbox %d %sd by uid %d", id, action, m.Ucred.Uid)
+	return m.Respond(&OkMsg{})
+}
+
+func (d *daemonState) handleGetLaunchEnv(msg *GetLaunchEnvMsg, m *ipc.Message) error {
+	// The redacted environment is available to any user
+	var sbox *Sandbox
+	var errmsg *ErrorMsg
+	if msg.Unredacted {
+		sbox, errmsg = d.ownedSandbox(msg.Id, m, "unredacted launch environment request")
+	} else if sbox = d.sandboxById(msg.Id); sbox == nil {
+		errmsg = &ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id), oz.ErrNotFound}
+	}
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	env, err := ozinit.GetLaunchEnv(sbox.addr, msg.Unredacted)
+	if err != nil {
+		return m.Respond(initErrorMsg("Unable to get launch environment", err))
+	}
+	return m.Respond(&GetLaunchEnvResp{Env: env})
+}
+
+func (d *daemonState) handlePutFile(msg *PutFileMsg, m *ipc.Message) error {
+	sbox, errmsg := d.ownedSandbox(msg.Id, m, "file write")
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	if err := ozinit.PutFile(sbox.addr, msg.Path, msg.Mode, msg.Data); err != nil {
+		return m.Respond(initErrorMsg("Unable to write file", err))
+	}
+	return m.Respond(&OkMsg{})
+}
+
+func (d *daemonState) handleDumpSeccomp(msg *DumpSeccompMsg, m *ipc.Message) error {
+	sbox, errmsg := d.ownedSandbox(msg.Id, m, "seccomp policy dump")
+	if errmsg != nil {
+		return m.Respond(errmsg)
+	}
+	paths, err := ozinit.DumpSeccomp(sbox.addr)
+	if err != nil {
+		return m.Respond(initErrorMsg("Unable to dump seccomp policy", err))
+	}
+	return m.Respond(&DumpSeccompResp{Paths: paths})
+}
+
 func (d *daemonState) handleLogs(logs *LogsMsg, msg *ipc.Message) error {
-	for n := d.memBackend.Head(); n != nil; n = n.Next() {
-		s := n.Record.Formatted(0)
-		msg.Respond(&LogData{Lines: []string{s}})
+	if logs.Compress {
+		batch := make([]string, 0, logBatchSize)
+		for n := d.memBackend.Head(); n != nil; n = n.Next() {
+			batch = append(batch, n.Record.Formatted(0))
+			if len(batch) == logBatchSize {
+				sendLogData(msg, batch, true)
+				batch = batch[:0]
+			}
+		}
+		if len(batch) > 0 {
+			sendLogData(msg, batch, true)
+		}
+	} else {
+		for n := d.memBackend.Head(); n != nil; n = n.Next() {
+			s := n.Record.Formatted(0)
+			msg.Respond(&LogData{Lines: []string{s}})
+		}
 	}
 	if logs.Follow {
-		d.followLogs(msg)
+		d.followLogs(msg, logs.Compress)
 		return nil
 	}
 	msg.Respond(&OkMsg{})
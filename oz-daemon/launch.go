@@ -3,6 +3,7 @@ package daemon
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
@@ -15,10 +16,12 @@ import (
 	"os/user"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/subgraph/oz"
 	"github.com/subgraph/oz/network"
@@ -45,11 +48,58 @@ type Sandbox struct {
 	ready        sync.WaitGroup
 	waiting      sync.WaitGroup
 	iface        *network.OzVeth
-	mountedFiles []string
+	mountedFiles []mountedFile
 	rawEnv       []string
 	forwarders   []ActiveForwarder
 	ovpn         *OpenVPN
 	ephemeral    bool
+	paused       bool
+	coreDir      string
+	launched     []*launchedProgram
+	launchedLock sync.Mutex
+	launchPath   string
+	launchArgs   []string
+	reconnect    xpraReconnect
+	logs         *logBuffer
+	exited       chan struct{}
+	// Closed once the sandbox is ready, along with ready
+	readyc chan struct{}
+	// Token of the launch which started the sandbox, for CancelLaunchMsg
+	launchToken string
+	// Held while the sandbox becomes ready or its launch is cancelled
+	readyLock sync.Mutex
+	cancelled bool
+}
+
+// State of the xpra client and of its automatic reattachment
+type xpraReconnect struct {
+	sync.Mutex
+	delay   time.Duration
+	last    time.Time
+	pending bool
+	stopped bool
+	// Options of the last client started, kept when reattaching
+	opts *oz.XpraClientOpts
+	// Pid of the running client, 0 once it exited
+	pid int
+	// When the daemon last killed a client to attach a new one, whose
+	// disconnection is then not reattached
+	replaced time.Time
+	// Whether the running client exited on its own with status 0, as when
+	// the user disconnects it
+	detached bool
+}
+
+// A program launched in the sandbox and not exited yet, matched by IsRunning
+type launchedProgram struct {
+	path string
+	args []string
+}
+
+type mountedFile struct {
+	source   string
+	target   string
+	readonly bool
 }
 
 type OpenVPN struct {
@@ -59,6 +109,7 @@ type OpenVPN struct {
 
 type ActiveForwarder struct {
 	name string
+	port string
 	desc string
 	dest string
 }
@@ -116,7 +167,9 @@ func createInitCommand(initPath string, cloneNet bool) *exec.Cmd {
 	return cmd
 }
 
-func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid, gid uint32, ephemeral bool, log *logging.Logger) (*Sandbox, error) {
+// launch starts a new sandbox for p with the given id, onExit being called
+// with the exit status of the program when set.
+func (d *daemonState) launch(id int, p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid, gid uint32, ephemeral bool, stdin *os.File, onExit func(int, error), log *logging.Logger) (*Sandbox, error) {
 	/*
 		u, err := user.LookupId(fmt.Sprintf("%d", uid))
 		if err != nil {
@@ -133,17 +186,47 @@ func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid
 	if err != nil {
 		return nil, fmt.Errorf("Failed to look up user with uid=%ld: %v", uid, err)
 	}
-	groups, err := d.sanitizeGroups(p, u.Username, msg.Gids)
+	// The user of the programs in the sandbox, the launching user staying
+	// the owner of the sandbox
+	su, suid, sgid := u, uid, gid
+	if p.RunAsUser != "" {
+		if su, suid, sgid, err = d.lookupRunAsUser(p); err != nil {
+			return nil, err
+		}
+		log.Notice("Sandbox for %s launched by %s runs as %s", p.Name, u.Username, su.Username)
+	}
+	groups, err := d.sanitizeGroups(p, su.Username, msg.Gids)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to sanitize user groups: %v", err)
 	}
 
 	display := 0
-	if p.XServer.Enabled && p.Networking.Nettype == network.TYPE_HOST {
+	if p.XServer.IsDirect() {
+		if display, err = hostDisplay(rawEnv); err != nil {
+			return nil, err
+		}
+		log.Warning("Sandbox for %s uses the host X11 display :%d directly, without xpra isolation", p.Name, display)
+	} else if p.XServer.UsesXpra() && p.Networking.Nettype == network.TYPE_HOST {
 		display = d.nextDisplay
 		d.nextDisplay += 1
 	}
 
+	waylandDisplay := ""
+	if p.XServer.IsWayland() {
+		if waylandDisplay, err = hostWaylandDisplay(rawEnv); err != nil {
+			return nil, err
+		}
+		log.Warning("Sandbox for %s uses the host Wayland compositor (%s) directly, without isolation", p.Name, waylandDisplay)
+	}
+
+	coreDir := ""
+	if p.CollectCores {
+		if coreDir, err = d.createCoreDir(p, id, suid, sgid); err != nil {
+			return nil, err
+		}
+		log.Notice("Core dumps of %s are collected in %s", p.Name, coreDir)
+	}
+
 	socketPath, err := createSocketPath(path.Join(d.config.SandboxPath, "sockets"), "oz-init-control")
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create random socket path: %v", err)
@@ -163,16 +246,18 @@ func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid
 	cmd.Env = append(cmd.Env, d.envOverrides...)
 
 	jdata, err := json.Marshal(ozinit.InitData{
-		Display:   display,
-		User:      *u,
-		Uid:       uid,
-		Gid:       gid,
-		Gids:      groups,
-		Profile:   *p,
-		Config:    *d.config,
-		Sockaddr:  socketPath,
-		LaunchEnv: msg.Env,
-		Ephemeral: ephemeral,
+		Display:        display,
+		User:           *su,
+		Uid:            suid,
+		Gid:            sgid,
+		Gids:           groups,
+		Profile:        *p,
+		Config:         *d.config,
+		Sockaddr:       socketPath,
+		LaunchEnv:      msg.Env,
+		Ephemeral:      ephemeral,
+		CoreDir:        coreDir,
+		WaylandDisplay: waylandDisplay,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("Unable to marshal init state: %+v", err)
@@ -187,22 +272,35 @@ func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid
 	//rootfs := path.Join(d.config.SandboxPath, "rootfs")
 	sbox := &Sandbox{
 		daemon:  d,
-		id:      d.nextSboxId,
+		id:      id,
 		display: display,
 		profile: p,
 		init:    cmd,
 		cred:    &syscall.Credential{Uid: uid, Gid: gid, Groups: msg.Gids},
-		user:    u,
-		fs:      fs.NewFilesystem(d.config, log, u, p),
+		user:    su,
+		fs:      fs.NewFilesystem(d.config, log, su, p),
 		//addr:    path.Join(rootfs, ozinit.SocketAddress),
 		addr:      socketPath,
 		stderr:    pp,
 		rawEnv:    rawEnv,
 		ephemeral: ephemeral,
+		coreDir:   coreDir,
+		logs:      newLogBuffer(d.config.MaxLogLines),
+		exited:    make(chan struct{}),
+		readyc:    make(chan struct{}),
+		// Set before the sandbox is registered, for the launch to be
+		// cancelled while it is set up
+		launchToken: msg.Token,
 	}
 
 	sbox.ready.Add(1)
 	sbox.waiting.Add(1)
+	// Registered before waiting for init, so that the exit of init is
+	// cleaned up and the launch can be cancelled from now on
+	if id >= d.nextSboxId {
+		d.nextSboxId = id + 1
+	}
+	d.sandboxes = append(d.sandboxes, sbox)
 	go sbox.logMessages()
 
 	sbox.waiting.Wait()
@@ -246,10 +344,12 @@ func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid
 			ovpn.runtoken, err = createRunToken("openvpn")
 			sbox.ovpn = &ovpn
 			if err != nil {
+				cmd.Process.Kill()
 				return nil, fmt.Errorf("Unable to create run token: %+v", err)
 			}
 			ovpn.cmd, err = sbox.startOpenVPN(ovpn.runtoken)
 			if err != nil {
+				cmd.Process.Kill()
 				return nil, fmt.Errorf("Unable to start VPN: %+v", err)
 			}
 			log.Info("VPN started, pid %n\n", ovpn.cmd.Process.Pid)
@@ -273,24 +373,69 @@ func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid
 		}()
 	}
 	if !msg.Noexec {
+		sbox.launchPath, sbox.launchArgs = msg.Path, msg.Args
+		if sbox.launchPath == "" {
+			sbox.launchPath = p.Path
+		}
+		lp := sbox.addLaunched(msg.Path, msg.Args)
 		go func() {
+			defer sbox.removeLaunched(lp)
 			sbox.ready.Wait()
 			wgNet.Wait()
-			go sbox.launchProgram(d.config.PrefixPath, msg.Path, msg.Pwd, msg.Args, log)
+			if onExit != nil {
+				onExit(sbox.launchProgramWait(d.config.PrefixPath, msg.Path, msg.Pwd, msg.Args, msg.SeccompModeOverride, stdin, log))
+				return
+			}
+			sbox.launchProgram(d.config.PrefixPath, msg.Path, msg.Pwd, msg.Args, msg.SeccompModeOverride, stdin, log)
 		}()
 	}
 
-	if sbox.profile.XServer.Enabled {
+	if sbox.profile.XServer.UsesXpra() {
 		go func() {
 			sbox.ready.Wait()
-			go sbox.startXpraClient()
+			go sbox.startXpraClient(nil)
 		}()
 	}
-	d.nextSboxId += 1
-	d.sandboxes = append(d.sandboxes, sbox)
+	if d.takeCancelledLaunch(msg.Token, uid) {
+		log.Notice("Launch of sandbox %d (%s) was cancelled before it was started", sbox.id, p.Name)
+		if _, err := sbox.cancelLaunch(); err != nil {
+			log.Warning("Failed to kill oz-init of cancelled sandbox %d: %v", sbox.id, err)
+		}
+	}
 	return sbox, nil
 }
 
+// lookupRunAsUser returns the service user of p with its uid and primary gid,
+// which must be allowed by the configuration and not be root.
+func (d *daemonState) lookupRunAsUser(p *oz.Profile) (*user.User, uint32, uint32, error) {
+	allowed := false
+	for _, name := range d.config.RunAsUsers {
+		if name == p.RunAsUser {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil, 0, 0, fmt.Errorf("profile %s runs as %s which is not in the run_as_users of the configuration", p.Name, p.RunAsUser)
+	}
+	su, err := user.Lookup(p.RunAsUser)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("Failed to look up run_as_user %s: %v", p.RunAsUser, err)
+	}
+	uid, err := strconv.ParseUint(su.Uid, 10, 32)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	gid, err := strconv.ParseUint(su.Gid, 10, 32)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if uid == 0 || gid == 0 {
+		return nil, 0, 0, fmt.Errorf("profile %s cannot run as the privileged user %s", p.Name, p.RunAsUser)
+	}
+	return su, uint32(uid), uint32(gid), nil
+}
+
 func (d *daemonState) sanitizeGroups(p *oz.Profile, username string, gids []uint32) (map[string]uint32, error) {
 	allowedGroups := d.config.DefaultGroups
 	allowedGroups = append(allowedGroups, p.AllowedGroups...)
@@ -368,11 +513,21 @@ func (sbox *Sandbox) getBridgeName() string {
 	return "default"
 }
 
-func (sbox *Sandbox) launchProgram(binpath, cpath, pwd string, args []string, log *logging.Logger) {
+// launchProgram runs a program in the sandbox and returns once it exits, the
+// sandbox being killed if the program fails to start. A non nil stdin is
+// connected to the stdin of the program and closed.
+func (sbox *Sandbox) launchProgram(binpath, cpath, pwd string, args []string, seccompMode oz.SeccompMode, stdin *os.File, log *logging.Logger) {
+	if stdin != nil {
+		defer stdin.Close()
+	}
 	if sbox.profile.AllowFiles {
 		sbox.whitelistArgumentFiles(binpath, pwd, args, log)
 	}
-	err := ozinit.RunProgram(sbox.addr, cpath, pwd, args)
+	// Held until the program exits, for its entry in sbox.launched
+	_, err := ozinit.RunProgramWait(sbox.addr, cpath, pwd, args, seccompMode, stdin)
+	if oz.IsErrorCode(err, oz.ErrShutdown) {
+		return
+	}
 	if err != nil {
 		log.Error("run program command failed: %v", err)
 		pid := sbox.init.Process.Pid
@@ -386,7 +541,104 @@ func (sbox *Sandbox) launchProgram(binpath, cpath, pwd string, args []string, lo
 	}
 }
 
-func (sbox *Sandbox) SetupDynamicForwarder(name, port string, log *logging.Logger) (desc string, e error) {
+// launchProgramWait runs a program like launchProgram but waits for it to
+// exit and returns its status, the sandbox being left running on failure.
+func (sbox *Sandbox) launchProgramWait(binpath, cpath, pwd string, args []string, seccompMode oz.SeccompMode, stdin *os.File, log *logging.Logger) (int, error) {
+	if stdin != nil {
+		defer stdin.Close()
+	}
+	if sbox.profile.AllowFiles {
+		sbox.whitelistArgumentFiles(binpath, pwd, args, log)
+	}
+	return ozinit.RunProgramWait(sbox.addr, cpath, pwd, args, seccompMode, stdin)
+}
+
+// addLaunched records a program launched in the sandbox until it is removed
+// with removeLaunched once the program exits.
+func (sbox *Sandbox) addLaunched(cpath string, args []string) *launchedProgram {
+	sbox.launchedLock.Lock()
+	defer sbox.launchedLock.Unlock()
+	lp := &launchedProgram{path: cpath, args: args}
+	sbox.launched = append(sbox.launched, lp)
+	return lp
+}
+
+func (sbox *Sandbox) removeLaunched(lp *launchedProgram) {
+	sbox.launchedLock.Lock()
+	defer sbox.launchedLock.Unlock()
+	for i, l := range sbox.launched {
+		if l == lp {
+			sbox.launched = append(sbox.launched[:i], sbox.launched[i+1:]...)
+			return
+		}
+	}
+}
+
+// matchesRunning reports whether the sandbox counts as running the program
+// cpath with args, according to the running match of its profile.
+func (sbox *Sandbox) matchesRunning(cpath string, args []string) bool {
+	if sbox.profile.RunningMatch != oz.PROFILE_RUNNING_MATCH_PATHARGS {
+		return true
+	}
+	sbox.launchedLock.Lock()
+	defer sbox.launchedLock.Unlock()
+	for _, lp := range sbox.launched {
+		if lp.path == cpath && equalArgs(lp.args, args) {
+			return true
+		}
+	}
+	return false
+}
+
+func equalArgs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Address the tcp external forwarders listen on when their profile does not
+// set one, a free port of the loopback interface
+const defaultExternalTCPAddr = "127.0.0.1:0"
+
+// listenExternalTCP listens on addr for a tcp external forwarder, returning
+// the file of the listener and the address it is bound to, whose port is
+// the one assigned when addr has port 0. Any process of the host can connect
+// to a tcp listener, so only loopback addresses are accepted.
+func listenExternalTCP(addr string) (*os.File, *net.TCPAddr, error) {
+	if addr == "" {
+		addr = defaultExternalTCPAddr
+	}
+	ta, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ta.IP == nil || !ta.IP.IsLoopback() {
+		return nil, nil, fmt.Errorf("tcp external forwarders only listen on loopback addresses, not %s", addr)
+	}
+	l, err := net.ListenTCP("tcp", ta)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The file is a duplicate of the listening socket, which stays open
+	// once our listener is closed
+	defer l.Close()
+	f, err := l.File()
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, l.Addr().(*net.TCPAddr), nil
+}
+
+// SetupDynamicForwarder creates the external listener of the forwarder name
+// and hands it over to init. It returns the description of the listener and
+// the port it is bound to, empty for listeners without a port.
+func (sbox *Sandbox) SetupDynamicForwarder(name, port string, log *logging.Logger) (desc, bound string, e error) {
 	// TODO: Put error checking here
 	var lp oz.ExternalForwarder
 	var f *os.File
@@ -399,67 +651,89 @@ func (sbox *Sandbox) SetupDynamicForwarder(name, port string, log *logging.Logge
 			break
 		}
 	}
-	if lp.ExtProto == "unix" {
+	if lp.ExtProto == "unix" || lp.ExtProto == "unixgram" {
 		socketPath, err := createSocketPath(path.Join(sbox.daemon.config.SandboxPath, "sockets"), "oz-dynamic-listener")
-		l, err := net.ListenUnix("unix", &net.UnixAddr{socketPath, "unix"})
+		var l interface {
+			File() (*os.File, error)
+		}
+		if lp.ExtProto == "unixgram" {
+			l, err = net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+		} else {
+			l, err = net.ListenUnix("unix", &net.UnixAddr{socketPath, "unix"})
+		}
 		if err != nil {
 			log.Warning("Socket creation failure: %+s", err)
-			return "", err
+			return "", "", err
 		}
 		if lp.SocketOwner != "" {
 			u, err := user.Lookup(lp.SocketOwner)
 			if err != nil {
-				return "", fmt.Errorf("failed to lookup user for uid=%d: %v", u.Uid, err)
+				return "", "", fmt.Errorf("failed to lookup user for uid=%d: %v", u.Uid, err)
 			}
 			uid, err := strconv.Atoi(u.Uid)
 			if err != nil {
-				return "", err
+				return "", "", err
 			}
 			err = syscall.Chown(socketPath, uid, 0)
 			if err != nil {
-				return "", fmt.Errorf("failed to set ownership of socket %s to uid %d: %v", socketPath, uid, err)
+				return "", "", fmt.Errorf("failed to set ownership of socket %s to uid %d: %v", socketPath, uid, err)
 			}
 		}
 
 		f, err = l.File()
 		if err != nil {
 			log.Warning("File object access failed: %+s", err)
-			return "", err
+			return "", "", err
 		}
 		fd = f.Fd()
 		desc = socketPath
+	} else if lp.ExtProto == "tcp" {
+		var ta *net.TCPAddr
+		var err error
+		f, ta, err = listenExternalTCP(lp.Addr)
+		if err != nil {
+			log.Warning("Listener creation failure: %+s", err)
+			return "", "", err
+		}
+		defer f.Close()
+		fd = f.Fd()
+		desc = ta.String()
+		bound = strconv.Itoa(ta.Port)
 	} else {
-		return "", fmt.Errorf("unimplemented external protocol type: %s", lp.ExtProto)
+		return "", "", fmt.Errorf("unimplemented external protocol type: %s", lp.ExtProto)
 	}
 
-	if lp.Proto == "tcp" {
+	if (lp.Proto == "udp") != (lp.ExtProto == "unixgram") {
+		return "", "", fmt.Errorf("external protocol %s cannot be forwarded to %s", lp.ExtProto, lp.Proto)
+	}
+	if lp.Proto == "tcp" || lp.Proto == "udp" {
 		if lp.TargetHost != "" {
 			if lp.TargetHost != "127.0.0.1" {
-				return "", fmt.Errorf("Unimplemented connectivity to %s\n", lp.TargetHost)
+				return "", "", fmt.Errorf("Unimplemented connectivity to %s\n", lp.TargetHost)
 			}
 			if lp.Dynamic {
 				if port != "" {
 					dest = lp.TargetHost + ":" + port
 				} else {
-					return "", fmt.Errorf("Port missing.")
+					return "", "", fmt.Errorf("Port missing.")
 				}
 			} else {
 				if lp.TargetPort != "" {
 					dest = lp.TargetHost + ":" + lp.TargetPort
 				} else {
-					return "", fmt.Errorf("Port missing.")
+					return "", "", fmt.Errorf("Port missing.")
 				}
 			}
 		}
 	} else {
-		return "", fmt.Errorf("Unimplemented target protocol type %s\n", lp.Proto)
+		return "", "", fmt.Errorf("Unimplemented target protocol type %s\n", lp.Proto)
 	}
 	err := ozinit.SetupForwarder(sbox.addr, lp.Proto, dest, fd)
 	if err != nil {
 		log.Warning("Error setting up forwarder: %+s", err)
-		return "", err
+		return "", "", err
 	}
-	sbox.forwarders = append(sbox.forwarders, ActiveForwarder{name: name, desc: desc, dest: dest})
+	sbox.forwarders = append(sbox.forwarders, ActiveForwarder{name: name, port: port, desc: desc, dest: dest})
 	/*
 		if sbox.forwarders[name] != nil {
 			sbox.forwarders[name] = append(sbox.forwarders[name], desc)
@@ -467,14 +741,65 @@ func (sbox *Sandbox) SetupDynamicForwarder(name, port string, log *logging.Logge
 			sbox.forwarders[name] = []string{desc}
 		}
 	*/
-	return desc, nil
+	return desc, bound, nil
+}
+
+// expandMountGlobs replaces the file patterns with the host files matching
+// them, each mounted in the directory given as target of its pattern if any.
+// Relative patterns are taken from the home directory like oz-mount does.
+// Expansion runs with the daemon privileges, so patterns and their matches,
+// symlinks resolved, are limited to the places oz-mount allows, the names in
+// other directories not being revealed to the user. A pattern matching
+// nothing is skipped.
+func (sbox *Sandbox) expandMountGlobs(files, targets []string, log *logging.Logger) ([]string, []string) {
+	var xfiles, xtargets []string
+	for i, f := range files {
+		if !strings.ContainsAny(f, "*?[") {
+			xfiles = append(xfiles, f)
+			if len(targets) > 0 {
+				xtargets = append(xtargets, targets[i])
+			}
+			continue
+		}
+		pattern := f
+		if !path.IsAbs(pattern) {
+			pattern = path.Join(sbox.user.HomeDir, pattern)
+		}
+		pattern = path.Clean(pattern)
+		if !oz.IsUserMountPath(pattern, sbox.user.HomeDir) {
+			log.Warning("Refusing to expand %s outside of the user home and mounts for sandbox %s", f, sbox.profile.Name)
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil || len(matches) == 0 {
+			log.Warning("No file matching %s to mount in sandbox %s", f, sbox.profile.Name)
+			continue
+		}
+		for _, m := range matches {
+			if rm, err := filepath.EvalSymlinks(m); err != nil || !oz.IsUserMountPath(rm, sbox.user.HomeDir) {
+				log.Warning("Skipping %s matching %s, outside of the user home and mounts", m, f)
+				continue
+			}
+			xfiles = append(xfiles, m)
+			if len(targets) > 0 {
+				xtargets = append(xtargets, path.Join(targets[i], path.Base(m)))
+			}
+		}
+	}
+	return xfiles, xtargets
 }
 
-func (sbox *Sandbox) MountFiles(files []string, readonly bool, binpath string, log *logging.Logger) error {
+func (sbox *Sandbox) MountFiles(files, targets []string, readonly bool, binpath string, log *logging.Logger) error {
 	pmnt := path.Join(binpath, "bin", "oz-mount")
-	args := files
+	var args []string
 	if readonly {
-		args = append([]string{"--readonly"}, files...)
+		args = append(args, "--readonly")
+	}
+	for i, f := range files {
+		if len(targets) > 0 {
+			args = append(args, "--target", targets[i])
+		}
+		args = append(args, f)
 	}
 	cmnt := exec.Command(pmnt, args...)
 	cmnt.Env = []string{
@@ -487,10 +812,15 @@ func (sbox *Sandbox) MountFiles(files []string, readonly bool, binpath string, l
 		log.Warning("Unable to bind files to sandbox: %s", string(pout))
 		return fmt.Errorf("%s", string(pout[2:]))
 	}
-	for _, mfile := range files {
+	for i, f := range files {
+		mfile := mountedFile{source: f, readonly: readonly}
+		if len(targets) > 0 {
+			mfile.target = targets[i]
+		}
 		found := false
-		for _, mmfile := range sbox.mountedFiles {
-			if mfile == mmfile {
+		for j, mmfile := range sbox.mountedFiles {
+			if mfile.source == mmfile.source && mfile.target == mmfile.target {
+				sbox.mountedFiles[j].readonly = readonly
 				found = true
 				break
 			}
@@ -503,9 +833,22 @@ func (sbox *Sandbox) MountFiles(files []string, readonly bool, binpath string, l
 	return nil
 }
 
+// UnmountFile removes a file mounted with MountFiles, file may be either the
+// source path or the target path it was mounted at.
 func (sbox *Sandbox) UnmountFile(file, binpath string, log *logging.Logger) error {
+	mfile := mountedFile{source: file}
+	for _, item := range sbox.mountedFiles {
+		if item.source == file || item.target == file {
+			mfile = item
+			break
+		}
+	}
+	args := []string{mfile.source}
+	if mfile.target != "" {
+		args = []string{"--target", mfile.target, mfile.source}
+	}
 	pmnt := path.Join(binpath, "bin", "oz-umount")
-	cmnt := exec.Command(pmnt, file)
+	cmnt := exec.Command(pmnt, args...)
 	cmnt.Env = []string{
 		"_OZ_NSPID=" + strconv.Itoa(sbox.init.Process.Pid),
 		"_OZ_HOMEDIR=" + sbox.user.HomeDir,
@@ -516,14 +859,47 @@ func (sbox *Sandbox) UnmountFile(file, binpath string, log *logging.Logger) erro
 		return fmt.Errorf("%s", string(pout[2:]))
 	}
 	for i, item := range sbox.mountedFiles {
-		if item == file {
+		if item == mfile {
 			sbox.mountedFiles = append(sbox.mountedFiles[:i], sbox.mountedFiles[i+1:]...)
+			break
 		}
 	}
 	log.Info("%s", string(pout))
 	return nil
 }
 
+// info returns the description of the sandbox given by ListSandboxes
+func (sbox *Sandbox) info() SandboxInfo {
+	status := SandboxRunning
+	if sbox.paused {
+		status = SandboxPaused
+	}
+	return SandboxInfo{
+		Id:         sbox.id,
+		Address:    sbox.addr,
+		Mounts:     sbox.mountedFilePaths(),
+		Profile:    sbox.profile.Name,
+		Ephemeral:  sbox.ephemeral,
+		InitPid:    sbox.init.Process.Pid,
+		User:       sbox.user.Username,
+		Status:     status,
+		LaunchPath: sbox.launchPath,
+		LaunchArgs: sbox.launchArgs,
+	}
+}
+
+func (sbox *Sandbox) mountedFilePaths() []string {
+	var paths []string
+	for _, item := range sbox.mountedFiles {
+		if item.target != "" {
+			paths = append(paths, item.source+" -> "+item.target)
+		} else {
+			paths = append(paths, item.source)
+		}
+	}
+	return paths
+}
+
 func (sbox *Sandbox) whitelistArgumentFiles(binpath, pwd string, args []string, log *logging.Logger) {
 	var files []string
 	for _, fpath := range args {
@@ -543,7 +919,7 @@ func (sbox *Sandbox) whitelistArgumentFiles(binpath, pwd string, args []string,
 		}
 	}
 	if len(files) > 0 {
-		sbox.MountFiles(files, false, binpath, log)
+		sbox.MountFiles(files, nil, false, binpath, log)
 	}
 }
 
@@ -563,6 +939,12 @@ func (sbox *Sandbox) remove(log *logging.Logger) {
 			}
 			//		sb.fs.Cleanup()
 			os.Remove(sb.addr)
+			sb.reconnect.Lock()
+			sb.reconnect.stopped = true
+			sb.reconnect.Unlock()
+			if sb.coreDir != "" {
+				sb.collectCores()
+			}
 		} else {
 			sboxes = append(sboxes, sb)
 		}
@@ -570,6 +952,40 @@ func (sbox *Sandbox) remove(log *logging.Logger) {
 	sbox.daemon.sandboxes = sboxes
 }
 
+// isReady returns whether the sandbox is ready
+func (sbox *Sandbox) isReady() bool {
+	select {
+	case <-sbox.readyc:
+		return true
+	default:
+		return false
+	}
+}
+
+// markReady closes readyc, unless the launch of the sandbox was cancelled
+// in which case false is returned.
+func (sbox *Sandbox) markReady() bool {
+	sbox.readyLock.Lock()
+	defer sbox.readyLock.Unlock()
+	if sbox.cancelled {
+		return false
+	}
+	close(sbox.readyc)
+	return true
+}
+
+// cancelLaunch kills the oz-init of the sandbox unless it is ready, which
+// cannot happen meanwhile. It returns whether the sandbox was ready.
+func (sbox *Sandbox) cancelLaunch() (bool, error) {
+	sbox.readyLock.Lock()
+	defer sbox.readyLock.Unlock()
+	if sbox.isReady() {
+		return true, nil
+	}
+	sbox.cancelled = true
+	return false, sbox.init.Process.Kill()
+}
+
 func (sbox *Sandbox) logMessages() {
 	scanner := bufio.NewScanner(sbox.stderr)
 	seenOk := false
@@ -584,6 +1000,11 @@ func (sbox *Sandbox) logMessages() {
 			sbox.daemon.log.Info("oz-init (%s) is ready", sbox.profile.Name)
 			seenOk = true
 			sbox.ready.Done()
+			if sbox.markReady() && sbox.daemon.config.ReadyHook != "" {
+				go sbox.runReadyHook(sbox.daemon.config.ReadyHook)
+			}
+		} else if line == ozinit.XpraClientLostLine && sbox.profile.XServer.AutoReconnect {
+			sbox.scheduleXpraReconnect()
 		} else if len(line) > 1 {
 			sbox.logLine(line)
 		}
@@ -591,10 +1012,31 @@ func (sbox *Sandbox) logMessages() {
 	sbox.stderr.Close()
 }
 
+// How long the ready_hook may run before it is killed
+const readyHookTimeout = 30 * time.Second
+
+// runReadyHook runs the ready_hook of the configuration for the sandbox,
+// logging its output and failure.
+func (sbox *Sandbox) runReadyHook(hook string) {
+	log := sbox.daemon.log
+	ctx, cancel := context.WithTimeout(context.Background(), readyHookTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, hook, strconv.Itoa(sbox.id), sbox.profile.Name).CombinedOutput()
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line != "" {
+			log.Info("[%s] ready hook: %s", sbox.profile.Name, line)
+		}
+	}
+	if err != nil {
+		log.Warning("[%s] Ready hook %s failed: %v", sbox.profile.Name, hook, err)
+	}
+}
+
 func (sbox *Sandbox) logLine(line string) {
 	if len(line) < 2 {
 		return
 	}
+	sbox.logs.add(line)
 	f := sbox.getLogFunc(line[0])
 	msg := line[2:]
 	if f != nil {
@@ -623,15 +1065,36 @@ func (sbox *Sandbox) getLogFunc(c byte) func(string, ...interface{}) {
 	return nil
 }
 
-func (sbox *Sandbox) startXpraClient() {
+func (sbox *Sandbox) startXpraClient(opts *oz.XpraClientOpts) {
+	if !sbox.profile.XServer.UsesXpra() {
+		sbox.daemon.Info("Not starting xpra client for sandbox %d, it does not use xpra", sbox.id)
+		return
+	}
 	u, err := user.LookupId(fmt.Sprintf("%d", sbox.cred.Uid))
 	if err != nil {
 		sbox.daemon.Error("Failed to lookup user for uid=%d, cannot start xpra", sbox.cred.Uid)
 		return
 	}
 	xpraPath := path.Join(u.HomeDir, ".Xoz", sbox.profile.Name)
+	rc := &sbox.reconnect
+	rc.Lock()
+	defer rc.Unlock()
+	if opts == nil {
+		opts = rc.opts
+	}
+	rc.opts = opts
+	// The server would disconnect the running client, which would in
+	// turn get reattached and disconnect the new one
+	if rc.pid != 0 && sbox.xpra != nil && sbox.xpra.Process.Process != nil {
+		if err := sbox.xpra.Process.Process.Kill(); err == nil {
+			rc.replaced = time.Now()
+		}
+	}
+	rc.pid = 0
+	rc.detached = false
 	sbox.xpra = xpra.NewClient(
 		&sbox.profile.XServer,
+		opts,
 		uint64(sbox.display),
 		sbox.cred,
 		path.Join(sbox.daemon.config.PrefixPath, "bin", "oz-seccomp"),
@@ -647,7 +1110,110 @@ func (sbox *Sandbox) startXpraClient() {
 	}
 	if err := sbox.xpra.Process.Start(); err != nil {
 		sbox.daemon.Warning("Failed to start xpra client: %v", err)
+		return
+	}
+	rc.pid = sbox.xpra.Process.Process.Pid
+}
+
+// How long after the daemon replaced an xpra client the disconnections
+// reported by the server are taken as those of the replaced client
+const xpraReplaceGrace = 5 * time.Second
+
+// xpraClientExited records the exit of the xpra client of the sandbox if
+// pid is its pid, returning whether it was.
+func (sbox *Sandbox) xpraClientExited(pid int, wstatus syscall.WaitStatus) bool {
+	rc := &sbox.reconnect
+	rc.Lock()
+	defer rc.Unlock()
+	if rc.pid == 0 || rc.pid != pid {
+		return false
+	}
+	rc.pid = 0
+	rc.detached = wstatus.Exited() && wstatus.ExitStatus() == 0
+	return true
+}
+
+// Bounds of the delay before reattaching a disconnected xpra client. It is
+// doubled on each disconnection following a reattachment by less than the
+// maximum, to avoid reconnecting in a loop to a failing display.
+const (
+	xpraReconnectMinDelay = time.Second
+	xpraReconnectMaxDelay = time.Minute
+)
+
+func nextReconnectDelay(prev, sinceLast time.Duration) time.Duration {
+	if prev == 0 || sinceLast > xpraReconnectMaxDelay {
+		return xpraReconnectMinDelay
+	}
+	if prev*2 > xpraReconnectMaxDelay {
+		return xpraReconnectMaxDelay
+	}
+	return prev * 2
+}
+
+func (sbox *Sandbox) scheduleXpraReconnect() {
+	rc := &sbox.reconnect
+	rc.Lock()
+	defer rc.Unlock()
+	if rc.pending || rc.stopped {
+		return
+	}
+	if time.Since(rc.replaced) < xpraReplaceGrace {
+		sbox.daemon.Info("xpra client of sandbox %d (%s) replaced by a new one, not reattaching it", sbox.id, sbox.profile.Name)
+		return
+	}
+	rc.delay = nextReconnectDelay(rc.delay, time.Since(rc.last))
+	rc.pending = true
+	sbox.daemon.Notice("xpra client of sandbox %d (%s) disconnected, reattaching in %v", sbox.id, sbox.profile.Name, rc.delay)
+	time.AfterFunc(rc.delay, func() {
+		rc.Lock()
+		rc.pending = false
+		rc.last = time.Now()
+		stopped, detached := rc.stopped, rc.detached
+		rc.Unlock()
+		if detached {
+			sbox.daemon.Notice("xpra client of sandbox %d (%s) was disconnected by the user, not reattaching it", sbox.id, sbox.profile.Name)
+		} else if !stopped {
+			sbox.startXpraClient(nil)
+		}
+	})
+}
+
+var localDisplayRe = regexp.MustCompile(`^(unix)?:([0-9]+)(\.[0-9]+)?$`)
+
+// hostDisplay returns the number of the local X11 display named by the
+// DISPLAY variable of env, a remote display having no socket to bind.
+func hostDisplay(env []string) (int, error) {
+	for _, e := range env {
+		if !strings.HasPrefix(e, "DISPLAY=") {
+			continue
+		}
+		d := strings.TrimPrefix(e, "DISPLAY=")
+		m := localDisplayRe.FindStringSubmatch(d)
+		if m == nil {
+			return 0, fmt.Errorf("DISPLAY %s is not a local X11 display", d)
+		}
+		return strconv.Atoi(m[2])
+	}
+	return 0, fmt.Errorf("no DISPLAY set in the environment")
+}
+
+var waylandDisplayRe = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// hostWaylandDisplay returns the socket name of the Wayland compositor from
+// WAYLAND_DISPLAY, which must name a socket of the runtime directory.
+func hostWaylandDisplay(env []string) (string, error) {
+	for _, e := range env {
+		if !strings.HasPrefix(e, "WAYLAND_DISPLAY=") {
+			continue
+		}
+		d := strings.TrimPrefix(e, "WAYLAND_DISPLAY=")
+		if !waylandDisplayRe.MatchString(d) {
+			return "", fmt.Errorf("WAYLAND_DISPLAY %s is not a socket name of the runtime directory", d)
+		}
+		return d, nil
 	}
+	return "", fmt.Errorf("no WAYLAND_DISPLAY set in the environment")
 }
 
 func (sbox *Sandbox) setupXpraLogging() {
@@ -0,0 +1,228 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+
+	"github.com/subgraph/oz"
+)
+
+func TestHostDisplay(t *testing.T) {
+	for display, expected := range map[string]int{
+		":0":      0,
+		":1.0":    1,
+		"unix:12": 12,
+	} {
+		d, err := hostDisplay([]string{"HOME=/home/user", "DISPLAY=" + display})
+		if err != nil {
+			t.Errorf("unexpected error for DISPLAY=%s: %v", display, err)
+		} else if d != expected {
+			t.Errorf("expected display %d for DISPLAY=%s, got %d", expected, display, d)
+		}
+	}
+	for _, env := range [][]string{
+		{"HOME=/home/user"},
+		{"DISPLAY=remote:0"},
+		{"DISPLAY=localhost:10.0"},
+		{"DISPLAY="},
+	} {
+		if _, err := hostDisplay(env); err == nil {
+			t.Errorf("expected an error for %v", env)
+		}
+	}
+}
+
+func TestNextReconnectDelay(t *testing.T) {
+	cases := []struct {
+		prev, sinceLast, expected time.Duration
+	}{
+		{0, 0, xpraReconnectMinDelay},
+		{time.Second, 10 * time.Second, 2 * time.Second},
+		{16 * time.Second, time.Second, 32 * time.Second},
+		{32 * time.Second, time.Second, xpraReconnectMaxDelay},
+		{xpraReconnectMaxDelay, time.Second, xpraReconnectMaxDelay},
+		{xpraReconnectMaxDelay, 2 * xpraReconnectMaxDelay, xpraReconnectMinDelay},
+	}
+	for _, c := range cases {
+		if d := nextReconnectDelay(c.prev, c.sinceLast); d != c.expected {
+			t.Errorf("nextReconnectDelay(%v, %v) = %v, expected %v", c.prev, c.sinceLast, d, c.expected)
+		}
+	}
+}
+
+func TestHostWaylandDisplay(t *testing.T) {
+	for _, name := range []string{"wayland-0", "wayland-1.lock-free"} {
+		d, err := hostWaylandDisplay([]string{"HOME=/home/user", "WAYLAND_DISPLAY=" + name})
+		if err != nil || d != name {
+			t.Errorf("hostWaylandDisplay for %s returned %s, %v", name, d, err)
+		}
+	}
+	for _, env := range [][]string{
+		{"HOME=/home/user"},
+		{"WAYLAND_DISPLAY="},
+		{"WAYLAND_DISPLAY=/run/user/1000/wayland-0"},
+		{"WAYLAND_DISPLAY=../wayland-0"},
+		{"WAYLAND_DISPLAY=.."},
+	} {
+		if _, err := hostWaylandDisplay(env); err == nil {
+			t.Errorf("expected an error for %v", env)
+		}
+	}
+}
+
+func TestRunReadyHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oz-hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := path.Join(dir, "args")
+	hook := path.Join(dir, "hook")
+	script := "#!/bin/sh\necho \"$@\" > " + out + "\necho done\n"
+	if err := ioutil.WriteFile(hook, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	sbox := &Sandbox{
+		id:      3,
+		profile: &oz.Profile{Name: "firefox"},
+		daemon:  &daemonState{log: logging.MustGetLogger("oz-test")},
+	}
+	sbox.runReadyHook(hook)
+	args, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("hook did not run: %v", err)
+	}
+	if string(args) != "3 firefox\n" {
+		t.Errorf("hook got arguments %q, expected the id and profile name", args)
+	}
+	// A failing hook is only logged
+	sbox.runReadyHook(path.Join(dir, "missing"))
+}
+
+func TestListenExternalTCP(t *testing.T) {
+	f, addr, err := listenExternalTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if addr.Port == 0 {
+		t.Fatal("expected the port assigned to the listener, got 0")
+	}
+	l, err := net.FileListener(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if la := l.Addr().(*net.TCPAddr); la.Port != addr.Port {
+		t.Errorf("listener is bound to port %d, reported %d", la.Port, addr.Port)
+	}
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("cannot connect to the reported address %s: %v", addr, err)
+	}
+	conn.Close()
+
+	f, addr, err = listenExternalTCP("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if !addr.IP.IsLoopback() || addr.Port == 0 {
+		t.Errorf("expected a loopback port by default, got %v", addr)
+	}
+
+	for _, a := range []string{"0.0.0.0:0", ":0"} {
+		if f, _, err := listenExternalTCP(a); err == nil {
+			f.Close()
+			t.Errorf("expected listening on %s to be refused", a)
+		}
+	}
+}
+
+func TestCancelLaunch(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	sbox := &Sandbox{init: cmd, readyc: make(chan struct{})}
+	if ready, err := sbox.cancelLaunch(); ready || err != nil {
+		t.Fatalf("expected the launch to be cancelled, got ready %v, %v", ready, err)
+	}
+	if err := cmd.Wait(); err == nil {
+		t.Error("expected oz-init to be killed")
+	}
+	if sbox.markReady() || sbox.isReady() {
+		t.Error("expected a cancelled sandbox not to become ready")
+	}
+
+	sbox = &Sandbox{readyc: make(chan struct{})}
+	if !sbox.markReady() {
+		t.Fatal("expected the sandbox to become ready")
+	}
+	if ready, err := sbox.cancelLaunch(); !ready || err != nil {
+		t.Errorf("expected a ready sandbox not to be cancelled, got ready %v, %v", ready, err)
+	}
+}
+
+func TestCancelledLaunch(t *testing.T) {
+	d := &daemonState{}
+	d.recordCancelledLaunch("launch-a", 1000)
+	if d.takeCancelledLaunch("launch-a", 1001) {
+		t.Error("launch cancelled by another user")
+	}
+	d.recordCancelledLaunch("launch-a", 1000)
+	if !d.takeCancelledLaunch("launch-a", 1000) {
+		t.Error("expected the launch to be cancelled")
+	}
+	if d.takeCancelledLaunch("launch-a", 1000) {
+		t.Error("expected the cancellation to be forgotten once taken")
+	}
+	d.cancelledLaunches["launch-b"] = cancelledLaunch{uid: 1000, at: time.Now().Add(-2 * cancelledLaunchExpiry)}
+	d.recordCancelledLaunch("launch-c", 1000)
+	if _, ok := d.cancelledLaunches["launch-b"]; ok {
+		t.Error("expected expired cancellations to be dropped")
+	}
+}
+
+func TestXpraReconnect(t *testing.T) {
+	sbox := &Sandbox{
+		id:      3,
+		profile: &oz.Profile{Name: "firefox"},
+		daemon:  &daemonState{log: logging.MustGetLogger("oz-test")},
+	}
+	rc := &sbox.reconnect
+
+	// A client replaced by the daemon is not reattached
+	rc.replaced = time.Now()
+	sbox.scheduleXpraReconnect()
+	if rc.pending {
+		t.Error("expected the disconnection of a replaced client to be ignored")
+	}
+
+	rc.replaced = time.Time{}
+	rc.pid = 42
+	if sbox.xpraClientExited(43, 0) {
+		t.Error("expected the exit of another process to be ignored")
+	}
+	if !sbox.xpraClientExited(42, 0) || !rc.detached || rc.pid != 0 {
+		t.Errorf("expected a client exiting with status 0 to be detached, got %+v", rc)
+	}
+	rc.pid = 42
+	// Killed by SIGKILL
+	if !sbox.xpraClientExited(42, 9) || rc.detached {
+		t.Error("expected a killed client not to be detached")
+	}
+
+	rc.stopped = true
+	sbox.scheduleXpraReconnect()
+	if rc.pending {
+		t.Error("expected no reattachment of a stopped sandbox")
+	}
+}
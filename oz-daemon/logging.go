@@ -1,10 +1,15 @@
 package daemon
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"github.com/op/go-logging"
 	"github.com/subgraph/oz/ipc"
 	"log"
 	"os"
+	"sync"
+	"time"
 )
 
 func (d *daemonState) Debug(format string, args ...interface{}) {
@@ -67,26 +72,141 @@ func (d *daemonState) installBackends() {
 	d.log.SetBackend(logging.MultiLogger(d.backends...))
 }
 
+// Delay over which the records followed with compression are batched in a
+// single LogData message
+const logFlushDelay = 200 * time.Millisecond
+
 type logFollower struct {
-	daemon  *daemonState
-	wrapper logging.Backend
-	m       *ipc.Message
+	daemon   *daemonState
+	wrapper  logging.Backend
+	m        *ipc.Message
+	compress bool
+	// Held while the pending records are added or sent
+	lock    sync.Mutex
+	pending []string
+	flushes *time.Timer
 }
 
 func (lf *logFollower) Log(level logging.Level, calldepth int, rec *logging.Record) error {
 	s := rec.Formatted(calldepth)
-	if err := lf.m.Respond(&LogData{[]string{s}}); err != nil {
-		lf.remove()
+	if !lf.compress {
+		if err := sendLogData(lf.m, []string{s}, false); err != nil {
+			lf.remove()
+		}
+		return nil
+	}
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
+	lf.pending = append(lf.pending, s)
+	if lf.flushes == nil {
+		lf.flushes = time.AfterFunc(logFlushDelay, lf.flush)
 	}
 	return nil
 }
 
+// flush sends the pending records, the lock being held until sent so that
+// batches are never sent out of order.
+func (lf *logFollower) flush() {
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
+	lines := lf.pending
+	lf.pending, lf.flushes = nil, nil
+	if err := sendLogData(lf.m, lines, true); err != nil {
+		lf.remove()
+	}
+}
+
 func (lf *logFollower) remove() {
 	lf.daemon.removeBackend(lf.wrapper)
 }
 
-func (d *daemonState) followLogs(m *ipc.Message) {
-	be := &logFollower{m: m, daemon: d}
+func (d *daemonState) followLogs(m *ipc.Message, compress bool) {
+	be := &logFollower{m: m, daemon: d, compress: compress}
 	be.wrapper = logging.NewBackendFormatter(be, format)
 	d.addBackend(be.wrapper)
 }
+
+// Number of lines of the log history sent in each compressed batch
+const logBatchSize = 100
+
+// sendLogData sends lines as a single LogData message. Every compressed
+// batch is a complete gzip stream, so that a batch is never held back
+// waiting for more lines. The records are encoded as a list, those spanning
+// several lines being kept whole.
+func sendLogData(m *ipc.Message, lines []string, compress bool) error {
+	if !compress {
+		return m.Respond(&LogData{Lines: lines})
+	}
+	data, err := compressLines(lines)
+	if err != nil {
+		return err
+	}
+	return m.Respond(&LogData{Compressed: data})
+}
+
+func compressLines(lines []string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(w).Encode(lines); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressLines(data []byte) ([]string, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var lines []string
+	if err := json.NewDecoder(r).Decode(&lines); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// Number of lines kept for each sandbox when max_log_lines is not set
+const defaultMaxLogLines = 1000
+
+// logBuffer keeps the last lines logged by a sandbox, dropping the oldest
+// ones past its maximum.
+type logBuffer struct {
+	sync.Mutex
+	lines []string
+	max   int
+}
+
+func newLogBuffer(max int) *logBuffer {
+	if max <= 0 {
+		max = defaultMaxLogLines
+	}
+	return &logBuffer{max: max}
+}
+
+func (b *logBuffer) add(line string) {
+	b.Lock()
+	defer b.Unlock()
+	b.lines = append(b.lines, time.Now().Format("15:04:05")+" "+line)
+	if len(b.lines) > b.max {
+		b.lines = b.lines[len(b.lines)-b.max:]
+	}
+}
+
+func (b *logBuffer) get() []string {
+	b.Lock()
+	defer b.Unlock()
+	return append([]string{}, b.lines...)
+}
+
+// clear drops the buffered lines, returning their number
+func (b *logBuffer) clear() int {
+	b.Lock()
+	defer b.Unlock()
+	n := len(b.lines)
+	b.lines = nil
+	return n
+}
@@ -0,0 +1,52 @@
+package daemon
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompressLines(t *testing.T) {
+	for _, lines := range [][]string{
+		{"single line"},
+		{"first", "", "third with\ttab"},
+		{"panic: record\nspanning lines", "next"},
+	} {
+		data, err := compressLines(lines)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		out, err := decompressLines(data)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(out, lines) {
+			t.Errorf("expected %q, got %q", lines, out)
+		}
+	}
+}
+
+func TestLogBuffer(t *testing.T) {
+	b := newLogBuffer(3)
+	for _, l := range []string{"I one", "I two", "I three", "W four"} {
+		b.add(l)
+	}
+	lines := b.get()
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %d: %v", len(lines), lines)
+	}
+	for i, expected := range []string{"I two", "I three", "W four"} {
+		if !strings.HasSuffix(lines[i], " "+expected) {
+			t.Errorf("line %d is %q, expected it to end with %q", i, lines[i], expected)
+		}
+	}
+	if n := b.clear(); n != 3 {
+		t.Errorf("clear returned %d, expected 3", n)
+	}
+	if lines := b.get(); len(lines) != 0 {
+		t.Errorf("lines left after clear: %v", lines)
+	}
+	if b := newLogBuffer(0); b.max != defaultMaxLogLines {
+		t.Errorf("unset maximum gave %d lines", b.max)
+	}
+}
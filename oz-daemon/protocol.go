@@ -1,6 +1,12 @@
 package daemon
 
-import "github.com/subgraph/oz/ipc"
+import (
+	"github.com/subgraph/oz"
+	"github.com/subgraph/oz/ipc"
+	"github.com/subgraph/oz/network"
+	"github.com/subgraph/oz/openvpn"
+	"github.com/subgraph/oz/oz-init"
+)
 
 const SocketName = "@oz-control"
 
@@ -13,7 +19,12 @@ type NotOkMsg struct {
 }
 
 type ErrorMsg struct {
-	Msg string "Error"
+	Msg  string "Error"
+	Code oz.ErrorCode
+}
+
+func (e *ErrorMsg) err() error {
+	return &oz.Error{Code: e.Code, Msg: e.Msg}
 }
 
 type PingMsg struct {
@@ -24,14 +35,19 @@ type GetConfigMsg struct {
 	Data string "GetConfig"
 }
 
+// The JSON encoded configuration of the daemon
+type GetConfigResp struct {
+	Config string "GetConfigResp"
+}
+
 type ListProfilesMsg struct {
 	_ string "ListProfiles"
 }
 
 type Profile struct {
-	Index int
-	Name  string
-	Path  string
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+	Path  string `json:"path"`
 }
 
 type ListProfilesResp struct {
@@ -64,6 +80,10 @@ type GetProfileMsg struct {
 	Env  []string
 }
 
+type GetProfileByNameMsg struct {
+	Name string "GetProfileByName"
+}
+
 type GetProfileResp struct {
 	Profile string "Profile"
 }
@@ -78,19 +98,46 @@ type LaunchMsg struct {
 	Env       []string
 	Noexec    bool
 	Ephemeral bool
+	// Seccomp mode replacing the one of the profile for this launch only,
+	// refused unless allowed by the configuration
+	SeccompModeOverride oz.SeccompMode
+	// Respond with a LaunchExitMsg once the program exits instead of as
+	// soon as it is launched
+	Wait bool
+	// Connect the descriptor passed with the message to the stdin of the
+	// program
+	Stdin bool
+	// Optional token naming the launch for CancelLaunchMsg. A new sandbox is
+	// then only responded to once it is ready
+	Token string
+}
+
+type LaunchExitMsg struct {
+	Status int "LaunchExit"
 }
 
 type ListSandboxesMsg struct {
 	_ string "ListSandboxes"
 }
 
+// Sandbox status reported by ListSandboxes
+const (
+	SandboxRunning = "running"
+	SandboxPaused  = "paused"
+)
+
 type SandboxInfo struct {
-	Id        int
-	Address   string
-	Profile   string
-	Mounts    []string
-	Ephemeral bool
-	InitPid int
+	Id        int      `json:"id"`
+	Address   string   `json:"address"`
+	Profile   string   `json:"profile"`
+	Mounts    []string `json:"mounts"`
+	Ephemeral bool     `json:"ephemeral"`
+	InitPid   int      `json:"init_pid"`
+	User      string   `json:"user"`
+	Status    string   `json:"status"`
+	// Program the sandbox was launched with, empty if launched without one
+	LaunchPath string   `json:"launch_path"`
+	LaunchArgs []string `json:"launch_args"`
 }
 
 type ListSandboxesResp struct {
@@ -102,12 +149,14 @@ type KillSandboxMsg struct {
 }
 
 type RelaunchXpraClientMsg struct {
-	Id int "RelaunchXpraClient"
+	Id   int "RelaunchXpraClient"
+	Opts oz.XpraClientOpts
 }
 
 type MountFilesMsg struct {
 	Id       int "MountFiles"
 	Files    []string
+	Targets  []string
 	ReadOnly bool
 }
 
@@ -117,12 +166,65 @@ type UnmountFileMsg struct {
 }
 
 type LogsMsg struct {
-	Count  int "Logs"
-	Follow bool
+	Count    int "Logs"
+	Follow   bool
+	Compress bool
 }
 
+// A batch of log lines, sent gzipped in Compressed instead of Lines when
+// requested by the LogsMsg
 type LogData struct {
-	Lines []string "LogData"
+	Lines      []string "LogData"
+	Compressed []byte
+}
+
+// The log lines of a sandbox kept by the daemon
+type SandboxLogsMsg struct {
+	Id int "SandboxLogs"
+}
+
+type SandboxLogsResp struct {
+	Lines []string "SandboxLogsResp"
+}
+
+type ClearLogsMsg struct {
+	Id int "ClearLogs"
+}
+
+type RestartSandboxMsg struct {
+	Id int "RestartSandbox"
+}
+
+type DiagnosticBundleMsg struct {
+	Id int "DiagnosticBundle"
+}
+
+// Streams the output of the program Pid of the sandbox as ProgramOutputMsg,
+// ending with OkMsg once the program closes it
+type FollowProgramMsg struct {
+	Id  int "FollowProgram"
+	Pid int
+}
+
+type ProgramOutputMsg struct {
+	Line string "ProgramOutput"
+}
+
+// Diagnostic snapshot of a sandbox for bug reports, the sections which could
+// not be collected being left empty with the reason listed in Errors
+type Diagnostics struct {
+	Sandbox   SandboxInfo           `json:"sandbox"`
+	Profile   oz.Profile            `json:"profile"`
+	Processes []ozinit.ProcessEntry `json:"processes"`
+	Mounts    []ozinit.MountEntry   `json:"mounts"`
+	Network   *network.NetInfo      `json:"network"`
+	Stats     *ozinit.SandboxStats  `json:"stats"`
+	Logs      []string              `json:"logs"`
+	Errors    []string              `json:"errors"`
+}
+
+type DiagnosticBundleResp struct {
+	Bundle Diagnostics "DiagnosticBundleResp"
 }
 
 type ListForwardersMsg struct {
@@ -145,15 +247,165 @@ type AskForwarderMsg struct {
 }
 
 type Forwarder struct {
-	Name   string "Forwarder"
-	Desc   string
-	Target string
+	Name        string `json:"name"`
+	Desc        string `json:"desc"`
+	Target      string `json:"target"`
+	BytesIn     int64  `json:"bytes_in"`
+	BytesOut    int64  `json:"bytes_out"`
+	Connections int    `json:"connections"`
 }
 
 type ForwarderSuccessMsg struct {
 	Proto string "ForwarderSuccess"
 	Addr  string
-	Port  string
+	// Port the listener is bound to, assigned by the kernel when the
+	// profile asks for port 0, empty for listeners without a port
+	Port string
+}
+
+type ListMountsMsg struct {
+	Id int "ListMounts"
+}
+
+type ListMountsResp struct {
+	Mounts []ozinit.MountEntry "ListMountsResp"
+}
+
+type SetClipboardMsg struct {
+	Id      int "SetClipboard"
+	Enabled bool
+}
+
+type DumpSeccompMsg struct {
+	Id int "DumpSeccomp"
+}
+
+type DumpSeccompResp struct {
+	Paths []string "DumpSeccompResp"
+}
+
+type NetworkInfoMsg struct {
+	Id int "NetworkInfo"
+}
+
+type NetworkInfoResp struct {
+	Info network.NetInfo "NetworkInfoResp"
+}
+
+// Status of the openvpn client of a sandbox, queried through its management
+// interface when openvpn_management is enabled
+type VPNStatusMsg struct {
+	Id int "VPNStatus"
+}
+
+type VPNStatusResp struct {
+	Status openvpn.Status "VPNStatusResp"
+}
+
+type PutFileMsg struct {
+	Id   int "PutFile"
+	Path string
+	Mode uint32
+	Data []byte
+}
+
+type LaunchBatchMsg struct {
+	Id    int "LaunchBatch"
+	Specs []ozinit.ProgramSpec
+}
+
+type LaunchBatchResp struct {
+	Errors []string "LaunchBatchResp"
+}
+
+type GetLaunchEnvMsg struct {
+	Id         int "GetLaunchEnv"
+	Unredacted bool
+}
+
+type GetLaunchEnvResp struct {
+	Env []string "GetLaunchEnvResp"
+}
+
+// Shows a desktop notification in the sandbox, Body being optional
+type NotifyMsg struct {
+	Id      int "Notify"
+	Summary string
+	Body    string
+}
+
+type SeccompStatsMsg struct {
+	Id int "SeccompStats"
+}
+
+type SeccompStatsResp struct {
+	Stats ozinit.SeccompStatsResp "SeccompStatsResp"
+}
+
+// Aborts the launch named Token while its sandbox is not ready yet
+type CancelLaunchMsg struct {
+	Token string "CancelLaunch"
+}
+
+// Hostname is set to <profile>-<id> when empty
+type SetHostnameMsg struct {
+	Id       int "SetHostname"
+	Hostname string
+}
+
+// Terminates the programs of a sandbox without shutting it down
+type StopAppMsg struct {
+	Id int "StopApp"
+}
+
+type PauseSandboxMsg struct {
+	Id int "PauseSandbox"
+}
+
+type ResumeSandboxMsg struct {
+	Id int "ResumeSandbox"
+}
+
+type SandboxStatsMsg struct {
+	Id int "SandboxStats"
+}
+
+type SandboxStatsResp struct {
+	Stats ozinit.SandboxStats "SandboxStatsResp"
+}
+
+// Runs a program in the running sandbox Id with its stdin kept open
+type RunInteractiveMsg struct {
+	Id   int "RunInteractive"
+	Path string
+	Pwd  string
+	Args []string
+}
+
+// Pid of the interactive program in the pid namespace of the sandbox
+type RunInteractiveResp struct {
+	Pid int "RunInteractiveResp"
+}
+
+type WriteStdinMsg struct {
+	Id   int "WriteStdin"
+	Pid  int
+	Data []byte
+}
+
+type CloseStdinMsg struct {
+	Id  int "CloseStdin"
+	Pid int
+}
+
+type DetachChildMsg struct {
+	Id  int "DetachChild"
+	Pid int
+}
+
+type AttachChildMsg struct {
+	Id  int "AttachChild"
+	Pid int
 }
 
 var messageFactory = ipc.NewMsgFactory(
@@ -162,11 +414,13 @@ var messageFactory = ipc.NewMsgFactory(
 	new(NotOkMsg),
 	new(ErrorMsg),
 	new(GetConfigMsg),
+	new(GetConfigResp),
 	new(ListProfilesMsg),
 	new(ListProfilesResp),
 	new(LaunchMsg),
 	new(IsRunningMsg),
 	new(GetProfileMsg),
+	new(GetProfileByNameMsg),
 	new(GetProfileResp),
 	new(ListSandboxesMsg),
 	new(ListSandboxesResp),
@@ -184,4 +438,43 @@ var messageFactory = ipc.NewMsgFactory(
 	new(ListBridgesResp),
 	new(ListProxiesMsg),
 	new(ListProxiesResp),
+	new(ListMountsMsg),
+	new(ListMountsResp),
+	new(SetClipboardMsg),
+	new(DumpSeccompMsg),
+	new(DumpSeccompResp),
+	new(NetworkInfoMsg),
+	new(NetworkInfoResp),
+	new(VPNStatusMsg),
+	new(VPNStatusResp),
+	new(PutFileMsg),
+	new(LaunchBatchMsg),
+	new(LaunchBatchResp),
+	new(GetLaunchEnvMsg),
+	new(GetLaunchEnvResp),
+	new(SetHostnameMsg),
+	new(PauseSandboxMsg),
+	new(ResumeSandboxMsg),
+	new(SandboxStatsMsg),
+	new(SandboxStatsResp),
+	new(LaunchExitMsg),
+	new(RunInteractiveMsg),
+	new(RunInteractiveResp),
+	new(WriteStdinMsg),
+	new(CloseStdinMsg),
+	new(DetachChildMsg),
+	new(AttachChildMsg),
+	new(SandboxLogsMsg),
+	new(SandboxLogsResp),
+	new(ClearLogsMsg),
+	new(RestartSandboxMsg),
+	new(DiagnosticBundleMsg),
+	new(DiagnosticBundleResp),
+	new(FollowProgramMsg),
+	new(ProgramOutputMsg),
+	new(NotifyMsg),
+	new(CancelLaunchMsg),
+	new(SeccompStatsMsg),
+	new(SeccompStatsResp),
+	new(StopAppMsg),
 )
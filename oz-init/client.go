@@ -1,33 +1,58 @@
 package ozinit
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"os"
+	"time"
+
+	"github.com/subgraph/oz"
 	"github.com/subgraph/oz/ipc"
+	"github.com/subgraph/oz/network"
 )
 
+// How long clientSend waits for oz-init to respond
+const clientTimeout = 30 * time.Second
+
 func clientConnect(addr string) (*ipc.MsgConn, error) {
 	return ipc.Connect(addr, messageFactory, nil)
 }
 
-func clientSend(addr string, msg interface{}) (*ipc.Message, error) {
+func clientSend(addr string, msg interface{}, fds ...int) (*ipc.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	return SendContext(ctx, addr, msg, fds...)
+}
+
+// SendContext sends msg to the oz-init listening on addr and waits for the
+// response until ctx is done, the connection being closed either way.
+func SendContext(ctx context.Context, addr string, msg interface{}, fds ...int) (*ipc.Message, error) {
 	c, err := clientConnect(addr)
 	if err != nil {
 		return nil, err
 	}
 	defer c.Close()
-	rr, err := c.ExchangeMsg(msg)
+	rr, err := c.ExchangeMsg(msg, fds...)
 	if err != nil {
 		return nil, err
 	}
-
-	resp := <-rr.Chan()
-	rr.Done()
+	resp, err := ipc.WaitResponse(ctx, rr)
+	if err != nil {
+		return nil, fmt.Errorf("no response from oz-init: %v", err)
+	}
 	return resp, nil
 }
 
 func Ping(addr string) error {
-	resp, err := clientSend(addr, new(PingMsg))
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	return PingContext(ctx, addr)
+}
+
+// PingContext checks that oz-init answers before ctx is done
+func PingContext(ctx context.Context, addr string) error {
+	resp, err := SendContext(ctx, addr, new(PingMsg))
 	if err != nil {
 		return err
 	}
@@ -35,27 +60,34 @@ func Ping(addr string) error {
 	case *PingMsg:
 		return nil
 	case *ErrorMsg:
-		return errors.New(body.Msg)
+		return body.err()
 	default:
 		return fmt.Errorf("Unexpected message received: %+v", body)
 	}
 }
 
-func RunProgram(addr, cpath, pwd string, args []string) error {
-	c, err := clientConnect(addr)
-	if err != nil {
-		return err
+// RunProgram launches a program in the sandbox. Any fds are passed along and
+// made available to the program from fd 3 onwards, with their count in the
+// OZ_PASSED_FDS environment variable. The program is then able to use them
+// regardless of its access to the filesystem, so only pass descriptors meant
+// for it. The caller still owns and should close its own copies. A non empty
+// seccompMode replaces the mode of the profile if the configuration allows it.
+// A non nil stdin is connected to the stdin of the program, which otherwise
+// reads from the null device, the file it was opened from not needing to be
+// visible in the sandbox.
+func RunProgram(addr, cpath, pwd string, args []string, seccompMode oz.SeccompMode, stdin *os.File, fds ...int) error {
+	msg := &RunProgramMsg{Path: cpath, Args: args, Pwd: pwd, SeccompMode: seccompMode}
+	if stdin != nil {
+		msg.Stdin = true
+		fds = append([]int{int(stdin.Fd())}, fds...)
 	}
-	rr, err := c.ExchangeMsg(&RunProgramMsg{Path: cpath, Args: args, Pwd: pwd})
-	resp := <-rr.Chan()
-	rr.Done()
-	c.Close()
+	resp, err := clientSend(addr, msg, fds...)
 	if err != nil {
 		return err
 	}
 	switch body := resp.Body.(type) {
 	case *ErrorMsg:
-		return errors.New(body.Msg)
+		return body.err()
 	case *OkMsg:
 		return nil
 	default:
@@ -63,21 +95,88 @@ func RunProgram(addr, cpath, pwd string, args []string) error {
 	}
 }
 
-func RunShell(addr, term string) (int, error) {
-	c, err := clientConnect(addr)
+// RunProgramWait launches a program in the sandbox like RunProgram and waits
+// without timeout for it to exit, returning its exit status. An error is
+// returned if the sandbox shuts down first.
+func RunProgramWait(addr, cpath, pwd string, args []string, seccompMode oz.SeccompMode, stdin *os.File) (int, error) {
+	msg := &RunProgramMsg{Path: cpath, Args: args, Pwd: pwd, SeccompMode: seccompMode, Wait: true}
+	var fds []int
+	if stdin != nil {
+		msg.Stdin = true
+		fds = append(fds, int(stdin.Fd()))
+	}
+	resp, err := SendContext(context.Background(), addr, msg, fds...)
+	if err != nil {
+		return -1, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return -1, body.err()
+	case *ProgramExitMsg:
+		return body.Status, nil
+	default:
+		return -1, fmt.Errorf("Unexpected message type received: %+v", body)
+	}
+}
+
+// RunProgramInteractive launches a program in the sandbox whose stdin is kept
+// open, returning its pid to write to it with WriteStdin.
+func RunProgramInteractive(addr, cpath, pwd string, args []string) (int, error) {
+	resp, err := clientSend(addr, &RunProgramMsg{Path: cpath, Args: args, Pwd: pwd, Interactive: true})
 	if err != nil {
 		return 0, err
 	}
-	rr, err := c.ExchangeMsg(&RunShellMsg{Term: term})
-	resp := <-rr.Chan()
-	rr.Done()
-	c.Close()
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return 0, body.err()
+	case *ProgramStartedMsg:
+		return body.Pid, nil
+	default:
+		return 0, fmt.Errorf("Unexpected message type received: %+v", body)
+	}
+}
+
+// WriteStdin writes data to the stdin of the interactive program pid. It
+// times out if the program does not read it.
+func WriteStdin(addr string, pid int, data []byte) error {
+	return sendOk(addr, &WriteStdinMsg{Pid: pid, Data: data})
+}
+
+func CloseStdin(addr string, pid int) error {
+	return sendOk(addr, &CloseStdinMsg{Pid: pid})
+}
+
+func DetachChild(addr string, pid int) error {
+	return sendOk(addr, &DetachChildMsg{Pid: pid})
+}
+
+func AttachChild(addr string, pid int) error {
+	return sendOk(addr, &AttachChildMsg{Pid: pid})
+}
+
+func LaunchBatch(addr string, specs []ProgramSpec) ([]string, error) {
+	resp, err := clientSend(addr, &LaunchBatchMsg{Specs: specs})
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, body.err()
+	case *LaunchBatchResp:
+		return body.Errors, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message type received: %+v", body)
+	}
+}
+
+func RunShell(addr, term string) (int, error) {
+	resp, err := clientSend(addr, &RunShellMsg{Term: term})
 	if err != nil {
 		return 0, err
 	}
 	switch body := resp.Body.(type) {
 	case *ErrorMsg:
-		return 0, errors.New(body.Msg)
+		return 0, body.err()
 	case *OkMsg:
 		if len(resp.Fds) == 0 {
 			return 0, errors.New("RunShell message returned Ok, but no file descriptor received")
@@ -88,23 +187,275 @@ func RunShell(addr, term string) (int, error) {
 	}
 }
 
-func SetupForwarder(addr, proto, daddr string, fd uintptr) error {
+func AttachProgram(addr string, pid int) (int, error) {
+	resp, err := clientSend(addr, &AttachProgramMsg{Pid: pid})
+	if err != nil {
+		return 0, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return 0, body.err()
+	case *OkMsg:
+		if len(resp.Fds) == 0 {
+			return 0, errors.New("AttachProgram message returned Ok, but no file descriptor received")
+		}
+		return resp.Fds[0], nil
+	default:
+		return 0, fmt.Errorf("Unexpected message type received: %+v", body)
+	}
+}
+
+func PutFile(addr, fpath string, mode uint32, data []byte) error {
+	resp, err := clientSend(addr, &PutFileMsg{Path: fpath, Mode: mode, Data: data})
+	if err != nil {
+		return err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return body.err()
+	case *OkMsg:
+		return nil
+	default:
+		return fmt.Errorf("Unexpected message type received: %+v", body)
+	}
+}
+
+func GetLaunchEnv(addr string, unredacted bool) ([]string, error) {
+	resp, err := clientSend(addr, &GetLaunchEnvMsg{Unredacted: unredacted})
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, body.err()
+	case *GetLaunchEnvResp:
+		return body.Env, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message type received: %+v", body)
+	}
+}
+
+// Notify shows a desktop notification from the sandbox, doing nothing if the
+// profile does not enable notifications
+func Notify(addr, summary, body string) error {
+	return sendOk(addr, &NotifyMsg{Summary: summary, Body: body})
+}
+
+func SetHostname(addr, hostname string) error {
+	resp, err := clientSend(addr, &SetHostnameMsg{Hostname: hostname})
+	if err != nil {
+		return err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return body.err()
+	case *OkMsg:
+		return nil
+	default:
+		return fmt.Errorf("Unexpected message type received: %+v", body)
+	}
+}
+
+func GetSandboxStats(addr string) (*SandboxStats, error) {
+	resp, err := clientSend(addr, new(SandboxStatsMsg))
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, body.err()
+	case *SandboxStatsResp:
+		return &body.Stats, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message type received: %+v", body)
+	}
+}
+
+func SeccompStats(addr string) (*SeccompStatsResp, error) {
+	resp, err := clientSend(addr, new(SeccompStatsMsg))
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, body.err()
+	case *SeccompStatsResp:
+		return body, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message type received: %+v", body)
+	}
+}
+
+func ListProcesses(addr string) ([]ProcessEntry, error) {
+	resp, err := clientSend(addr, new(ListProcessesMsg))
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, body.err()
+	case *ListProcessesResp:
+		return body.Processes, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message type received: %+v", body)
+	}
+}
+
+// FollowProgram calls fn with each output line of the program pid until the
+// program closes its output. If fn returns an error the program is not
+// followed anymore and that error is returned.
+func FollowProgram(addr string, pid int, fn func(line string) error) error {
 	c, err := clientConnect(addr)
 	if err != nil {
 		return err
 	}
-	rr, err := c.ExchangeMsg(&ForwarderSuccessMsg{Addr: daddr, Proto: proto}, int(fd))
+	rr, err := c.ExchangeMsg(&FollowProgramMsg{Pid: pid})
+	if err != nil {
+		c.Close()
+		return err
+	}
+	defer func() {
+		c.Close()
+		// A line arriving meanwhile is sent while holding the lock Done()
+		// takes, drain it so that neither blocks.
+		go func() {
+			for range rr.Chan() {
+			}
+		}()
+		rr.Done()
+	}()
+	for resp := range rr.Chan() {
+		switch body := resp.Body.(type) {
+		case *ErrorMsg:
+			return body.err()
+		case *OkMsg:
+			return nil
+		case *ProgramOutputMsg:
+			if err := fn(body.Line); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("Unexpected message type received: %+v", body)
+		}
+	}
+	return nil
+}
+
+func StopApp(addr string) error {
+	return sendOk(addr, new(StopAppMsg))
+}
+
+func PauseSandbox(addr string) error {
+	return sendOk(addr, new(PauseSandboxMsg))
+}
+
+func ResumeSandbox(addr string) error {
+	return sendOk(addr, new(ResumeSandboxMsg))
+}
+
+// sendOk sends msg and waits for an OkMsg in response
+func sendOk(addr string, msg interface{}) error {
+	resp, err := clientSend(addr, msg)
+	if err != nil {
+		return err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return body.err()
+	case *OkMsg:
+		return nil
+	default:
+		return fmt.Errorf("Unexpected message type received: %+v", body)
+	}
+}
+
+func SetupForwarder(addr, proto, daddr string, fd uintptr) error {
+	resp, err := clientSend(addr, &ForwarderSuccessMsg{Addr: daddr, Proto: proto}, int(fd))
+	if err != nil {
+		return err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return body.err()
+	case *OkMsg:
+		return nil
+	default:
+		return fmt.Errorf("Unexpected message type received: %+v", body)
+	}
+
+}
+
+func ListMounts(addr string) ([]MountEntry, error) {
+	resp, err := clientSend(addr, new(ListMountsMsg))
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, body.err()
+	case *ListMountsResp:
+		return body.Mounts, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message type received: %+v", body)
+	}
+}
+
+func SetClipboard(addr string, enabled bool) error {
+	resp, err := clientSend(addr, &SetClipboardMsg{Enabled: enabled})
 	if err != nil {
-		return fmt.Errorf("Error %v: %+v", err, rr)
+		return err
 	}
-	resp := <-rr.Chan()
 	switch body := resp.Body.(type) {
 	case *ErrorMsg:
-		return errors.New(body.Msg)
+		return body.err()
 	case *OkMsg:
 		return nil
 	default:
 		return fmt.Errorf("Unexpected message type received: %+v", body)
 	}
+}
+
+func DumpSeccomp(addr string) ([]string, error) {
+	resp, err := clientSend(addr, new(DumpSeccompMsg))
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, body.err()
+	case *DumpSeccompResp:
+		return body.Paths, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message type received: %+v", body)
+	}
+}
 
+func ListForwarderStats(addr string) ([]ForwarderStats, error) {
+	resp, err := clientSend(addr, new(ListForwarderStatsMsg))
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, body.err()
+	case *ListForwarderStatsResp:
+		return body.Stats, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message type received: %+v", body)
+	}
+}
+
+func NetworkInfo(addr string) (*network.NetInfo, error) {
+	resp, err := clientSend(addr, new(NetworkInfoMsg))
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, body.err()
+	case *NetworkInfoResp:
+		return &body.Info, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message type received: %+v", body)
+	}
 }
@@ -0,0 +1,62 @@
+package ozinit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/subgraph/oz"
+)
+
+const corePatternPath = "/proc/sys/kernel/core_pattern"
+
+// RLIM_INFINITY of the Rlimit fields, syscall defining it as -1
+const rlimInfinity = ^uint64(0)
+
+// setupCores raises the core size limit inherited by the programs of the
+// sandbox and returns the item binding the core directory of the daemon
+// where the host core_pattern makes the kernel write the dumps.
+func (st *initState) setupCores() (oz.WhitelistItem, error) {
+	bs, err := ioutil.ReadFile(corePatternPath)
+	if err != nil {
+		return oz.WhitelistItem{}, err
+	}
+	item, err := coreWhitelistItem(strings.TrimSpace(string(bs)), st.coreDir)
+	if err != nil {
+		return item, err
+	}
+	lim := &syscall.Rlimit{Cur: rlimInfinity, Max: rlimInfinity}
+	if err := syscall.Setrlimit(syscall.RLIMIT_CORE, lim); err != nil {
+		return item, fmt.Errorf("failed to raise core size limit: %v", err)
+	}
+	st.log.Info("Core dumps written to %s are collected in %s", item.Target, st.coreDir)
+	return item, nil
+}
+
+// coreWhitelistItem returns the item binding coreDir over the directory of
+// the core_pattern pattern. The pattern must be an absolute path, which the
+// kernel resolves inside the sandbox of the crashing program, and not pipe
+// the dumps to a host helper nor write them in its working directory.
+func coreWhitelistItem(pattern, coreDir string) (oz.WhitelistItem, error) {
+	if strings.HasPrefix(pattern, "|") {
+		return oz.WhitelistItem{}, fmt.Errorf("core_pattern pipes dumps to a host helper (%s)", pattern)
+	}
+	if !path.IsAbs(pattern) {
+		return oz.WhitelistItem{}, fmt.Errorf("core_pattern is not an absolute path (%s)", pattern)
+	}
+	dir := path.Dir(pattern)
+	if strings.Contains(dir, "%") {
+		return oz.WhitelistItem{}, fmt.Errorf("core_pattern directory depends on the dumping process (%s)", pattern)
+	}
+	if dir == "/" {
+		return oz.WhitelistItem{}, fmt.Errorf("core_pattern writes dumps to the root directory (%s)", pattern)
+	}
+	return oz.WhitelistItem{
+		Path:   coreDir,
+		Target: dir,
+		Force:  true,
+		NoExec: true,
+	}, nil
+}
@@ -0,0 +1,30 @@
+package ozinit
+
+import (
+	"testing"
+)
+
+func TestCoreWhitelistItem(t *testing.T) {
+	item, err := coreWhitelistItem("/var/crash/core.%e.%p", "/var/lib/oz/cores/firefox-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if item.Path != "/var/lib/oz/cores/firefox-1" || item.Target != "/var/crash" {
+		t.Errorf("unexpected bind %s -> %s", item.Path, item.Target)
+	}
+	if !item.NoExec || item.ReadOnly {
+		t.Errorf("core directory should be a writable noexec bind: %+v", item)
+	}
+
+	for _, pattern := range []string{
+		"core",
+		"core.%p",
+		"|/lib/systemd/systemd-coredump %P %u %g %s %t %c %h",
+		"/core.%p",
+		"/var/crash/%u/core",
+	} {
+		if _, err := coreWhitelistItem(pattern, "/var/lib/oz/cores/firefox-1"); err == nil {
+			t.Errorf("expected an error for core_pattern %s", pattern)
+		}
+	}
+}
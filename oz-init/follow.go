@@ -0,0 +1,86 @@
+package ozinit
+
+import (
+	"sync"
+)
+
+// Number of lines held for a follower not keeping up with the output of the
+// program, further lines being dropped for it until it catches up
+const followerBacklog = 256
+
+// A client attached to the output of a program, the lines being read from
+// the channel until it is closed
+type outputFollower struct {
+	lines chan string
+}
+
+// outputFollowers tees the output lines of the programs launched by init to
+// the clients following them. Sending never blocks the goroutines reading
+// the output of the programs.
+type outputFollowers struct {
+	lock      sync.Mutex
+	followers map[int][]*outputFollower
+}
+
+func newOutputFollowers() *outputFollowers {
+	return &outputFollowers{followers: make(map[int][]*outputFollower)}
+}
+
+// open allows following the output of the program pid until close is called
+func (of *outputFollowers) open(pid int) {
+	of.lock.Lock()
+	defer of.lock.Unlock()
+	if _, ok := of.followers[pid]; !ok {
+		of.followers[pid] = nil
+	}
+}
+
+// attach adds a follower of the output of pid, it returns false if the
+// output of pid cannot be followed.
+func (of *outputFollowers) attach(pid int) (*outputFollower, bool) {
+	of.lock.Lock()
+	defer of.lock.Unlock()
+	fs, ok := of.followers[pid]
+	if !ok {
+		return nil, false
+	}
+	f := &outputFollower{lines: make(chan string, followerBacklog)}
+	of.followers[pid] = append(fs, f)
+	return f, true
+}
+
+// detach removes the follower f of pid, closing its channel
+func (of *outputFollowers) detach(pid int, f *outputFollower) {
+	of.lock.Lock()
+	defer of.lock.Unlock()
+	fs := of.followers[pid]
+	for i := range fs {
+		if fs[i] == f {
+			of.followers[pid] = append(fs[:i:i], fs[i+1:]...)
+			close(f.lines)
+			return
+		}
+	}
+}
+
+// send passes line to every follower of pid
+func (of *outputFollowers) send(pid int, line string) {
+	of.lock.Lock()
+	defer of.lock.Unlock()
+	for _, f := range of.followers[pid] {
+		select {
+		case f.lines <- line:
+		default:
+		}
+	}
+}
+
+// close ends the output of pid, closing the channels of its followers
+func (of *outputFollowers) close(pid int) {
+	of.lock.Lock()
+	defer of.lock.Unlock()
+	for _, f := range of.followers[pid] {
+		close(f.lines)
+	}
+	delete(of.followers, pid)
+}
@@ -0,0 +1,55 @@
+package ozinit
+
+import (
+	"testing"
+)
+
+func readFollower(f *outputFollower) []string {
+	var lines []string
+	for line := range f.lines {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestOutputFollowers(t *testing.T) {
+	of := newOutputFollowers()
+	if _, ok := of.attach(10); ok {
+		t.Fatal("expected attaching to a program whose output is not open to fail")
+	}
+
+	of.open(10)
+	a, ok := of.attach(10)
+	if !ok {
+		t.Fatal("attaching to an open program failed")
+	}
+	b, _ := of.attach(10)
+	of.send(10, "one")
+	of.detach(10, a)
+	of.send(10, "two")
+	of.send(11, "other")
+	of.close(10)
+
+	if lines := readFollower(a); len(lines) != 1 || lines[0] != "one" {
+		t.Errorf("detached follower got %q, expected only the line sent before", lines)
+	}
+	if lines := readFollower(b); len(lines) != 2 || lines[0] != "one" || lines[1] != "two" {
+		t.Errorf("follower got %q, expected both lines", lines)
+	}
+	if _, ok := of.attach(10); ok {
+		t.Error("expected attaching to a closed program output to fail")
+	}
+}
+
+func TestOutputFollowersBacklog(t *testing.T) {
+	of := newOutputFollowers()
+	of.open(10)
+	f, _ := of.attach(10)
+	for i := 0; i < followerBacklog+10; i++ {
+		of.send(10, "line")
+	}
+	of.close(10)
+	if n := len(readFollower(f)); n != followerBacklog {
+		t.Errorf("follower not reading got %d lines, expected the %d of the backlog", n, followerBacklog)
+	}
+}
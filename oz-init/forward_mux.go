@@ -0,0 +1,246 @@
+package ozinit
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A destination of the aggregated forwarder, for the connections accepted on
+// the local port it is registered for
+type muxBackend struct {
+	proto string
+	addr  string
+	stats *forwarderStats
+}
+
+// forwarderMux accepts the connections of all its tcp listeners from a single
+// goroutine polling them with epoll, each connection being routed to the
+// backend of the local port the client connected to. This avoids a goroutine
+// blocked in Accept for every forwarder of the profile.
+type forwarderMux struct {
+	epfd      int
+	wake      [2]int
+	lock      sync.Mutex
+	closed    bool
+	listeners map[int]*os.File
+	backends  map[int]*muxBackend
+	handle    func(net.Conn, *muxBackend)
+}
+
+// errNotPortListener is returned by add for listeners without a port, such
+// as unix sockets, which keep a forwarder of their own
+var errNotPortListener = fmt.Errorf("listener is not bound to a port")
+
+func newForwarderMux(handle func(net.Conn, *muxBackend)) (*forwarderMux, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	m := &forwarderMux{
+		epfd:      epfd,
+		listeners: make(map[int]*os.File),
+		backends:  make(map[int]*muxBackend),
+		handle:    handle,
+	}
+	// Closing the epoll descriptor does not wake up EpollWait, a write to
+	// this pipe does
+	if err := syscall.Pipe2(m.wake[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+	if err := m.poll(m.wake[0]); err != nil {
+		m.release()
+		return nil, err
+	}
+	go m.run()
+	return m, nil
+}
+
+// listenerPort returns the local port of the listening socket fd
+func listenerPort(fd int) (int, error) {
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return 0, err
+	}
+	switch a := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return a.Port, nil
+	case *syscall.SockaddrInet6:
+		return a.Port, nil
+	}
+	return 0, errNotPortListener
+}
+
+// add registers b as the backend of the port the listener f is bound to. The
+// mux owns f once added, f being left to the caller on error.
+func (m *forwarderMux) add(f *os.File, b *muxBackend) error {
+	fd := int(f.Fd())
+	port, err := listenerPort(fd)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return fmt.Errorf("forwarder is closed")
+	}
+	if _, ok := m.backends[port]; ok {
+		return fmt.Errorf("a forwarder is already listening on port %d", port)
+	}
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		return err
+	}
+	if err := m.poll(fd); err != nil {
+		return err
+	}
+	m.listeners[fd] = f
+	m.backends[port] = b
+	return nil
+}
+
+// Longest delay between the accept attempts after temporary errors
+const acceptMaxDelay = time.Second
+
+// nextAcceptDelay doubles the delay before accepting again after a
+// temporary error, from 5ms up to acceptMaxDelay.
+func nextAcceptDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	if delay *= 2; delay > acceptMaxDelay {
+		return acceptMaxDelay
+	}
+	return delay
+}
+
+func (m *forwarderMux) poll(fd int) error {
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+	return syscall.EpollCtl(m.epfd, syscall.EPOLL_CTL_ADD, fd, &ev)
+}
+
+func (m *forwarderMux) backend(port int) *muxBackend {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.backends[port]
+}
+
+func (m *forwarderMux) run() {
+	defer m.release()
+	events := make([]syscall.EpollEvent, 16)
+	var delay time.Duration
+	for {
+		n, err := syscall.EpollWait(m.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return
+		}
+		exhausted := false
+		for _, ev := range events[:n] {
+			if int(ev.Fd) == m.wake[0] {
+				return
+			}
+			switch err := m.acceptAll(int(ev.Fd)); {
+			case isAcceptExhausted(err):
+				exhausted = true
+			case err != nil:
+				m.remove(int(ev.Fd))
+			}
+		}
+		// The epoll is level-triggered, the listener left with a pending
+		// connection would wake it up again at once
+		if exhausted {
+			delay = nextAcceptDelay(delay)
+			time.Sleep(delay)
+		} else {
+			delay = 0
+		}
+	}
+}
+
+// isAcceptExhausted reports whether the accept error err is caused by running
+// out of descriptors or memory, which may be released later
+func isAcceptExhausted(err error) bool {
+	switch err {
+	case syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM:
+		return true
+	}
+	return false
+}
+
+// remove stops polling the listener fd, which failed to accept, and frees
+// its port for another forwarder
+func (m *forwarderMux) remove(fd int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	syscall.EpollCtl(m.epfd, syscall.EPOLL_CTL_DEL, fd, nil)
+	if port, err := listenerPort(fd); err == nil {
+		delete(m.backends, port)
+	}
+	if f, ok := m.listeners[fd]; ok {
+		f.Close()
+		delete(m.listeners, fd)
+	}
+}
+
+// acceptAll accepts the pending connections of the listener fd, returning nil
+// once none is left or the error which stopped it
+func (m *forwarderMux) acceptAll(fd int) error {
+	for {
+		nfd, _, err := syscall.Accept4(fd, syscall.SOCK_CLOEXEC)
+		if err == syscall.EINTR || err == syscall.ECONNABORTED {
+			continue
+		} else if err == syscall.EAGAIN {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		f := os.NewFile(uintptr(nfd), "")
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		port := 0
+		if a, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			port = a.Port
+		}
+		b := m.backend(port)
+		if b == nil {
+			conn.Close()
+			continue
+		}
+		go m.handle(conn, b)
+	}
+}
+
+// release closes the descriptors of the mux once run has returned
+func (m *forwarderMux) release() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.closed = true
+	for _, f := range m.listeners {
+		f.Close()
+	}
+	m.listeners = nil
+	syscall.Close(m.epfd)
+	syscall.Close(m.wake[0])
+	syscall.Close(m.wake[1])
+}
+
+// Close stops accepting connections on all the listeners of the mux, the
+// connections already accepted being left open.
+func (m *forwarderMux) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	_, err := syscall.Write(m.wake[1], []byte{0})
+	return err
+}
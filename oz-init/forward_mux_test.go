@@ -0,0 +1,116 @@
+package ozinit
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func listenerFile(t *testing.T) (*os.File, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, l.Addr().String()
+}
+
+func TestForwarderMuxRouting(t *testing.T) {
+	type routed struct {
+		backend string
+		local   string
+	}
+	accepted := make(chan routed, 4)
+	m, err := newForwarderMux(func(conn net.Conn, b *muxBackend) {
+		accepted <- routed{b.addr, conn.LocalAddr().String()}
+		conn.Close()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	backends := map[string]string{}
+	for _, dest := range []string{"127.0.0.1:8080", "127.0.0.1:9090"} {
+		f, addr := listenerFile(t)
+		if err := m.add(f, &muxBackend{proto: "tcp", addr: dest}); err != nil {
+			t.Fatalf("adding listener %s failed: %v", addr, err)
+		}
+		backends[addr] = dest
+	}
+
+	for addr, dest := range backends {
+		for i := 0; i < 2; i++ {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case r := <-accepted:
+				if r.backend != dest || r.local != addr {
+					t.Errorf("connection to %s routed to %s from %s, expected %s", addr, r.backend, r.local, dest)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("connection to %s was not accepted", addr)
+			}
+			c.Close()
+		}
+	}
+}
+
+func TestForwarderMuxAdd(t *testing.T) {
+	m, err := newForwarderMux(func(conn net.Conn, b *muxBackend) { conn.Close() })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "mux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ul, err := net.ListenUnix("unix", &net.UnixAddr{Name: path.Join(dir, "sock"), Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uf, err := ul.File()
+	ul.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uf.Close()
+	if err := m.add(uf, &muxBackend{proto: "unix", addr: "/tmp/sock"}); err != errNotPortListener {
+		t.Errorf("expected a unix listener to be refused with errNotPortListener, got %v", err)
+	}
+
+	m.Close()
+	f, _ := listenerFile(t)
+	defer f.Close()
+	if err := m.add(f, &muxBackend{proto: "tcp", addr: "127.0.0.1:80"}); err == nil {
+		t.Error("expected adding to a closed forwarder to fail")
+	}
+}
+
+func TestNextAcceptDelay(t *testing.T) {
+	delay := nextAcceptDelay(0)
+	if delay != 5*time.Millisecond {
+		t.Errorf("first delay is %v", delay)
+	}
+	for i := 0; i < 20; i++ {
+		delay = nextAcceptDelay(delay)
+	}
+	if delay != acceptMaxDelay {
+		t.Errorf("delay grew to %v, expected it capped to %v", delay, acceptMaxDelay)
+	}
+	if !isAcceptExhausted(syscall.EMFILE) || isAcceptExhausted(syscall.EINVAL) {
+		t.Error("descriptor exhaustion not told apart from other accept errors")
+	}
+}
@@ -0,0 +1,126 @@
+package ozinit
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Time after which a datagram forwarding session without traffic in either
+// direction is expired
+const udpIdleTimeout = 60 * time.Second
+
+const maxDatagramSize = 65535
+
+// A client of a datagram forwarder, with its own socket to the destination
+// so that the replies can be sent back to it
+type udpSession struct {
+	conn     net.Conn
+	client   net.Addr
+	lastSeen int64
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastSeen, time.Now().UnixNano())
+}
+
+func (s *udpSession) idleSince() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastSeen)))
+}
+
+// proxyDatagrams forwards the datagrams received on pc to the udp address
+// rAddr, until pc is closed. Each client source address gets a session whose
+// replies are written back to that address, expired after idle of inactivity.
+// Datagrams from clients without an address, like unbound unix datagram
+// sockets, are forwarded but cannot be answered.
+func (st *initState) proxyDatagrams(pc net.PacketConn, rAddr string, stats *forwarderStats, idle time.Duration) {
+	var lock sync.Mutex
+	sessions := make(map[string]*udpSession)
+
+	removeSession := func(key string, s *udpSession) {
+		lock.Lock()
+		if sessions[key] == s {
+			delete(sessions, key)
+		}
+		lock.Unlock()
+		s.conn.Close()
+		atomic.AddInt64(&stats.active, -1)
+	}
+
+	replyLoop := func(key string, s *udpSession) {
+		defer removeSession(key, s)
+		buf := make([]byte, maxDatagramSize)
+		for {
+			s.conn.SetReadDeadline(time.Now().Add(idle))
+			n, err := s.conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() && s.idleSince() < idle {
+					continue
+				}
+				return
+			}
+			s.touch()
+			if s.client == nil {
+				continue
+			}
+			if _, err := pc.WriteTo(buf[:n], s.client); err != nil {
+				st.log.Debug("Failed to forward datagram reply from %s: %v", rAddr, err)
+				continue
+			}
+			atomic.AddInt64(&stats.bytesOut, int64(n))
+		}
+	}
+
+	defer func() {
+		lock.Lock()
+		for _, s := range sessions {
+			s.conn.Close()
+		}
+		lock.Unlock()
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if st.isForwarderClosing() {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			st.log.Warning("Datagram forwarder to %s stopped: %v", rAddr, err)
+			return
+		}
+		key := ""
+		if addr != nil {
+			key = addr.String()
+		}
+		lock.Lock()
+		s := sessions[key]
+		if s == nil {
+			conn, err := net.Dial("udp", rAddr)
+			if err != nil {
+				lock.Unlock()
+				st.log.Warning("Failed to forward datagram to %s: %v", rAddr, err)
+				continue
+			}
+			if key == "" {
+				addr = nil
+			}
+			s = &udpSession{conn: conn, client: addr}
+			s.touch()
+			sessions[key] = s
+			atomic.AddInt64(&stats.active, 1)
+			go replyLoop(key, s)
+		}
+		lock.Unlock()
+		s.touch()
+		if _, err := s.conn.Write(buf[:n]); err != nil {
+			st.log.Debug("Failed to forward datagram to %s: %v", rAddr, err)
+			continue
+		}
+		atomic.AddInt64(&stats.bytesIn, int64(n))
+	}
+}
@@ -0,0 +1,83 @@
+package ozinit
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+func startUdpEcho(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+func TestProxyDatagrams(t *testing.T) {
+	echo := startUdpEcho(t)
+	defer echo.Close()
+
+	dir, err := ioutil.TempDir("", "ozudp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pc, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path.Join(dir, "fwd"), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	st := &initState{log: logging.MustGetLogger("test")}
+	stats := new(forwarderStats)
+	go st.proxyDatagrams(pc, echo.LocalAddr().String(), stats, 200*time.Millisecond)
+
+	client, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path.Join(dir, "client"), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.WriteTo([]byte("ping"), pc.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 16)
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no reply received: %v", err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Errorf("expected reply 'ping', got %q", buf[:n])
+	}
+	if in, out := atomic.LoadInt64(&stats.bytesIn), atomic.LoadInt64(&stats.bytesOut); in != 4 || out != 4 {
+		t.Errorf("expected 4 bytes in each direction, got %d in and %d out", in, out)
+	}
+	if a := atomic.LoadInt64(&stats.active); a != 1 {
+		t.Errorf("expected 1 active session, got %d", a)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&stats.active) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle session was not expired")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
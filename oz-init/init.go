@@ -3,6 +3,7 @@ package ozinit
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -15,11 +16,14 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
-	//"time"
+	"time"
 
 	"github.com/subgraph/oz"
 	"github.com/subgraph/oz/fs"
@@ -29,6 +33,7 @@ import (
 
 	"github.com/kr/pty"
 	"github.com/op/go-logging"
+	"golang.org/x/sys/unix"
 )
 
 type procState struct {
@@ -42,8 +47,18 @@ type initState struct {
 	config            *oz.Config
 	sockaddr          string
 	launchEnv         []string
+	envOverrides      []string
+	hostname          string
 	lock              sync.Mutex
+	umaskLock         sync.Mutex
 	children          map[int]procState
+	seccompSnapshots  map[int]string
+	seccompDumps      map[int]chan struct{}
+	snapshotCount     int
+	appPtys           map[int]*os.File
+	stdinPipes        map[int]io.WriteCloser
+	exitWaiters       map[int]*ipc.Message
+	shutdownTimer     *time.Timer
 	uid               uint32
 	gid               uint32
 	gids              map[string]uint32
@@ -53,9 +68,38 @@ type initState struct {
 	ipcServer         *ipc.MsgServer
 	xpra              *xpra.Xpra
 	xpraReady         sync.WaitGroup
+	xpraReadyOnce     sync.Once
 	dbusUuid          string
 	shutdownRequested bool
+	stoppingApp       bool
+	paused            bool
+	shutdownSignals   []os.Signal
+	forwardSignals    []os.Signal
 	ephemeral         bool
+	coreDir           string
+	waylandDisplay    string
+	whitelistFailures []string
+	fwdLock           sync.Mutex
+	fwdClosing        bool
+	fwdListeners      []io.Closer
+	fwdConns          map[net.Conn]net.Conn
+	fwdActive         sync.WaitGroup
+	fwdStats          map[string]*forwarderStats
+	fwdMux            *forwarderMux
+	outputLogLock     sync.Mutex
+	outputLog         io.WriteCloser
+	outputFollowers   *outputFollowers
+	deviceGids        []uint32
+	socketForwards    []socketForward
+	seccompStats      seccompStats
+}
+
+// Traffic counters of the forwarders to a destination address, updated
+// atomically by the copy loops of each connection
+type forwarderStats struct {
+	bytesIn  int64
+	bytesOut int64
+	active   int64
 }
 
 type InitData struct {
@@ -69,13 +113,62 @@ type InitData struct {
 	User      user.User
 	Display   int
 	Ephemeral bool
+	// Host directory receiving the core dumps when the profile collects them
+	CoreDir string
+	// Name of the socket of the host Wayland compositor in the runtime
+	// directory of the user, in the wayland xserver mode
+	WaylandDisplay string
 }
 
+// Environment variable set to the number of descriptors passed to a program
+// with RunProgram, they are numbered consecutively from 3 in the program.
+const PassedFdsEnv = "OZ_PASSED_FDS"
+
+// How long DumpSeccomp waits for the tracers to write their snapshots
+const seccompDumpTimeout = 5 * time.Second
+
+// How long shutdown waits for active forwarded connections to finish
+// before closing them forcibly.
+const forwarderDrainTimeout = 3 * time.Second
+
+// How long init waits for the SIGUSR1 of the daemon when the configuration
+// does not set a positive parent_ready_timeout
+const defaultParentReadyTimeout = 30 * time.Second
+
+// How long shutdown waits for xpra stop when the configuration does not set
+// a positive xpra_stop_timeout
+const defaultXpraStopTimeout = 10 * time.Second
+
+// Program sending the notifications of NotifyMsg, and how long it may take
 const (
-	DBUS_VAR_REGEXP = "[A-Za-z_]+=[a-zA-Z_:-@]+=/tmp/.+"
+	notifySendPath = "/usr/bin/notify-send"
+	notifyTimeout  = 5 * time.Second
 )
 
-var dbusValidVar = regexp.MustCompile(DBUS_VAR_REGEXP)
+// Directories bound read-only with bind_fonts, those missing being skipped
+var fontPaths = []string{
+	"/usr/share/fonts",
+	"/usr/local/share/fonts",
+	"/var/cache/fontconfig",
+	"${HOME}/.fonts",
+	"${HOME}/.local/share/fonts",
+	"${HOME}/.cache/fontconfig",
+}
+
+// Directories of the CA certificates of the host bound read-only with
+// bind_ca_certs, for the Debian and RedHat layouts
+var caCertPaths = []string{
+	"/etc/ssl/certs",
+	"/etc/pki/tls/certs",
+	"/etc/pki/ca-trust/extracted",
+}
+
+// dbus-launch is run up to dbusLaunchAttempts times, waiting
+// dbusLaunchRetryDelay between attempts
+const (
+	dbusLaunchAttempts   = 3
+	dbusLaunchRetryDelay = 500 * time.Millisecond
+)
 
 // By convention oz-init writes log messages to stderr with a single character
 // prefix indicating the logging level.  These messages are read one line at a time
@@ -117,29 +210,62 @@ func parseArgs() *initState {
 		log.Error("invalid uid or user passed to init.")
 		os.Exit(1)
 	}
+	// A service user is passed with its own primary group
+	if ru := initData.Profile.RunAsUser; ru != "" {
+		if initData.User.Username != ru || initData.User.Gid != strconv.Itoa(int(initData.Gid)) || initData.Gid == 0 {
+			log.Error("invalid run_as_user %s passed to init.", ru)
+			os.Exit(1)
+		}
+	}
 
 	env := []string{}
 	env = append(env, initData.LaunchEnv...)
-	env = append(env, "PATH=/usr/bin:/bin")
-
-	if initData.Profile.XServer.Enabled {
-		env = append(env, "DISPLAY=:"+strconv.Itoa(initData.Display))
+	env = append(env, "PATH="+initData.Profile.LaunchPath())
+
+	if initData.Profile.XServer.IsWayland() {
+		env = append(env, "WAYLAND_DISPLAY="+initData.WaylandDisplay)
+	} else if initData.Profile.XServer.Enabled {
+		if d := initData.Config.DisplayOverride; d != "" {
+			log.Notice("Using display %s instead of :%d as configured", d, initData.Display)
+			env = append(env, "DISPLAY="+d)
+		} else {
+			env = append(env, "DISPLAY=:"+strconv.Itoa(initData.Display))
+		}
+	}
+	if sd := initData.Profile.XServer.SecondaryDisplay; sd > 0 {
+		if initData.Profile.XServer.Enabled && sd == initData.Display {
+			log.Error("Secondary display :%d is the display of the sandbox", sd)
+			os.Exit(1)
+		}
+		env = append(env, "OZ_SECONDARY_DISPLAY=:"+strconv.Itoa(sd))
 	}
 
 	return &initState{
-		log:       log,
-		config:    &initData.Config,
-		sockaddr:  initData.Sockaddr,
-		launchEnv: env,
-		profile:   &initData.Profile,
-		children:  make(map[int]procState),
-		uid:       initData.Uid,
-		gid:       initData.Gid,
-		gids:      initData.Gids,
-		user:      &initData.User,
-		display:   initData.Display,
-		fs:        fs.NewFilesystem(&initData.Config, log, &initData.User, &initData.Profile),
-		ephemeral: initData.Ephemeral,
+		log:              log,
+		config:           &initData.Config,
+		sockaddr:         initData.Sockaddr,
+		launchEnv:        env,
+		envOverrides:     environOverrides(),
+		hostname:         initData.Profile.Name,
+		profile:          &initData.Profile,
+		children:         make(map[int]procState),
+		seccompSnapshots: make(map[int]string),
+		seccompDumps:     make(map[int]chan struct{}),
+		appPtys:          make(map[int]*os.File),
+		stdinPipes:       make(map[int]io.WriteCloser),
+		exitWaiters:      make(map[int]*ipc.Message),
+		fwdConns:         make(map[net.Conn]net.Conn),
+		fwdStats:         make(map[string]*forwarderStats),
+		outputFollowers:  newOutputFollowers(),
+		uid:              initData.Uid,
+		gid:              initData.Gid,
+		gids:             initData.Gids,
+		user:             &initData.User,
+		display:          initData.Display,
+		fs:               fs.NewFilesystem(&initData.Config, log, &initData.User, &initData.Profile),
+		ephemeral:        initData.Ephemeral,
+		coreDir:          initData.CoreDir,
+		waylandDisplay:   initData.WaylandDisplay,
 	}
 }
 
@@ -147,12 +273,23 @@ func (st *initState) waitForParentReady() *initState {
 	// Signal the daemon we are ready
 	os.Stderr.WriteString("WAITING\n")
 
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGUSR1)
-
-	sig := <-c
-	st.log.Info("Received SIGUSR1 from parent (%v), ready to init.", sig)
-	signal.Stop(c)
+	defer signal.Stop(c)
+
+	timeout := time.Duration(st.config.ParentReadyTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultParentReadyTimeout
+	}
+	// The daemon may have died before signalling, leaving nobody to kill us
+	select {
+	case sig := <-c:
+		st.log.Info("Received SIGUSR1 from parent (%v), ready to init.", sig)
+	case <-time.After(timeout):
+		st.log.Error("No SIGUSR1 received from parent after %v, exiting.", timeout)
+		signal.Stop(c)
+		os.Exit(1)
+	}
 
 	return st
 }
@@ -160,20 +297,53 @@ func (st *initState) waitForParentReady() *initState {
 func (st *initState) runInit() {
 	st.log.Info("Starting oz-init for profile: %s", st.profile.Name)
 	sigs := make(chan os.Signal)
-	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	st.shutdownSignals = st.parseSignals(st.config.ShutdownSignals)
+	if len(st.shutdownSignals) == 0 {
+		st.log.Warning("No valid shutdown signals configured, using SIGTERM and SIGINT")
+		st.shutdownSignals = []os.Signal{syscall.SIGTERM, syscall.SIGINT}
+	}
+	st.forwardSignals = st.parseSignals(st.config.ForwardSignals)
+	signal.Notify(sigs, append(st.shutdownSignals, st.forwardSignals...)...)
 
 	s, err := ipc.NewServer(st.sockaddr, messageFactory, st.log,
 		handlePing,
 		st.handleRunProgram,
 		st.handleRunShell,
 		st.handleSetupForwarder,
+		st.handleListMounts,
+		st.handleSetClipboard,
+		st.handleDumpSeccomp,
+		st.handleListForwarderStats,
+		st.handleNetworkInfo,
+		st.handleAttachProgram,
+		st.handlePutFile,
+		st.handleLaunchBatch,
+		st.handleGetLaunchEnv,
+		st.handleSetHostname,
+		st.handlePauseSandbox,
+		st.handleResumeSandbox,
+		st.handleSandboxStats,
+		st.handleWriteStdin,
+		st.handleCloseStdin,
+		st.handleDetachChild,
+		st.handleAttachChild,
+		st.handleListProcesses,
+		st.handleFollowProgram,
+		st.handleNotify,
+		st.handleSeccompStats,
+		st.handleStopApp,
 	)
 	if err != nil {
 		st.log.Error("NewServer failed: %v", err)
 		os.Exit(1)
 	}
+	s.SetDispatchHook(st.logMessage)
 
 	if err := os.Chown(st.sockaddr, int(st.uid), int(st.gid)); err != nil {
+		if st.config.RequireSocketChown {
+			st.log.Error("Failed to chown oz-init control socket: %v", err)
+			os.Exit(1)
+		}
 		st.log.Warning("Failed to chown oz-init control socket: %v", err)
 	}
 
@@ -190,6 +360,16 @@ func (st *initState) runInit() {
 		wlExtras = append(wlExtras, oz.WhitelistItem{Path: "/dev/shm/pulse-shm-*", Ignore: true})
 	}
 
+	if st.config.BindFonts {
+		for _, p := range fontPaths {
+			wlExtras = append(wlExtras, oz.WhitelistItem{Path: p, Ignore: true, ReadOnly: true})
+		}
+	}
+
+	if st.config.BindCACerts {
+		wlExtras = append(wlExtras, caCertItems(st.config.EtcIncludes)...)
+	}
+
 	if st.ephemeral {
 		for i := len(st.profile.SharedFolders) - 1; i >= 0; i-- {
 			sf := st.profile.SharedFolders[i]
@@ -202,6 +382,14 @@ func (st *initState) runInit() {
 		wlExtras = st.addSharedFolders(wlExtras)
 	}
 
+	if st.profile.CollectCores && st.coreDir != "" {
+		if item, err := st.setupCores(); err != nil {
+			st.log.Warning("Core dumps will not be collected: %v", err)
+		} else {
+			wlExtras = append(wlExtras, item)
+		}
+	}
+
 	if err := st.setupFilesystem(wlExtras, blExtras); err != nil {
 		st.log.Error("Failed to setup filesytem: %v", err)
 		os.Exit(1)
@@ -210,25 +398,51 @@ func (st *initState) runInit() {
 	if st.user != nil && st.user.HomeDir != "" {
 		st.launchEnv = append(st.launchEnv, "HOME="+st.user.HomeDir)
 	}
+	st.expandEnvironment()
+
+	if st.config.SetXdgRuntimeDir {
+		dir := st.runtimeDir()
+		// The variable passed from the launching user may name another uid
+		env := []string{}
+		for _, e := range st.launchEnv {
+			if !strings.HasPrefix(e, "XDG_RUNTIME_DIR=") {
+				env = append(env, e)
+			}
+		}
+		if err := createRuntimeDir(dir, int(st.uid), int(st.gid)); err != nil {
+			st.log.Warning("Unable to create the runtime directory %s, XDG_RUNTIME_DIR is not set: %v", dir, err)
+			st.launchEnv = env
+		} else {
+			st.launchEnv = append(env, "XDG_RUNTIME_DIR="+dir)
+		}
+	}
 
-	if st.profile.Networking.Nettype != network.TYPE_HOST ||
-		st.profile.Networking.Nettype != network.TYPE_NONE {
+	if st.profile.Networking.Nettype.NeedsSetup() {
 		err := network.NetSetup()
 		if err != nil {
 			st.log.Error("Unable to setup networking: %+v", err)
 			os.Exit(1)
 		}
+	} else {
+		st.log.Info("Skipping network setup for %s networking", st.profile.Networking.Nettype)
 	}
 	network.NetPrint(st.log)
 
-	if syscall.Sethostname([]byte(st.profile.Name)) != nil {
-		st.log.Error("Failed to set hostname to (%s)", st.profile.Name)
-		os.Exit(1)
-	}
-	if syscall.Setdomainname([]byte("local")) != nil {
-		st.log.Error("Failed to set domainname")
+	if st.profile.PreserveHostname {
+		if name, err := os.Hostname(); err == nil {
+			st.hostname = name
+		}
+		st.log.Info("Hostname (%s) preserved", st.hostname)
+	} else {
+		if syscall.Sethostname([]byte(st.hostname)) != nil {
+			st.log.Error("Failed to set hostname to (%s)", st.hostname)
+			os.Exit(1)
+		}
+		if syscall.Setdomainname([]byte("local")) != nil {
+			st.log.Error("Failed to set domainname")
+		}
+		st.log.Info("Hostname set to (%s.local)", st.hostname)
 	}
-	st.log.Info("Hostname set to (%s.local)", st.profile.Name)
 
 	if err := st.setupDbus(); err != nil {
 		st.log.Error("Unable to setup dbus: %v", err)
@@ -237,16 +451,34 @@ func (st *initState) runInit() {
 
 	st.setupEtcFiles()
 
+	if st.profile.LogToFile != "" {
+		st.openOutputLog()
+	}
+
+	// Before the reaper, which would otherwise collect the script status
+	if st.profile.SetupScript != "" {
+		if err := st.runSetupScript(); err != nil {
+			st.log.Error("%v", err)
+			os.Exit(1)
+		}
+	}
+
 	oz.ReapChildProcs(st.log, st.handleChildExit)
 
-	if st.profile.XServer.Enabled {
+	if st.profile.XServer.UsesXpra() {
 		st.xpraReady.Add(1)
 		st.startXpraServer()
 		st.xpraReady.Wait()
 		st.log.Info("XPRA started")
+	} else if st.profile.XServer.IsDirect() {
+		st.log.Warning("Using the host X11 display :%d directly, programs are not isolated from the other X11 clients", st.display)
+	} else if st.profile.XServer.IsWayland() {
+		st.log.Warning("Using the host Wayland compositor (%s) directly, programs are not isolated from its other clients", st.waylandDisplay)
 	}
 
-	if st.needsDbus() {
+	if st.needsDbus() && st.profile.DisableDbusSession {
+		st.log.Warning("Not starting a dbus session as disabled by the profile, features relying on the session bus may not work")
+	} else if st.needsDbus() {
 		if err := st.getDbusSession(); err != nil {
 			st.log.Error("Unable to get dbus session information: %v", err)
 			os.Exit(1)
@@ -276,22 +508,37 @@ func (st *initState) addSharedFolders(wlExtras []oz.WhitelistItem) []oz.Whitelis
 			st.log.Warning("Failed to resolve path for symliunk: " + sf)
 			continue
 		}
-		if strings.HasPrefix(spath, st.user.HomeDir) {
-			spath = strings.Replace(spath, st.user.HomeDir, "", 1)
-		}
-		dname := strings.Replace(spath, "/", "-", -1)
-		if strings.HasPrefix(dname, "-") {
-			dname = strings.Replace(dname, "-", "", 1)
-		}
-		wlExtras = append(wlExtras, oz.WhitelistItem{
-			Path:      path.Join("${HOME}/OZ", strings.Title(st.profile.Name), dname),
-			Target:    path.Join("${HOME}/.shared/", dname),
-			Symlink:   path.Join("${HOME}", spath),
-			CanCreate: true})
+		wlExtras = append(wlExtras, sharedFolderItem(spath, st.user.HomeDir, st.profile.Name))
 	}
 	return wlExtras
 }
 
+// sharedFolderItem returns the whitelist item sharing the folder spath of the
+// sandbox with ${HOME}/OZ/<Profile> on the host. Folders outside of the home
+// directory go to an external subdirectory named after their base name, or
+// after their whole path when it has none.
+func sharedFolderItem(spath, home, profileName string) oz.WhitelistItem {
+	spath = path.Clean(spath)
+	if spath == home || strings.HasPrefix(spath, home+"/") {
+		rpath := strings.TrimPrefix(spath, home)
+		dname := strings.TrimPrefix(strings.Replace(rpath, "/", "-", -1), "-")
+		return oz.WhitelistItem{
+			Path:      path.Join("${HOME}/OZ", strings.Title(profileName), dname),
+			Target:    path.Join("${HOME}/.shared/", dname),
+			Symlink:   path.Join("${HOME}", rpath),
+			CanCreate: true}
+	}
+	dname := path.Base(spath)
+	if dname == "/" || dname == "." {
+		dname = "root"
+	}
+	return oz.WhitelistItem{
+		Path:      path.Join("${HOME}/OZ", strings.Title(profileName), "external", dname),
+		Target:    path.Join("${HOME}/.shared/external", dname),
+		Symlink:   spath,
+		CanCreate: true}
+}
+
 const hostsfile = `127.0.0.1	localhost
 127.0.1.1	%HOSTNAME% %HOSTNAME%.%DOMAINNAME%
 ::1     localhost ip6-localhost ip6-loopback
@@ -301,30 +548,115 @@ ff02::2 ip6-allrouters
 
 const domainname = "local"
 
-func (st *initState) setupEtcFiles() {
+func (st *initState) hostsContent(hostname string) string {
 	phosts := st.profile.Networking.Hosts
 	if len(phosts) > 0 {
 		phosts = "\n\n" + phosts
 	}
 	hosts := hostsfile
-	hosts = strings.Replace(hosts, "%HOSTNAME%", st.profile.Name, -1)
+	hosts = strings.Replace(hosts, "%HOSTNAME%", hostname, -1)
 	hosts = strings.Replace(hosts, "%DOMAINNAME%", domainname, -1)
 	hosts = strings.Replace(hosts, "\n%ADDITIONAL%", phosts, -1)
+	return hosts
+}
+
+func (st *initState) setupEtcFiles() {
+	st.writeEtcFiles("/etc")
+}
+
+// etcFiles returns the content of the files written in /etc, by name
+func (st *initState) etcFiles() map[string]string {
 	etcfiles := map[string]string{
-		"hostname":   st.profile.Name,
+		"hostname":   st.hostname,
 		"domainname": domainname,
-		"hosts":      hosts,
+		"hosts":      st.hostsContent(st.hostname),
 		"machine-id": st.dbusUuid,
 		"fstab":      "# This fstab file is empty",
 	}
-	for fpath, fcontents := range etcfiles {
-		fpath = path.Join("/etc", fpath)
+	if st.profile.PreserveHostname {
+		delete(etcfiles, "hostname")
+		delete(etcfiles, "domainname")
+	}
+	if st.config.MinimalPasswd {
+		etcfiles["passwd"] = minimalPasswd(st.user, st.uid, st.gid, st.config.ShellPath)
+		etcfiles["group"] = minimalGroup(st.user.Username, st.gid, st.gids)
+	}
+	return etcfiles
+}
+
+// writeEtcFiles writes the etc files in dir
+func (st *initState) writeEtcFiles(dir string) {
+	for fpath, fcontents := range st.etcFiles() {
+		fpath = path.Join(dir, fpath)
 		if err := ioutil.WriteFile(fpath, []byte(fcontents+"\n"), 0644); err != nil {
 			st.log.Warning("Unable to setup etc file item: %v", err)
 		}
 	}
 }
 
+// minimalPasswd returns the content of an /etc/passwd listing only root,
+// nobody and the sandbox user u, so that the host accounts cannot be
+// enumerated from the sandbox.
+func minimalPasswd(u *user.User, uid, gid uint32, shell string) string {
+	return strings.Join([]string{
+		"root:x:0:0:root:/root:/usr/sbin/nologin",
+		fmt.Sprintf("%s:x:%d:%d:%s:%s:%s", u.Username, uid, gid, u.Name, u.HomeDir, shell),
+		"nobody:x:65534:65534:nobody:/nonexistent:/usr/sbin/nologin",
+	}, "\n")
+}
+
+// minimalGroup returns the content of an /etc/group listing only root,
+// nogroup, the primary group of the sandbox user, named after the user unless
+// it is one of gids, and the groups allowed in the sandbox with the user as
+// member.
+func minimalGroup(username string, gid uint32, gids map[string]uint32) string {
+	lines := []string{"root:x:0:"}
+	primary := username
+	names := []string{}
+	for name, g := range gids {
+		if g == gid {
+			primary = name
+		} else if g != 0 && g != 65534 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	lines = append(lines, fmt.Sprintf("%s:x:%d:", primary, gid))
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%s:x:%d:%s", name, gids[name], username))
+	}
+	lines = append(lines, "nogroup:x:65534:")
+	return strings.Join(lines, "\n")
+}
+
+var hostnameLabelRe = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// isValidHostname reports whether name is a single legal DNS label
+func isValidHostname(name string) bool {
+	return hostnameLabelRe.MatchString(name)
+}
+
+// setHostname changes the hostname of the sandbox and rewrites the etc
+// files which contain it.
+func (st *initState) setHostname(name string) error {
+	if !isValidHostname(name) {
+		return fmt.Errorf("invalid hostname '%s'", name)
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if err := syscall.Sethostname([]byte(name)); err != nil {
+		return fmt.Errorf("failed to set hostname: %v", err)
+	}
+	if err := ioutil.WriteFile("/etc/hostname", []byte(name+"\n"), 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile("/etc/hosts", []byte(st.hostsContent(name)+"\n"), 0644); err != nil {
+		return err
+	}
+	st.hostname = name
+	return nil
+}
+
 func (st *initState) needsDbus() bool {
 	return (st.profile.XServer.AudioMode == oz.PROFILE_AUDIO_FULL ||
 		st.profile.XServer.AudioMode == oz.PROFILE_AUDIO_SPEAKER ||
@@ -342,7 +674,27 @@ func (st *initState) setupDbus() error {
 	return nil
 }
 
+// getDbusSession starts the session bus of the sandbox with dbus-launch and
+// adds its address to the environment, retrying a few times as dbus-launch
+// occasionally fails transiently.
 func (st *initState) getDbusSession() error {
+	for attempt := 1; ; attempt++ {
+		dbusenv, err := st.runDbusLaunch()
+		if err == nil {
+			st.launchEnv = append(st.launchEnv, dbusenv)
+			vv := strings.SplitN(dbusenv, "=", 2)
+			os.Setenv(vv[0], vv[1])
+			return nil
+		}
+		if attempt == dbusLaunchAttempts {
+			return err
+		}
+		st.log.Warning("dbus-launch attempt %d of %d failed, retrying: %v", attempt, dbusLaunchAttempts, err)
+		time.Sleep(dbusLaunchRetryDelay)
+	}
+}
+
+func (st *initState) runDbusLaunch() (string, error) {
 	args := []string{
 		"--autolaunch",
 		st.dbusUuid,
@@ -359,27 +711,39 @@ func (st *initState) getDbusSession() error {
 	}
 
 	benvs, err := dcmd.Output()
-	if err != nil && len(benvs) <= 1 {
-		return fmt.Errorf("dbus-launch failed: %v %v", err, string(benvs))
-	}
-	benvs = bytes.Trim(benvs, "\x00")
-	senvs := strings.TrimSpace(string(benvs))
-	senvs = strings.Replace(senvs, "export ", "", -1)
-	senvs = strings.Replace(senvs, ";", "", -1)
-	senvs = strings.Replace(senvs, "'", "", -1)
-	dbusenv := ""
-	for _, line := range strings.Split(senvs, "\n") {
-		if dbusValidVar.MatchString(line) {
-			dbusenv = line
-			break
-		}
-	}
-	if dbusenv != "" {
-		st.launchEnv = append(st.launchEnv, dbusenv)
-		vv := strings.Split(dbusenv, "=")
-		os.Setenv(vv[0], strings.Join(vv[1:], "="))
+	dbusenv, perr := parseDbusLaunch(benvs)
+	if perr != nil {
+		if err != nil {
+			return "", fmt.Errorf("dbus-launch failed: %v %v", err, string(benvs))
+		}
+		return "", perr
 	}
-	return nil
+	return dbusenv, nil
+}
+
+// parseDbusLaunch returns the DBUS_SESSION_BUS_ADDRESS variable assignment
+// from the shell syntax output of dbus-launch, in whatever order and spacing
+// the variables are printed.
+func parseDbusLaunch(out []byte) (string, error) {
+	out = bytes.Trim(out, "\x00")
+	for _, line := range strings.Split(string(out), "\n") {
+		for _, stmt := range strings.Split(line, ";") {
+			stmt = strings.TrimSpace(stmt)
+			stmt = strings.TrimSpace(strings.TrimPrefix(stmt, "export "))
+			kv := strings.SplitN(stmt, "=", 2)
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) != "DBUS_SESSION_BUS_ADDRESS" {
+				continue
+			}
+			val := strings.TrimSpace(kv[1])
+			if len(val) >= 2 && (val[0] == '\'' || val[0] == '"') && val[len(val)-1] == val[0] {
+				val = val[1 : len(val)-1]
+			}
+			if val != "" {
+				return "DBUS_SESSION_BUS_ADDRESS=" + val, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no session bus address in dbus-launch output %q", out)
 }
 
 func (st *initState) startXpraServer() {
@@ -405,7 +769,7 @@ func (st *initState) startXpraServer() {
 	xpra.Process.Env = []string{
 		"HOME=" + st.user.HomeDir,
 	}
-	xpra.Process.Env = setEnvironOverrides(xpra.Process.Env)
+	xpra.Process.Env = append(xpra.Process.Env, st.envOverrides...)
 
 	groups := append([]uint32{}, st.gid)
 	if gid, gexists := st.gids["video"]; gexists {
@@ -426,35 +790,78 @@ func (st *initState) startXpraServer() {
 	st.log.Info("Starting xpra server")
 	if err := xpra.Process.Start(); err != nil {
 		st.log.Warning("Failed to start xpra server: %v", err)
-		st.xpraReady.Done()
+		st.xpraReadyDone()
 	}
 	st.xpra = xpra
 }
 
+// xpraReadyDone releases the wait for xpra startup, both a failure to start
+// and the end of xpra output may do so, hence the once.
+func (st *initState) xpraReadyDone() {
+	st.xpraReadyOnce.Do(st.xpraReady.Done)
+}
+
 func (st *initState) readXpraOutput(r io.ReadCloser) {
 	sc := bufio.NewScanner(r)
 	seenReady := false
+	autoReconnect := st.profile.XServer.AutoReconnect
 	for sc.Scan() {
 		line := sc.Text()
 		if len(line) > 0 {
 			//if strings.Contains(line, "_OZ_XXSTARTEDXX") &&
 			//	strings.Contains(line, "has terminated") && !seenReady {
-			if strings.Contains(line, "xpra is ready.") && !seenReady {
+			if !seenReady && xpra.IsReadyLine(line, st.config.XpraReadyPatterns) {
 				seenReady = true
-				st.xpraReady.Done()
-				if !st.config.LogXpra {
+				st.xpraReadyDone()
+				if !st.config.LogXpra && !autoReconnect {
 					r.Close()
 					return
 				}
 			}
+			if seenReady && autoReconnect && xpra.IsClientDisconnectedLine(line) {
+				st.log.Info("xpra client disconnected, asking the daemon to reattach it")
+				os.Stderr.WriteString(XpraClientLostLine + "\n")
+			}
 			if st.config.LogXpra {
 				st.log.Debug("(xpra-server) %s", line)
 			}
 		}
 	}
+	if !seenReady {
+		st.log.Warning("xpra output ended before the server was seen ready")
+		st.xpraReadyDone()
+	}
+}
+
+// seccompBinary returns the oz-seccomp binary applying the policy of p, which
+// when overridden by the profile must be an executable file in the sandbox
+// that only root can replace.
+func (st *initState) seccompBinary(p *oz.Profile) (string, error) {
+	if p.Seccomp.BinaryPath == "" {
+		return path.Join(st.config.PrefixPath, "bin", "oz-seccomp"), nil
+	}
+	if err := oz.CheckRootExecutable(p.Seccomp.BinaryPath); err != nil {
+		return "", fmt.Errorf("invalid seccomp binary_path of profile %s: %v", p.Name, err)
+	}
+	return p.Seccomp.BinaryPath, nil
 }
 
-func (st *initState) launchApplication(cpath, pwd string, cmdArgs []string) (*exec.Cmd, error) {
+// launchApplication starts a program in the sandbox. When interactive its
+// stdin pipe is kept open to be written to with WriteStdin.
+func (st *initState) launchApplication(cpath, pwd string, cmdArgs []string, fds []int, seccompMode oz.SeccompMode, interactive, stdinFd bool, waiter *ipc.Message) (*exec.Cmd, error) {
+	// Our copies of the passed descriptors must be closed once the child
+	// has them (or failed to start), otherwise they leak into init and are
+	// inherited by every program launched after it.
+	var passed []*os.File
+	for _, fd := range fds {
+		passed = append(passed, os.NewFile(uintptr(fd), ""))
+	}
+	defer func() {
+		for _, f := range passed {
+			f.Close()
+		}
+	}()
+
 	if cpath == "" {
 		cpath = st.profile.Path
 	}
@@ -472,66 +879,137 @@ func (st *initState) launchApplication(cpath, pwd string, cmdArgs []string) (*ex
 		cmdArgs = append(st.profile.DefaultParams, cmdArgs...)
 	}
 
-	switch st.profile.Seccomp.Mode {
+	profile := st.profile
+	if seccompMode != "" && seccompMode != profile.Seccomp.Mode {
+		st.log.Notice("Overriding seccomp mode of %s from %s to %s for this launch", cpath, profile.Seccomp.Mode, seccompMode)
+		p := *st.profile
+		p.Seccomp.Mode = seccompMode
+		profile = &p
+	}
+
+	snapshot := ""
+	spath := ""
+	// Whether the program runs under oz-seccomp-tracer
+	traced := false
+	if profile.Seccomp.Mode != oz.PROFILE_SECCOMP_DISABLED {
+		var err error
+		if spath, err = st.seccompBinary(profile); err != nil {
+			return nil, err
+		}
+	}
+	switch profile.Seccomp.Mode {
 	case oz.PROFILE_SECCOMP_TRAIN:
 		st.log.Notice("Enabling seccomp training mode for : %s", cpath)
-		spath := path.Join(st.config.PrefixPath, "bin", "oz-seccomp")
+		st.lock.Lock()
+		st.snapshotCount++
+		snapshot = path.Join(st.user.HomeDir, fmt.Sprintf("%s-%d.snapshot.seccomp", st.profile.Name, st.snapshotCount))
+		st.lock.Unlock()
 		cmdArgs = append([]string{spath, "-mode=whitelist", cpath}, cmdArgs...)
 		cpath = path.Join(st.config.PrefixPath, "bin", "oz-seccomp-tracer")
+		traced = true
 	case oz.PROFILE_SECCOMP_WHITELIST:
 		st.log.Notice("Enabling seccomp whitelist for: %s", cpath)
-		if st.profile.Seccomp.Enforce == false {
-			spath := path.Join(st.config.PrefixPath, "bin", "oz-seccomp")
+		if profile.Seccomp.Enforce == false {
 			cmdArgs = append([]string{"-r", "-p", "-", spath, "-mode=whitelist", cpath}, cmdArgs...)
 			cpath = path.Join(st.config.PrefixPath, "bin", "oz-seccomp-tracer")
+			traced = true
 			 
 		} else {
 			cmdArgs = append([]string{"-mode=whitelist", cpath}, cmdArgs...)
-			cpath = path.Join(st.config.PrefixPath, "bin", "oz-seccomp")
+			cpath = spath
 		}
 	case oz.PROFILE_SECCOMP_BLACKLIST:
 		st.log.Notice("Enabling seccomp blacklist for: %s", cpath)
-		if st.profile.Seccomp.Enforce == false {
-			spath := path.Join(st.config.PrefixPath, "bin", "oz-seccomp")
+		if profile.Seccomp.Enforce == false {
 			cmdArgs = append([]string{spath, "-mode=blacklist", cpath}, cmdArgs...)
 			cpath = path.Join(st.config.PrefixPath, "bin", "oz-seccomp-tracer")
+			traced = true
 		} else {
 			cmdArgs = append([]string{"-mode=blacklist", cpath}, cmdArgs...)
-			cpath = path.Join(st.config.PrefixPath, "bin", "oz-seccomp")
+			cpath = spath
 		}
 	}
 
-	cmd := exec.Command(cpath)
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		st.log.Warning("Failed to create stdout pipe: %v", err)
-		return nil, err
+	// The seccomp modes other than disabled take the profile from stdin
+	if interactive && profile.Seccomp.Mode != oz.PROFILE_SECCOMP_DISABLED {
+		return nil, fmt.Errorf("interactive programs cannot be run with seccomp mode %s", profile.Seccomp.Mode)
+	}
+	// With stdinFd the first passed descriptor is the stdin of the program,
+	// which otherwise reads from the null device
+	extra := passed
+	var stdinFile *os.File
+	if stdinFd {
+		switch {
+		case len(passed) == 0:
+			return nil, fmt.Errorf("no descriptor passed for stdin")
+		case interactive || st.profile.NeedsPty:
+			return nil, fmt.Errorf("stdin cannot be passed to an interactive or pty program")
+		case profile.Seccomp.Mode != oz.PROFILE_SECCOMP_DISABLED:
+			return nil, fmt.Errorf("stdin cannot be passed to programs run with seccomp mode %s", profile.Seccomp.Mode)
+		}
+		stdinFile, extra = passed[0], passed[1:]
 	}
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		st.log.Warning("Failed to create stderr pipe: %v", err)
-		return nil, err
+
+	cmd := exec.Command(cpath)
+	if stdinFile != nil {
+		cmd.Stdin = stdinFile
+	}
+	var stdin io.WriteCloser
+	if interactive {
+		var err error
+		if stdin, err = cmd.StdinPipe(); err != nil {
+			return nil, fmt.Errorf("error creating stdin pipe: %v", err)
+		}
 	}
-	groups := append([]uint32{}, st.gid)
-	for _, gid := range st.gids {
-		groups = append(groups, gid)
+	// When output is discarded stdout and stderr are left unset, which
+	// connects them to the null device
+	var stdout, stderr io.ReadCloser
+	if !st.profile.DiscardOutput && !st.profile.NeedsPty {
+		var err error
+		stdout, err = cmd.StdoutPipe()
+		if err != nil {
+			st.log.Warning("Failed to create stdout pipe: %v", err)
+			return nil, err
+		}
+		stderr, err = cmd.StderrPipe()
+		if err != nil {
+			st.log.Warning("Failed to create stderr pipe: %v", err)
+			return nil, err
+		}
 	}
 	cmd.SysProcAttr = &syscall.SysProcAttr{}
 	cmd.SysProcAttr.Credential = &syscall.Credential{
 		Uid:    st.uid,
 		Gid:    st.gid,
-		Groups: groups,
+		Groups: st.programGroups(),
 	}
-	cmd.Env = setEnvironOverrides(cmd.Env)
+	cmd.Env = append(cmd.Env, st.envOverrides...)
 	cmd.Env = append(cmd.Env, st.launchEnv...)
+	if st.profile.Locale != "" {
+		cmd.Env = append(cmd.Env, "LANG="+st.profile.Locale)
+	}
+	if st.profile.LcAll != "" {
+		cmd.Env = append(cmd.Env, "LC_ALL="+st.profile.LcAll)
+	}
+	if snapshot != "" {
+		cmd.Env = append(cmd.Env, oz.SeccompSnapshotEnv+"="+snapshot)
+	}
+	if len(extra) > 0 {
+		cmd.ExtraFiles = extra
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", PassedFdsEnv, len(extra)))
+	}
 
-	if st.profile.Seccomp.Mode == oz.PROFILE_SECCOMP_WHITELIST ||
-		st.profile.Seccomp.Mode == oz.PROFILE_SECCOMP_BLACKLIST || st.profile.Seccomp.Mode == oz.PROFILE_SECCOMP_TRAIN {
+	if profile.Seccomp.Mode == oz.PROFILE_SECCOMP_WHITELIST ||
+		profile.Seccomp.Mode == oz.PROFILE_SECCOMP_BLACKLIST || profile.Seccomp.Mode == oz.PROFILE_SECCOMP_TRAIN {
+		if st.profile.NeedsPty {
+			// stdin carries the profile, oz-seccomp switches to the pty after
+			cmd.Env = append(cmd.Env, oz.SeccompTtyEnv+"=1")
+		}
 		pi, err := cmd.StdinPipe()
 		if err != nil {
 			return nil, fmt.Errorf("error creating stdin pipe for seccomp process: %v", err)
 		}
-		jdata, err := json.Marshal(st.profile)
+		jdata, err := json.Marshal(profile)
 		if err != nil {
 			return nil, fmt.Errorf("Unable to marshal seccomp state: %+v", err)
 		}
@@ -548,19 +1026,144 @@ func (st *initState) launchApplication(cpath, pwd string, cmdArgs []string) (*ex
 		cmd.Dir = pwd
 	}
 
-	if err := cmd.Start(); err != nil {
+	// The tracer reports the denied syscalls on a pipe of its own, which the
+	// program cannot write to, after the passed descriptors
+	var hits *os.File
+	if traced {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, fmt.Errorf("error creating seccomp hits pipe: %v", err)
+		}
+		defer w.Close()
+		hits = r
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", oz.SeccompHitsFdEnv, 3+len(cmd.ExtraFiles)))
+		cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+	}
+
+	start := cmd.Start
+	var ptty *os.File
+	if st.profile.NeedsPty {
+		start = func() (err error) {
+			ptty, err = ptyStart(cmd)
+			return err
+		}
+	}
+	if caps := st.profile.BoundingCapsDrop(oz.LastCapability()); len(caps) > 0 {
+		startCmd := start
+		start = func() error {
+			return startWithoutCaps(startCmd, caps)
+		}
+	}
+	// st.lock is held from the start of the program until it is registered,
+	// so that the reaper cannot handle its exit before, waiter included
+	st.lock.Lock()
+	if st.paused {
+		st.lock.Unlock()
+		if hits != nil {
+			hits.Close()
+		}
+		return nil, fmt.Errorf("sandbox is paused")
+	}
+	if err := st.startWithUmask(start); err != nil {
+		st.lock.Unlock()
 		st.log.Warning("Failed to start application (%s): %v", st.profile.Path, err)
+		if hits != nil {
+			hits.Close()
+		}
 		return nil, err
 	}
-	st.addChildProcess(cmd, true)
+	st.addChild(cmd, true)
+	if ptty != nil {
+		st.appPtys[cmd.Process.Pid] = ptty
+	}
+	if stdin != nil {
+		st.stdinPipes[cmd.Process.Pid] = stdin
+	}
+	if snapshot != "" {
+		st.seccompSnapshots[cmd.Process.Pid] = snapshot
+	}
+	if waiter != nil {
+		st.exitWaiters[cmd.Process.Pid] = waiter
+	}
+	st.lock.Unlock()
 
-	go st.readApplicationOutput(stdout, "stdout")
-	go st.readApplicationOutput(stderr, "stderr")
+	if hits != nil {
+		pid := cmd.Process.Pid
+		go st.seccompStats.readHits(hits, func() { st.seccompSnapshotWritten(pid) }, st.log)
+	}
+	if stdout != nil {
+		pid := cmd.Process.Pid
+		st.outputFollowers.open(pid)
+		var output sync.WaitGroup
+		output.Add(2)
+		go func() {
+			st.readApplicationOutput(stdout, "stdout", pid)
+			output.Done()
+		}()
+		go func() {
+			st.readApplicationOutput(stderr, "stderr", pid)
+			output.Done()
+		}()
+		go func() {
+			output.Wait()
+			st.outputFollowers.close(pid)
+		}()
+	}
 
 	return cmd, nil
 }
 
-func setEnvironOverrides(env []string) []string {
+// programGroups returns the primary and supplementary groups of the programs
+// launched in the sandbox: all the allowed groups, or only those listed in
+// the groups of the profile, with video and audio added when the xserver and
+// audio settings need them like for the xpra server.
+func (st *initState) programGroups() []uint32 {
+	groups := append([]uint32{}, st.gid)
+	seen := map[uint32]bool{st.gid: true}
+	add := func(gid uint32) {
+		if !seen[gid] {
+			seen[gid] = true
+			groups = append(groups, gid)
+		}
+	}
+	if len(st.profile.Groups) == 0 {
+		for _, gid := range st.gids {
+			add(gid)
+		}
+	} else {
+		names := append([]string{}, st.profile.Groups...)
+		if st.profile.XServer.Enabled {
+			names = append(names, "video")
+			if st.profile.XServer.AudioMode != oz.PROFILE_AUDIO_NONE {
+				names = append(names, "audio")
+			}
+		}
+		for _, name := range names {
+			if gid, ok := st.gids[name]; ok {
+				add(gid)
+			}
+		}
+	}
+	// Groups owning the devices of the profile
+	for _, gid := range st.deviceGids {
+		add(gid)
+	}
+	return groups
+}
+
+// userGroups returns the groups of the programs as the ids taken by asUser
+func (st *initState) userGroups() []int {
+	groups := []int{}
+	for _, gid := range st.programGroups() {
+		groups = append(groups, int(gid))
+	}
+	return groups
+}
+
+// environOverrides returns the OZ_ variables of the init environment, which
+// are forwarded to the sandboxed processes
+func environOverrides() []string {
+	env := []string{}
 	for _, evar := range os.Environ() {
 		if strings.HasPrefix(evar, "OZ_") {
 			env = append(env, evar)
@@ -569,97 +1172,1165 @@ func setEnvironOverrides(env []string) []string {
 	return env
 }
 
-func (st *initState) readApplicationOutput(r io.ReadCloser, label string) {
-	sc := bufio.NewScanner(r)
-	for sc.Scan() {
-		line := sc.Text()
-		st.log.Debug("(%s) %s", label, line)
-
+// redactEnv returns a copy of env with the values replaced, keeping only
+// the variable names
+func redactEnv(env []string) []string {
+	r := make([]string, len(env))
+	for i, evar := range env {
+		r[i] = strings.SplitN(evar, "=", 2)[0] + "=" + redactedValue
 	}
-
+	return r
 }
 
-func loadProfile(dir, name string) (*oz.Profile, error) {
-	ps, err := oz.LoadProfiles(dir)
-	if err != nil {
-		return nil, err
+const redactedValue = "<redacted>"
+
+// runSetupScript runs the setup script of the profile as the sandbox user and
+// waits for it, logging its output.
+func (st *initState) runSetupScript() error {
+	st.log.Info("Running setup script %s", st.profile.SetupScript)
+	cmd := exec.Command(st.profile.SetupScript)
+	cmd.Env = append([]string{}, st.launchEnv...)
+	if st.user != nil {
+		cmd.Dir = st.user.HomeDir
 	}
-	for _, p := range ps {
-		if name == p.Name {
-			return p, nil
-		}
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid:    st.uid,
+		Gid:    st.gid,
+		Groups: st.programGroups(),
 	}
-	return nil, fmt.Errorf("no profile named '%s'", name)
-}
-
-func handlePing(ping *PingMsg, msg *ipc.Message) error {
-	return msg.Respond(&PingMsg{Data: ping.Data})
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := st.startWithUmask(cmd.Start)
+	if err == nil {
+		err = cmd.Wait()
+	}
+	sc := bufio.NewScanner(&out)
+	for sc.Scan() {
+		st.log.Info("(setup) %s", sc.Text())
+	}
+	if err != nil {
+		return fmt.Errorf("setup script %s failed: %v", st.profile.SetupScript, err)
+	}
+	return nil
 }
 
-func (st *initState) handleSetupForwarder(rp *ForwarderSuccessMsg, msg *ipc.Message) error {
-	st.log.Info("Setting up forwarder to: %s", rp.Addr)
-	if len(msg.Fds) == 0 {
-		return fmt.Errorf("SetupForwarder message received, but no file descriptor included")
+func (st *initState) readApplicationOutput(r io.ReadCloser, label string, pid int) {
+	max := st.config.MaxLogLineBytes
+	if max <= 0 {
+		max = oz.DefaultMaxLogLineBytes
 	}
-	go func() {
-		f := os.NewFile(uintptr(msg.Fds[0]), "")
-		l, err := net.FileListener(f)
-		if err != nil {
-			st.log.Warning(err.Error())
-			return
-		}
-		for {
-			conn, err := l.Accept()
-			if err != nil {
-				st.log.Error(err.Error())
-			}
-			st.log.Info("Forwarder to accepted incoming client.", rp.Addr)
-			go proxyForwarder(&conn, rp.Proto, rp.Addr)
+	err := readLines(r, max, func(line string, truncated bool) {
+		if truncated {
+			st.log.Notice("(%s) line longer than %d bytes truncated", label, max)
 		}
-	}()
-	err := msg.Respond(&OkMsg{})
-	return err
+		st.log.Debug("(%s) %s", label, line)
+		st.writeOutputLog(line)
+		st.outputFollowers.send(pid, line)
+	})
+	if err != nil {
+		st.log.Warning("Error reading application %s: %v", label, err)
+	}
 }
 
-func proxyForwarder(conn *net.Conn, proto string, rAddr string) error {
-	rConn, err := net.Dial(proto, rAddr)
+// openOutputLog creates the log_to_file of the profile for the sandbox user,
+// the output of programs not being written to a file if it fails.
+func (st *initState) openOutputLog() {
+	fpath, err := fs.ResolvePathNoGlob(st.profile.LogToFile, st.display, st.user, st.fs.GetXDGDirs(), st.profile)
+	if err == nil && !path.IsAbs(fpath) {
+		err = fmt.Errorf("not an absolute path")
+	}
 	if err != nil {
-		return fmt.Errorf("Socket: %+v.\n", err)
+		st.log.Warning("Invalid log_to_file %s: %v", st.profile.LogToFile, err)
+		return
 	}
-
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	copyLoop := func(dst, src net.Conn) {
-		defer wg.Done()
-		defer dst.Close()
-		io.Copy(dst, src)
+	f, err := createUserFile(fpath, int(st.uid), int(st.gid))
+	if err != nil {
+		st.log.Warning("Program output will not be written to %s: %v", fpath, err)
+		return
 	}
-
-	go copyLoop(*conn, rConn)
-	go copyLoop(rConn, *conn)
-
-	return nil
+	st.log.Info("Writing program output to %s", fpath)
+	st.outputLogLock.Lock()
+	st.outputLog = f
+	st.outputLogLock.Unlock()
 }
 
-func (st *initState) handleRunProgram(rp *RunProgramMsg, msg *ipc.Message) error {
-	st.log.Info("Run program message received: %+v", rp)
-	_, err := st.launchApplication(rp.Path, rp.Pwd, rp.Args)
-	if err != nil {
-		err := msg.Respond(&ErrorMsg{Msg: err.Error()})
-		return err
-	} else {
-		err := msg.Respond(&OkMsg{})
-		return err
+// writeOutputLog appends a line of program output to the log_to_file, which
+// is given up after a write error such as a full filesystem.
+func (st *initState) writeOutputLog(line string) {
+	st.outputLogLock.Lock()
+	defer st.outputLogLock.Unlock()
+	if st.outputLog == nil {
+		return
+	}
+	if _, err := io.WriteString(st.outputLog, line+"\n"); err != nil {
+		st.log.Warning("Stopped writing program output to file: %v", err)
+		st.outputLog.Close()
+		st.outputLog = nil
 	}
 }
 
-func (st *initState) handleRunShell(rs *RunShellMsg, msg *ipc.Message) error {
-	if msg.Ucred == nil {
-		return msg.Respond(&ErrorMsg{"No credentials received for RunShell command"})
+// createUserFile creates or truncates fpath and its missing parent
+// directories as uid and gid, so that symlinks the user planted in the path
+// are only followed with the permissions of the user. Only a regular file is
+// truncated, the user could otherwise have a special file such as a fifo
+// opened by init.
+func createUserFile(fpath string, uid, gid int) (f *os.File, err error) {
+	err = asUser(uid, gid, nil, func() error {
+		if err := os.MkdirAll(path.Dir(fpath), 0755); err != nil {
+			return err
+		}
+		if fi, err := os.Lstat(fpath); err == nil && !fi.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file", fpath)
+		}
+		f, err = os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, 0600)
+		return err
+	})
+	return f, err
+}
+
+// mkdirUser creates the directory dir and its missing parents as uid and
+// gid, like createUserFile.
+func mkdirUser(dir string, uid, gid int) error {
+	return asUser(uid, gid, nil, func() error {
+		return os.MkdirAll(dir, 0755)
+	})
+}
+
+// caCertItems returns read-only whitelist items for the caCertPaths of the
+// host which exist, except those already bound by the etc includes.
+func caCertItems(etcIncludes []string) []oz.WhitelistItem {
+	var items []oz.WhitelistItem
+	for _, p := range caCertPaths {
+		included := false
+		for _, inc := range etcIncludes {
+			if inc = path.Clean(inc); p == inc || strings.HasPrefix(p, inc+"/") {
+				included = true
+				break
+			}
+		}
+		if _, err := os.Stat(p); included || err != nil {
+			continue
+		}
+		items = append(items, oz.WhitelistItem{Path: p, ReadOnly: true})
+	}
+	return items
+}
+
+// expandEnvironment replaces the variables, such as ${HOME} or ${UID}, in the
+// values the environment of the profile sets, which are passed unexpanded by
+// the daemon. Every occurrence is replaced wherever it is in the value, which
+// is otherwise kept as is.
+func (st *initState) expandEnvironment() {
+	static := make(map[string]bool)
+	for _, ev := range st.profile.Environment {
+		if ev.Name != "" && ev.Value != "" {
+			static[ev.Name] = true
+		}
+	}
+	vars := st.environmentVars()
+	for i, e := range st.launchEnv {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || !static[kv[0]] || !strings.Contains(kv[1], "${") {
+			continue
+		}
+		v := kv[1]
+		for name, value := range vars {
+			v = strings.Replace(v, name, value, -1)
+		}
+		st.launchEnv[i] = kv[0] + "=" + v
+	}
+}
+
+// environmentVars returns the values of the variables of the bind lists
+// expanded in the environment of the profile, ${PATH} excepted.
+func (st *initState) environmentVars() map[string]string {
+	vars := map[string]string{
+		"${SANDBOXNAME}": st.profile.Name,
+		"${DISPLAY}":     strconv.Itoa(st.display),
+	}
+	if st.user != nil {
+		vars["${HOME}"] = st.user.HomeDir
+		vars["${UID}"] = st.user.Uid
+		vars["${USER}"] = st.user.Username
+	}
+	if dirs := st.fs.GetXDGDirs(); dirs != nil {
+		for name := range dirs.GetDirs() {
+			if dir := dirs.GetDir(name); dir != "" {
+				vars["${XDG_"+name+"_DIR}"] = dir
+			}
+		}
+	}
+	return vars
+}
+
+// runtimeDir returns the runtime directory of the sandbox user
+func (st *initState) runtimeDir() string {
+	return path.Join("/run/user", strconv.FormatUint(uint64(st.uid), 10))
+}
+
+// createRuntimeDir creates the runtime directory dir of the user uid with mode
+// 0700 if it is missing, for instance hidden by a mount over /run. Its parent
+// directories are created owned by root.
+func createRuntimeDir(dir string, uid, gid int) error {
+	if err := os.MkdirAll(path.Dir(dir), 0755); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	}
+	return os.Chown(dir, uid, gid)
+}
+
+// readLines calls fn with each line read from r until EOF. The lines longer
+// than max bytes are cut to their first max bytes with truncated set, the
+// rest of the line being skipped, so that reading goes on and the writer is
+// never left blocked on a full pipe.
+func readLines(r io.Reader, max int, fn func(line string, truncated bool)) error {
+	br := bufio.NewReaderSize(r, max)
+	for {
+		bs, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			fn(string(bs), true)
+			for err == bufio.ErrBufferFull {
+				_, err = br.ReadSlice('\n')
+			}
+		} else if len(bs) > 0 {
+			line := strings.TrimSuffix(string(bs), "\n")
+			fn(strings.TrimSuffix(line, "\r"), false)
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func loadProfile(dir, name string) (*oz.Profile, error) {
+	ps, err := oz.LoadProfiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range ps {
+		if name == p.Name {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("no profile named '%s'", name)
+}
+
+// logMessage records which process sent each control message, to audit the
+// operations requested on the sandbox
+func (st *initState) logMessage(m *ipc.Message) {
+	if m.Ucred == nil {
+		st.log.Info("Received %s message without credentials", m.Type)
+		return
+	}
+	st.log.Info("Received %s message from uid = %d, gid = %d, pid = %d", m.Type, m.Ucred.Uid, m.Ucred.Gid, m.Ucred.Pid)
+}
+
+func handlePing(ping *PingMsg, msg *ipc.Message) error {
+	return msg.Respond(&PingMsg{Data: ping.Data})
+}
+
+// Protocols which forwarders may dial in the sandbox
+var forwarderProtos = map[string]bool{
+	"tcp":  true,
+	"tcp4": true,
+	"tcp6": true,
+	"unix": true,
+	"udp":  true,
+}
+
+func (st *initState) handleSetupForwarder(rp *ForwarderSuccessMsg, msg *ipc.Message) error {
+	st.log.Info("Setting up forwarder to: %s", rp.Addr)
+	if len(msg.Fds) == 0 {
+		return fmt.Errorf("SetupForwarder message received, but no file descriptor included")
+	}
+	f := os.NewFile(uintptr(msg.Fds[0]), "")
+	if !forwarderProtos[rp.Proto] {
+		f.Close()
+		st.log.Error("Rejected forwarder to %s with unsupported protocol '%s'", rp.Addr, rp.Proto)
+		return msg.Respond(&ErrorMsg{Msg: fmt.Sprintf("unsupported forwarder protocol '%s'", rp.Proto), Code: oz.ErrInvalid})
+	}
+	if st.config.AggregateForwarders && rp.Proto != "udp" {
+		err := st.addMuxForwarder(f, rp)
+		if err == nil {
+			return msg.Respond(&OkMsg{})
+		} else if err != errNotPortListener {
+			f.Close()
+			return msg.Respond(&ErrorMsg{Msg: err.Error(), Code: oz.ErrInternal})
+		}
+		// Listeners without a port, like unix sockets, are served on their own
+	}
+	var l net.Listener
+	var pc net.PacketConn
+	var err error
+	var closer io.Closer
+	if rp.Proto == "udp" {
+		pc, err = net.FilePacketConn(f)
+		closer = pc
+	} else {
+		l, err = net.FileListener(f)
+		closer = l
+	}
+	f.Close()
+	if err != nil {
+		return msg.Respond(&ErrorMsg{Msg: err.Error(), Code: oz.ErrInternal})
+	}
+	st.fwdLock.Lock()
+	if st.fwdClosing {
+		st.fwdLock.Unlock()
+		closer.Close()
+		return msg.Respond(&ErrorMsg{Msg: "sandbox is shutting down", Code: oz.ErrInternal})
+	}
+	st.fwdListeners = append(st.fwdListeners, closer)
+	stats := st.fwdStats[rp.Addr]
+	if stats == nil {
+		stats = new(forwarderStats)
+		st.fwdStats[rp.Addr] = stats
+	}
+	st.fwdLock.Unlock()
+	if pc != nil {
+		go st.proxyDatagrams(pc, rp.Addr, stats, udpIdleTimeout)
+		return msg.Respond(&OkMsg{})
+	}
+	go st.acceptForwarded(l, rp.Proto, rp.Addr, stats)
+	return msg.Respond(&OkMsg{})
+}
+
+// acceptForwarded proxies the connections accepted on l to addr until the
+// forwarders are shut down. Temporary errors, such as running out of
+// descriptors, are retried after a delay doubled up to acceptMaxDelay.
+func (st *initState) acceptForwarded(l net.Listener, proto, addr string, stats *forwarderStats) {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if st.isForwarderClosing() {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				delay = nextAcceptDelay(delay)
+				st.log.Warning("Forwarder to %s failed to accept, retrying in %v: %v", addr, delay, err)
+				time.Sleep(delay)
+				continue
+			}
+			st.log.Error("Forwarder to %s stopped: %v", addr, err)
+			return
+		}
+		delay = 0
+		st.log.Info("Forwarder to %s accepted incoming client.", addr)
+		go st.proxyForwarder(conn, proto, addr, stats)
+	}
+}
+
+// addMuxForwarder hands the listener f over to the aggregated forwarder of
+// the sandbox, which is created with the first one.
+func (st *initState) addMuxForwarder(f *os.File, rp *ForwarderSuccessMsg) error {
+	st.fwdLock.Lock()
+	defer st.fwdLock.Unlock()
+	if st.fwdClosing {
+		return fmt.Errorf("sandbox is shutting down")
+	}
+	if st.fwdMux == nil {
+		m, err := newForwarderMux(func(conn net.Conn, b *muxBackend) {
+			st.log.Info("Forwarder to %s accepted incoming client.", b.addr)
+			st.proxyForwarder(conn, b.proto, b.addr, b.stats)
+		})
+		if err != nil {
+			return err
+		}
+		st.fwdMux = m
+		st.fwdListeners = append(st.fwdListeners, m)
+	}
+	stats := st.fwdStats[rp.Addr]
+	if stats == nil {
+		stats = new(forwarderStats)
+		st.fwdStats[rp.Addr] = stats
+	}
+	return st.fwdMux.add(f, &muxBackend{proto: rp.Proto, addr: rp.Addr, stats: stats})
+}
+
+func (st *initState) isForwarderClosing() bool {
+	st.fwdLock.Lock()
+	defer st.fwdLock.Unlock()
+	return st.fwdClosing
+}
+
+func (st *initState) proxyForwarder(conn net.Conn, proto string, rAddr string, stats *forwarderStats) error {
+	if !forwarderProtos[proto] {
+		conn.Close()
+		return fmt.Errorf("unsupported forwarder protocol '%s'", proto)
+	}
+	rConn, err := st.dialForwarded(proto, rAddr)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("Socket: %+v.\n", err)
+	}
+
+	st.fwdLock.Lock()
+	if st.fwdClosing {
+		st.fwdLock.Unlock()
+		conn.Close()
+		rConn.Close()
+		return nil
+	}
+	st.fwdConns[conn] = rConn
+	st.fwdActive.Add(1)
+	st.fwdLock.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	copyLoop := func(dst, src net.Conn, count *int64) {
+		defer wg.Done()
+		defer dst.Close()
+		io.Copy(&countingWriter{w: dst, n: count}, src)
+	}
+
+	atomic.AddInt64(&stats.active, 1)
+	go copyLoop(conn, rConn, &stats.bytesOut)
+	go copyLoop(rConn, conn, &stats.bytesIn)
+
+	go func() {
+		wg.Wait()
+		atomic.AddInt64(&stats.active, -1)
+		st.fwdLock.Lock()
+		delete(st.fwdConns, conn)
+		st.fwdLock.Unlock()
+		st.fwdActive.Done()
+	}()
+
+	return nil
+}
+
+// countingWriter adds the number of bytes written through it to n
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(cw.n, int64(n))
+	return n, err
+}
+
+// shutdownForwarders closes the forwarder listeners so no new clients are
+// accepted, then gives active connections forwarderDrainTimeout to finish
+// before closing whatever is left.
+func (st *initState) shutdownForwarders() {
+	st.fwdLock.Lock()
+	st.fwdClosing = true
+	for _, l := range st.fwdListeners {
+		l.Close()
+	}
+	st.fwdListeners = nil
+	st.fwdLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		st.fwdActive.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(forwarderDrainTimeout):
+	}
+
+	st.fwdLock.Lock()
+	st.log.Warning("Closing %d forwarded connections still active after %v", len(st.fwdConns), forwarderDrainTimeout)
+	for c, rc := range st.fwdConns {
+		c.Close()
+		rc.Close()
+	}
+	st.fwdLock.Unlock()
+	<-done
+}
+
+func (st *initState) handleRunProgram(rp *RunProgramMsg, msg *ipc.Message) error {
+	st.log.Info("Run program message received: %+v", rp)
+	if rp.SeccompMode != "" {
+		// Only the daemon, which checks the configuration and logs the
+		// requester, may override the mode
+		if msg.Ucred == nil || msg.Ucred.Uid != 0 {
+			return msg.Respond(&ErrorMsg{Msg: "seccomp mode can only be overridden through the daemon", Code: oz.ErrPermission})
+		}
+		if !st.config.AllowSeccompOverride {
+			return msg.Respond(&ErrorMsg{Msg: "seccomp mode override is not allowed by the configuration", Code: oz.ErrPermission})
+		}
+		if !oz.IsValidSeccompMode(rp.SeccompMode) {
+			return msg.Respond(&ErrorMsg{Msg: fmt.Sprintf("invalid seccomp mode '%s'", rp.SeccompMode), Code: oz.ErrInvalid})
+		}
+	}
+	if rp.Interactive && rp.Wait {
+		return msg.Respond(&ErrorMsg{Msg: "an interactive program cannot be waited for", Code: oz.ErrInvalid})
+	}
+	var waiter *ipc.Message
+	if rp.Wait {
+		// The response is held until the program exits
+		waiter = msg
+	}
+	cmd, err := st.launchApplication(rp.Path, rp.Pwd, rp.Args, msg.Fds, rp.SeccompMode, rp.Interactive, rp.Stdin, waiter)
+	if err != nil {
+		err := msg.Respond(&ErrorMsg{Msg: err.Error(), Code: oz.ErrInternal})
+		return err
+	} else if rp.Interactive {
+		return msg.Respond(&ProgramStartedMsg{Pid: cmd.Process.Pid})
+	} else if rp.Wait {
+		return nil
+	} else {
+		err := msg.Respond(&OkMsg{})
+		return err
+	}
+}
+
+// handleLaunchBatch launches the programs in order, a failure being reported
+// for its item without stopping the rest of the batch.
+func (st *initState) handleLaunchBatch(lb *LaunchBatchMsg, msg *ipc.Message) error {
+	st.log.Info("Launch batch message received with %d programs", len(lb.Specs))
+	r := &LaunchBatchResp{Errors: make([]string, len(lb.Specs))}
+	for i, spec := range lb.Specs {
+		if _, err := st.launchApplication(spec.Path, spec.Pwd, spec.Args, nil, "", false, false, nil); err != nil {
+			r.Errors[i] = err.Error()
+		}
+	}
+	return msg.Respond(r)
+}
+
+// isSandboxUser returns whether msg was sent by root or by the sandbox user,
+// a message without credentials being sent by neither
+func (st *initState) isSandboxUser(msg *ipc.Message) bool {
+	return msg.Ucred != nil && (msg.Ucred.Uid == 0 || msg.Ucred.Uid == st.uid)
+}
+
+func (st *initState) stdinPipe(pid int, msg *ipc.Message) (io.WriteCloser, *ErrorMsg) {
+	if !st.isSandboxUser(msg) {
+		return nil, &ErrorMsg{Msg: "stdin can only be written by the sandbox user", Code: oz.ErrPermission}
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	w, ok := st.stdinPipes[pid]
+	if !ok {
+		return nil, &ErrorMsg{Msg: fmt.Sprintf("no interactive program with pid %d", pid), Code: oz.ErrNotFound}
+	}
+	return w, nil
+}
+
+// How long handleWriteStdin waits for a program to read its stdin, as the
+// requests of other clients are not handled meanwhile
+const stdinWriteTimeout = 10 * time.Second
+
+// handleWriteStdin writes to the stdin of an interactive program, blocking
+// until the program has read enough of it or stdinWriteTimeout expires.
+func (st *initState) handleWriteStdin(ws *WriteStdinMsg, msg *ipc.Message) error {
+	w, errmsg := st.stdinPipe(ws.Pid, msg)
+	if errmsg != nil {
+		return msg.Respond(errmsg)
+	}
+	if err := writeStdin(w, ws.Data, stdinWriteTimeout); err != nil {
+		return msg.Respond(&ErrorMsg{Msg: fmt.Sprintf("failed to write to stdin of pid %d: %v", ws.Pid, err), Code: oz.ErrInternal})
+	}
+	return msg.Respond(&OkMsg{})
+}
+
+// writeStdin writes data to the stdin pipe w, giving up after timeout. The
+// pipe of exec.Cmd.StdinPipe is an *os.File underneath, whose deadline can
+// be set.
+func writeStdin(w io.Writer, data []byte, timeout time.Duration) error {
+	if d, ok := w.(interface {
+		SetWriteDeadline(time.Time) error
+	}); ok {
+		d.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	n, err := w.Write(data)
+	if err != nil && os.IsTimeout(err) {
+		return fmt.Errorf("program did not read it within %v, %d of %d bytes written", timeout, n, len(data))
+	}
+	return err
+}
+
+func (st *initState) handleCloseStdin(cs *CloseStdinMsg, msg *ipc.Message) error {
+	w, errmsg := st.stdinPipe(cs.Pid, msg)
+	if errmsg != nil {
+		return msg.Respond(errmsg)
+	}
+	st.lock.Lock()
+	delete(st.stdinPipes, cs.Pid)
+	st.lock.Unlock()
+	w.Close()
+	return msg.Respond(&OkMsg{})
+}
+
+func (st *initState) handleDetachChild(dc *DetachChildMsg, msg *ipc.Message) error {
+	return st.handleTrackChild(dc.Pid, false, msg)
+}
+
+func (st *initState) handleAttachChild(ac *AttachChildMsg, msg *ipc.Message) error {
+	return st.handleTrackChild(ac.Pid, true, msg)
+}
+
+func (st *initState) handleTrackChild(pid int, track bool, msg *ipc.Message) error {
+	if !st.isSandboxUser(msg) {
+		return msg.Respond(&ErrorMsg{Msg: "children can only be detached or attached by the sandbox user", Code: oz.ErrPermission})
+	}
+	if errmsg := st.setChildTracked(pid, track); errmsg != nil {
+		return msg.Respond(errmsg)
+	}
+	if track {
+		st.log.Info("Child process pid=%d attached", pid)
+	} else {
+		st.log.Info("Child process pid=%d detached", pid)
+	}
+	return msg.Respond(&OkMsg{})
+}
+
+// setChildTracked sets whether the child pid keeps the sandbox alive. The
+// last tracked child of an automatically shut down sandbox cannot be
+// detached, as nothing would then shut the sandbox down.
+func (st *initState) setChildTracked(pid int, track bool) *ErrorMsg {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	proc, ok := st.children[pid]
+	if !ok {
+		return &ErrorMsg{Msg: fmt.Sprintf("no child process with pid %d", pid), Code: oz.ErrNotFound}
+	}
+	if !track && proc.track && st.profile.AutoShutdown == oz.PROFILE_SHUTDOWN_YES {
+		last := true
+		for p, c := range st.children {
+			if p != pid && c.track {
+				last = false
+				break
+			}
+		}
+		if last {
+			return &ErrorMsg{Msg: fmt.Sprintf("pid %d is the last tracked child, detaching it would keep the sandbox running", pid), Code: oz.ErrInvalid}
+		}
+	}
+	proc.track = track
+	st.children[pid] = proc
+	if track {
+		st.cancelShutdown()
+	}
+	return nil
+}
+
+// handleNotify shows a desktop notification from the sandbox through its
+// session bus, doing nothing when the profile does not enable notifications.
+func (st *initState) handleNotify(n *NotifyMsg, msg *ipc.Message) error {
+	if !st.isSandboxUser(msg) {
+		return msg.Respond(&ErrorMsg{Msg: "notifications can only be sent by the sandbox user", Code: oz.ErrPermission})
+	}
+	if !st.profile.XServer.EnableNotifications || st.profile.DisableDbusSession {
+		st.log.Info("Notification '%s' not shown, notifications are not enabled for the profile", n.Summary)
+		return msg.Respond(&OkMsg{})
+	}
+	if n.Summary == "" {
+		return msg.Respond(&ErrorMsg{Msg: "empty notification summary", Code: oz.ErrInvalid})
+	}
+	go func() {
+		if err := st.notify(n.Summary, n.Body); err != nil {
+			st.log.Warning("Failed to send notification '%s': %v", n.Summary, err)
+			msg.Respond(&ErrorMsg{Msg: err.Error(), Code: oz.ErrInternal})
+			return
+		}
+		msg.Respond(&OkMsg{})
+	}()
+	return nil
+}
+
+// notify runs notify-send as the sandbox user to reach the notification
+// server of the session bus, which xpra forwards to the host.
+func (st *initState) notify(summary, body string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	args := []string{"--app-name=" + st.profile.Name, "--", summary}
+	if body != "" {
+		args = append(args, body)
+	}
+	cmd := exec.CommandContext(ctx, notifySendPath, args...)
+	cmd.Env = append([]string{}, st.launchEnv...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid: st.uid,
+		Gid: st.gid,
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %v %s", notifySendPath, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (st *initState) handleSetHostname(sh *SetHostnameMsg, msg *ipc.Message) error {
+	if !st.isSandboxUser(msg) {
+		return msg.Respond(&ErrorMsg{Msg: "hostname can only be changed by the sandbox user", Code: oz.ErrPermission})
+	}
+	if st.profile.PreserveHostname {
+		return msg.Respond(&ErrorMsg{Msg: "the profile preserves the hostname", Code: oz.ErrInvalid})
+	}
+	if !isValidHostname(sh.Hostname) {
+		return msg.Respond(&ErrorMsg{Msg: fmt.Sprintf("invalid hostname '%s'", sh.Hostname), Code: oz.ErrInvalid})
+	}
+	if err := st.setHostname(sh.Hostname); err != nil {
+		st.log.Warning("Failed to change hostname to %s: %v", sh.Hostname, err)
+		return msg.Respond(&ErrorMsg{Msg: err.Error(), Code: oz.ErrInternal})
+	}
+	st.log.Info("Hostname changed to (%s.%s)", sh.Hostname, domainname)
+	return msg.Respond(&OkMsg{})
+}
+
+func (st *initState) handleSandboxStats(ss *SandboxStatsMsg, msg *ipc.Message) error {
+	if st.profile.NoSysProc {
+		return msg.Respond(&ErrorMsg{Msg: "proc is not mounted in this sandbox", Code: oz.ErrNotFound})
+	}
+	stats, err := readSandboxStats("/proc")
+	if err != nil {
+		return msg.Respond(&ErrorMsg{Msg: err.Error(), Code: oz.ErrInternal})
+	}
+	return msg.Respond(&SandboxStatsResp{Stats: *stats})
+}
+
+func (st *initState) handleSeccompStats(ss *SeccompStatsMsg, msg *ipc.Message) error {
+	resp := st.seccompStats.get()
+	return msg.Respond(&resp)
+}
+
+func (st *initState) handleListProcesses(lp *ListProcessesMsg, msg *ipc.Message) error {
+	if st.profile.NoSysProc {
+		return msg.Respond(&ErrorMsg{Msg: "proc is not mounted in this sandbox", Code: oz.ErrNotFound})
+	}
+	procs, err := readProcessList("/proc")
+	if err != nil {
+		return msg.Respond(&ErrorMsg{Msg: err.Error(), Code: oz.ErrInternal})
+	}
+	st.lock.Lock()
+	for i := range procs {
+		procs[i].Tracked = st.children[procs[i].Pid].track
+	}
+	st.lock.Unlock()
+	return msg.Respond(&ListProcessesResp{Processes: procs})
+}
+
+// handleFollowProgram streams the output lines of a program to the client
+// until the program closes its output, a client gone away being detached at
+// the next line.
+func (st *initState) handleFollowProgram(fp *FollowProgramMsg, msg *ipc.Message) error {
+	if !st.isSandboxUser(msg) {
+		return msg.Respond(&ErrorMsg{Msg: "program output can only be followed by the sandbox user", Code: oz.ErrPermission})
+	}
+	f, ok := st.outputFollowers.attach(fp.Pid)
+	if !ok {
+		return msg.Respond(&ErrorMsg{Msg: fmt.Sprintf("no program with pid %d whose output can be followed", fp.Pid), Code: oz.ErrNotFound})
+	}
+	go func() {
+		for line := range f.lines {
+			if err := msg.Respond(&ProgramOutputMsg{Line: line}); err != nil {
+				st.outputFollowers.detach(fp.Pid, f)
+				return
+			}
+		}
+		msg.Respond(&OkMsg{})
+	}()
+	return nil
+}
+
+// handleStopApp terminates the tracked children without the sandbox being
+// shut down once they have exited, so that programs can be launched in it
+// again.
+func (st *initState) handleStopApp(sa *StopAppMsg, msg *ipc.Message) error {
+	if !st.isSandboxUser(msg) {
+		return msg.Respond(&ErrorMsg{Msg: "programs can only be stopped by the sandbox user", Code: oz.ErrPermission})
+	}
+	if st.shutdownRequested {
+		return msg.Respond(&ErrorMsg{Msg: "sandbox is shutting down", Code: oz.ErrInvalid})
+	}
+	// Stopped processes would only handle the signal once resumed
+	if err := st.setPaused(false); err != nil {
+		return msg.Respond(&ErrorMsg{Msg: err.Error(), Code: oz.ErrInternal})
+	}
+	n, err := st.stopApp()
+	if err != nil {
+		return msg.Respond(&ErrorMsg{Msg: err.Error(), Code: oz.ErrNotFound})
+	}
+	st.log.Info("Stopping %d program(s), the sandbox is kept running", n)
+	return msg.Respond(&OkMsg{})
+}
+
+// stopApp sends SIGTERM to the tracked children and keeps their exit from
+// triggering auto_shutdown, returning the number of children signalled.
+func (st *initState) stopApp() (int, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	n := 0
+	for pid, proc := range st.children {
+		if !proc.track {
+			continue
+		}
+		if err := proc.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			st.log.Warning("Failed to signal program pid=%d to stop: %v", pid, err)
+			continue
+		}
+		n++
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("no program running in the sandbox")
+	}
+	st.stoppingApp = true
+	return n, nil
+}
+
+func (st *initState) handlePauseSandbox(ps *PauseSandboxMsg, msg *ipc.Message) error {
+	return st.respondSetPaused(true, msg)
+}
+
+func (st *initState) handleResumeSandbox(rs *ResumeSandboxMsg, msg *ipc.Message) error {
+	return st.respondSetPaused(false, msg)
+}
+
+func (st *initState) respondSetPaused(paused bool, msg *ipc.Message) error {
+	if !st.isSandboxUser(msg) {
+		return msg.Respond(&ErrorMsg{Msg: "sandbox can only be paused or resumed by the sandbox user", Code: oz.ErrPermission})
+	}
+	if paused && st.shutdownRequested {
+		return msg.Respond(&ErrorMsg{Msg: "sandbox is shutting down", Code: oz.ErrInvalid})
+	}
+	if err := st.setPaused(paused); err != nil {
+		return msg.Respond(&ErrorMsg{Msg: err.Error(), Code: oz.ErrInternal})
+	}
+	return msg.Respond(&OkMsg{})
+}
+
+func (st *initState) isPaused() bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	return st.paused
+}
+
+// setPaused stops or continues the launched programs and their descendants,
+// leaving xpra and shells running. Each tree is signalled parents first:
+// the seccomp tracer is the root of a traced program, so it is stopped
+// before its tracees and continued first, continuing in turn the tracees
+// it holds in a ptrace stop. Launches are refused while paused.
+func (st *initState) setPaused(paused bool) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.paused == paused {
+		return nil
+	}
+	sig := syscall.SIGCONT
+	if paused {
+		sig = syscall.SIGSTOP
+	}
+	parents, err := readProcessParents("/proc")
+	if err != nil {
+		return fmt.Errorf("failed to list sandbox processes: %v", err)
+	}
+	for pid, proc := range st.children {
+		if !proc.track {
+			continue
+		}
+		for _, p := range processTree(parents, pid) {
+			if err := syscall.Kill(p, sig); err != nil && err != syscall.ESRCH {
+				return fmt.Errorf("failed to send %v to pid %d: %v", sig, p, err)
+			}
+		}
+	}
+	st.paused = paused
+	if paused {
+		st.log.Info("Sandbox processes paused")
+	} else {
+		st.log.Info("Sandbox processes resumed")
+	}
+	return nil
+}
+
+func (st *initState) handleGetLaunchEnv(gl *GetLaunchEnvMsg, msg *ipc.Message) error {
+	if !gl.Unredacted {
+		return msg.Respond(&GetLaunchEnvResp{Env: redactEnv(st.envOverrides)})
+	}
+	if !st.isSandboxUser(msg) {
+		st.log.Notice("Rejected unredacted launch environment request not sent by the sandbox user")
+		return msg.Respond(&ErrorMsg{Msg: "unredacted launch environment is only available to the sandbox user", Code: oz.ErrPermission})
+	}
+	return msg.Respond(&GetLaunchEnvResp{Env: append([]string{}, st.envOverrides...)})
+}
+
+func (st *initState) handleListMounts(lm *ListMountsMsg, msg *ipc.Message) error {
+	mounts, err := readMountInfo("/proc/self/mountinfo")
+	if err != nil {
+		return msg.Respond(&ErrorMsg{Msg: err.Error(), Code: oz.ErrInternal})
+	}
+	return msg.Respond(&ListMountsResp{Mounts: mounts})
+}
+
+func (st *initState) handleListForwarderStats(lf *ListForwarderStatsMsg, msg *ipc.Message) error {
+	r := new(ListForwarderStatsResp)
+	st.fwdLock.Lock()
+	for addr, stats := range st.fwdStats {
+		r.Stats = append(r.Stats, ForwarderStats{
+			Addr:     addr,
+			BytesIn:  atomic.LoadInt64(&stats.bytesIn),
+			BytesOut: atomic.LoadInt64(&stats.bytesOut),
+			Active:   int(atomic.LoadInt64(&stats.active)),
+		})
+	}
+	st.fwdLock.Unlock()
+	return msg.Respond(r)
+}
+
+func (st *initState) handleNetworkInfo(ni *NetworkInfoMsg, msg *ipc.Message) error {
+	nettype := st.profile.Networking.Nettype
+	if nettype == network.TYPE_HOST || nettype == network.TYPE_NONE {
+		// Either the host namespace or no namespace setup, nothing to gather
+		return msg.Respond(&NetworkInfoResp{Info: network.NetInfo{Nettype: nettype}})
+	}
+	info, err := network.GetNetInfo(nettype)
+	if err != nil {
+		return msg.Respond(&ErrorMsg{Msg: err.Error(), Code: oz.ErrInternal})
+	}
+	return msg.Respond(&NetworkInfoResp{Info: *info})
+}
+
+func (st *initState) handlePutFile(pf *PutFileMsg, msg *ipc.Message) error {
+	if len(pf.Data) > MaxPutFileSize {
+		return msg.Respond(&ErrorMsg{Msg: fmt.Sprintf("file content is larger than %d bytes", MaxPutFileSize), Code: oz.ErrInvalid})
+	}
+	if err := st.putFile(pf.Path, os.FileMode(pf.Mode).Perm(), pf.Data); err != nil {
+		st.log.Warning("Failed to write %s: %v", pf.Path, err)
+		return msg.Respond(&ErrorMsg{Msg: err.Error(), Code: oz.ErrPermission})
+	}
+	st.log.Info("Wrote %d bytes to %s", len(pf.Data), pf.Path)
+	return msg.Respond(&OkMsg{})
+}
+
+// putFile writes data to fpath, owned by the sandbox user, provided that it
+// is inside the PutFilePrefix directory once symlinks are resolved. The file
+// is written as the sandbox user, as the user could swap the directories of
+// the path for symlinks once checked.
+func (st *initState) putFile(fpath string, mode os.FileMode, data []byte) error {
+	if !path.IsAbs(fpath) {
+		return fmt.Errorf("path %s is not absolute", fpath)
+	}
+	prefix, err := fs.ResolvePathNoGlob(st.config.PutFilePrefix, st.display, st.user, st.fs.GetXDGDirs(), st.profile)
+	if err != nil {
+		return fmt.Errorf("unable to resolve put file prefix: %v", err)
+	}
+	prefix = path.Clean(prefix)
+	if p, err := filepath.EvalSymlinks(prefix); err == nil {
+		prefix = p
+	}
+	dir, err := filepath.EvalSymlinks(path.Dir(path.Clean(fpath)))
+	if err != nil {
+		return err
+	}
+	if dir != prefix && !strings.HasPrefix(dir, prefix+"/") {
+		return fmt.Errorf("path %s is outside of %s", fpath, prefix)
+	}
+	target := path.Join(dir, path.Base(fpath))
+	return asUser(int(st.uid), int(st.gid), st.userGroups(), func() error {
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, mode)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := f.Chmod(mode); err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	})
+}
+
+func (st *initState) handleSetClipboard(sc *SetClipboardMsg, msg *ipc.Message) error {
+	if st.xpra == nil || st.xpra.Process.ProcessState != nil {
+		return msg.Respond(&ErrorMsg{Msg: "xpra is not running in this sandbox", Code: oz.ErrNotFound})
+	}
+	if sc.Enabled && st.profile.XServer.DisableClipboard {
+		return msg.Respond(&ErrorMsg{Msg: "clipboard is disabled in the sandbox profile", Code: oz.ErrPermission})
+	}
+	creds := &syscall.Credential{
+		Uid: uint32(st.uid),
+		Gid: uint32(st.gid),
+	}
+	if out, err := st.xpra.SetClipboard(sc.Enabled, creds); err != nil {
+		st.log.Warning("Error running xpra control: %v (%s)", err, strings.TrimSpace(string(out)))
+		return msg.Respond(&ErrorMsg{Msg: fmt.Sprintf("xpra control failed: %v", err), Code: oz.ErrInternal})
+	}
+	st.log.Info("Clipboard sharing set to %t", sc.Enabled)
+	return msg.Respond(&OkMsg{})
+}
+
+func (st *initState) handleDumpSeccomp(dm *DumpSeccompMsg, msg *ipc.Message) error {
+	if st.profile.Seccomp.Mode != oz.PROFILE_SECCOMP_TRAIN {
+		return msg.Respond(&ErrorMsg{Msg: "sandbox is not running in seccomp training mode", Code: oz.ErrInvalid})
+	}
+	type seccompDump struct {
+		pid   int
+		spath string
+		done  chan struct{}
+	}
+	st.lock.Lock()
+	if len(st.seccompSnapshots) == 0 {
+		st.lock.Unlock()
+		return msg.Respond(&ErrorMsg{Msg: "no seccomp tracer is running", Code: oz.ErrNotFound})
+	}
+	if len(st.seccompDumps) > 0 {
+		st.lock.Unlock()
+		return msg.Respond(&ErrorMsg{Msg: "a seccomp policy dump is already in progress", Code: oz.ErrInvalid})
+	}
+	dumps := []seccompDump{}
+	for pid, spath := range st.seccompSnapshots {
+		done := make(chan struct{})
+		st.seccompDumps[pid] = done
+		if err := syscall.Kill(pid, syscall.SIGUSR2); err != nil {
+			st.log.Warning("Failed to signal seccomp tracer (%d): %v", pid, err)
+			delete(st.seccompDumps, pid)
+			continue
+		}
+		dumps = append(dumps, seccompDump{pid, spath, done})
+	}
+	st.lock.Unlock()
+
+	// The tracers report their snapshots on their hits pipe, which are
+	// waited for without holding up the other requests
+	go func() {
+		paths := []string{}
+		deadline := time.Now().Add(seccompDumpTimeout)
+		for _, sd := range dumps {
+			select {
+			case <-sd.done:
+				paths = append(paths, sd.spath)
+			case <-time.After(deadline.Sub(time.Now())):
+				st.log.Warning("Seccomp tracer (%d) did not write its snapshot in time", sd.pid)
+			}
+		}
+		st.lock.Lock()
+		for _, sd := range dumps {
+			delete(st.seccompDumps, sd.pid)
+		}
+		st.lock.Unlock()
+		if len(paths) == 0 {
+			msg.Respond(&ErrorMsg{Msg: "no seccomp policy snapshot was written", Code: oz.ErrInternal})
+			return
+		}
+		msg.Respond(&DumpSeccompResp{Paths: paths})
+	}()
+	return nil
+}
+
+// seccompSnapshotWritten ends the wait of a pending DumpSeccomp for the
+// snapshot of the tracer pid
+func (st *initState) seccompSnapshotWritten(pid int) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if done, ok := st.seccompDumps[pid]; ok {
+		close(done)
+		delete(st.seccompDumps, pid)
+	}
+}
+
+// readMountInfo parses the mountinfo file format described in proc(5):
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+//
+// Optional fields are terminated by a single hyphen, after which come the
+// filesystem type and the mount source. Spaces, tabs, newlines and
+// backslashes in the paths are escaped as octal sequences such as \040.
+func readMountInfo(fpath string) ([]MountEntry, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mounts := []MountEntry{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || len(fields) < sep+3 {
+			continue
+		}
+		me := MountEntry{
+			Root:    unescapeMountField(fields[3]),
+			Target:  unescapeMountField(fields[4]),
+			Options: fields[5],
+			FsType:  fields[sep+1],
+			Source:  unescapeMountField(fields[sep+2]),
+		}
+		for _, opt := range strings.Split(me.Options, ",") {
+			if opt == "ro" {
+				me.ReadOnly = true
+				break
+			}
+		}
+		mounts = append(mounts, me)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return mounts, nil
+}
+
+// unescapeMountField decodes the \ooo octal escapes of a mountinfo field
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isOctal(s[i+1]) && isOctal(s[i+2]) && isOctal(s[i+3]) {
+			buf = append(buf, (s[i+1]-'0')<<6|(s[i+2]-'0')<<3|(s[i+3]-'0'))
+			i += 3
+			continue
+		}
+		buf = append(buf, s[i])
+	}
+	return string(buf)
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
+
+// isShellAllowed reports whether uid may open a shell, any uid being allowed
+// when the profile does not restrict them
+func (st *initState) isShellAllowed(uid uint32) bool {
+	if len(st.profile.ShellAllowedUids) == 0 {
+		return true
+	}
+	for _, u := range st.profile.ShellAllowedUids {
+		if u == uid {
+			return true
+		}
+	}
+	return false
+}
+
+func (st *initState) handleRunShell(rs *RunShellMsg, msg *ipc.Message) error {
+	if msg.Ucred == nil {
+		return msg.Respond(&ErrorMsg{"No credentials received for RunShell command", oz.ErrPermission})
 	}
 	if (msg.Ucred.Uid == 0 || msg.Ucred.Gid == 0) && st.config.AllowRootShell != true {
-		return msg.Respond(&ErrorMsg{"Cannot open shell because allowRootShell is disabled"})
+		return msg.Respond(&ErrorMsg{"Cannot open shell because allowRootShell is disabled", oz.ErrPermission})
+	}
+	if msg.Ucred.Uid != 0 && !st.isShellAllowed(msg.Ucred.Uid) {
+		st.log.Notice("Denied shell to uid = %d, not in the profile's shell_allowed_uids", msg.Ucred.Uid)
+		return msg.Respond(&ErrorMsg{fmt.Sprintf("uid %d is not allowed to open a shell in this sandbox", msg.Ucred.Uid), oz.ErrPermission})
 	}
 	groups := append([]uint32{}, st.gid)
 	if msg.Ucred.Uid != 0 && msg.Ucred.Gid != 0 {
@@ -684,25 +2355,132 @@ func (st *initState) handleRunShell(rs *RunShellMsg, msg *ipc.Message) error {
 			cmd.Dir = st.user.HomeDir
 		}
 	}
-	cmd.Env = append(cmd.Env, fmt.Sprintf("PS1=[%s] $ ", st.profile.Name))
-	st.log.Info("Executing shell...")
-	f, err := ptyStart(cmd)
-	defer f.Close()
+	cmd.Env = append(cmd.Env, fmt.Sprintf("PS1=[%s] $ ", st.profile.Name))
+	if st.isPaused() {
+		return msg.Respond(&ErrorMsg{"sandbox is paused", oz.ErrInvalid})
+	}
+	st.log.Info("Executing shell...")
+	var f *os.File
+	err := st.startWithUmask(func() (err error) {
+		f, err = ptyStart(cmd)
+		return err
+	})
+	defer f.Close()
+	if err != nil {
+		return msg.Respond(&ErrorMsg{err.Error(), oz.ErrInternal})
+	}
+	st.addChildProcess(cmd, false)
+	err = msg.Respond(&OkMsg{}, int(f.Fd()))
+	return err
+}
+
+// handleAttachProgram hands out the pty of a program launched by a profile
+// with NeedsPty. Its output blocks once the terminal buffer is full until a
+// client attaches and reads it.
+func (st *initState) handleAttachProgram(ap *AttachProgramMsg, msg *ipc.Message) error {
+	if msg.Ucred == nil {
+		return msg.Respond(&ErrorMsg{"No credentials received for AttachProgram command", oz.ErrPermission})
+	}
+	if msg.Ucred.Uid != st.uid && msg.Ucred.Uid != 0 {
+		return msg.Respond(&ErrorMsg{fmt.Sprintf("uid %d is not allowed to attach to programs of this sandbox", msg.Ucred.Uid), oz.ErrPermission})
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	pid := ap.Pid
+	if pid == 0 {
+		if len(st.appPtys) > 1 {
+			return msg.Respond(&ErrorMsg{fmt.Sprintf("%d programs are running in a pty, a pid is needed", len(st.appPtys)), oz.ErrInvalid})
+		}
+		for p := range st.appPtys {
+			pid = p
+		}
+	}
+	f, ok := st.appPtys[pid]
+	if !ok {
+		return msg.Respond(&ErrorMsg{"no program running in a pty found", oz.ErrNotFound})
+	}
+	st.log.Info("Attaching uid = %d to program pid = %d", msg.Ucred.Uid, pid)
+	return msg.Respond(&OkMsg{}, int(f.Fd()))
+}
+
+// startWithUmask runs start with the profile umask in effect so that it is
+// inherited by the forked child. The umask is process wide so it is restored
+// as soon as start returns.
+func (st *initState) startWithUmask(start func() error) error {
+	if st.profile.Umask == "" {
+		return start()
+	}
+	mask, err := strconv.ParseUint(st.profile.Umask, 8, 32)
 	if err != nil {
-		return msg.Respond(&ErrorMsg{err.Error()})
+		return fmt.Errorf("invalid umask '%s': %v", st.profile.Umask, err)
 	}
-	st.addChildProcess(cmd, false)
-	err = msg.Respond(&OkMsg{}, int(f.Fd()))
-	return err
+	st.umaskLock.Lock()
+	defer st.umaskLock.Unlock()
+	old := syscall.Umask(int(mask))
+	defer syscall.Umask(old)
+	return start()
+}
+
+// startWithoutCaps calls start on a thread whose bounding set has caps
+// dropped, for the child forked by start to inherit it. The thread is left
+// locked so that it exits with the goroutine instead of running others.
+func startWithoutCaps(start func() error, caps []int) error {
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		for _, c := range caps {
+			if _, _, e := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_CAPBSET_DROP, uintptr(c), 0); e != 0 {
+				errc <- fmt.Errorf("failed to drop capability %d from the bounding set: %v", c, e)
+				return
+			}
+		}
+		errc <- start()
+	}()
+	return <-errc
+}
+
+// asUser calls fn on a thread whose effective uid and gid, and supplementary
+// groups, are those of a user. The files it creates are then owned by the
+// user, its path lookups, symlinks included, are checked against the
+// permissions of the user instead of those of root, and the servers of the
+// unix sockets it connects to see the credentials of the user. Only the
+// credentials of this thread change, and it is left locked so that it exits
+// with the goroutine instead of running others.
+func asUser(uid, gid int, groups []int, fn func() error) error {
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		// In this order, as changing the groups and the gid needs the
+		// capabilities lost with the uid
+		if err := unix.Setgroups(groups); err != nil {
+			errc <- fmt.Errorf("failed to set groups %v: %v", groups, err)
+			return
+		}
+		if err := unix.Setresgid(-1, gid, -1); err != nil {
+			errc <- fmt.Errorf("failed to set gid %d: %v", gid, err)
+			return
+		}
+		if err := unix.Setresuid(-1, uid, -1); err != nil {
+			errc <- fmt.Errorf("failed to set uid %d: %v", uid, err)
+			return
+		}
+		errc <- fn()
+	}()
+	return <-errc
 }
 
+// ptyStart starts c with a new pty as its controlling terminal and returns
+// the master side. A stdin already set on c is kept, the pty is then only
+// connected to stdout and stderr.
 func ptyStart(c *exec.Cmd) (ptty *os.File, err error) {
 	ptty, tty, err := pty.Open()
 	if err != nil {
 		return nil, err
 	}
 	defer tty.Close()
-	c.Stdin = tty
+	if c.Stdin == nil {
+		c.Stdin = tty
+	}
 	c.Stdout = tty
 	c.Stderr = tty
 	if c.SysProcAttr == nil {
@@ -710,6 +2488,7 @@ func ptyStart(c *exec.Cmd) (ptty *os.File, err error) {
 	}
 	c.SysProcAttr.Setctty = true
 	c.SysProcAttr.Setsid = true
+	c.SysProcAttr.Ctty = 1
 	if err := c.Start(); err != nil {
 		ptty.Close()
 		return nil, err
@@ -720,12 +2499,30 @@ func ptyStart(c *exec.Cmd) (ptty *os.File, err error) {
 func (st *initState) addChildProcess(cmd *exec.Cmd, track bool) {
 	st.lock.Lock()
 	defer st.lock.Unlock()
+	st.addChild(cmd, track)
+}
+
+// addChild registers the child cmd, with st.lock held
+func (st *initState) addChild(cmd *exec.Cmd, track bool) {
 	st.children[cmd.Process.Pid] = procState{cmd: cmd, track: track}
+	if track {
+		st.stoppingApp = false
+		st.cancelShutdown()
+	}
 }
 
 func (st *initState) removeChildProcess(pid int) bool {
 	st.lock.Lock()
 	defer st.lock.Unlock()
+	delete(st.seccompSnapshots, pid)
+	if f, ok := st.appPtys[pid]; ok {
+		f.Close()
+		delete(st.appPtys, pid)
+	}
+	if w, ok := st.stdinPipes[pid]; ok {
+		w.Close()
+		delete(st.stdinPipes, pid)
+	}
 	if _, ok := st.children[pid]; ok {
 		delete(st.children, pid)
 		return true
@@ -733,10 +2530,41 @@ func (st *initState) removeChildProcess(pid int) bool {
 	return false
 }
 
+// failExitWaiters answers every held RunProgram with an error, the programs
+// not being waited for anymore.
+func (st *initState) failExitWaiters(errmsg string) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	for pid, msg := range st.exitWaiters {
+		msg.Respond(&ErrorMsg{Msg: errmsg, Code: oz.ErrShutdown})
+		delete(st.exitWaiters, pid)
+	}
+}
+
+func exitStatus(wstatus syscall.WaitStatus) int {
+	if wstatus.Signaled() {
+		return 128 + int(wstatus.Signal())
+	}
+	return wstatus.ExitStatus()
+}
+
 func (st *initState) handleChildExit(pid int, wstatus syscall.WaitStatus) {
 	st.log.Debug("Child process pid=%d exited from init with status %d", pid, wstatus.ExitStatus())
+	st.lock.Lock()
 	track := st.children[pid].track
+	st.lock.Unlock()
 	st.removeChildProcess(pid)
+	if wstatus.Signaled() && wstatus.Signal() == syscall.SIGSYS {
+		st.log.Warning("Program (pid %d) was killed by its seccomp policy", pid)
+		st.seccompStats.addKilled()
+	}
+
+	st.lock.Lock()
+	if msg, ok := st.exitWaiters[pid]; ok {
+		delete(st.exitWaiters, pid)
+		msg.Respond(&ProgramExitMsg{Status: exitStatus(wstatus)})
+	}
+	st.lock.Unlock()
 
 	for _, proc := range st.children {
 		if proc.track {
@@ -744,6 +2572,15 @@ func (st *initState) handleChildExit(pid int, wstatus syscall.WaitStatus) {
 		}
 	}
 
+	st.lock.Lock()
+	stopped := st.stoppingApp
+	st.stoppingApp = false
+	st.lock.Unlock()
+	if stopped {
+		st.log.Info("Programs stopped, keeping the sandbox running")
+		return
+	}
+
 	if len(st.profile.Watchdog) > 0 {
 		//if st.getProcessExists(st.profile.Watchdog) {
 		//	return
@@ -759,11 +2596,59 @@ func (st *initState) handleChildExit(pid int, wstatus syscall.WaitStatus) {
 		//}
 	}
 	if track == true && st.profile.AutoShutdown == oz.PROFILE_SHUTDOWN_YES {
+		if st.profile.ShutdownDelay > 0 {
+			st.scheduleShutdown(time.Duration(st.profile.ShutdownDelay) * time.Second)
+			return
+		}
 		st.log.Info("Shutting down sandbox after child exit.")
 		st.shutdown()
 	}
 }
 
+// scheduleShutdown shuts the sandbox down after delay unless a tracked child
+// starts in the meantime, for programs restarting in place.
+func (st *initState) scheduleShutdown(delay time.Duration) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.shutdownTimer != nil {
+		st.shutdownTimer.Stop()
+	}
+	st.log.Info("No tracked child left, shutting down in %v unless one starts", delay)
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		st.lock.Lock()
+		if st.shutdownTimer != timer {
+			st.lock.Unlock()
+			return
+		}
+		st.shutdownTimer = nil
+		for _, proc := range st.children {
+			if proc.track {
+				st.lock.Unlock()
+				return
+			}
+		}
+		st.lock.Unlock()
+		if len(st.profile.Watchdog) > 0 && st.getProcessExists(st.profile.Watchdog) {
+			st.log.Info("Not shutting down, a watchdog process is running")
+			return
+		}
+		st.log.Info("Shutting down sandbox after shutdown delay.")
+		st.shutdown()
+	})
+	st.shutdownTimer = timer
+}
+
+// cancelShutdown stops the scheduled shutdown, if any, with st.lock held
+func (st *initState) cancelShutdown() {
+	if st.shutdownTimer == nil {
+		return
+	}
+	st.shutdownTimer.Stop()
+	st.shutdownTimer = nil
+	st.log.Info("Scheduled shutdown cancelled by a new tracked child")
+}
+
 func (st *initState) getProcessExists(pnames []string) bool {
 	paths, _ := filepath.Glob("/proc/[0-9]*/cmdline")
 	for _, path := range paths {
@@ -795,8 +2680,40 @@ func (st *initState) processSignals(c <-chan os.Signal, s *ipc.MsgServer) {
 	for {
 		sig := <-c
 		st.log.Info("Received signal (%v)", sig)
-		st.shutdown()
+		if containsSignal(st.shutdownSignals, sig) {
+			st.shutdown()
+			continue
+		}
+		if containsSignal(st.forwardSignals, sig) {
+			for _, child := range st.childrenVector() {
+				if err := child.cmd.Process.Signal(sig); err != nil {
+					st.log.Warning("Failed to forward signal (%v) to pid %d: %v", sig, child.cmd.Process.Pid, err)
+				}
+			}
+		}
+	}
+}
+
+func (st *initState) parseSignals(names []string) []os.Signal {
+	sigs := []os.Signal{}
+	for _, name := range names {
+		sig, err := oz.ParseSignal(name)
+		if err != nil {
+			st.log.Warning("Ignoring configured signal: %v", err)
+			continue
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs
+}
+
+func containsSignal(sigs []os.Signal, sig os.Signal) bool {
+	for _, s := range sigs {
+		if s == sig {
+			return true
+		}
 	}
+	return false
 }
 
 func (st *initState) shutdown() {
@@ -804,12 +2721,20 @@ func (st *initState) shutdown() {
 		return
 	}
 	st.shutdownRequested = true
+	// Stopped processes would only handle the interrupt once resumed
+	if err := st.setPaused(false); err != nil {
+		st.log.Warning("Failed to resume sandbox processes before shutdown: %v", err)
+	}
 	for _, c := range st.childrenVector() {
 		c.cmd.Process.Signal(os.Interrupt)
 	}
 
 	st.shutdownXpra()
 
+	st.shutdownForwarders()
+
+	st.failExitWaiters("sandbox shut down before the program exited")
+
 	if st.ipcServer != nil {
 		st.ipcServer.Close()
 	}
@@ -823,17 +2748,42 @@ func (st *initState) shutdownXpra() {
 		Uid: uint32(st.uid),
 		Gid: uint32(st.gid),
 	}
-	out, err := st.xpra.Stop(creds)
-	if err != nil {
-		st.log.Warning("Error running xpra stop: %v", err)
-		return
+	timeout := time.Duration(st.config.XpraStopTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultXpraStopTimeout
 	}
-
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	out, err := st.xpra.StopContext(ctx, creds)
 	for _, line := range strings.Split(string(out), "\n") {
 		if len(line) > 0 {
 			st.log.Debug("(xpra stop) %s", line)
 		}
 	}
+	if ctx.Err() == context.DeadlineExceeded {
+		st.log.Warning("xpra stop did not complete within %v, killing the xpra server", timeout)
+		st.killXpraServer()
+		return
+	}
+	if err != nil {
+		st.log.Warning("Error running xpra stop: %v", err)
+		return
+	}
+	st.log.Info("xpra server stopped")
+}
+
+// killXpraServer kills the xpra server process when it cannot be stopped
+func (st *initState) killXpraServer() {
+	if st.xpra.Process == nil || st.xpra.Process.Process == nil {
+		st.log.Warning("No xpra server process to kill")
+		return
+	}
+	pid := st.xpra.Process.Process.Pid
+	if err := st.xpra.Process.Process.Kill(); err != nil {
+		st.log.Warning("Failed to kill xpra server (pid %d): %v", pid, err)
+		return
+	}
+	st.log.Info("Killed xpra server (pid %d)", pid)
 }
 
 func (st *initState) childrenVector() []procState {
@@ -850,10 +2800,53 @@ func (st *initState) setupFilesystem(extra_whitelist []oz.WhitelistItem, extra_b
 
 	//	fs := fs.NewFilesystem(st.config, st.log)
 
-	if err := setupRootfs(st.fs, st.user, st.uid, st.gid, st.display, st.config.UseFullDev, st.log, st.config.EtcIncludes); err != nil {
+	etcIncludes := st.config.EtcIncludes
+	if !st.config.BindTimezone || st.config.MinimalPasswd {
+		etcIncludes = []string{}
+		for _, inc := range st.config.EtcIncludes {
+			if !st.config.BindTimezone && (inc == "/etc/localtime" || inc == "/etc/timezone") {
+				continue
+			}
+			// Written by setupEtcFiles instead
+			if st.config.MinimalPasswd && (inc == "/etc/passwd" || inc == "/etc/group") {
+				continue
+			}
+			etcIncludes = append(etcIncludes, inc)
+		}
+	}
+	if err := setupRootfs(st.fs, st.user, st.uid, st.gid, st.display, st.config.UseFullDev, st.log, etcIncludes); err != nil {
+		return err
+	}
+
+	if st.config.BindTimezone || st.profile.Timezone != "" {
+		bound, err := setupTimezone(st.fs, st.profile.Timezone, st.log)
+		if err != nil {
+			return err
+		}
+		// A TZ variable would otherwise override /etc/localtime
+		if bound {
+			env := []string{}
+			for _, e := range st.launchEnv {
+				if !strings.HasPrefix(e, "TZ=") {
+					env = append(env, e)
+				}
+			}
+			st.launchEnv = env
+		}
+	}
+
+	if err := st.mountTmpfs(st.fs, st.profile.Tmpfs); err != nil {
 		return err
 	}
 
+	if len(st.profile.Devices) > 0 {
+		if st.config.UseFullDev {
+			st.log.Info("Devices of the profile not bound, the sandbox has the full /dev")
+		} else if err := st.bindDevices(); err != nil {
+			return err
+		}
+	}
+
 	if st.ephemeral {
 		for i := len(st.profile.Whitelist) - 1; i >= 0; i-- {
 			wl := st.profile.Whitelist[i]
@@ -866,11 +2859,25 @@ func (st *initState) setupFilesystem(extra_whitelist []oz.WhitelistItem, extra_b
 		}
 	}
 
-	if err := st.bindWhitelist(st.fs, extra_whitelist); err != nil {
-		return err
+	if st.profile.EphemeralHomeOverlay {
+		if err := st.fs.MountHomeOverlay(st.user.HomeDir, int(st.uid), int(st.gid)); err != nil {
+			return err
+		}
+		// Binding the home items would let changes through to the host
+		// home, the overlay already shows them
+		for i := len(st.profile.Whitelist) - 1; i >= 0; i-- {
+			wl := st.profile.Whitelist[i]
+			if wl.Target == "" && !wl.SocketForward && whitelistItemIsEphemeral(wl) {
+				st.profile.Whitelist = append(st.profile.Whitelist[:i], st.profile.Whitelist[i+1:]...)
+			}
+		}
 	}
 
-	if err := st.bindWhitelist(st.fs, st.profile.Whitelist); err != nil {
+	wlist, err := st.checkWhitelist(append(append([]oz.WhitelistItem{}, extra_whitelist...), st.profile.Whitelist...))
+	if err != nil {
+		return err
+	}
+	if err := st.bindWhitelist(st.fs, wlist); err != nil {
 		return err
 	}
 
@@ -886,7 +2893,7 @@ func (st *initState) setupFilesystem(extra_whitelist []oz.WhitelistItem, extra_b
 		return err
 	}
 
-	if st.profile.XServer.Enabled {
+	if st.profile.XServer.UsesXpra() {
 		xprapath, err := xpra.CreateDir(st.user, st.profile.Name)
 		if err != nil {
 			return err
@@ -894,6 +2901,28 @@ func (st *initState) setupFilesystem(extra_whitelist []oz.WhitelistItem, extra_b
 		if err := st.fs.BindPath(xprapath, 0, st.display); err != nil {
 			return err
 		}
+	} else if st.profile.XServer.IsDirect() {
+		xsock := fmt.Sprintf("/tmp/.X11-unix/X%d", st.display)
+		if err := st.fs.BindPath(xsock, 0, st.display); err != nil {
+			return fmt.Errorf("unable to bind the host X11 socket: %v", err)
+		}
+	} else if st.profile.XServer.IsWayland() {
+		wsock := path.Join("/run/user/${UID}", st.waylandDisplay)
+		if err := st.fs.BindPath(wsock, 0, st.display); err != nil {
+			return fmt.Errorf("unable to bind the host Wayland socket: %v", err)
+		}
+	}
+	if sd := st.profile.XServer.SecondaryDisplay; sd > 0 {
+		xsock := fmt.Sprintf("/tmp/.X11-unix/X%d", sd)
+		if err := st.fs.BindPath(xsock, 0, st.display); err != nil {
+			return fmt.Errorf("unable to bind the socket of the secondary display: %v", err)
+		}
+	}
+
+	if st.config.ReadOnlyRoot {
+		if err := st.setupReadOnlyRoot(); err != nil {
+			return err
+		}
 	}
 
 	if err := st.fs.Chroot(); err != nil {
@@ -908,7 +2937,89 @@ func (st *initState) setupFilesystem(extra_whitelist []oz.WhitelistItem, extra_b
 	if st.profile.NoSysProc != true {
 		mo.add(st.fs.MountProc, st.fs.MountSys)
 	}
-	return mo.run()
+	if err := mo.run(); err != nil {
+		return err
+	}
+
+	if err := st.startSocketForwards(); err != nil {
+		return err
+	}
+
+	if len(st.whitelistFailures) > 0 {
+		st.log.Warning("%d whitelist items failed to bind: %s", len(st.whitelistFailures), strings.Join(st.whitelistFailures, "; "))
+	}
+	return nil
+}
+
+// Directory of the sandbox holding the etc files with read_only_root
+const etcFilesDir = "/run/oz-etc"
+
+// Size of the tmpfs mounted on the runtime directory with read_only_root
+const runtimeDirSizeMB = 32
+
+// setupReadOnlyRoot remounts the sandbox root read-only. The etc files,
+// written once in the chroot and again by SetHostname, are kept writable,
+// and so is the runtime directory of the user unless binds created it.
+func (st *initState) setupReadOnlyRoot() error {
+	names := []string{}
+	for name := range st.etcFiles() {
+		names = append(names, name)
+	}
+	if err := st.fs.MountWritableFiles(etcFilesDir, "/etc", names); err != nil {
+		return err
+	}
+	if st.config.SetXdgRuntimeDir {
+		dir := st.runtimeDir()
+		if _, err := os.Stat(path.Join(st.fs.Root(), dir)); os.IsNotExist(err) {
+			if err := st.fs.MountTmpfs(dir, runtimeDirSizeMB, 0700, int(st.uid), int(st.gid)); err != nil {
+				st.log.Warning("Runtime directory %s left read-only: %v", dir, err)
+			}
+		}
+	}
+	return st.fs.RemountRootReadOnly()
+}
+
+// bindDevices binds the devices of the profile, the groups owning them
+// except root being added to those of the launched programs
+func (st *initState) bindDevices() error {
+	for _, pattern := range st.profile.Devices {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid device '%s': %v", pattern, err)
+		}
+		if len(matches) == 0 {
+			st.log.Warning("No device matching %s, ignored", pattern)
+		}
+		for _, dev := range matches {
+			gid, err := st.fs.BindDevice(dev, st.profile.AllowBlockDevices)
+			if err != nil {
+				return fmt.Errorf("unable to bind device: %v", err)
+			}
+			if gid == 0 {
+				st.log.Warning("Device %s belongs to the root group, which is not given to programs", dev)
+			} else if gid != st.gid {
+				st.deviceGids = append(st.deviceGids, gid)
+			}
+		}
+	}
+	return nil
+}
+
+func (st *initState) mountTmpfs(fsys *fs.Filesystem, items []oz.TmpfsItem) error {
+	for _, t := range items {
+		tpath, err := fs.ResolvePathNoGlob(t.Path, -1, st.user, fsys.GetXDGDirs(), st.profile)
+		if err != nil {
+			return err
+		}
+		mode, err := strconv.ParseUint(t.Mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid tmpfs mode '%s' for %s: %v", t.Mode, t.Path, err)
+		}
+		if err := fsys.MountTmpfs(tpath, t.SizeMB, os.FileMode(mode), int(st.uid), int(st.gid)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (st *initState) createBindSymlinks(fsys *fs.Filesystem, wlist []oz.WhitelistItem) error {
@@ -957,6 +3068,9 @@ func (st *initState) bindWhitelist(fsys *fs.Filesystem, wlist []oz.WhitelistItem
 		if wl.Ignore {
 			flags |= fs.BindIgnore
 		}
+		if wl.Optional {
+			flags |= fs.BindOptional
+		}
 		if wl.ReadOnly {
 			flags |= fs.BindReadOnly
 		}
@@ -970,16 +3084,217 @@ func (st *initState) bindWhitelist(fsys *fs.Filesystem, wlist []oz.WhitelistItem
 		if wl.NoFollow {
 			flags |= fs.BindNoFollow
 		}
+		if wl.NoExec {
+			flags |= fs.BindNoExec
+		}
 		if wl.Path == "" {
 			continue
 		}
-		if err := fsys.BindTo(wl.Path, wl.Target, flags, st.display); err != nil {
+		var err error
+		if wl.SocketForward {
+			err = st.bindForwardedSocket(fsys, wl)
+		} else if wl.SourceRoot != "" {
+			err = fsys.BindFromRoot(wl.SourceRoot, wl.Path, wl.Target, flags, st.display)
+		} else {
+			err = fsys.BindTo(wl.Path, wl.Target, flags, st.display)
+		}
+		if err != nil {
+			if !st.config.WhitelistBestEffort {
+				return err
+			}
+			st.whitelistFailures = append(st.whitelistFailures, err.Error())
+		}
+	}
+	return nil
+}
+
+// Directory of the sandbox where the host sockets of socket_forward whitelist
+// items are bound, which only root and the group of the sandbox user can
+// traverse
+const socketForwardDir = "/run/oz-sockets"
+
+// A host unix socket bound at source in the sandbox, served to the sandbox
+// user at target
+type socketForward struct {
+	source string
+	target string
+}
+
+// bindForwardedSocket binds the host socket of wl in socketForwardDir, which
+// the sandbox user cannot list, for startSocketForwards to serve it at the
+// target of wl once in the chroot.
+func (st *initState) bindForwardedSocket(fsys *fs.Filesystem, wl oz.WhitelistItem) error {
+	src, err := fs.ResolvePathNoGlob(wl.Path, st.display, st.user, fsys.GetXDGDirs(), st.profile)
+	if err != nil {
+		return err
+	}
+	target := src
+	if wl.Target != "" {
+		if target, err = fs.ResolvePathNoGlob(wl.Target, st.display, st.user, fsys.GetXDGDirs(), st.profile); err != nil {
+			return err
+		}
+	}
+	fi, err := os.Stat(src)
+	if err != nil && (wl.Ignore || wl.Optional) && os.IsNotExist(err) {
+		st.log.Warning("Socket %s missing and ignored", src)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s is not a unix socket", src)
+	}
+	source := path.Join(socketForwardDir, strconv.Itoa(len(st.socketForwards)))
+	if err := fsys.BindTo(src, source, 0, st.display); err != nil {
+		return err
+	}
+	// Binding gives the directory the permissions of the source directory
+	dir := path.Join(fsys.Root(), socketForwardDir)
+	if err := os.Chown(dir, 0, int(st.gid)); err != nil {
+		return err
+	}
+	if err := os.Chmod(dir, 0710); err != nil {
+		return err
+	}
+	st.socketForwards = append(st.socketForwards, socketForward{source: source, target: target})
+	return nil
+}
+
+// startSocketForwards listens on the targets of the socket_forward items,
+// with sockets owned by the sandbox user, and proxies their connections to
+// the host sockets. The host sockets are connected with the credentials of
+// the sandbox user, so that servers checking the peer credentials, such as
+// ssh-agent, see the sandbox user and not root.
+func (st *initState) startSocketForwards() error {
+	for _, sf := range st.socketForwards {
+		if err := mkdirUser(path.Dir(sf.target), int(st.uid), int(st.gid)); err != nil {
+			return err
+		}
+		l, err := net.Listen("unix", sf.target)
+		if err != nil {
+			return fmt.Errorf("unable to forward socket: %v", err)
+		}
+		if err := os.Chown(sf.target, int(st.uid), int(st.gid)); err != nil {
+			l.Close()
+			return err
+		}
+		if err := os.Chmod(sf.target, 0600); err != nil {
+			l.Close()
 			return err
 		}
+		st.log.Info("Forwarding socket %s to the host socket", sf.target)
+		stats := new(forwarderStats)
+		st.fwdLock.Lock()
+		st.fwdListeners = append(st.fwdListeners, l)
+		st.fwdStats[sf.target] = stats
+		st.fwdLock.Unlock()
+		go st.acceptForwarded(l, "unix", sf.source, stats)
 	}
 	return nil
 }
 
+// dialForwarded connects to addr, as the sandbox user when addr is the host
+// socket of a socket_forward item.
+func (st *initState) dialForwarded(proto, addr string) (net.Conn, error) {
+	if proto != "unix" {
+		return net.Dial(proto, addr)
+	}
+	for _, sf := range st.socketForwards {
+		if sf.source != addr {
+			continue
+		}
+		var conn net.Conn
+		err := asUser(int(st.uid), int(st.gid), st.userGroups(), func() error {
+			var err error
+			conn, err = net.Dial(proto, addr)
+			return err
+		})
+		return conn, err
+	}
+	return net.Dial(proto, addr)
+}
+
+// checkWhitelist drops the duplicated whitelist items and fails on items
+// binding different sources to the same target, unless whitelist failures
+// are tolerated in which case the first item binding the target is kept.
+func (st *initState) checkWhitelist(wlist []oz.WhitelistItem) ([]oz.WhitelistItem, error) {
+	resolve := func(wl oz.WhitelistItem) ([]fs.BindPair, error) {
+		return st.fs.ResolveBind(wl.SourceRoot, wl.Path, wl.Target, st.display)
+	}
+	kept, dups, conflicts := checkWhitelistTargets(wlist, resolve)
+	for _, d := range dups {
+		st.log.Warning("Ignoring duplicated whitelist item %s", d)
+	}
+	if len(conflicts) == 0 {
+		return kept, nil
+	}
+	if !st.config.WhitelistBestEffort {
+		return nil, conflicts[0]
+	}
+	for _, err := range conflicts {
+		st.log.Warning("Ignoring conflicting whitelist item: %v", err)
+		st.whitelistFailures = append(st.whitelistFailures, err.Error())
+	}
+	return kept, nil
+}
+
+func describeWhitelistItem(wl oz.WhitelistItem) string {
+	if wl.Target == "" || wl.Target == wl.Path {
+		return fmt.Sprintf("(%s)", wl.Path)
+	}
+	return fmt.Sprintf("(%s -> %s)", wl.Path, wl.Target)
+}
+
+// checkWhitelistTargets returns the items of wlist in order without those
+// binding only what earlier items already bind, described in dups, and
+// without those binding a target of an earlier item to another source,
+// reported in conflicts. Items which fail to resolve are kept for the bind
+// to report the error.
+func checkWhitelistTargets(wlist []oz.WhitelistItem, resolve func(oz.WhitelistItem) ([]fs.BindPair, error)) (kept []oz.WhitelistItem, dups []string, conflicts []error) {
+	type bound struct {
+		source string
+		item   oz.WhitelistItem
+	}
+	targets := make(map[string]bound)
+	for _, wl := range wlist {
+		if wl.Path == "" {
+			continue
+		}
+		pairs, err := resolve(wl)
+		if err != nil {
+			kept = append(kept, wl)
+			continue
+		}
+		var conflict error
+		duplicate := len(pairs) > 0
+		for _, p := range pairs {
+			b, ok := targets[path.Clean(p.Target)]
+			if !ok {
+				duplicate = false
+			} else if path.Clean(b.source) != path.Clean(p.Source) {
+				conflict = fmt.Errorf("whitelist items %s and %s bind different sources to %s",
+					describeWhitelistItem(b.item), describeWhitelistItem(wl), p.Target)
+				break
+			}
+		}
+		if conflict != nil {
+			conflicts = append(conflicts, conflict)
+			continue
+		}
+		if duplicate {
+			dups = append(dups, describeWhitelistItem(wl))
+			continue
+		}
+		for _, p := range pairs {
+			if _, ok := targets[path.Clean(p.Target)]; !ok {
+				targets[path.Clean(p.Target)] = bound{source: p.Source, item: wl}
+			}
+		}
+		kept = append(kept, wl)
+	}
+	return kept, dups, conflicts
+}
+
 func (st *initState) applyBlacklist(fsys *fs.Filesystem, blist []oz.BlacklistItem) error {
 	if blist == nil {
 		return nil
@@ -0,0 +1,957 @@
+package ozinit
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+
+	"github.com/subgraph/oz"
+	"github.com/subgraph/oz/fs"
+	"github.com/subgraph/oz/ipc"
+)
+
+func TestSharedFolderItem(t *testing.T) {
+	cases := []struct {
+		spath    string
+		expected oz.WhitelistItem
+	}{
+		{"/home/user/Downloads", oz.WhitelistItem{
+			Path:    "${HOME}/OZ/Firefox/Downloads",
+			Target:  "${HOME}/.shared/Downloads",
+			Symlink: "${HOME}/Downloads",
+		}},
+		{"/home/user/Documents/work", oz.WhitelistItem{
+			Path:    "${HOME}/OZ/Firefox/Documents-work",
+			Target:  "${HOME}/.shared/Documents-work",
+			Symlink: "${HOME}/Documents/work",
+		}},
+		{"/media/usb", oz.WhitelistItem{
+			Path:    "${HOME}/OZ/Firefox/external/usb",
+			Target:  "${HOME}/.shared/external/usb",
+			Symlink: "/media/usb",
+		}},
+		{"/mnt/data/", oz.WhitelistItem{
+			Path:    "${HOME}/OZ/Firefox/external/data",
+			Target:  "${HOME}/.shared/external/data",
+			Symlink: "/mnt/data",
+		}},
+		{"/", oz.WhitelistItem{
+			Path:    "${HOME}/OZ/Firefox/external/root",
+			Target:  "${HOME}/.shared/external/root",
+			Symlink: "/",
+		}},
+		{"/home/username/share", oz.WhitelistItem{
+			Path:    "${HOME}/OZ/Firefox/external/share",
+			Target:  "${HOME}/.shared/external/share",
+			Symlink: "/home/username/share",
+		}},
+	}
+	for _, c := range cases {
+		c.expected.CanCreate = true
+		item := sharedFolderItem(c.spath, "/home/user", "firefox")
+		if item != c.expected {
+			t.Errorf("shared folder %s: expected %+v, got %+v", c.spath, c.expected, item)
+		}
+	}
+}
+
+func TestRedactEnv(t *testing.T) {
+	env := []string{"OZ_TOKEN=secret", "OZ_EMPTY=", "OZ_EQ=a=b"}
+	expected := []string{"OZ_TOKEN=<redacted>", "OZ_EMPTY=<redacted>", "OZ_EQ=<redacted>"}
+	r := redactEnv(env)
+	for i := range expected {
+		if r[i] != expected[i] {
+			t.Errorf("expected %s, got %s", expected[i], r[i])
+		}
+	}
+	if env[0] != "OZ_TOKEN=secret" {
+		t.Errorf("redactEnv modified its argument: %s", env[0])
+	}
+}
+
+func TestIsValidHostname(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"firefox":               true,
+		"firefox-2":             true,
+		"2fa":                   true,
+		"":                      false,
+		"-firefox":              false,
+		"firefox-":              false,
+		"fire.fox":              false,
+		"fire_fox":              false,
+		"fire fox":              false,
+		strings.Repeat("a", 63): true,
+		strings.Repeat("a", 64): false,
+	} {
+		if isValidHostname(name) != expected {
+			t.Errorf("expected isValidHostname(%q) to be %v", name, expected)
+		}
+	}
+}
+
+func TestMinimalPasswd(t *testing.T) {
+	u := &user.User{Username: "alice", Name: "Alice", HomeDir: "/home/alice"}
+	expected := "root:x:0:0:root:/root:/usr/sbin/nologin\n" +
+		"alice:x:1000:1000:Alice:/home/alice:/bin/bash\n" +
+		"nobody:x:65534:65534:nobody:/nonexistent:/usr/sbin/nologin"
+	if p := minimalPasswd(u, 1000, 1000, "/bin/bash"); p != expected {
+		t.Errorf("expected passwd:\n%s\ngot:\n%s", expected, p)
+	}
+
+	gids := map[string]uint32{"video": 44, "audio": 29, "users": 100}
+	expected = "root:x:0:\nalice:x:1000:\naudio:x:29:alice\nusers:x:100:alice\nvideo:x:44:alice\nnogroup:x:65534:"
+	if g := minimalGroup("alice", 1000, gids); g != expected {
+		t.Errorf("expected group:\n%s\ngot:\n%s", expected, g)
+	}
+	expected = "root:x:0:\nusers:x:100:\naudio:x:29:alice\nvideo:x:44:alice\nnogroup:x:65534:"
+	if g := minimalGroup("alice", 100, gids); g != expected {
+		t.Errorf("expected group with named primary group:\n%s\ngot:\n%s", expected, g)
+	}
+}
+
+func TestProxyForwarderProto(t *testing.T) {
+	st := &initState{}
+	for _, proto := range []string{"ip4:icmp", "unixpacket", ""} {
+		conn, peer := net.Pipe()
+		if err := st.proxyForwarder(conn, proto, "127.0.0.1:1", nil); err == nil {
+			t.Errorf("expected protocol '%s' to be rejected", proto)
+		}
+		if _, err := peer.Write([]byte("x")); err == nil {
+			t.Errorf("expected the connection to be closed for protocol '%s'", proto)
+		}
+	}
+}
+
+func TestSeccompBinary(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root to own the binary")
+	}
+	dir, err := ioutil.TempDir("", "seccomp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	exe := path.Join(dir, "oz-seccomp-new")
+	if err := ioutil.WriteFile(exe, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	noexec := path.Join(dir, "policy")
+	if err := ioutil.WriteFile(noexec, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	writable := path.Join(dir, "writable")
+	if err := ioutil.WriteFile(writable, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(writable, 0775)
+	owned := path.Join(dir, "owned")
+	if err := ioutil.WriteFile(owned, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(owned, 65534, 65534); err != nil {
+		t.Fatal(err)
+	}
+	shared := path.Join(dir, "shared")
+	if err := os.Mkdir(shared, 0777); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(shared, 0777)
+	inShared := path.Join(shared, "oz-seccomp")
+	if err := ioutil.WriteFile(inShared, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	st := &initState{config: &oz.Config{PrefixPath: "/usr/local"}}
+	for bpath, expected := range map[string]string{
+		"":                        "/usr/local/bin/oz-seccomp",
+		exe:                       exe,
+		noexec:                    "",
+		writable:                  "",
+		owned:                     "",
+		inShared:                  "",
+		dir:                       "",
+		path.Join(dir, "no-such"): "",
+	} {
+		p := &oz.Profile{Name: "app"}
+		p.Seccomp.BinaryPath = bpath
+		spath, err := st.seccompBinary(p)
+		if expected == "" && err == nil {
+			t.Errorf("expected binary path %s to be rejected, got %s", bpath, spath)
+		} else if expected != "" && (err != nil || spath != expected) {
+			t.Errorf("expected %s for binary path '%s', got %s (%v)", expected, bpath, spath, err)
+		}
+	}
+}
+
+func TestReadLines(t *testing.T) {
+	long := strings.Repeat("A", 100)
+	input := "first\r\n" + long + "\nafter\n" + long + long + "\nlast"
+	type line struct {
+		text      string
+		truncated bool
+	}
+	var lines []line
+	err := readLines(strings.NewReader(input), 32, func(text string, truncated bool) {
+		lines = append(lines, line{text, truncated})
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []line{
+		{"first", false},
+		{long[:32], true},
+		{"after", false},
+		{long[:32], true},
+		{"last", false},
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %+v, got %+v", expected, lines)
+	}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], lines[i])
+		}
+	}
+}
+
+func TestCreateUserFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outputlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	uid, gid := os.Getuid(), os.Getgid()
+
+	fpath := path.Join(dir, ".local/share/oz/app.log")
+	f, err := createUserFile(fpath, uid, gid)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f.WriteString("first launch\n")
+	f.Close()
+	if f, err = createUserFile(fpath, uid, gid); err != nil {
+		t.Fatalf("unexpected error reopening: %v", err)
+	}
+	f.Close()
+	if bs, _ := ioutil.ReadFile(fpath); len(bs) != 0 {
+		t.Errorf("expected the file to be truncated, got %q", bs)
+	}
+
+	target := path.Join(dir, "target")
+	if err := ioutil.WriteFile(target, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := path.Join(dir, "link.log")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createUserFile(link, uid, gid); err == nil {
+		t.Error("expected a symlink to be refused")
+	}
+	if bs, _ := ioutil.ReadFile(target); string(bs) != "keep" {
+		t.Errorf("symlink target was modified: %q", bs)
+	}
+
+	if uid != 0 {
+		return
+	}
+	// A directory of the path swapped by the user for a symlink to a
+	// directory only root can write
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	private := path.Join(dir, "private")
+	if err := os.Mkdir(private, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(private, path.Join(dir, "logs")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createUserFile(path.Join(dir, "logs/oz/app.log"), 65534, 65534); err == nil {
+		t.Error("expected the directories to be created with the permissions of the user")
+	}
+	if _, err := os.Stat(path.Join(private, "oz")); err == nil {
+		t.Error("expected no directory created through the symlink")
+	}
+}
+
+func TestProgramGroups(t *testing.T) {
+	gids := map[string]uint32{"video": 44, "audio": 29, "users": 100, "debian-tor": 120}
+	cases := []struct {
+		groups   []string
+		xserver  bool
+		audio    oz.AudioMode
+		expected []uint32
+	}{
+		{[]string{"users"}, false, oz.PROFILE_AUDIO_NONE, []uint32{1000, 100}},
+		{[]string{"users", "unknown"}, true, oz.PROFILE_AUDIO_NONE, []uint32{1000, 100, 44}},
+		{[]string{"debian-tor", "video"}, true, oz.PROFILE_AUDIO_PULSE, []uint32{1000, 120, 44, 29}},
+	}
+	for _, c := range cases {
+		p := &oz.Profile{Groups: c.groups}
+		p.XServer.Enabled = c.xserver
+		p.XServer.AudioMode = c.audio
+		st := &initState{profile: p, gid: 1000, gids: gids}
+		groups := st.programGroups()
+		if fmt.Sprint(groups) != fmt.Sprint(c.expected) {
+			t.Errorf("groups %v: expected %v, got %v", c.groups, c.expected, groups)
+		}
+	}
+
+	st := &initState{profile: &oz.Profile{}, gid: 1000, gids: gids}
+	if groups := st.programGroups(); len(groups) != len(gids)+1 {
+		t.Errorf("expected all the allowed groups without a groups list, got %v", groups)
+	}
+
+	st = &initState{profile: &oz.Profile{Groups: []string{"users"}}, gid: 1000, gids: gids, deviceGids: []uint32{100, 85}}
+	if groups := st.programGroups(); fmt.Sprint(groups) != fmt.Sprint([]uint32{1000, 100, 85}) {
+		t.Errorf("expected the device groups to be added once, got %v", groups)
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	cases := []struct {
+		wstatus  syscall.WaitStatus
+		expected int
+	}{
+		{0, 0},
+		{3 << 8, 3},
+		{syscall.WaitStatus(syscall.SIGKILL), 128 + 9},
+		{syscall.WaitStatus(syscall.SIGTERM), 128 + 15},
+	}
+	for _, c := range cases {
+		if got := exitStatus(c.wstatus); got != c.expected {
+			t.Errorf("exitStatus(%#x) = %d, expected %d", uint32(c.wstatus), got, c.expected)
+		}
+	}
+}
+
+func TestRunSetupScript(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("running as the sandbox user requires root")
+	}
+	dir, err := ioutil.TempDir("", "oz-setup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := path.Join(dir, "setup.sh")
+	seeded := path.Join(dir, "seeded")
+	st := &initState{
+		log:       logging.MustGetLogger("test"),
+		profile:   &oz.Profile{SetupScript: script},
+		launchEnv: []string{"SEEDED=" + seeded},
+	}
+
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho seeding\ntouch \"$SEEDED\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.runSetupScript(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(seeded); err != nil {
+		t.Errorf("setup script did not run: %v", err)
+	}
+
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\nexit 3\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.runSetupScript(); err == nil {
+		t.Error("expected an error from a failing setup script")
+	}
+}
+
+func TestStdinPipe(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	st := &initState{uid: 1000, stdinPipes: map[int]io.WriteCloser{42: w}}
+
+	if _, errmsg := st.stdinPipe(42, &ipc.Message{Ucred: &syscall.Ucred{Uid: 1001}}); errmsg == nil || errmsg.Code != oz.ErrPermission {
+		t.Errorf("expected a permission error for another user, got %+v", errmsg)
+	}
+	if _, errmsg := st.stdinPipe(42, &ipc.Message{}); errmsg == nil || errmsg.Code != oz.ErrPermission {
+		t.Errorf("expected a permission error without credentials, got %+v", errmsg)
+	}
+	if _, errmsg := st.stdinPipe(43, &ipc.Message{Ucred: &syscall.Ucred{Uid: 1000}}); errmsg == nil || errmsg.Code != oz.ErrNotFound {
+		t.Errorf("expected a not found error for an unknown pid, got %+v", errmsg)
+	}
+	for _, uid := range []uint32{0, 1000} {
+		p, errmsg := st.stdinPipe(42, &ipc.Message{Ucred: &syscall.Ucred{Uid: uid}})
+		if errmsg != nil || p != w {
+			t.Errorf("expected the stdin pipe for uid %d, got %v %+v", uid, p, errmsg)
+		}
+	}
+}
+
+func TestWriteStdinTimeout(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	defer w.Close()
+
+	if err := writeStdin(w, []byte("read later\n"), time.Second); err != nil {
+		t.Fatalf("unexpected error writing to the pipe buffer: %v", err)
+	}
+	// More than the pipe buffer, which the program never reads
+	if err := writeStdin(w, make([]byte, 1<<20), 100*time.Millisecond); err == nil {
+		t.Error("expected the write to time out")
+	}
+}
+
+func TestCheckWhitelistTargets(t *testing.T) {
+	resolve := func(wl oz.WhitelistItem) ([]fs.BindPair, error) {
+		if wl.Path == "/unresolved" {
+			return nil, os.ErrNotExist
+		}
+		if wl.Path == "/glob/*" {
+			return []fs.BindPair{{Source: "/glob/a", Target: "/glob/a"}, {Source: "/glob/b", Target: "/glob/b"}}, nil
+		}
+		target := wl.Target
+		if target == "" {
+			target = wl.Path
+		}
+		return []fs.BindPair{{Source: wl.Path, Target: target}}, nil
+	}
+	wlist := []oz.WhitelistItem{
+		{Path: "/home/user/Downloads"},
+		{Path: "/home/user/Downloads/"},
+		{Path: "/home/user/Other", Target: "/home/user/Downloads"},
+		{Path: "/glob/a"},
+		{Path: "/glob/*"},
+		{Path: "/unresolved"},
+		{Path: ""},
+	}
+	kept, dups, conflicts := checkWhitelistTargets(wlist, resolve)
+
+	expected := []string{"/home/user/Downloads", "/glob/a", "/glob/*", "/unresolved"}
+	if len(kept) != len(expected) {
+		t.Fatalf("expected %d items kept, got %+v", len(expected), kept)
+	}
+	for i, p := range expected {
+		if kept[i].Path != p {
+			t.Errorf("expected item %d to be %s, got %s", i, p, kept[i].Path)
+		}
+	}
+	if len(dups) != 1 || dups[0] != "(/home/user/Downloads/)" {
+		t.Errorf("unexpected duplicates: %v", dups)
+	}
+	if len(conflicts) != 1 {
+		t.Fatalf("expected 1 conflict, got %v", conflicts)
+	}
+	for _, s := range []string{"(/home/user/Downloads)", "(/home/user/Other -> /home/user/Downloads)"} {
+		if !strings.Contains(conflicts[0].Error(), s) {
+			t.Errorf("conflict %q does not name %s", conflicts[0], s)
+		}
+	}
+}
+
+func TestSetChildTracked(t *testing.T) {
+	st := &initState{
+		profile:  &oz.Profile{AutoShutdown: oz.PROFILE_SHUTDOWN_YES},
+		children: map[int]procState{2: {track: true}, 3: {track: true}, 4: {track: false}},
+	}
+	if errmsg := st.setChildTracked(5, false); errmsg == nil || errmsg.Code != oz.ErrNotFound {
+		t.Errorf("detaching an unknown child returned %+v", errmsg)
+	}
+	if errmsg := st.setChildTracked(2, false); errmsg != nil {
+		t.Fatalf("detaching a tracked child failed: %+v", errmsg)
+	}
+	if st.children[2].track {
+		t.Error("detached child is still tracked")
+	}
+	if errmsg := st.setChildTracked(3, false); errmsg == nil || errmsg.Code != oz.ErrInvalid {
+		t.Errorf("detaching the last tracked child returned %+v", errmsg)
+	}
+	if errmsg := st.setChildTracked(4, true); errmsg != nil || !st.children[4].track {
+		t.Errorf("attaching a detached child failed: %+v", errmsg)
+	}
+	if errmsg := st.setChildTracked(3, false); errmsg != nil {
+		t.Errorf("detaching a child with another tracked child failed: %+v", errmsg)
+	}
+
+	st.profile.AutoShutdown = oz.PROFILE_SHUTDOWN_NO
+	if errmsg := st.setChildTracked(4, false); errmsg != nil {
+		t.Errorf("detaching the last tracked child without autoshutdown failed: %+v", errmsg)
+	}
+}
+
+func TestScheduledShutdownCancel(t *testing.T) {
+	st := &initState{
+		log:      logging.MustGetLogger("oz-test"),
+		profile:  &oz.Profile{AutoShutdown: oz.PROFILE_SHUTDOWN_YES, ShutdownDelay: 3600},
+		children: map[int]procState{},
+	}
+	st.scheduleShutdown(time.Hour)
+	if st.shutdownTimer == nil {
+		t.Fatal("no shutdown was scheduled")
+	}
+	st.addChildProcess(&exec.Cmd{Process: &os.Process{Pid: 2}}, false)
+	if st.shutdownTimer == nil {
+		t.Error("untracked child cancelled the scheduled shutdown")
+	}
+	if errmsg := st.setChildTracked(2, true); errmsg != nil {
+		t.Fatalf("attaching the child failed: %+v", errmsg)
+	}
+	if st.shutdownTimer != nil {
+		t.Error("attached child did not cancel the scheduled shutdown")
+	}
+
+	st.scheduleShutdown(time.Hour)
+	st.addChildProcess(&exec.Cmd{Process: &os.Process{Pid: 3}}, true)
+	if st.shutdownTimer != nil {
+		t.Error("tracked child did not cancel the scheduled shutdown")
+	}
+}
+
+func TestParseDbusLaunch(t *testing.T) {
+	addr := "unix:path=/tmp/dbus-Ab1,guid=f00"
+	for _, out := range []string{
+		"DBUS_SESSION_BUS_ADDRESS='" + addr + "';\nexport DBUS_SESSION_BUS_ADDRESS;\nDBUS_SESSION_BUS_PID=12;\n",
+		"DBUS_SESSION_BUS_PID=12;\n  export DBUS_SESSION_BUS_ADDRESS ; DBUS_SESSION_BUS_ADDRESS = \"" + addr + "\" ;\n\x00",
+		"export DBUS_SESSION_BUS_ADDRESS=" + addr + "\n",
+	} {
+		env, err := parseDbusLaunch([]byte(out))
+		if err != nil {
+			t.Errorf("parsing %q failed: %v", out, err)
+		} else if env != "DBUS_SESSION_BUS_ADDRESS="+addr {
+			t.Errorf("parsing %q returned %q", out, env)
+		}
+	}
+	for _, out := range []string{"", "DBUS_SESSION_BUS_PID=12;\n", "DBUS_SESSION_BUS_ADDRESS='';\n"} {
+		if env, err := parseDbusLaunch([]byte(out)); err == nil {
+			t.Errorf("expected parsing %q to fail, got %q", out, env)
+		}
+	}
+}
+
+func TestStartSocketForwards(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sockfwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Let the sandbox user reach the host socket and create the target
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	source := path.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := os.Chmod(source, 0777); err != nil {
+		t.Fatal(err)
+	}
+	peers := make(chan uint32, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			f, err := c.(*net.UnixConn).File()
+			if err == nil {
+				if cred, err := syscall.GetsockoptUcred(int(f.Fd()), syscall.SOL_SOCKET, syscall.SO_PEERCRED); err == nil {
+					peers <- cred.Uid
+				}
+				f.Close()
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	const nobody = 65534
+	target := path.Join(dir, "run/user/agent")
+	st := &initState{
+		log:            logging.MustGetLogger("test"),
+		uid:            nobody,
+		gid:            nobody,
+		profile:        &oz.Profile{},
+		fwdConns:       make(map[net.Conn]net.Conn),
+		fwdStats:       make(map[string]*forwarderStats),
+		socketForwards: []socketForward{{source: source, target: target}},
+	}
+	if err := st.startSocketForwards(); err != nil {
+		t.Fatal(err)
+	}
+	defer st.shutdownForwarders()
+
+	fi, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0600 {
+		t.Errorf("expected a socket with mode 0600, got %v", fi.Mode())
+	}
+	c, err := net.Dial("unix", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("expected the host socket to echo through the forward, got %q, %v", buf, err)
+	}
+	select {
+	case uid := <-peers:
+		if uid != nobody {
+			t.Errorf("expected the host socket to see uid %d, got %d", nobody, uid)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the peer credentials of the forwarded connection")
+	}
+}
+
+func boundingSet(t *testing.T, cmd *exec.Cmd) uint64 {
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var set uint64
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(out)), "CapBnd:\t%x", &set); err != nil {
+		t.Fatalf("cannot parse %q: %v", out, err)
+	}
+	return set
+}
+
+func TestStartWithoutCaps(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("dropping capabilities from the bounding set requires root")
+	}
+	netRaw := uint64(1) << uint(oz.Capabilities["CAP_NET_RAW"])
+	if boundingSet(t, exec.Command("grep", "CapBnd", "/proc/self/status"))&netRaw == 0 {
+		t.Skip("CAP_NET_RAW is not in the bounding set")
+	}
+
+	cmd := exec.Command("grep", "CapBnd", "/proc/self/status")
+	var out []byte
+	err := startWithoutCaps(func() (err error) {
+		out, err = cmd.Output()
+		return err
+	}, []int{oz.Capabilities["CAP_NET_RAW"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var set uint64
+	fmt.Sscanf(strings.TrimSpace(string(out)), "CapBnd:\t%x", &set)
+	if set == 0 || set&netRaw != 0 {
+		t.Errorf("expected only CAP_NET_RAW to be dropped from the bounding set, got %x", set)
+	}
+	if boundingSet(t, exec.Command("grep", "CapBnd", "/proc/self/status"))&netRaw == 0 {
+		t.Error("CAP_NET_RAW was dropped from the bounding set of later programs")
+	}
+}
+
+func TestCreateRuntimeDir(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("creating a directory owned by another user requires root")
+	}
+	dir, err := ioutil.TempDir("", "oz-rundir-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rundir := path.Join(dir, "run/user/1000")
+	if err := createRuntimeDir(rundir, 1000, 1000); err != nil {
+		t.Fatal(err)
+	}
+	for p, expected := range map[string]uint32{path.Join(dir, "run/user"): 0, rundir: 1000} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uid := fi.Sys().(*syscall.Stat_t).Uid; uid != expected {
+			t.Errorf("%s is owned by %d, expected %d", p, uid, expected)
+		}
+	}
+	if fi, _ := os.Stat(rundir); fi.Mode().Perm() != 0700 {
+		t.Errorf("runtime directory has mode %v, expected 0700", fi.Mode().Perm())
+	}
+
+	os.Chown(rundir, 1001, 1001)
+	if err := createRuntimeDir(rundir, 1000, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(rundir); fi.Sys().(*syscall.Stat_t).Uid != 1001 {
+		t.Error("an existing runtime directory was changed")
+	}
+}
+
+func TestReadOnlyRootEtcFiles(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+	// The mount namespace is private to this thread, which is never
+	// unlocked so that it exits with the test goroutine
+	runtime.LockOSThread()
+	if err := syscall.Unshare(syscall.CLONE_NEWNS); err != nil {
+		t.Skipf("unable to create a mount namespace: %v", err)
+	}
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		t.Fatalf("failed to make mounts private: %v", err)
+	}
+	base, err := ioutil.TempDir("", "oz-rootfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	u := &user.User{Uid: "1000", Gid: "1000", Username: "user", HomeDir: "/home/user"}
+	p := &oz.Profile{Name: "app"}
+	config := &oz.Config{SandboxPath: base, ReadOnlyRoot: true, MinimalPasswd: true, ShellPath: "/bin/sh", SetXdgRuntimeDir: true}
+	st := &initState{
+		log:      logging.MustGetLogger("test"),
+		config:   config,
+		profile:  p,
+		user:     u,
+		uid:      1000,
+		gid:      1000,
+		fs:       fs.NewFilesystem(config, nil, u, p),
+		hostname: "app",
+		dbusUuid: "0123456789abcdef",
+	}
+	root := st.fs.Root()
+	if err := os.MkdirAll(path.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mount("tmpfs", root, "tmpfs", 0, "mode=755"); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unmount(root, syscall.MNT_DETACH)
+	if err := os.Mkdir(path.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := st.setupReadOnlyRoot(); err != nil {
+		t.Fatal(err)
+	}
+	etc := path.Join(root, "etc")
+	if err := ioutil.WriteFile(path.Join(etc, "other"), []byte("x"), 0644); err == nil {
+		t.Error("expected the root to be read-only")
+	}
+	st.writeEtcFiles(etc)
+	for name, expected := range map[string]string{
+		"hostname":   "app",
+		"machine-id": "0123456789abcdef",
+		"passwd":     "user:x:1000:1000",
+	} {
+		data, err := ioutil.ReadFile(path.Join(etc, name))
+		if err != nil || !strings.Contains(string(data), expected) {
+			t.Errorf("expected /etc/%s to contain %q, got %q, %v", name, expected, data, err)
+		}
+	}
+	if data, _ := ioutil.ReadFile(path.Join(etc, "hosts")); !strings.Contains(string(data), "app") {
+		t.Errorf("expected /etc/hosts to name the sandbox, got %q", data)
+	}
+	rundir := path.Join(root, "run/user/1000")
+	if err := createRuntimeDir(rundir, 1000, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(rundir, "file"), []byte("x"), 0600); err != nil {
+		t.Errorf("expected the runtime directory to be writable: %v", err)
+	}
+	if fi, err := os.Stat(rundir); err != nil || fi.Sys().(*syscall.Stat_t).Uid != 1000 || fi.Mode().Perm() != 0700 {
+		t.Errorf("expected the runtime directory to be owned by the user with mode 0700, got %v", err)
+	}
+}
+
+func TestReadMountInfo(t *testing.T) {
+	f, err := ioutil.TempFile("", "mountinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("36 35 98:0 /my\\040docs /home/user/My\\040Documents ro,noatime master:1 - ext4 /dev/mapper/a\\134b rw\n")
+	f.Close()
+
+	mounts, err := readMountInfo(f.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(mounts) != 1 {
+		t.Fatalf("expected a single mount, got %v", mounts)
+	}
+	me := mounts[0]
+	if me.Root != "/my docs" || me.Target != "/home/user/My Documents" || me.Source != "/dev/mapper/a\\b" {
+		t.Errorf("escapes not decoded: %+v", me)
+	}
+	if me.FsType != "ext4" || !me.ReadOnly {
+		t.Errorf("unexpected mount entry %+v", me)
+	}
+}
+
+func TestExpandEnvironment(t *testing.T) {
+	u := &user.User{Uid: "1000", Username: "user", HomeDir: "/home/user"}
+	p := &oz.Profile{Name: "app", Environment: []oz.EnvVar{
+		{Name: "CACHE", Value: "${HOME}/.cache/app"},
+		{Name: "PATHS", Value: "/opt/${USER}:${HOME}/bin:${HOME}/.local/bin"},
+		{Name: "PULSE_SERVER", Value: "unix:/run/user/${UID}/pulse/native"},
+		{Name: "GDK_BACKEND", Value: "x11"},
+		{Name: "CLONED"},
+	}}
+	st := &initState{
+		log:     logging.MustGetLogger("test"),
+		profile: p,
+		user:    u,
+		fs:      fs.NewFilesystem(&oz.Config{}, nil, u, p),
+		launchEnv: []string{
+			"CACHE=${HOME}/.cache/app",
+			"PATHS=/opt/${USER}:${HOME}/bin:${HOME}/.local/bin",
+			"PULSE_SERVER=unix:/run/user/${UID}/pulse/native",
+			"GDK_BACKEND=x11",
+			"CLONED=${HOME}",
+		},
+	}
+	st.expandEnvironment()
+	expected := []string{
+		"CACHE=/home/user/.cache/app",
+		"PATHS=/opt/user:/home/user/bin:/home/user/.local/bin",
+		"PULSE_SERVER=unix:/run/user/1000/pulse/native",
+		"GDK_BACKEND=x11",
+		"CLONED=${HOME}",
+	}
+	for i, e := range expected {
+		if st.launchEnv[i] != e {
+			t.Errorf("expected %s, got %s", e, st.launchEnv[i])
+		}
+	}
+}
+
+func TestCaCertItems(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oz-cacerts-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	debian, redhat := path.Join(dir, "etc/ssl/certs"), path.Join(dir, "etc/pki/tls/certs")
+	if err := os.MkdirAll(debian, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(paths []string) { caCertPaths = paths }(caCertPaths)
+	caCertPaths = []string{debian, redhat}
+
+	items := caCertItems(nil)
+	if len(items) != 1 || items[0].Path != debian || !items[0].ReadOnly {
+		t.Errorf("expected a read-only item for the existing directory only, got %+v", items)
+	}
+	if items := caCertItems([]string{path.Join(dir, "etc/ssl") + "/"}); len(items) != 0 {
+		t.Errorf("expected no item for a directory of the etc includes, got %+v", items)
+	}
+}
+
+func TestStopAppKeepsSandbox(t *testing.T) {
+	st := &initState{
+		log:      logging.MustGetLogger("test"),
+		profile:  &oz.Profile{AutoShutdown: oz.PROFILE_SHUTDOWN_YES},
+		children: make(map[int]procState),
+	}
+	if _, err := st.stopApp(); err == nil {
+		t.Fatal("expected an error without any program running")
+	}
+
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	st.addChildProcess(cmd, true)
+	if n, err := st.stopApp(); err != nil || n != 1 {
+		t.Fatalf("expected one program stopped, got %d: %v", n, err)
+	}
+	cmd.Wait()
+	st.handleChildExit(cmd.Process.Pid, cmd.ProcessState.Sys().(syscall.WaitStatus))
+	if st.shutdownRequested {
+		t.Error("expected the sandbox to be kept running")
+	}
+	if st.stoppingApp {
+		t.Error("expected the next program exit to shut the sandbox down again")
+	}
+}
+
+func TestAsUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root to change the filesystem uid")
+	}
+	dir, err := ioutil.TempDir("", "asuser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	const nobody = 65534
+
+	private := path.Join(dir, "private")
+	if err := os.Mkdir(private, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// A symlink planted by the user to a directory only root can write
+	link := path.Join(dir, "link")
+	if err := os.Symlink(private, link); err != nil {
+		t.Fatal(err)
+	}
+	err = asUser(nobody, nobody, nil, func() error {
+		return ioutil.WriteFile(path.Join(link, "file"), []byte("x"), 0644)
+	})
+	if err == nil {
+		t.Error("expected the write through the symlink to be refused")
+	}
+
+	owned := path.Join(dir, "owned")
+	if err := os.Mkdir(owned, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(owned, nobody, nobody); err != nil {
+		t.Fatal(err)
+	}
+	fpath := path.Join(owned, "file")
+	if err := asUser(nobody, nobody, nil, func() error {
+		return ioutil.WriteFile(fpath, []byte("x"), 0644)
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); st.Uid != nobody || st.Gid != nobody {
+		t.Errorf("expected the file to be owned by %d:%d, got %d:%d", nobody, nobody, st.Uid, st.Gid)
+	}
+
+	// The calling thread keeps the filesystem ids of root
+	if err := ioutil.WriteFile(path.Join(private, "file"), []byte("x"), 0644); err != nil {
+		t.Errorf("unexpected error writing as root: %v", err)
+	}
+}
@@ -1,27 +1,81 @@
 package ozinit
 
-import "github.com/subgraph/oz/ipc"
+import (
+	"github.com/subgraph/oz"
+	"github.com/subgraph/oz/ipc"
+	"github.com/subgraph/oz/network"
+)
 
 type OkMsg struct {
 	_ string "Ok"
 }
 
 type ErrorMsg struct {
-	Msg string "Error"
+	Msg  string "Error"
+	Code oz.ErrorCode
+}
+
+func (e *ErrorMsg) err() error {
+	return &oz.Error{Code: e.Code, Msg: e.Msg}
 }
 
 type PingMsg struct {
 	Data string "Ping"
 }
 
+// Written by oz-init on its stderr, read by the daemon, when the xpra client
+// of a profile with auto_reconnect has been disconnected
+const XpraClientLostLine = "XPRA-CLIENT-LOST"
+
 type RunShellMsg struct {
 	Term string "RunShell"
 }
 
 type RunProgramMsg struct {
-	Args []string "RunProgram"
-	Pwd  string
-	Path string
+	Args        []string "RunProgram"
+	Pwd         string
+	Path        string
+	SeccompMode oz.SeccompMode
+	// Hold the response until the program exits and answer with a
+	// ProgramExitMsg carrying its status
+	Wait bool
+	// Keep the stdin of the program open for WriteStdin and answer with a
+	// ProgramStartedMsg carrying its pid
+	Interactive bool
+	// Connect the first passed descriptor to the stdin of the program instead
+	// of passing it as descriptor 3
+	Stdin bool
+}
+
+type ProgramStartedMsg struct {
+	Pid int "ProgramStarted"
+}
+
+type WriteStdinMsg struct {
+	Pid  int "WriteStdin"
+	Data []byte
+}
+
+// Closes the stdin of an interactive program, which then reads EOF
+type CloseStdinMsg struct {
+	Pid int "CloseStdin"
+}
+
+// Stops counting a child towards keeping the sandbox alive, its exit neither
+// delaying nor triggering the automatic shutdown
+type DetachChildMsg struct {
+	Pid int "DetachChild"
+}
+
+// Counts a detached child towards keeping the sandbox alive again
+type AttachChildMsg struct {
+	Pid int "AttachChild"
+}
+
+// Exit status of a program run with Wait, 128 plus the signal number when it
+// was killed by a signal
+type ProgramExitMsg struct {
+	Status int "ProgramExit"
 }
 
 type ForwarderSuccessMsg struct {
@@ -30,6 +84,179 @@ type ForwarderSuccessMsg struct {
 	Addr  string
 }
 
+type ListMountsMsg struct {
+	_ string "ListMounts"
+}
+
+type MountEntry struct {
+	Source   string
+	Root     string
+	Target   string
+	FsType   string
+	Options  string
+	ReadOnly bool
+}
+
+type ListMountsResp struct {
+	Mounts []MountEntry "ListMountsResp"
+}
+
+type SetClipboardMsg struct {
+	Enabled bool "SetClipboard"
+}
+
+type DumpSeccompMsg struct {
+	_ string "DumpSeccomp"
+}
+
+type DumpSeccompResp struct {
+	Paths []string "DumpSeccompResp"
+}
+
+type ListForwarderStatsMsg struct {
+	_ string "ListForwarderStats"
+}
+
+// Traffic through the forwarders to Addr. BytesIn counts what clients sent
+// into the sandbox and BytesOut what was sent back to them.
+type ForwarderStats struct {
+	Addr     string
+	BytesIn  int64
+	BytesOut int64
+	Active   int
+}
+
+type ListForwarderStatsResp struct {
+	Stats []ForwarderStats "ListForwarderStatsResp"
+}
+
+type NetworkInfoMsg struct {
+	_ string "NetworkInfo"
+}
+
+type NetworkInfoResp struct {
+	Info network.NetInfo "NetworkInfoResp"
+}
+
+// Attach to the pty of the program with Pid, or of the only program running
+// in one if Pid is 0
+type AttachProgramMsg struct {
+	Pid int "AttachProgram"
+}
+
+// Largest content accepted by PutFile, to keep the messages small
+const MaxPutFileSize = 64 * 1024
+
+type PutFileMsg struct {
+	Path string "PutFile"
+	Mode uint32
+	Data []byte
+}
+
+type ProgramSpec struct {
+	Path string
+	Pwd  string
+	Args []string
+}
+
+type LaunchBatchMsg struct {
+	Specs []ProgramSpec "LaunchBatch"
+}
+
+// Outcome of each program of a batch in order, empty when it was launched
+type LaunchBatchResp struct {
+	Errors []string "LaunchBatchResp"
+}
+
+// Request for the OZ_ variables forwarded to the sandboxed processes, the
+// values are only returned when Unredacted is set
+type GetLaunchEnvMsg struct {
+	Unredacted bool "GetLaunchEnv"
+}
+
+type GetLaunchEnvResp struct {
+	Env []string "GetLaunchEnvResp"
+}
+
+type SetHostnameMsg struct {
+	Hostname string "SetHostname"
+}
+
+// Shows a desktop notification, Body being optional
+type NotifyMsg struct {
+	Summary string "Notify"
+	Body    string
+}
+
+type SeccompStatsMsg struct {
+	_ string "SeccompStats"
+}
+
+// Syscalls denied by the seccomp policies of the programs of a sandbox.
+// Denied counts the denials of policies which are not enforced, with the
+// names of the most recent ones in Recent, Killed the programs killed by an
+// enforced policy, whose denied syscall is not known.
+type SeccompStatsResp struct {
+	Denied int "SeccompStatsResp"
+	Killed int
+	Recent []string
+}
+
+// Terminates the tracked programs of the sandbox, which keeps running once
+// they have exited
+type StopAppMsg struct {
+	_ string "StopApp"
+}
+
+type PauseSandboxMsg struct {
+	_ string "PauseSandbox"
+}
+
+type ResumeSandboxMsg struct {
+	_ string "ResumeSandbox"
+}
+
+type SandboxStatsMsg struct {
+	_ string "SandboxStats"
+}
+
+// Resource usage summed over the processes of a sandbox
+type SandboxStats struct {
+	Processes int
+	CpuTimeMs int64
+	RssKB     int64
+	OpenFds   int
+}
+
+type SandboxStatsResp struct {
+	Stats SandboxStats "SandboxStatsResp"
+}
+
+type ListProcessesMsg struct {
+	_ string "ListProcesses"
+}
+
+// A process of the sandbox, Pid being in the pid namespace of the sandbox
+type ProcessEntry struct {
+	Pid     int
+	Command string
+	Tracked bool
+}
+
+type ListProcessesResp struct {
+	Processes []ProcessEntry "ListProcessesResp"
+}
+
+// Streams the output of a program launched with its output captured as
+// ProgramOutputMsg, ending with OkMsg once the program closes it
+type FollowProgramMsg struct {
+	Pid int "FollowProgram"
+}
+
+type ProgramOutputMsg struct {
+	Line string "ProgramOutput"
+}
+
 var messageFactory = ipc.NewMsgFactory(
 	new(OkMsg),
 	new(ErrorMsg),
@@ -37,4 +264,38 @@ var messageFactory = ipc.NewMsgFactory(
 	new(RunShellMsg),
 	new(RunProgramMsg),
 	new(ForwarderSuccessMsg),
+	new(ListMountsMsg),
+	new(ListMountsResp),
+	new(SetClipboardMsg),
+	new(DumpSeccompMsg),
+	new(DumpSeccompResp),
+	new(ListForwarderStatsMsg),
+	new(ListForwarderStatsResp),
+	new(NetworkInfoMsg),
+	new(NetworkInfoResp),
+	new(AttachProgramMsg),
+	new(PutFileMsg),
+	new(LaunchBatchMsg),
+	new(LaunchBatchResp),
+	new(GetLaunchEnvMsg),
+	new(GetLaunchEnvResp),
+	new(SetHostnameMsg),
+	new(PauseSandboxMsg),
+	new(ResumeSandboxMsg),
+	new(SandboxStatsMsg),
+	new(SandboxStatsResp),
+	new(ProgramExitMsg),
+	new(ProgramStartedMsg),
+	new(WriteStdinMsg),
+	new(CloseStdinMsg),
+	new(DetachChildMsg),
+	new(AttachChildMsg),
+	new(ListProcessesMsg),
+	new(ListProcessesResp),
+	new(FollowProgramMsg),
+	new(ProgramOutputMsg),
+	new(NotifyMsg),
+	new(SeccompStatsMsg),
+	new(SeccompStatsResp),
+	new(StopAppMsg),
 )
@@ -2,10 +2,13 @@ package ozinit
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/user"
 	"path"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/naegelejd/go-acl"
@@ -225,6 +228,44 @@ func setupEtcIncludes(fsys *fs.Filesystem, etcIncludes []string, display int) er
 	return nil
 }
 
+const zoneinfoPath = "/usr/share/zoneinfo"
+
+// setupTimezone binds the zoneinfo file of the timezone tz, or of the host
+// timezone if empty, at /etc/localtime and writes its name in /etc/timezone.
+// It returns false when the host timezone cannot be resolved, which is only
+// logged as sandboxes can then still be launched.
+func setupTimezone(fsys *fs.Filesystem, tz string, log *logging.Logger) (bool, error) {
+	src := path.Join(zoneinfoPath, tz)
+	if tz == "" {
+		var err error
+		// /etc/localtime is usually a symlink into the zoneinfo directory
+		if src, err = filepath.EvalSymlinks("/etc/localtime"); err != nil {
+			log.Warning("Unable to resolve host localtime, timezone not set: %v", err)
+			return false, nil
+		}
+		if bs, err := ioutil.ReadFile("/etc/timezone"); err == nil {
+			tz = strings.TrimSpace(string(bs))
+		} else if strings.HasPrefix(src, zoneinfoPath+"/") {
+			tz = strings.TrimPrefix(src, zoneinfoPath+"/")
+		}
+	}
+	if err := fsys.BindTo(src, "/etc/localtime", fs.BindReadOnly|fs.BindForce, -1); err != nil {
+		return false, err
+	}
+	if tz == "" {
+		return true, nil
+	}
+
+	// Replace an /etc/timezone bound from the host by the etc includes
+	tzpath := path.Join(fsys.Root(), "/etc/timezone")
+	syscall.Unmount(tzpath, syscall.MNT_DETACH)
+	if err := ioutil.WriteFile(tzpath, []byte(tz+"\n"), 0644); err != nil {
+		log.Warning("Unable to write /etc/timezone: %v", err)
+	}
+	log.Info("Sandbox timezone set to %s", tz)
+	return true, nil
+}
+
 func setupMountDirectory(fsys *fs.Filesystem, src string) error {
 	acls, err := acl.GetFileAccess(src)
 	if err != nil {
@@ -0,0 +1,76 @@
+package ozinit
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/subgraph/oz"
+
+	"github.com/op/go-logging"
+)
+
+// Number of denied syscall names kept by seccompStats, the oldest ones being
+// dropped first
+const seccompRecentSyscalls = 10
+
+// seccompStats counts the syscalls denied by the seccomp policies of the
+// programs of the sandbox. The names are only known for policies which are
+// not enforced, the denials being reported by oz-seccomp-tracer on a pipe of
+// its own, while an enforced policy kills the program with SIGSYS.
+type seccompStats struct {
+	lock   sync.Mutex
+	denied int
+	killed int
+	recent []string
+}
+
+// addSyscall counts a denied syscall
+func (ss *seccompStats) addSyscall(name string) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	ss.denied++
+	ss.recent = append(ss.recent, name)
+	if len(ss.recent) > seccompRecentSyscalls {
+		ss.recent = ss.recent[len(ss.recent)-seccompRecentSyscalls:]
+	}
+}
+
+// readHits counts the syscalls written by a tracer to r, one name per line,
+// until it exits. snapshot is called each time the tracer reports having
+// written a snapshot of its training policy.
+func (ss *seccompStats) readHits(r io.ReadCloser, snapshot func(), log *logging.Logger) {
+	defer r.Close()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		name := strings.TrimSpace(scanner.Text())
+		switch name {
+		case "":
+		case oz.SeccompSnapshotHit:
+			snapshot()
+		default:
+			ss.addSyscall(name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Warning("Error reading seccomp hits: %v", err)
+	}
+}
+
+// addKilled counts a program killed by its enforced policy
+func (ss *seccompStats) addKilled() {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	ss.killed++
+}
+
+func (ss *seccompStats) get() SeccompStatsResp {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	return SeccompStatsResp{
+		Denied: ss.denied,
+		Killed: ss.killed,
+		Recent: append([]string{}, ss.recent...),
+	}
+}
@@ -0,0 +1,39 @@
+package ozinit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/subgraph/oz"
+
+	"github.com/op/go-logging"
+)
+
+func TestSeccompStats(t *testing.T) {
+	ss := &seccompStats{}
+	snapshots := 0
+	hits := "ptrace\n\n" + oz.SeccompSnapshotHit + "\n"
+	ss.readHits(ioutil.NopCloser(strings.NewReader(hits)), func() { snapshots++ }, logging.MustGetLogger("test"))
+	ss.addKilled()
+
+	if snapshots != 1 {
+		t.Errorf("expected 1 snapshot reported, got %d", snapshots)
+	}
+	s := ss.get()
+	if s.Denied != 1 || s.Killed != 1 || len(s.Recent) != 1 || s.Recent[0] != "ptrace" {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	for i := 0; i < seccompRecentSyscalls+5; i++ {
+		ss.addSyscall(fmt.Sprintf("call%d", i))
+	}
+	s = ss.get()
+	if s.Denied != seccompRecentSyscalls+6 || len(s.Recent) != seccompRecentSyscalls {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	if last := s.Recent[len(s.Recent)-1]; last != fmt.Sprintf("call%d", seccompRecentSyscalls+4) {
+		t.Errorf("expected the most recent syscall last, got %s", last)
+	}
+}
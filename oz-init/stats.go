@@ -0,0 +1,210 @@
+package ozinit
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Clock ticks per second of the utime and stime fields of /proc/<pid>/stat,
+// which is 100 on every Linux architecture supported
+const clockTicks = 100
+
+// readSandboxStats sums the resource usage of every process listed in
+// procPath but init itself. As init is pid 1 of the sandbox namespace these
+// are all the processes of the sandbox, whether tracked or not. Processes
+// exiting while they are read are left out.
+func readSandboxStats(procPath string) (*SandboxStats, error) {
+	entries, err := ioutil.ReadDir(procPath)
+	if err != nil {
+		return nil, err
+	}
+	stats := new(SandboxStats)
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || !e.IsDir() || pid == 1 {
+			continue
+		}
+		ps, err := readProcessStats(path.Join(procPath, e.Name()))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("error reading stats of pid %d: %v", pid, err)
+		}
+		stats.Processes++
+		stats.CpuTimeMs += ps.CpuTimeMs
+		stats.RssKB += ps.RssKB
+		stats.OpenFds += ps.OpenFds
+	}
+	return stats, nil
+}
+
+// readProcessList returns the processes listed in procPath ordered by pid,
+// with their command line or, for processes without one such as zombies, the
+// name of their executable in brackets.
+func readProcessList(procPath string) ([]ProcessEntry, error) {
+	entries, err := ioutil.ReadDir(procPath)
+	if err != nil {
+		return nil, err
+	}
+	procs := []ProcessEntry{}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		cmd, err := readProcessCommand(path.Join(procPath, e.Name()))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("error reading command of pid %d: %v", pid, err)
+		}
+		procs = append(procs, ProcessEntry{Pid: pid, Command: cmd})
+	}
+	sort.Sort(processesByPid(procs))
+	return procs, nil
+}
+
+// readProcessParents returns the parent pid of each process listed in
+// procPath. Processes exiting while they are read are left out.
+func readProcessParents(procPath string) (map[int]int, error) {
+	entries, err := ioutil.ReadDir(procPath)
+	if err != nil {
+		return nil, err
+	}
+	parents := map[int]int{}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		bs, err := ioutil.ReadFile(path.Join(procPath, e.Name(), "stat"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("error reading stat of pid %d: %v", pid, err)
+		}
+		// The fields following the name: state, ppid...
+		stat := string(bs)
+		fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("malformed stat line of pid %d", pid)
+		}
+		if parents[pid], err = strconv.Atoi(fields[1]); err != nil {
+			return nil, fmt.Errorf("malformed stat line of pid %d: %v", pid, err)
+		}
+	}
+	return parents, nil
+}
+
+// processTree returns root and its descendants in parents, each process
+// before its children.
+func processTree(parents map[int]int, root int) []int {
+	children := map[int][]int{}
+	for pid, ppid := range parents {
+		children[ppid] = append(children[ppid], pid)
+	}
+	tree := []int{root}
+	for i := 0; i < len(tree); i++ {
+		kids := children[tree[i]]
+		sort.Ints(kids)
+		tree = append(tree, kids...)
+	}
+	return tree
+}
+
+type processesByPid []ProcessEntry
+
+func (ps processesByPid) Len() int           { return len(ps) }
+func (ps processesByPid) Swap(i, j int)      { ps[i], ps[j] = ps[j], ps[i] }
+func (ps processesByPid) Less(i, j int) bool { return ps[i].Pid < ps[j].Pid }
+
+func readProcessCommand(ppath string) (string, error) {
+	bs, err := ioutil.ReadFile(path.Join(ppath, "cmdline"))
+	if err != nil {
+		return "", err
+	}
+	if args := strings.TrimRight(string(bs), "\x00"); args != "" {
+		return strings.Replace(args, "\x00", " ", -1), nil
+	}
+	bs, err = ioutil.ReadFile(path.Join(ppath, "stat"))
+	if err != nil {
+		return "", err
+	}
+	stat := string(bs)
+	i, j := strings.Index(stat, "("), strings.LastIndex(stat, ")")
+	if i == -1 || j < i {
+		return "", fmt.Errorf("malformed stat line")
+	}
+	return "[" + stat[i+1:j] + "]", nil
+}
+
+func readProcessStats(ppath string) (*SandboxStats, error) {
+	ps := new(SandboxStats)
+	bs, err := ioutil.ReadFile(path.Join(ppath, "stat"))
+	if err != nil {
+		return nil, err
+	}
+	if ps.CpuTimeMs, err = parseStatCpuTime(string(bs)); err != nil {
+		return nil, err
+	}
+	if ps.RssKB, err = readStatusRss(path.Join(ppath, "status")); err != nil {
+		return nil, err
+	}
+	fds, err := ioutil.ReadDir(path.Join(ppath, "fd"))
+	if err != nil {
+		return nil, err
+	}
+	ps.OpenFds = len(fds)
+	return ps, nil
+}
+
+// parseStatCpuTime returns the user and system time of a process in
+// milliseconds. The fields are counted from the end of the command name,
+// which is in parentheses and may contain spaces.
+func parseStatCpuTime(stat string) (int64, error) {
+	i := strings.LastIndex(stat, ")")
+	if i == -1 {
+		return 0, fmt.Errorf("malformed stat line")
+	}
+	// The fields after the name start with state, the 3rd field
+	fields := strings.Fields(stat[i+1:])
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("malformed stat line")
+	}
+	utime, err := strconv.ParseInt(fields[11], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	stime, err := strconv.ParseInt(fields[12], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return (utime + stime) * 1000 / clockTicks, nil
+}
+
+// readStatusRss returns the VmRSS of a process, absent for kernel threads
+// and zombies
+func readStatusRss(fpath string) (int64, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "VmRSS:" {
+			return strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+	return 0, sc.Err()
+}
@@ -0,0 +1,120 @@
+package ozinit
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func writeProcEntry(t *testing.T, proc, pid, stat, status string, fds int) {
+	p := path.Join(proc, pid)
+	if err := os.MkdirAll(path.Join(p, "fd"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(p, "stat"), []byte(stat), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(p, "status"), []byte(status), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < fds; i++ {
+		if err := ioutil.WriteFile(path.Join(p, "fd", string('0'+rune(i))), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadSandboxStats(t *testing.T) {
+	proc, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(proc)
+
+	writeProcEntry(t, proc, "1", "1 (oz-init) S 0 1 1 0 -1 4194560 500 0 0 0 900 900 0 0 20 0 4 0 1 0 0", "VmRSS:\t 9000 kB\n", 5)
+	writeProcEntry(t, proc, "12", "12 (firefox) S 1 12 12 0 -1 4194560 500 0 0 0 150 50 0 0 20 0 4 0 1 0 0", "Name:\tfirefox\nVmRSS:\t  2048 kB\n", 3)
+	writeProcEntry(t, proc, "20", "20 (Web Content) R 12 12 12 0 -1 4194560 500 0 0 0 30 20 0 0 20 0 4 0 1 0 0", "Name:\tWeb Content\nVmRSS:\t  1024 kB\n", 2)
+	// Exited between the listing and the read
+	if err := os.MkdirAll(path.Join(proc, "33"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(path.Join(proc, "self"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := readSandboxStats(proc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := SandboxStats{Processes: 2, CpuTimeMs: 2500, RssKB: 3072, OpenFds: 5}
+	if *stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, *stats)
+	}
+}
+
+func TestReadProcessList(t *testing.T) {
+	proc, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(proc)
+
+	writeProcEntry(t, proc, "1", "1 (oz-init) S 0 1 1 0 -1", "", 0)
+	writeProcEntry(t, proc, "12", "12 (firefox) S 1 12 12 0 -1", "", 0)
+	writeProcEntry(t, proc, "9", "9 (Web Content) Z 1 9 9 0 -1", "", 0)
+	for pid, cmdline := range map[string]string{
+		"1":  "/usr/local/bin/oz-init\x00",
+		"12": "/usr/bin/firefox\x00--new-window\x00",
+		"9":  "",
+	} {
+		if err := ioutil.WriteFile(path.Join(proc, pid, "cmdline"), []byte(cmdline), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Exited between the listing and the read
+	if err := os.MkdirAll(path.Join(proc, "33"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	procs, err := readProcessList(proc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []ProcessEntry{
+		{Pid: 1, Command: "/usr/local/bin/oz-init"},
+		{Pid: 9, Command: "[Web Content]"},
+		{Pid: 12, Command: "/usr/bin/firefox --new-window"},
+	}
+	if len(procs) != len(expected) {
+		t.Fatalf("expected %+v, got %+v", expected, procs)
+	}
+	for i := range expected {
+		if procs[i] != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], procs[i])
+		}
+	}
+}
+
+func TestProcessTree(t *testing.T) {
+	proc, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(proc)
+
+	writeProcEntry(t, proc, "1", "1 (oz-init) S 0 1 1 0 -1", "", 0)
+	writeProcEntry(t, proc, "12", "12 (oz-seccomp-tracer) S 1 12 12 0 -1", "", 0)
+	writeProcEntry(t, proc, "20", "20 (Web Content) S 12 12 12 0 -1", "", 0)
+	writeProcEntry(t, proc, "15", "15 (a) (b)) S 20 12 12 0 -1", "", 0)
+	writeProcEntry(t, proc, "30", "30 (xpra) S 1 30 30 0 -1", "", 0)
+
+	parents, err := readProcessParents(proc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tree := processTree(parents, 12)
+	if len(tree) != 3 || tree[0] != 12 || tree[1] != 20 || tree[2] != 15 {
+		t.Errorf("expected the tree of 12 parents first, got %v", tree)
+	}
+}
@@ -25,7 +25,6 @@ import (
 	"fmt"
 	"os"
 	"path"
-	"strings"
 
 	"github.com/subgraph/oz"
 	"github.com/subgraph/oz/fs"
@@ -61,7 +60,28 @@ func Main(mode int) {
 		start = 2
 		readonly = true
 	}
-	for _, fpath := range os.Args[start:] {
+	// A path may be preceded by `--target <path>` to mount it at
+	// an explicit location inside the sandbox
+	target := ""
+	for i := start; i < len(os.Args); i++ {
+		fpath := os.Args[i]
+		if fpath == "--target" {
+			if i+1 == len(os.Args) {
+				log.Error("--target requires a path")
+				os.Exit(1)
+			}
+			i++
+			target = path.Clean(os.Args[i])
+			if !path.IsAbs(target) {
+				log.Error("target must be an absolute path: %s", target)
+				os.Exit(1)
+			}
+			if !oz.IsUserMountPath(target, homedir) {
+				log.Error("target must be inside of the user home or mounts: %s", target)
+				os.Exit(1)
+			}
+			continue
+		}
 		cpath, err := cleanPath(fpath, homedir)
 		if err != nil || cpath == "" {
 			log.Error("%v", err)
@@ -69,13 +89,17 @@ func Main(mode int) {
 		}
 		switch mode {
 		case MOUNT:
-			mount(cpath, readonly, fsys, log)
+			mount(cpath, target, readonly, fsys, log)
 		case UMOUNT:
+			if target != "" {
+				cpath = target
+			}
 			unmount(cpath, fsys, log)
 		default:
 			log.Error("Unknown mode!")
 			os.Exit(1)
 		}
+		target = ""
 	}
 
 	os.Exit(0)
@@ -86,13 +110,13 @@ func cleanPath(spath, homedir string) (string, error) {
 	if !path.IsAbs(spath) {
 		spath = path.Join(homedir, spath)
 	}
-	if !strings.HasPrefix(spath, homedir) && !strings.HasPrefix(spath, "/media/user") {
+	if !oz.IsUserMountPath(spath, homedir) {
 		return "", fmt.Errorf("only files inside of the user home and mounts are permitted")
 	}
 	return spath, nil
 }
 
-func mount(fpath string, readonly bool, fsys *fs.Filesystem, log *logging.Logger) {
+func mount(fpath, target string, readonly bool, fsys *fs.Filesystem, log *logging.Logger) {
 	//log.Notice("Adding file `%s`.", fpath)
 	// TODO: Check if target is empty directory (and not a mountpoint) and allow the bind in that case
 	if _, err := os.Stat(fpath); err != nil {
@@ -103,7 +127,7 @@ func mount(fpath string, readonly bool, fsys *fs.Filesystem, log *logging.Logger
 	if readonly {
 		flags |= fs.BindReadOnly
 	}
-	if err := fsys.BindPath(fpath, flags, -1); err != nil {
+	if err := fsys.BindTo(fpath, target, flags, -1); err != nil {
 		log.Error("%v", err)
 		os.Exit(1)
 	}
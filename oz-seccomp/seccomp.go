@@ -7,10 +7,12 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 	"syscall"
 
 	"github.com/subgraph/oz"
 	seccomp "github.com/twtiger/gosecco"
+	"github.com/twtiger/gosecco/parser"
 
 	"github.com/op/go-logging"
 )
@@ -77,6 +79,11 @@ func Main() {
 			if err := json.NewDecoder(os.Stdin).Decode(&p); err != nil {
 				log.Fatal("unable to decode profile data: ", err)
 			}
+			if os.Getenv(oz.SeccompTtyEnv) != "" {
+				if err := attachTty(); err != nil {
+					log.Fatal("unable to attach to terminal: ", err)
+				}
+			}
 		}
 	}
 
@@ -123,11 +130,13 @@ func Main() {
 
 		enforce := true
 		fpath := ""
+		var inline []string
 		if p.Seccomp.Mode == oz.PROFILE_SECCOMP_WHITELIST {
-			if p.Seccomp.Whitelist == "" {
-				log.Fatal("[FATAL] profile referenced no seccomp whitelist policy file.")
+			if p.Seccomp.Whitelist == "" && len(p.Seccomp.WhitelistSyscalls) == 0 {
+				log.Fatal("[FATAL] profile referenced no seccomp whitelist policy file nor syscalls.")
 			}
 			fpath = p.Seccomp.Whitelist
+			inline = p.Seccomp.WhitelistSyscalls
 			enforce = p.Seccomp.Enforce
 		} else if p.Seccomp.Mode == oz.PROFILE_SECCOMP_TRAIN {
 			if enforce == true {
@@ -143,7 +152,7 @@ func Main() {
 			settings.DefaultNegativeAction = "trace"
 			settings.DefaultPolicyAction = "trace"
 		}
-		filter, err := seccomp.Prepare(fpath, settings)
+		filter, err := seccomp.PrepareSource(policySource(fpath, inline), settings)
 		if err != nil {
 			log.Fatal("[FATAL] Seccomp filter compile failed: ", err)
 		}
@@ -171,6 +180,8 @@ func Main() {
 		settings.DefaultPolicyAction = "allow"
 		enforce := p.Seccomp.Enforce
 
+		// Inline syscalls are added to the generic blacklist, never
+		// replacing it
 		if p.Seccomp.Blacklist == "" {
 			p.Seccomp.Blacklist = path.Join(config.EtcPrefix, "blacklist-generic.seccomp")
 		}
@@ -178,7 +189,7 @@ func Main() {
 		if enforce == false {
 			settings.DefaultPositiveAction = "trace"
 		}
-		filter, err := seccomp.Prepare(p.Seccomp.Blacklist, settings)
+		filter, err := seccomp.PrepareSource(policySource(p.Seccomp.Blacklist, p.Seccomp.BlacklistSyscalls), settings)
 		if err != nil {
 			log.Fatal("[FATAL] Seccomp blacklist filter compile failed: ", err)
 		}
@@ -210,3 +221,40 @@ func loadProfile(dir, name string) (*oz.Profile, error) {
 	}
 	return nil, fmt.Errorf("no profile named '%s'", name)
 }
+
+// attachTty connects stdin, stdout and stderr to the controlling terminal,
+// for programs run in a pty whose stdin was used to pass the profile
+func attachTty() error {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer tty.Close()
+	for fd := 0; fd <= 2; fd++ {
+		if err := syscall.Dup3(int(tty.Fd()), fd, 0); err != nil {
+			return err
+		}
+	}
+	return os.Unsetenv(oz.SeccompTtyEnv)
+}
+
+// policySource returns the policy of the file fpath, if any, combined with a
+// rule matching each of the syscalls listed inline in the profile.
+func policySource(fpath string, syscalls []string) parser.Source {
+	var sources []parser.Source
+	if fpath != "" {
+		sources = append(sources, &parser.FileSource{Filename: fpath})
+	}
+	if len(syscalls) > 0 {
+		sources = append(sources, &parser.StringSource{Name: "profile", Content: inlinePolicy(syscalls)})
+	}
+	return parser.CombineSources(sources...)
+}
+
+func inlinePolicy(syscalls []string) string {
+	lines := make([]string, len(syscalls))
+	for i, sc := range syscalls {
+		lines[i] = sc + ": 1"
+	}
+	return strings.Join(lines, "\n")
+}
@@ -5,13 +5,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"bufio"
 	"os"
 	"os/exec"
+	"os/signal"
 	"os/user"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -831,7 +834,12 @@ func TMain(ctx *cli.Context) {
 	log.Info("Tracer running command (%v) arguments (%v)\n", cmd, cmdArgs)
 	c := exec.Command(cmd)
 	c.SysProcAttr = &syscall.SysProcAttr{Ptrace: true}
-	c.Env = os.Environ()
+	c.Env = []string{}
+	for _, evar := range os.Environ() {
+		if !strings.HasPrefix(evar, oz.SeccompHitsFdEnv+"=") {
+			c.Env = append(c.Env, evar)
+		}
+	}
 	c.Args = append(c.Args, cmdArgs...)
 
 	if train == false {
@@ -852,10 +860,45 @@ func TMain(ctx *cli.Context) {
 	children := make(map[int]bool)
 	renderFunctions := getRenderingFunctions()
 
+	// Guards the training state, read by the snapshots
+	var trainingLock sync.Mutex
 	trainingset := make(map[int]bool)
 	freqcount := make(map[int]int)
 	trainingargs := make(map[int]map[int][]uint)
 
+	// The denied syscalls are reported to oz-init on a descriptor of their
+	// own, which the traced program does not inherit
+	var hits *os.File
+	if fd, err := strconv.Atoi(os.Getenv(oz.SeccompHitsFdEnv)); err == nil {
+		syscall.CloseOnExec(fd)
+		hits = os.NewFile(uintptr(fd), "seccomp-hits")
+	}
+
+	// In training mode a snapshot of the policy observed so far is written
+	// on SIGUSR2, which is reported on the hits descriptor. It is taken from
+	// its own goroutine, as the tracing loop may wait for a long time on a
+	// tracee blocked in a syscall.
+	snapshotPath := os.Getenv(oz.SeccompSnapshotEnv)
+	if train && snapshotPath != "" {
+		snapshotc := make(chan os.Signal, 1)
+		signal.Notify(snapshotc, syscall.SIGUSR2)
+		go func() {
+			for range snapshotc {
+				trainingLock.Lock()
+				policy := renderTrainingPolicy(freqcount, trainingargs, false, ctx.Bool("verbose"))
+				trainingLock.Unlock()
+				if err := writePolicyFile(snapshotPath, policy); err != nil {
+					log.Error("Error writing policy snapshot \"%s\": %v", snapshotPath, err)
+				} else {
+					log.Info("Wrote training policy snapshot to %s", snapshotPath)
+					if hits != nil {
+						fmt.Fprintln(hits, oz.SeccompSnapshotHit)
+					}
+				}
+			}
+		}()
+	}
+
 	pstdout, err := c.StdoutPipe()
 	if err != nil {
 		log.Fatal("Unable to get handle of process stdout: ", err)
@@ -961,6 +1004,7 @@ func TMain(ctx *cli.Context) {
 				call := ""
 
 				if train == true {
+					trainingLock.Lock()
 					trainingset[getSyscallNumber(regs)] = true
 					freqcount[getSyscallNumber(regs)]++
 					if systemcall.captureArgs != nil {
@@ -986,8 +1030,13 @@ func TMain(ctx *cli.Context) {
 
 						trackSyscall(uint(getSyscallNumber(regs)), rmask, r0, r1, r2, r3, r4, r5)
 					}
+					trainingLock.Unlock()
 				}
 
+				// In training mode the syscalls are recorded, not denied
+				if hits != nil && !train {
+					fmt.Fprintln(hits, systemcall.name)
+				}
 				if f, ok := renderFunctions[getSyscallNumber(regs)]; ok {
 					call, err = f(pid, r)
 					if err != nil {
@@ -1120,60 +1169,62 @@ func TMain(ctx *cli.Context) {
 					resolvedpath, e = fs.ResolvePathNoGlob(s, -1, u, nil, nil)
 //				}
 			}
-			policyout := ""
-
-			collapseMatchingBitmasks()
-			sk := sortedKeys(freqcount)
-			if ctx.Bool("vtrain") == true {
-				fmt.Println("\nInvocation counts for observed system calls:\n")
-			}
-			for _, call := range sk {
-				sc, _ := syscallByNum(call)
-				if ctx.Bool("vtrain") == true {
-					fmt.Printf("%s calls: %d\n", sc.name, freqcount[call])
-				}
-				done := false
-				for c := range trainingargs {
-					if c == call {
-						done = true
-					}
-				}
-				if done == false {
-					sc, _ := syscallByNum(call)
-					policyout += fmt.Sprintf("%s:1\n", sc.name)
-				} else {
-					policyout += getSyscallsTracked(sc.name)
-				}
-			}
-
-			policyout += fmt.Sprintf("execve:1")
-
-			if ctx.Bool("verbose") {
-				policyout += "\n\n# Raw system call data:\n" + dumpSyscallsTrackedRaw() + "\n"
-			}
+			trainingLock.Lock()
+			policyout := renderTrainingPolicy(freqcount, trainingargs, ctx.Bool("vtrain"), ctx.Bool("verbose"))
+			trainingLock.Unlock()
 
 			if ctx.Bool("vtrain") == true {
 				fmt.Println("\nTrainer generated seccomp-bpf whitelist policy:\n")
 				fmt.Println(policyout)
 			}
 
-			f, err := os.OpenFile(resolvedpath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
-			if err == nil {
-				_, err := f.WriteString(policyout)
-				if err != nil {
-					log.Error("Error writing policy file: %v", err)
-				}
-				err = f.Close()
-				if err != nil {
-					log.Error("Error closing policy file: %v", err)
-				}
-			} else {
-				log.Error("Error opening policy file \"%s\": %v", resolvedpath, err)
+			if err := writePolicyFile(resolvedpath, policyout); err != nil {
+				log.Error("Error writing policy file \"%s\": %v", resolvedpath, err)
 			}
 		}
 	}
 }
 
+// renderTrainingPolicy generates the whitelist policy allowing the system
+// calls observed so far in training mode.
+func renderTrainingPolicy(freqcount map[int]int, trainingargs map[int]map[int][]uint, vtrain, verbose bool) string {
+	policyout := ""
+
+	collapseMatchingBitmasks()
+	sk := sortedKeys(freqcount)
+	if vtrain {
+		fmt.Print("\nInvocation counts for observed system calls:\n\n")
+	}
+	for _, call := range sk {
+		sc, _ := syscallByNum(call)
+		if vtrain {
+			fmt.Printf("%s calls: %d\n", sc.name, freqcount[call])
+		}
+		if _, ok := trainingargs[call]; !ok {
+			policyout += fmt.Sprintf("%s:1\n", sc.name)
+		} else {
+			policyout += getSyscallsTracked(sc.name)
+		}
+	}
+
+	policyout += "execve:1"
+
+	if verbose {
+		policyout += "\n\n# Raw system call data:\n" + dumpSyscallsTrackedRaw() + "\n"
+	}
+	return policyout
+}
+
+// writePolicyFile writes the policy through a temporary file so that
+// readers of fpath never see a partially written policy.
+func writePolicyFile(fpath, policy string) error {
+	tmp := fpath + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(policy), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fpath)
+}
+
 func genArgs(scName string, a uint, vals []uint, allVals []uint, exclude bool, warg bool) string {
 	s := ""
 	for idx, x := range vals {
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/subgraph/oz"
 	"github.com/subgraph/oz/oz-daemon"
@@ -76,7 +81,7 @@ func runSandboxed() {
 			}
 		}
 	}
-	if err := daemon.Launch("0", apath, os.Args[1:], false, ephemeral); err != nil {
+	if err := daemon.Launch("0", apath, os.Args[1:], false, ephemeral, "", nil); err != nil {
 		fmt.Fprintf(os.Stderr, "launch command failed: %v.\n", err)
 		os.Exit(1)
 	}
@@ -96,6 +101,12 @@ func runApplication() {
 			Name:   "profiles",
 			Usage:  "list available application profiles",
 			Action: handleProfiles,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the list as JSON",
+				},
+			},
 		},
 		{
 			Name:   "launch",
@@ -108,6 +119,18 @@ func runApplication() {
 				cli.BoolFlag{
 					Name: "ephemeral, e",
 				},
+				cli.BoolFlag{
+					Name:  "wait, w",
+					Usage: "wait for the program to exit and exit with its status",
+				},
+				cli.StringFlag{
+					Name:  "seccomp-mode",
+					Usage: "replace the seccomp mode of the profile for this launch (train, whitelist, blacklist, disabled), if allowed by the configuration",
+				},
+				cli.StringFlag{
+					Name:  "stdin",
+					Usage: "connect the stdin of the program to a file of the host",
+				},
 			},
 		},
 		{
@@ -116,7 +139,12 @@ func runApplication() {
 			Action: handleList,
 			Flags: []cli.Flag{
 				cli.BoolFlag{
-					Name: "verbose, v",
+					Name:  "verbose, v",
+					Usage: "show the program each sandbox was launched with",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the list as JSON",
 				},
 			},
 		},
@@ -125,6 +153,11 @@ func runApplication() {
 			Usage:  "start a shell in a running sandbox",
 			Action: handleShell,
 		},
+		{
+			Name:   "attach",
+			Usage:  "attach to the terminal of a program running in a pty in a sandbox, optionally given its pid",
+			Action: handleAttach,
+		},
 		{
 			Name:   "mount",
 			Usage:  "cause a sandbox to mount a file from the host",
@@ -149,6 +182,24 @@ func runApplication() {
 			Name:   "relaunchxpra",
 			Usage:  "relaunch xpra client for a running sandbox (\"all\" for all sandboxes)",
 			Action: handleRelaunchXpraClient,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "encoding",
+					Usage: "xpra picture encoding",
+				},
+				cli.StringFlag{
+					Name:  "opengl",
+					Usage: "opengl acceleration: yes, no or auto",
+				},
+				cli.StringFlag{
+					Name:  "border",
+					Usage: "window border: auto, no or a #rrggbb color",
+				},
+				cli.StringFlag{
+					Name:  "desktop-scaling",
+					Usage: "desktop scaling: on, off, auto or a factor",
+				},
+			},
 		},
 		{
 			Name:   "logs",
@@ -158,8 +209,58 @@ func runApplication() {
 				cli.BoolFlag{
 					Name: "f",
 				},
+				cli.BoolFlag{
+					Name:  "z",
+					Usage: "compress the log stream",
+				},
+			},
+		},
+		{
+			Name:   "sandboxlogs",
+			Usage:  "display the log lines of a running sandbox kept by oz-daemon",
+			Action: handleSandboxLogs,
+		},
+		{
+			Name:   "clearlogs",
+			Usage:  "clear the log lines of a running sandbox kept by oz-daemon",
+			Action: handleClearLogs,
+		},
+		{
+			Name:   "restart",
+			Usage:  "restart a running sandbox with its reloaded profile, keeping its id and runtime mounts",
+			Action: handleRestart,
+		},
+		{
+			Name:   "diagnostics",
+			Usage:  "write the processes, mounts, network, logs and profile of a running sandbox to a file for bug reports",
+			Action: handleDiagnosticBundle,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "file the bundle is written to, oz-diagnostics-<id>.json by default",
+				},
 			},
 		},
+		{
+			Name:   "follow",
+			Usage:  "print the output of a program running in a sandbox until it exits",
+			Action: handleFollowProgram,
+		},
+		{
+			Name:   "notify",
+			Usage:  "show a desktop notification from a running sandbox",
+			Action: handleNotify,
+		},
+		{
+			Name:   "seccompstats",
+			Usage:  "show the syscalls denied by seccomp in a running sandbox",
+			Action: handleSeccompStats,
+		},
+		{
+			Name:   "config",
+			Usage:  "show the configuration the daemon is running with",
+			Action: handleGetConfig,
+		},
 		{
 			Name:   "listbridges",
 			Usage:  "list configured bridges",
@@ -195,6 +296,98 @@ func runApplication() {
 					Usage: "Sandbox number, e.g. 1",
 					Value: -1,
 				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the list as JSON",
+				},
+			},
+		},
+		{
+			Name:   "mounts",
+			Usage:  "list the filesystem mounts of a running sandbox",
+			Action: handleListMounts,
+		},
+		{
+			Name:   "clipboard",
+			Usage:  "enable or disable clipboard sharing of a running sandbox",
+			Action: handleSetClipboard,
+		},
+		{
+			Name:   "dumpseccomp",
+			Usage:  "write a snapshot of the seccomp policy trained so far in a sandbox",
+			Action: handleDumpSeccomp,
+		},
+		{
+			Name:   "netinfo",
+			Usage:  "show the network configuration of a running sandbox",
+			Action: handleNetworkInfo,
+		},
+		{
+			Name:   "vpnstatus",
+			Usage:  "show the state and traffic of the openvpn client of a running sandbox",
+			Action: handleVPNStatus,
+		},
+		{
+			Name:   "stats",
+			Usage:  "show the resource usage of a running sandbox",
+			Action: handleSandboxStats,
+		},
+		{
+			Name:   "stopapp",
+			Usage:  "terminate the programs of a running sandbox, keeping the sandbox running",
+			Action: handleStopApp,
+		},
+		{
+			Name:   "pause",
+			Usage:  "stop the programs of a running sandbox, refusing launches until resumed",
+			Action: handlePauseSandbox,
+		},
+		{
+			Name:   "resume",
+			Usage:  "continue the programs of a paused sandbox",
+			Action: handleResumeSandbox,
+		},
+		{
+			Name:   "sethostname",
+			Usage:  "change the hostname of a running sandbox, <profile>-<id> if none is given",
+			Action: handleSetHostname,
+		},
+		{
+			Name:   "launchenv",
+			Usage:  "list the OZ_ environment variables forwarded into a running sandbox",
+			Action: handleGetLaunchEnv,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "unredacted",
+					Usage: "show the values of the variables",
+				},
+			},
+		},
+		{
+			Name:   "feed",
+			Usage:  "run a program in a running sandbox and write the standard input to it, refused for profiles with seccomp enabled",
+			Action: handleFeed,
+		},
+		{
+			Name:   "detachchild",
+			Usage:  "stop a program from keeping its sandbox alive",
+			Action: handleDetachChild,
+		},
+		{
+			Name:   "attachchild",
+			Usage:  "make a detached program keep its sandbox alive again",
+			Action: handleAttachChild,
+		},
+		{
+			Name:   "ready",
+			Usage:  "exit successfully if the daemon answers within the timeout",
+			Action: handleReady,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "timeout, t",
+					Usage: "seconds to wait for the daemon",
+					Value: 5,
+				},
 			},
 		},
 		{
@@ -212,6 +405,10 @@ func handleProfiles(c *cli.Context) {
 		fmt.Printf("Error listing profiles: %v\n", err)
 		os.Exit(1)
 	}
+	if c.Bool("json") {
+		printJSONList(ps)
+		return
+	}
 	for i, p := range ps {
 		fmt.Printf("%2d) %-30s %s\n", i+1, p.Name, p.Path)
 	}
@@ -227,7 +424,46 @@ func handleLaunch(c *cli.Context) {
 		fmt.Println("Argument needed to launch command")
 		os.Exit(1)
 	}
-	err := daemon.Launch(c.Args()[0], "", c.Args()[1:], noexec, ephemeral)
+	seccompMode := oz.SeccompMode(c.String("seccomp-mode"))
+	// The file is opened here so that it is read with the permissions of
+	// the user rather than those of the daemon
+	var stdin *os.File
+	if path := c.String("stdin"); path != "" {
+		if noexec {
+			fmt.Println("--stdin cannot be used with --noexec")
+			os.Exit(1)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Printf("cannot open stdin file: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		stdin = f
+	}
+	if c.Bool("wait") {
+		if noexec {
+			fmt.Println("--wait cannot be used with --noexec")
+			os.Exit(1)
+		}
+		status, err := daemon.LaunchWait(c.Args()[0], "", c.Args()[1:], ephemeral, seccompMode, stdin)
+		if err != nil {
+			fmt.Printf("launch command failed: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(status)
+	}
+	// Interrupting the launch before the sandbox is ready cancels it rather
+	// than leaving it half started
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+	err := daemon.LaunchContext(ctx, c.Args()[0], "", c.Args()[1:], noexec, ephemeral, seccompMode, stdin)
 	if err != nil {
 		fmt.Printf("launch command failed: %v\n", err)
 		os.Exit(1)
@@ -240,6 +476,10 @@ func handleList(c *cli.Context) {
 		fmt.Printf("Error listing running sandboxes: %v\n", err)
 		os.Exit(1)
 	}
+	if c.Bool("json") {
+		printJSONList(sboxes)
+		return
+	}
 	if len(sboxes) == 0 {
 		fmt.Println("No running sandboxes")
 		return
@@ -250,9 +490,21 @@ func handleList(c *cli.Context) {
 			ephemeral = " [ephemeral]"
 		}
 		fmt.Printf("%2d) %s%s\n", sb.Id, sb.Profile, ephemeral)
+		if c.Bool("verbose") && sb.LaunchPath != "" {
+			fmt.Printf("    %s\n", strings.Join(append([]string{sb.LaunchPath}, sb.LaunchArgs...), " "))
+		}
 	}
 }
 
+func printJSONList(list interface{}) {
+	bs, err := daemon.MarshalList(list)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding list as JSON: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(bs))
+}
+
 func handleListBridges(c *cli.Context) {
 	bridges, err := daemon.ListBridges()
 	if err != nil {
@@ -279,7 +531,7 @@ func handleMount(c *cli.Context) {
 		start = 2
 	}
 
-	err = daemon.MountFiles(id, c.Args()[start:], readOnly)
+	err = daemon.MountFiles(id, c.Args()[start:], nil, readOnly)
 	if err != nil {
 		fmt.Println("MountFiles FAIL", err)
 	}
@@ -350,6 +602,53 @@ func handleShell(c *cli.Context) {
 	fmt.Println("done..")
 }
 
+func handleAttach(c *cli.Context) {
+	if len(c.Args()) == 0 {
+		fmt.Println("Sandbox id argument needed")
+		os.Exit(1)
+	}
+	id, err := strconv.Atoi(c.Args()[0])
+	if err != nil {
+		fmt.Println("Sandbox id argument must be an integer")
+		os.Exit(1)
+	}
+	pid := 0
+	if len(c.Args()) > 1 {
+		pid, err = strconv.Atoi(c.Args()[1])
+		if err != nil {
+			fmt.Println("Pid argument must be an integer")
+			os.Exit(1)
+		}
+	}
+
+	sb, err := getSandboxById(id)
+	if err != nil {
+		fmt.Printf("Error retrieving sandbox list: %v\n", err)
+		os.Exit(1)
+	}
+	if sb == nil {
+		fmt.Printf("No sandbox found with id = %d\n", id)
+		os.Exit(1)
+	}
+
+	fd, err := ozinit.AttachProgram(sb.Address, pid)
+	if err != nil {
+		fmt.Printf("attach command failed: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Attached to program in `%s`\n\n", sb.Profile)
+	st, err := SetRawTerminal(0)
+	HandleResize(fd)
+	f := os.NewFile(uintptr(fd), "")
+	go io.Copy(f, os.Stdin)
+	io.Copy(os.Stdout, f)
+	if err := RestoreTerminal(0, st); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("done..")
+}
+
 func getSandboxById(id int) (*daemon.SandboxInfo, error) {
 	sboxes, err := daemon.ListSandboxes()
 	if err != nil {
@@ -393,9 +692,23 @@ func handleKill(c *cli.Context) {
 	}
 
 }
+func handleGetConfig(c *cli.Context) {
+	config, err := daemon.GetConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Config command failed: %s.\n", err)
+		os.Exit(1)
+	}
+	jdata, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to format configuration: %s.\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(jdata))
+}
+
 func handleLogs(c *cli.Context) {
 	follow := c.Bool("f")
-	ch, err := daemon.Logs(0, follow)
+	ch, err := daemon.Logs(0, follow, c.Bool("z"))
 	if err != nil {
 		fmt.Println("Logs failed", err)
 		os.Exit(1)
@@ -405,13 +718,101 @@ func handleLogs(c *cli.Context) {
 	}
 }
 
+func handleSandboxLogs(c *cli.Context) {
+	id := sandboxIdArg(c, "display logs")
+	lines, err := daemon.SandboxLogs(id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Logs failed: %s.\n", err)
+		os.Exit(1)
+	}
+	for _, ll := range lines {
+		fmt.Println(ll)
+	}
+}
+
+func handleClearLogs(c *cli.Context) {
+	id := sandboxIdArg(c, "clear logs")
+	if err := daemon.ClearLogs(id); err != nil {
+		fmt.Fprintf(os.Stderr, "Clear logs command failed: %s.\n", err)
+		os.Exit(1)
+	}
+}
+
+func handleRestart(c *cli.Context) {
+	id := sandboxIdArg(c, "restart")
+	if err := daemon.RestartSandbox(id); err != nil {
+		fmt.Fprintf(os.Stderr, "Restart command failed: %s.\n", err)
+		os.Exit(1)
+	}
+}
+
+func handleFollowProgram(c *cli.Context) {
+	id, pid := childPidArgs(c, "follow")
+	err := daemon.FollowProgram(id, pid, func(line string) {
+		fmt.Println(line)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Follow command failed: %s.\n", err)
+		os.Exit(1)
+	}
+}
+
+func handleNotify(c *cli.Context) {
+	if len(c.Args()) < 2 || len(c.Args()) > 3 {
+		fmt.Fprintf(os.Stderr, "oz notify <sandbox_id> <summary> [body]\n")
+		os.Exit(1)
+	}
+	id := sandboxIdArg(c, "notify")
+	body := ""
+	if len(c.Args()) == 3 {
+		body = c.Args()[2]
+	}
+	if err := daemon.Notify(id, c.Args()[1], body); err != nil {
+		fmt.Fprintf(os.Stderr, "Notify command failed: %s.\n", err)
+		os.Exit(1)
+	}
+}
+
+func handleSeccompStats(c *cli.Context) {
+	id := sandboxIdArg(c, "show seccomp stats")
+	stats, err := daemon.SeccompStats(id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Seccomp stats command failed: %s.\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Denied syscalls:  %d\n", stats.Denied)
+	fmt.Printf("Programs killed:  %d\n", stats.Killed)
+	if len(stats.Recent) > 0 {
+		fmt.Printf("Recently denied:  %s\n", strings.Join(stats.Recent, " "))
+	}
+}
+
+func handleDiagnosticBundle(c *cli.Context) {
+	id := sandboxIdArg(c, "collect diagnostics")
+	output := c.String("output")
+	if output == "" {
+		output = fmt.Sprintf("oz-diagnostics-%d.json", id)
+	}
+	if err := daemon.DiagnosticBundle(id, output); err != nil {
+		fmt.Fprintf(os.Stderr, "Diagnostics command failed: %s.\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Diagnostics of sandbox %d written to %s\n", id, output)
+}
+
 func handleRelaunchXpraClient(c *cli.Context) {
 	if len(c.Args()) == 0 {
 		fmt.Fprintf(os.Stderr, "Need a sandbox id to relaunch\n")
 		os.Exit(1)
 	}
+	opts := oz.XpraClientOpts{
+		Encoding:       c.String("encoding"),
+		OpenGL:         c.String("opengl"),
+		Border:         c.String("border"),
+		DesktopScaling: c.String("desktop-scaling"),
+	}
 	if c.Args()[0] == "all" {
-		if err := daemon.RelaunchAllXpraClient(); err != nil {
+		if err := daemon.RelaunchAllXpraClient(opts); err != nil {
 			fmt.Fprintf(os.Stderr, "Killall command failed: %s.\n", err)
 			os.Exit(1)
 		}
@@ -422,7 +823,7 @@ func handleRelaunchXpraClient(c *cli.Context) {
 			fmt.Fprintf(os.Stderr, "Could not parse id value %s\n", c.Args()[0])
 			os.Exit(1)
 		}
-		if err := daemon.RelaunchXpraClient(id); err != nil {
+		if err := daemon.RelaunchXpraClient(id, opts); err != nil {
 			fmt.Fprintf(os.Stderr, "Relaunch command failed: %s.\n", err)
 			os.Exit(1)
 		}
@@ -442,7 +843,7 @@ func handleForward(c *cli.Context) {
 		fmt.Fprintf(os.Stderr, "Missing required arguments.\n")
 		os.Exit(1)
 	}
-	if out, err = daemon.AskForwarder(id, c.String("name"), c.String("port")); err != nil {
+	if out, _, err = daemon.AskForwarder(id, c.String("name"), c.String("port")); err != nil {
 		fmt.Fprintf(os.Stderr, "Fowarder command failed: %s.\n", err)
 		os.Exit(1)
 	}
@@ -460,10 +861,243 @@ func handleListForwarders(c *cli.Context) {
 		fmt.Fprintf(os.Stderr, "List forwarders failed: %+v %+v", err, forwarders)
 		os.Exit(1)
 	}
+	if c.Bool("json") {
+		printJSONList(forwarders)
+		return
+	}
 
 	fmt.Printf("Listeners for sandbox %d:\n", id)
 	for _, r := range forwarders {
-		fmt.Printf("  %s: %s => %s\n", r.Name, r.Desc, r.Target)
+		fmt.Printf("  %s: %s => %s (%d active, %d bytes in, %d bytes out)\n", r.Name, r.Desc, r.Target, r.Connections, r.BytesIn, r.BytesOut)
+	}
+}
+
+func handleListMounts(c *cli.Context) {
+	id := sandboxIdArg(c, "list mounts")
+	mounts, err := daemon.ListMounts(id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "List mounts failed: %s.\n", err)
+		os.Exit(1)
+	}
+	for _, mnt := range mounts {
+		ro := ""
+		if mnt.ReadOnly {
+			ro = " [ro]"
+		}
+		fmt.Printf("%-40s %-10s %s%s\n", mnt.Target, mnt.FsType, path.Join(mnt.Source, mnt.Root), ro)
+	}
+}
+
+func handleSetClipboard(c *cli.Context) {
+	if len(c.Args()) != 2 || (c.Args()[1] != "on" && c.Args()[1] != "off") {
+		fmt.Fprintf(os.Stderr, "oz clipboard <sandbox_id> <on|off>\n")
+		os.Exit(1)
+	}
+	id := sandboxIdArg(c, "set the clipboard")
+	if err := daemon.SetClipboard(id, c.Args()[1] == "on"); err != nil {
+		fmt.Fprintf(os.Stderr, "Set clipboard failed: %s.\n", err)
+		os.Exit(1)
+	}
+}
+
+func handleDumpSeccomp(c *cli.Context) {
+	id := sandboxIdArg(c, "dump the seccomp policy")
+	paths, err := daemon.DumpSeccomp(id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Dump seccomp failed: %s.\n", err)
+		os.Exit(1)
+	}
+	for _, p := range paths {
+		fmt.Println(p)
+	}
+}
+
+func handleNetworkInfo(c *cli.Context) {
+	id := sandboxIdArg(c, "show network info")
+	info, err := daemon.NetworkInfo(id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Network info failed: %s.\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Type:      %s\n", info.Nettype)
+	if info.Interface != "" {
+		fmt.Printf("Interface: %s\n", info.Interface)
+		fmt.Printf("IP:        %s\n", info.Ip)
+		fmt.Printf("Gateway:   %s\n", info.Gateway)
+		fmt.Printf("Table:     %d\n", info.Table)
+	}
+}
+
+func handleVPNStatus(c *cli.Context) {
+	id := sandboxIdArg(c, "show vpn status")
+	st, err := daemon.VPNStatus(id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "VPN status failed: %s.\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("State:   %s\n", st.State)
+	fmt.Printf("Local:   %s\n", st.LocalIp)
+	fmt.Printf("Remote:  %s:%s\n", st.RemoteIp, st.RemotePort)
+	fmt.Printf("Tun:     %d bytes read, %d bytes written\n", st.TunReadBytes, st.TunWriteBytes)
+	fmt.Printf("Link:    %d bytes read, %d bytes written\n", st.LinkReadBytes, st.LinkWriteBytes)
+}
+
+func handleSandboxStats(c *cli.Context) {
+	id := sandboxIdArg(c, "show stats")
+	stats, err := daemon.SandboxStats(id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Stats command failed: %s.\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Processes: %d\n", stats.Processes)
+	fmt.Printf("CPU time:  %.2fs\n", float64(stats.CpuTimeMs)/1000)
+	fmt.Printf("RSS:       %d kB\n", stats.RssKB)
+	fmt.Printf("Open fds:  %d\n", stats.OpenFds)
+}
+
+func handleStopApp(c *cli.Context) {
+	id := sandboxIdArg(c, "stopapp")
+	if err := daemon.StopApp(id); err != nil {
+		fmt.Fprintf(os.Stderr, "Stopapp command failed: %s.\n", err)
+		os.Exit(1)
+	}
+}
+
+func handlePauseSandbox(c *cli.Context) {
+	id := sandboxIdArg(c, "pause")
+	if err := daemon.PauseSandbox(id); err != nil {
+		fmt.Fprintf(os.Stderr, "Pause command failed: %s.\n", err)
+		os.Exit(1)
+	}
+}
+
+func handleResumeSandbox(c *cli.Context) {
+	id := sandboxIdArg(c, "resume")
+	if err := daemon.ResumeSandbox(id); err != nil {
+		fmt.Fprintf(os.Stderr, "Resume command failed: %s.\n", err)
+		os.Exit(1)
+	}
+}
+
+// handleReady exits with a non-zero status unless the daemon answers within
+// the timeout, for scripts waiting for it to start
+func handleReady(c *cli.Context) {
+	if !daemon.DaemonReady(time.Duration(c.Int("timeout")) * time.Second) {
+		os.Exit(1)
+	}
+}
+
+func handleDetachChild(c *cli.Context) {
+	id, pid := childPidArgs(c, "detachchild")
+	if err := daemon.DetachChild(id, pid); err != nil {
+		fmt.Fprintf(os.Stderr, "Detach command failed: %s.\n", err)
+		os.Exit(1)
+	}
+}
+
+func handleAttachChild(c *cli.Context) {
+	id, pid := childPidArgs(c, "attachchild")
+	if err := daemon.AttachChild(id, pid); err != nil {
+		fmt.Fprintf(os.Stderr, "Attach command failed: %s.\n", err)
+		os.Exit(1)
+	}
+}
+
+func childPidArgs(c *cli.Context, command string) (int, int) {
+	if len(c.Args()) != 2 {
+		fmt.Fprintf(os.Stderr, "oz %s <sandbox_id> <pid>\n", command)
+		os.Exit(1)
+	}
+	id := sandboxIdArg(c, command)
+	pid, err := strconv.Atoi(c.Args()[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not parse pid value %s\n", c.Args()[1])
+		os.Exit(1)
+	}
+	return id, pid
+}
+
+// sandboxIdArg returns the sandbox id given as first argument, or the id of
+// the running sandbox of the profile named by it, exiting if it is missing or
+// matches no sandbox
+func sandboxIdArg(c *cli.Context, action string) int {
+	if len(c.Args()) == 0 {
+		fmt.Fprintf(os.Stderr, "Need a sandbox id to %s\n", action)
+		os.Exit(1)
+	}
+	id, err := strconv.Atoi(c.Args()[0])
+	if err != nil {
+		if id, err = daemon.ResolveSandboxId(c.Args()[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not find sandbox %s: %s.\n", c.Args()[0], err)
+			os.Exit(1)
+		}
+	}
+	return id
+}
+
+func handleSetHostname(c *cli.Context) {
+	id := sandboxIdArg(c, "set the hostname")
+	hostname := ""
+	if len(c.Args()) > 1 {
+		hostname = c.Args()[1]
+	}
+	if err := daemon.SetHostname(id, hostname); err != nil {
+		fmt.Fprintf(os.Stderr, "Set hostname failed: %s.\n", err)
+		os.Exit(1)
+	}
+}
+
+func handleGetLaunchEnv(c *cli.Context) {
+	id := sandboxIdArg(c, "show the launch environment")
+	var env []string
+	var err error
+	if c.Bool("unredacted") {
+		env, err = daemon.GetLaunchEnvUnredacted(id)
+	} else {
+		env, err = daemon.GetLaunchEnv(id)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Launch environment failed: %s.\n", err)
+		os.Exit(1)
+	}
+	for _, e := range env {
+		fmt.Println(e)
+	}
+}
+
+// Size of the stdin chunks sent by oz feed
+const feedChunkSize = 32 * 1024
+
+func handleFeed(c *cli.Context) {
+	id := sandboxIdArg(c, "feed a program")
+	if len(c.Args()) < 2 {
+		fmt.Fprintf(os.Stderr, "oz feed <sandbox_id> <path> [args...]\n")
+		os.Exit(1)
+	}
+	pid, err := daemon.RunInteractive(id, c.Args()[1], c.Args()[2:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error running program: %v\n", err)
+		os.Exit(1)
+	}
+	buf := make([]byte, feedChunkSize)
+	for {
+		n, rerr := os.Stdin.Read(buf)
+		if n > 0 {
+			if err := daemon.WriteStdin(id, pid, buf[:n]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing to program: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if rerr == io.EOF {
+			break
+		} else if rerr != nil {
+			fmt.Fprintf(os.Stderr, "Error reading stdin: %v\n", rerr)
+			os.Exit(1)
+		}
+	}
+	if err := daemon.CloseStdin(id, pid); err != nil {
+		fmt.Fprintf(os.Stderr, "Error closing program stdin: %v\n", err)
+		os.Exit(1)
 	}
 }
 
@@ -8,9 +8,11 @@ import (
 	"os"
 	"path"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/subgraph/oz/network"
+	"github.com/twtiger/gosecco/constants"
 )
 
 type Profile struct {
@@ -22,20 +24,35 @@ type Profile struct {
 	Paths []string
 	// Path of the config file
 	ProfilePath string `json:"-"`
+	// Base profile files merged into this one, relative to its directory
+	Include []string `json:"include"`
 	// Default parameters to pass to the program
 	DefaultParams []string `json:"default_params"`
 	// Pass command-line arguments
 	RejectUserArgs bool `json:"reject_user_args"`
 	// Autoshutdown the sandbox when the process exits. One of (no, yes, soft), defaults to yes
 	AutoShutdown ShutdownMode `json:"auto_shutdown"`
+	// Seconds the sandbox is kept up once its last tracked child exited,
+	// a new tracked child cancelling the shutdown
+	ShutdownDelay int `json:"shutdown_delay"`
 	// Optional list of executable names to watch for exit in case initial command spawns and exit
 	Watchdog []string
 	// Optional wrapper binary to use when launching command (ex: tsocks)
 	Wrapper string
+	// Optional absolute directories searched before /usr/bin:/bin in the
+	// PATH of the launched programs
+	ExtraPath []string `json:"extra_path"`
 	// If true launch one sandbox per instance, otherwise run all instances in same sandbox
 	Multi bool
+	// Whether IsRunning compares only the path or also the args of the
+	// launched programs. One of (path, pathargs), defaults to path
+	RunningMatch RunningMatch `json:"running_match"`
 	// Disable mounting of sys and proc inside the sandbox
 	NoSysProc bool
+	// Make /proc/sys read-only, /sys always being so
+	ReadOnlyProcSys bool `json:"read_only_proc_sys"`
+	// Mount /proc with hidepid=2 so that processes of other users are hidden
+	ProcHidePid bool `json:"proc_hide_pid"`
 	// Disable bind mounting of default directories (etc,usr,bin,lib,lib64)
 	// Also disables default blacklist items (/sbin, /usr/sbin, /usr/bin/sudo)
 	// Normally not used
@@ -43,12 +60,63 @@ type Profile struct {
 	// Allow bind mounting of files passed as arguments inside the sandbox
 	AllowFiles    bool     `json:"allow_files"`
 	AllowedGroups []string `json:"allowed_groups"`
+	// Optional names of the allowed groups granted to the launched programs,
+	// all of them when empty. The video and audio groups are added when the
+	// xserver and audio settings need them
+	Groups []string `json:"groups"`
 	// Optional directory where per-process logs will be output
 	LogDir string `json:"log_dir"`
+	// Optional umask (octal string, ex: 0077) for processes launched in the sandbox
+	Umask string `json:"umask"`
+	// Never start a dbus session, even when features of the profile need one
+	DisableDbusSession bool `json:"disable_dbus_session"`
+	// Optional dedicated service user the sandbox runs as instead of the
+	// launching user, who stays the owner of the sandbox. It must be listed
+	// in the run_as_users of the configuration
+	RunAsUser string `json:"run_as_user"`
+	// Raise the core size limit and write the core dumps of crashed programs
+	// to the core_collect_path of the configuration
+	CollectCores bool `json:"collect_cores"`
+	// Optional script, by its path inside the sandbox, run as the sandbox user
+	// before the program is launched, the sandbox failing if it exits non zero
+	SetupScript string `json:"setup_script"`
+	// Run the program in a pseudo-terminal which can be attached to with oz attach
+	NeedsPty bool `json:"needs_pty"`
+	// Mount an overlay of the home directory of the user, backed by a tmpfs, so
+	// that programs see the real files but their changes are discarded on exit
+	EphemeralHomeOverlay bool `json:"ephemeral_home_overlay"`
+	// Device nodes (globs allowed) of the host bound in the sandbox /dev when
+	// use_full_dev is not set, their group being given to launched programs
+	Devices []string `json:"devices"`
+	// Allow block devices in devices, only character devices being bound otherwise
+	AllowBlockDevices bool `json:"allow_block_devices"`
+	// Keep the inherited hostname and domain name instead of setting them
+	PreserveHostname bool `json:"preserve_hostname"`
+	// Capabilities (ex: CAP_NET_RAW) dropped from the bounding set of the
+	// launched programs, so that no setuid or file capability grants them
+	DropCaps []string `json:"drop_caps"`
+	// Capabilities kept in the bounding set of the launched programs, all
+	// the others being dropped. It cannot be used with drop_caps
+	KeepCaps []string `json:"keep_caps"`
+	// Send the output of launched programs to /dev/null instead of logging it
+	DiscardOutput bool `json:"discard_output"`
+	// Optional file in the sandbox (variables allowed) the output of launched
+	// programs is also written to, truncated when the sandbox starts
+	LogToFile string `json:"log_to_file"`
+	// Optional timezone (ex: Europe/Paris) forced inside the sandbox instead of the host one
+	Timezone string `json:"timezone"`
+	// Optional locale (ex: fr_FR.UTF-8) set as LANG for the launched programs
+	Locale string `json:"locale"`
+	// Optional locale set as LC_ALL, overriding all the other locale variables
+	LcAll string `json:"lc_all"`
+	// Optional list of non-root uids allowed to open a shell in the sandbox, any if empty
+	ShellAllowedUids []uint32 `json:"shell_allowed_uids"`
 	// List of paths to bind mount inside jail
 	Whitelist []WhitelistItem
 	// List of paths to blacklist inside jail
 	Blacklist []BlacklistItem
+	// List of tmpfs scratch directories to mount inside jail
+	Tmpfs []TmpfsItem
 	// Shared Folders
 	SharedFolders []string `json:"shared_folders"`
 	// Optional XServer config
@@ -73,6 +141,13 @@ const (
 	//PROFILE_SHUTDOWN_SOFT     ShutdownMode = "soft" // Unimplemented
 )
 
+type RunningMatch string
+
+const (
+	PROFILE_RUNNING_MATCH_PATH     RunningMatch = "path"
+	PROFILE_RUNNING_MATCH_PATHARGS RunningMatch = "pathargs"
+)
+
 type AudioMode string
 
 const (
@@ -84,14 +159,58 @@ const (
 
 type XServerConf struct {
 	Enabled             bool
-	TrayIcon            string    `json:"tray_icon"`
-	WindowIcon          string    `json:"window_icon"`
-	EnableTray          bool      `json:"enable_tray"`
-	EnableNotifications bool      `json:"enable_notifications"`
-	DisableClipboard    bool      `json:"disable_clipboard"`
-	AudioMode           AudioMode `json:"audio_mode"`
-	PulseAudio          bool      `json:"pulseaudio"`
-	Border              bool      `json:"border"`
+	Mode                XServerMode `json:"mode"`
+	TrayIcon            string      `json:"tray_icon"`
+	WindowIcon          string      `json:"window_icon"`
+	EnableTray          bool        `json:"enable_tray"`
+	EnableNotifications bool        `json:"enable_notifications"`
+	DisableClipboard    bool        `json:"disable_clipboard"`
+	AudioMode           AudioMode   `json:"audio_mode"`
+	PulseAudio          bool        `json:"pulseaudio"`
+	Border              bool        `json:"border"`
+	// Reattach the xpra client when the server reports its disconnection
+	AutoReconnect bool `json:"auto_reconnect"`
+	// Optional number of a host display, such as an offscreen Xvfb, whose
+	// socket is bound in the sandbox and exported as OZ_SECONDARY_DISPLAY
+	SecondaryDisplay int `json:"secondary_display"`
+}
+
+type XServerMode string
+
+const (
+	PROFILE_XSERVER_XPRA XServerMode = "xpra"
+	// Bind the X11 socket of the host display, without any isolation from
+	// the other clients of the display
+	PROFILE_XSERVER_X11DIRECT XServerMode = "x11direct"
+	// Bind the socket of the host Wayland compositor, which the programs
+	// then access directly
+	PROFILE_XSERVER_WAYLAND XServerMode = "wayland"
+)
+
+// UsesXpra reports whether the programs of the sandbox display through xpra
+func (x *XServerConf) UsesXpra() bool {
+	return x.Enabled && x.Mode != PROFILE_XSERVER_X11DIRECT && x.Mode != PROFILE_XSERVER_WAYLAND
+}
+
+// IsWayland reports whether the sandbox uses the host Wayland compositor
+func (x *XServerConf) IsWayland() bool {
+	return x.Enabled && x.Mode == PROFILE_XSERVER_WAYLAND
+}
+
+// IsDirect reports whether the sandbox uses the host X11 display directly
+func (x *XServerConf) IsDirect() bool {
+	return x.Enabled && x.Mode == PROFILE_XSERVER_X11DIRECT
+}
+
+// XpraClientOpts overrides the attach parameters of a relaunched xpra client.
+// Empty fields keep the defaults derived from the profile.
+type XpraClientOpts struct {
+	Encoding       string
+	OpenGL         string
+	Border         string
+	DesktopScaling string
+	Tray           *bool
+	KeyboardSync   *bool
 }
 
 type SeccompMode string
@@ -103,6 +222,15 @@ const (
 	PROFILE_SECCOMP_DISABLED  SeccompMode = "disabled"
 )
 
+// IsValidSeccompMode reports whether m is one of the known seccomp modes
+func IsValidSeccompMode(m SeccompMode) bool {
+	switch m {
+	case PROFILE_SECCOMP_TRAIN, PROFILE_SECCOMP_WHITELIST, PROFILE_SECCOMP_BLACKLIST, PROFILE_SECCOMP_DISABLED:
+		return true
+	}
+	return false
+}
+
 type SeccompConf struct {
 	Mode        SeccompMode
 	Enforce     bool
@@ -112,8 +240,32 @@ type SeccompConf struct {
 	Whitelist   string
 	Blacklist   string
 	ExtraDefs   []string
+	// Syscalls allowed in whitelist mode, or killed in blacklist mode, in
+	// addition to the rules of the policy file, so that the profile does
+	// not need one
+	WhitelistSyscalls []string `json:"whitelist_syscalls"`
+	BlacklistSyscalls []string `json:"blacklist_syscalls"`
+	// Path in the sandbox of the oz-seccomp binary applying the policy,
+	// the one of the oz prefix being used when empty
+	BinaryPath string `json:"binary_path"`
 }
 
+// Environment variable giving oz-seccomp-tracer the path where it writes a
+// snapshot of the training policy when it receives SIGUSR2
+const SeccompSnapshotEnv = "_OZ_SECCOMP_SNAPSHOT"
+
+// Environment variable telling oz-seccomp to connect the program to its
+// controlling terminal once the profile has been read from stdin
+const SeccompTtyEnv = "_OZ_SECCOMP_TTY"
+
+// Environment variable giving oz-seccomp-tracer the descriptor where it
+// writes the name of each syscall denied by the policy, one per line
+const SeccompHitsFdEnv = "_OZ_SECCOMP_HITS_FD"
+
+// Line written by oz-seccomp-tracer on the hits descriptor once it has
+// written a snapshot of the training policy
+const SeccompSnapshotHit = "#snapshot"
+
 type VPNConf struct {
 	VpnType          string `json:"type"`
 	ConfigPath       string
@@ -143,6 +295,16 @@ type WhitelistItem struct {
 	Force       bool
 	NoFollow    bool `json:"no_follow"`
 	AllowSetuid bool `json:"allow_suid"`
+	// Mount the item noexec so that its files cannot be executed
+	NoExec bool `json:"no_exec"`
+	// Take the source path under this directory instead of the host root
+	SourceRoot string `json:"source_root"`
+	// Serve the host unix socket Path at the target through a socket owned by
+	// the sandbox user, instead of binding it with the host ownership
+	SocketForward bool `json:"socket_forward"`
+	// Skip the item if its source is missing, other errors failing the
+	// launch unlike with ignore
+	Optional bool `json:"optional"`
 }
 
 type BlacklistItem struct {
@@ -150,6 +312,18 @@ type BlacklistItem struct {
 	NoFollow bool `json:"no_follow"`
 }
 
+// Default size and mode of tmpfs items which do not specify them
+const (
+	DefaultTmpfsSizeMB = 256
+	DefaultTmpfsMode   = "0700"
+)
+
+type TmpfsItem struct {
+	Path   string
+	SizeMB int    `json:"size_mb"`
+	Mode   string `json:"mode"`
+}
+
 type FWRule struct {
 	Whitelist bool   `json:"whitelist"`
 	DstHost   string `json:"dst_host"`
@@ -280,25 +454,33 @@ func LoadProfiles(dir string) (Profiles, error) {
 
 var commentRegexp = regexp.MustCompile("^[ \t]*#")
 
+var localeRegexp = regexp.MustCompile(`^[a-zA-Z]{1,8}([_-][a-zA-Z0-9]{1,8})?(\.[a-zA-Z0-9-]{1,16})?(@[a-zA-Z0-9]{1,16})?$`)
+
+// PATH of the launched programs without extra_path
+const DefaultLaunchPath = "/usr/bin:/bin"
+
+// LaunchPath returns the PATH of the programs launched in the sandbox
+func (p *Profile) LaunchPath() string {
+	return strings.Join(append(append([]string{}, p.ExtraPath...), DefaultLaunchPath), ":")
+}
+
+// IsValidLocale loosely checks that l has the language[_territory][.codeset][@modifier]
+// form of locale names, C and POSIX included
+func IsValidLocale(l string) bool {
+	return localeRegexp.MatchString(l)
+}
+
 func loadProfileFile(fpath string) (*Profile, error) {
-	if err := checkConfigPermissions(fpath); err != nil {
+	m, err := loadProfileMap(path.Clean(fpath), nil)
+	if err != nil {
 		return nil, err
 	}
-
-	file, err := os.Open(fpath)
+	bs, err := json.Marshal(m)
 	if err != nil {
 		return nil, err
 	}
-	scanner := bufio.NewScanner(file)
-	bs := ""
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !commentRegexp.MatchString(line) {
-			bs += line + "\n"
-		}
-	}
 	p := new(Profile)
-	if err := json.Unmarshal([]byte(bs), p); err != nil {
+	if err := json.Unmarshal(bs, p); err != nil {
 		return nil, err
 	}
 	if p.Name == "" {
@@ -307,15 +489,205 @@ func loadProfileFile(fpath string) (*Profile, error) {
 	if p.AutoShutdown == "" {
 		p.AutoShutdown = PROFILE_SHUTDOWN_YES
 	}
+	switch p.RunningMatch {
+	case "":
+		p.RunningMatch = PROFILE_RUNNING_MATCH_PATH
+	case PROFILE_RUNNING_MATCH_PATH, PROFILE_RUNNING_MATCH_PATHARGS:
+	default:
+		return nil, fmt.Errorf("invalid running match '%s'", p.RunningMatch)
+	}
 	if p.XServer.AudioMode == "" {
 		p.XServer.AudioMode = PROFILE_AUDIO_NONE
 	}
+	switch p.XServer.Mode {
+	case "":
+		p.XServer.Mode = PROFILE_XSERVER_XPRA
+	case PROFILE_XSERVER_XPRA, PROFILE_XSERVER_X11DIRECT, PROFILE_XSERVER_WAYLAND:
+	default:
+		return nil, fmt.Errorf("invalid xserver mode '%s'", p.XServer.Mode)
+	}
+	for _, sc := range append(append([]string{}, p.Seccomp.WhitelistSyscalls...), p.Seccomp.BlacklistSyscalls...) {
+		if _, ok := constants.Syscalls[sc]; !ok {
+			return nil, fmt.Errorf("unknown syscall '%s' in seccomp policy", sc)
+		}
+	}
+	if p.Seccomp.BinaryPath != "" && !path.IsAbs(p.Seccomp.BinaryPath) {
+		return nil, fmt.Errorf("seccomp binary path '%s' is not an absolute path", p.Seccomp.BinaryPath)
+	}
+	if p.ShutdownDelay < 0 {
+		return nil, fmt.Errorf("invalid shutdown delay %d", p.ShutdownDelay)
+	}
+	if p.XServer.SecondaryDisplay < 0 {
+		return nil, fmt.Errorf("invalid secondary display %d", p.XServer.SecondaryDisplay)
+	}
 	if p.Seccomp.Mode == "" {
 		p.Seccomp.Mode = PROFILE_SECCOMP_DISABLED
 	}
+	if p.Umask != "" {
+		mask, err := strconv.ParseUint(p.Umask, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid umask '%s': %v", p.Umask, err)
+		}
+		if mask > 0777 {
+			return nil, fmt.Errorf("invalid umask '%s', must be at most 0777", p.Umask)
+		}
+	}
+	if err := p.validateCapabilities(); err != nil {
+		return nil, err
+	}
+	for _, dev := range p.Devices {
+		if !strings.HasPrefix(dev, "/dev/") || strings.Contains(dev, "..") {
+			return nil, fmt.Errorf("invalid device '%s', must be a path in /dev", dev)
+		}
+	}
+	if p.Timezone != "" && (path.IsAbs(p.Timezone) || strings.Contains(p.Timezone, "..")) {
+		return nil, fmt.Errorf("invalid timezone '%s'", p.Timezone)
+	}
+	if p.RunAsUser != "" && p.XServer.Enabled {
+		return nil, fmt.Errorf("run_as_user cannot be used with an xserver")
+	}
+	if p.SetupScript != "" && !path.IsAbs(p.SetupScript) {
+		return nil, fmt.Errorf("setup script '%s' is not an absolute path", p.SetupScript)
+	}
+	for _, l := range []string{p.Locale, p.LcAll} {
+		if l != "" && !IsValidLocale(l) {
+			return nil, fmt.Errorf("invalid locale '%s'", l)
+		}
+	}
+	for _, d := range p.ExtraPath {
+		if !path.IsAbs(d) || strings.Contains(d, ":") {
+			return nil, fmt.Errorf("invalid extra_path directory '%s'", d)
+		}
+	}
+	for _, wl := range p.Whitelist {
+		if wl.SourceRoot != "" && !path.IsAbs(wl.SourceRoot) {
+			return nil, fmt.Errorf("source root '%s' of %s is not an absolute path", wl.SourceRoot, wl.Path)
+		}
+	}
+	for i := range p.Tmpfs {
+		t := &p.Tmpfs[i]
+		if t.Path == "" {
+			return nil, fmt.Errorf("tmpfs item is missing a path")
+		}
+		if t.SizeMB <= 0 {
+			t.SizeMB = DefaultTmpfsSizeMB
+		}
+		if t.Mode == "" {
+			t.Mode = DefaultTmpfsMode
+		}
+		if _, err := strconv.ParseUint(t.Mode, 8, 32); err != nil {
+			return nil, fmt.Errorf("invalid tmpfs mode '%s' for %s: %v", t.Mode, t.Path, err)
+		}
+	}
 	if p.Networking.IpByte <= 1 || p.Networking.IpByte > 254 {
 		p.Networking.IpByte = 0
 	}
 	p.ProfilePath = fpath
 	return p, nil
 }
+
+// loadProfileMap reads the profile file fpath as a JSON object into which
+// the files it includes are merged. The fields of the including file take
+// precedence over the included ones, except for lists which are
+// concatenated. The included files are loaded by the files in chain.
+func loadProfileMap(fpath string, chain []string) (map[string]interface{}, error) {
+	for _, c := range chain {
+		if c == fpath {
+			return nil, fmt.Errorf("include cycle: %s", strings.Join(append(chain, fpath), " -> "))
+		}
+	}
+	m, err := readProfileMap(fpath)
+	if err != nil {
+		return nil, err
+	}
+	includes := []string{}
+	if inc, ok := m["include"]; ok {
+		items, ok := inc.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("include must be a list of file paths")
+		}
+		for _, item := range items {
+			s, ok := item.(string)
+			if !ok || s == "" {
+				return nil, fmt.Errorf("include must be a list of file paths")
+			}
+			includes = append(includes, s)
+		}
+	}
+	merged := make(map[string]interface{})
+	for _, inc := range includes {
+		if !path.IsAbs(inc) {
+			inc = path.Join(path.Dir(fpath), inc)
+		}
+		bm, err := loadProfileMap(path.Clean(inc), append(chain, fpath))
+		if err != nil {
+			return nil, fmt.Errorf("error loading include '%s': %v", inc, err)
+		}
+		delete(bm, "include")
+		mergeProfileMaps(merged, bm)
+	}
+	mergeProfileMaps(merged, m)
+	return merged, nil
+}
+
+// readProfileMap reads a profile file, skipping the comment lines
+func readProfileMap(fpath string) (map[string]interface{}, error) {
+	if err := checkConfigPermissions(fpath); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	bs := ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !commentRegexp.MatchString(line) {
+			bs += line + "\n"
+		}
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(bs), &m); err != nil {
+		return nil, err
+	}
+	return lowerKeys(m).(map[string]interface{}), nil
+}
+
+// lowerKeys lower cases the object keys in v, the JSON field names of a
+// profile being matched without case.
+func lowerKeys(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(vv))
+		for k, e := range vv {
+			m[strings.ToLower(k)] = lowerKeys(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range vv {
+			vv[i] = lowerKeys(e)
+		}
+	}
+	return v
+}
+
+func mergeProfileMaps(dst, src map[string]interface{}) {
+	for k, v := range src {
+		switch sv := v.(type) {
+		case map[string]interface{}:
+			if dv, ok := dst[k].(map[string]interface{}); ok {
+				mergeProfileMaps(dv, sv)
+				continue
+			}
+		case []interface{}:
+			if dv, ok := dst[k].([]interface{}); ok {
+				dst[k] = append(append([]interface{}{}, dv...), sv...)
+				continue
+			}
+		}
+		dst[k] = v
+	}
+}
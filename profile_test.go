@@ -0,0 +1,173 @@
+package oz
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func writeProfileFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "ozprofile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// loadProfileString loads a profile file with the given content
+func loadProfileString(t *testing.T, content string) (*Profile, error) {
+	dir := writeProfileFiles(t, map[string]string{"app.json": content})
+	defer os.RemoveAll(dir)
+	return loadProfileFile(path.Join(dir, "app.json"))
+}
+
+func TestLoadProfileInclude(t *testing.T) {
+	dir := writeProfileFiles(t, map[string]string{
+		"browser.json": `{
+	"name": "browser",
+	"path": "/usr/bin/browser",
+	"include": ["base.inc"],
+	"XServer": {"enable_tray": true},
+	"whitelist": [{"path": "${HOME}/Downloads"}]
+}`,
+		"base.inc": `# common settings
+{
+	"include": ["seccomp.inc"],
+	"path": "/usr/bin/base",
+	"umask": "0077",
+	"xserver": {"enabled": true, "audio_mode": "speaker"},
+	"whitelist": [{"path": "/etc/fonts", "read_only": true}]
+}`,
+		"seccomp.inc": `{"seccomp": {"mode": "whitelist"}}`,
+	})
+	defer os.RemoveAll(dir)
+
+	p, err := loadProfileFile(path.Join(dir, "browser.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.Path != "/usr/bin/browser" {
+		t.Errorf("expected the including profile path to win, got %s", p.Path)
+	}
+	if p.Umask != "0077" {
+		t.Errorf("expected umask from the base profile, got %q", p.Umask)
+	}
+	if !p.XServer.Enabled || !p.XServer.EnableTray || p.XServer.AudioMode != PROFILE_AUDIO_SPEAKER {
+		t.Errorf("expected merged xserver configuration, got %+v", p.XServer)
+	}
+	if p.Seccomp.Mode != PROFILE_SECCOMP_WHITELIST {
+		t.Errorf("expected seccomp mode from the nested include, got %s", p.Seccomp.Mode)
+	}
+	if len(p.Whitelist) != 2 || p.Whitelist[0].Path != "/etc/fonts" || p.Whitelist[1].Path != "${HOME}/Downloads" {
+		t.Errorf("expected concatenated whitelist, got %+v", p.Whitelist)
+	}
+	if len(p.Include) != 1 || p.Include[0] != "base.inc" {
+		t.Errorf("expected only the direct includes, got %v", p.Include)
+	}
+}
+
+func TestLoadProfileIncludeCycle(t *testing.T) {
+	dir := writeProfileFiles(t, map[string]string{
+		"a.json": `{"path": "/usr/bin/a", "include": ["b.inc"]}`,
+		"b.inc":  `{"include": ["c.inc"]}`,
+		"c.inc":  `{"include": ["b.inc"]}`,
+	})
+	defer os.RemoveAll(dir)
+
+	_, err := loadProfileFile(path.Join(dir, "a.json"))
+	if err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Errorf("expected an include cycle error, got %v", err)
+	}
+}
+
+func TestIsValidLocale(t *testing.T) {
+	for l, expected := range map[string]bool{
+		"C":                 true,
+		"POSIX":             true,
+		"en_US.UTF-8":       true,
+		"fr_FR.utf8":        true,
+		"de_DE@euro":        true,
+		"sr_RS.UTF-8@latin": true,
+		"":                  false,
+		"en_US.UTF-8 ":      false,
+		"../../etc":         false,
+		"en_US;rm":          false,
+	} {
+		if IsValidLocale(l) != expected {
+			t.Errorf("expected IsValidLocale(%q) to be %v", l, expected)
+		}
+	}
+}
+
+func TestLaunchPath(t *testing.T) {
+	p := &Profile{}
+	if lp := p.LaunchPath(); lp != DefaultLaunchPath {
+		t.Errorf("LaunchPath() = %s, want %s", lp, DefaultLaunchPath)
+	}
+	p.ExtraPath = []string{"/opt/app/bin", "/usr/local/bin"}
+	if lp := p.LaunchPath(); lp != "/opt/app/bin:/usr/local/bin:/usr/bin:/bin" {
+		t.Errorf("LaunchPath() = %s", lp)
+	}
+}
+
+// The fields of each row are added to a minimal profile, invalid ones having
+// to fail with an error containing errContains
+var profileOptionTests = []struct {
+	fields      string
+	valid       bool
+	errContains string
+}{
+	{`"extra_path": ["/opt/bin"]`, true, ""},
+	{`"extra_path": ["bin"]`, false, ""},
+	{`"extra_path": ["/opt/bin:/tmp"]`, false, ""},
+	{`"xserver": {"secondary_display": 99}`, true, ""},
+	{`"xserver": {"secondary_display": 0}`, true, ""},
+	{`"xserver": {"secondary_display": -1}`, false, ""},
+	{`"umask": "0077"`, true, ""},
+	{`"umask": "777"`, true, ""},
+	{`"umask": "01777"`, false, ""},
+	{`"umask": "0888"`, false, ""},
+	{`"seccomp": {"whitelist_syscalls": ["read", "write", "exit_group"]}`, true, ""},
+	{`"seccomp": {"blacklist_syscalls": ["kexec_load"]}`, true, ""},
+	{`"seccomp": {"whitelist_syscalls": ["read", "no_such_call"]}`, false, "no_such_call"},
+	{`"seccomp": {"blacklist_syscalls": ["READ"]}`, false, "READ"},
+	{`"drop_caps": ["CAP_NET_RAW", "CAP_SYS_ADMIN"]`, true, ""},
+	{`"keep_caps": ["CAP_CHOWN"]`, true, ""},
+	{`"drop_caps": ["CAP_NO_SUCH"]`, false, ""},
+	{`"drop_caps": ["net_raw"]`, false, ""},
+	{`"drop_caps": ["CAP_NET_RAW"], "keep_caps": ["CAP_CHOWN"]`, false, ""},
+}
+
+func TestLoadProfileOptions(t *testing.T) {
+	for _, tt := range profileOptionTests {
+		_, err := loadProfileString(t, `{"name": "app", "path": "/usr/bin/app", `+tt.fields+`}`)
+		if tt.valid && err != nil {
+			t.Errorf("loading %s failed: %v", tt.fields, err)
+		} else if !tt.valid && (err == nil || !strings.Contains(err.Error(), tt.errContains)) {
+			t.Errorf("loading %s returned %v", tt.fields, err)
+		}
+	}
+}
+
+func TestBoundingCapsDrop(t *testing.T) {
+	p := &Profile{DropCaps: []string{"CAP_NET_RAW", "CAP_CHECKPOINT_RESTORE"}}
+	if caps := p.BoundingCapsDrop(37); len(caps) != 1 || caps[0] != 13 {
+		t.Errorf("expected only CAP_NET_RAW known to the kernel to be dropped, got %v", caps)
+	}
+	p = &Profile{KeepCaps: []string{"CAP_CHOWN", "CAP_KILL"}}
+	caps := p.BoundingCapsDrop(6)
+	if len(caps) != 5 || caps[0] != 1 || caps[3] != 4 || caps[4] != 6 {
+		t.Errorf("expected all but CAP_CHOWN and CAP_KILL to be dropped, got %v", caps)
+	}
+}
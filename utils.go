@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 	"syscall"
 )
 
@@ -30,3 +32,76 @@ func checkPathRootPermissions(fpath string) error {
 	}
 	return nil
 }
+
+// CheckRootExecutable checks that fpath is an executable which only root can
+// replace, for programs run with privileges: it and its directory, symlinks
+// resolved, must be owned by root and not writable by group or others.
+func CheckRootExecutable(fpath string) error {
+	rpath, err := filepath.EvalSymlinks(fpath)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(rpath)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", fpath)
+	}
+	if fi.Mode()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", fpath)
+	}
+	for _, p := range []string{rpath, path.Dir(rpath), path.Dir(fpath)} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		if fi.Sys().(*syscall.Stat_t).Uid != 0 {
+			return fmt.Errorf("%s is not owned by root", p)
+		}
+		if fi.Mode().Perm()&022 != 0 {
+			return fmt.Errorf("%s is writable by group or others", p)
+		}
+	}
+	return nil
+}
+
+// Signals which may be named in the configuration, SIGUSR1 and SIGCHLD are
+// left out as oz-init relies on them itself, and SIGUSR2 as it asks the
+// seccomp tracers for a snapshot of their training policy.
+var configurableSignals = map[string]syscall.Signal{
+	"SIGHUP":   syscall.SIGHUP,
+	"SIGINT":   syscall.SIGINT,
+	"SIGQUIT":  syscall.SIGQUIT,
+	"SIGTERM":  syscall.SIGTERM,
+	"SIGWINCH": syscall.SIGWINCH,
+	"SIGCONT":  syscall.SIGCONT,
+}
+
+// ParseSignal returns the signal for a name such as SIGTERM or TERM.
+func ParseSignal(name string) (syscall.Signal, error) {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := configurableSignals[name]
+	if !ok {
+		return 0, fmt.Errorf("unsupported signal name '%s'", name)
+	}
+	return sig, nil
+}
+
+// Directory of the removable media of the sandbox user
+const UserMediaDir = "/media/user"
+
+// IsUserMountPath returns whether the clean absolute path p is in the home
+// directory homedir or in UserMediaDir, the only places files are mounted
+// from and at in a running sandbox.
+func IsUserMountPath(p, homedir string) bool {
+	for _, dir := range []string{homedir, UserMediaDir} {
+		if p == dir || strings.HasPrefix(p, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,19 @@
+package oz
+
+import "testing"
+
+func TestIsUserMountPath(t *testing.T) {
+	for p, expected := range map[string]bool{
+		"/home/user":               true,
+		"/home/user/Downloads/a":   true,
+		"/media/user/usb/file.pdf": true,
+		"/home/user2/file":         false,
+		"/media/username":          false,
+		"/etc/passwd":              false,
+		"/":                        false,
+	} {
+		if IsUserMountPath(p, "/home/user") != expected {
+			t.Errorf("expected IsUserMountPath(%q) to be %v", p, expected)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"regexp"
 	"syscall"
 
 	"github.com/subgraph/oz"
@@ -21,12 +22,12 @@ var xpraClientDefaultArgs = []string{
 	"--no-keyboard-sync",
 }
 
-func NewClient(config *oz.XServerConf, display uint64, cred *syscall.Credential, spath, workdir, hostname string, log *logging.Logger) *Xpra {
+func NewClient(config *oz.XServerConf, opts *oz.XpraClientOpts, display uint64, cred *syscall.Credential, spath, workdir, hostname string, log *logging.Logger) *Xpra {
 	x := new(Xpra)
 	x.Config = config
 	x.Display = display
 	x.WorkDir = workdir
-	x.xpraArgs = prepareClientArgs(config, display, workdir, log)
+	x.xpraArgs = prepareClientArgs(config, opts, display, workdir, log)
 
 	x.xpraArgs = append([]string{"-mode=blacklist", "/usr/bin/xpra"}, x.xpraArgs...)
 
@@ -49,7 +50,7 @@ func NewClient(config *oz.XServerConf, display uint64, cred *syscall.Credential,
 	return x
 }
 
-func prepareClientArgs(config *oz.XServerConf, display uint64, workdir string, log *logging.Logger) []string {
+func prepareClientArgs(config *oz.XServerConf, opts *oz.XpraClientOpts, display uint64, workdir string, log *logging.Logger) []string {
 	args := getDefaultArgs(config)
 	args = append(args, xpraClientDefaultArgs...)
 	if !config.EnableTray {
@@ -68,6 +69,11 @@ func prepareClientArgs(config *oz.XServerConf, display uint64, workdir string, l
 		io.WriteString(h, workdir)
 		args = append(args, "--border=#"+fmt.Sprintf("%x", h.Sum(nil)[0:3]))
 	}
+	// xpra uses the last occurrence of an option, so the overrides go after
+	// the defaults
+	if opts != nil {
+		args = append(args, clientOptsArgs(opts)...)
+	}
 	args = append(args,
 		fmt.Sprintf("--socket-dir=%s", workdir),
 		"attach",
@@ -90,3 +96,73 @@ func exists(path, label string, log *logging.Logger) bool {
 	}
 	return true
 }
+
+// Values accepted for the xpra client flags which can be overridden on
+// relaunch. An empty list means the value is checked by a pattern instead.
+var clientOptsAllowed = map[string][]string{
+	"encoding":        {"auto", "rgb", "png", "png/L", "png/P", "jpeg", "webp", "h264", "vp8", "vp9"},
+	"opengl":          {"yes", "no", "auto"},
+	"border":          {"auto", "no", "off"},
+	"desktop-scaling": {"on", "off", "auto"},
+}
+
+var borderColorRe = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+var scalingFactorRe = regexp.MustCompile(`^[0-9](\.[0-9]{1,2})?$`)
+
+func isAllowedOpt(flag, value string) bool {
+	for _, v := range clientOptsAllowed[flag] {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateClientOpts checks every value set in opts against the values
+// supported for the corresponding xpra client flag.
+func ValidateClientOpts(opts *oz.XpraClientOpts) error {
+	if opts.Encoding != "" && !isAllowedOpt("encoding", opts.Encoding) {
+		return fmt.Errorf("unsupported xpra encoding: %s", opts.Encoding)
+	}
+	if opts.OpenGL != "" && !isAllowedOpt("opengl", opts.OpenGL) {
+		return fmt.Errorf("unsupported xpra opengl value: %s", opts.OpenGL)
+	}
+	if opts.Border != "" && !isAllowedOpt("border", opts.Border) && !borderColorRe.MatchString(opts.Border) {
+		return fmt.Errorf("unsupported xpra border value: %s", opts.Border)
+	}
+	if opts.DesktopScaling != "" && !isAllowedOpt("desktop-scaling", opts.DesktopScaling) && !scalingFactorRe.MatchString(opts.DesktopScaling) {
+		return fmt.Errorf("unsupported xpra desktop scaling value: %s", opts.DesktopScaling)
+	}
+	return nil
+}
+
+func clientOptsArgs(opts *oz.XpraClientOpts) []string {
+	args := []string{}
+	if opts.Encoding != "" {
+		args = append(args, "--encoding="+opts.Encoding)
+	}
+	if opts.OpenGL != "" {
+		args = append(args, "--opengl="+opts.OpenGL)
+	}
+	if opts.Border != "" {
+		args = append(args, "--border="+opts.Border)
+	}
+	if opts.DesktopScaling != "" {
+		args = append(args, "--desktop-scaling="+opts.DesktopScaling)
+	}
+	if opts.Tray != nil {
+		if *opts.Tray {
+			args = append(args, "--tray")
+		} else {
+			args = append(args, "--no-tray")
+		}
+	}
+	if opts.KeyboardSync != nil {
+		if *opts.KeyboardSync {
+			args = append(args, "--keyboard-sync")
+		} else {
+			args = append(args, "--no-keyboard-sync")
+		}
+	}
+	return args
+}
@@ -0,0 +1,42 @@
+package xpra
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/subgraph/oz"
+)
+
+func TestValidateClientOpts(t *testing.T) {
+	valid := []oz.XpraClientOpts{
+		{},
+		{Encoding: "png", OpenGL: "no"},
+		{Border: "#ff0000", DesktopScaling: "1.5"},
+		{Border: "auto", DesktopScaling: "off"},
+	}
+	for _, opts := range valid {
+		if err := ValidateClientOpts(&opts); err != nil {
+			t.Errorf("expected %+v to be valid, got %v", opts, err)
+		}
+	}
+	invalid := []oz.XpraClientOpts{
+		{Encoding: "png --exec=/bin/sh"},
+		{OpenGL: "maybe"},
+		{Border: "red"},
+		{DesktopScaling: "2; rm"},
+	}
+	for _, opts := range invalid {
+		if err := ValidateClientOpts(&opts); err == nil {
+			t.Errorf("expected %+v to be rejected", opts)
+		}
+	}
+}
+
+func TestClientOptsArgs(t *testing.T) {
+	off := false
+	opts := &oz.XpraClientOpts{Encoding: "jpeg", Border: "no", Tray: &off}
+	expected := []string{"--encoding=jpeg", "--border=no", "--no-tray"}
+	if args := clientOptsArgs(opts); !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, got %v", expected, args)
+	}
+}
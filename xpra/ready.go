@@ -0,0 +1,32 @@
+package xpra
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Printed by the server once its unix socket is listening, used as an
+// alternate readiness signal for versions whose ready message is unknown.
+const socketCreatedMessage = "created unix domain socket"
+
+// IsReadyLine returns whether a line of xpra server output signals that the
+// server is ready to accept clients, either by containing one of patterns or
+// by reporting the creation of the server socket.
+func IsReadyLine(line string, patterns []string) bool {
+	for _, p := range patterns {
+		if p != "" && strings.Contains(line, p) {
+			return true
+		}
+	}
+	return strings.Contains(line, socketCreatedMessage)
+}
+
+// Printed by the server when an attached client goes away, whatever the
+// reason: the host display server restarting, a network failure...
+var clientDisconnectedRe = regexp.MustCompile(`xpra client [0-9]+ disconnected`)
+
+// IsClientDisconnectedLine returns whether a line of xpra server output
+// reports the disconnection of a client.
+func IsClientDisconnectedLine(line string) bool {
+	return clientDisconnectedRe.MatchString(line)
+}
@@ -0,0 +1,60 @@
+package xpra
+
+import (
+	"strings"
+	"testing"
+)
+
+var testReadyPatterns = []string{
+	"xpra is ready.",
+	"xpra X11 seamless server is ready",
+	"xpra X11 server is ready",
+}
+
+func TestIsReadyLine(t *testing.T) {
+	data := []struct {
+		name   string
+		output string
+		ready  int
+	}{
+		{"old format", `2016-01-12 14:55:01,230 Warning: cannot load dbus helper
+2016-01-12 14:55:01,451 xpra X11 version 0.15.10 64-bit
+2016-01-12 14:55:01,452 xpra is ready.`, 2},
+		{"new format", `2020-03-02 10:21:15,001 Xvfb command: Xvfb +extension GLX
+2020-03-02 10:21:15,840 xpra X11 seamless server version 3.0.6-r25174 64-bit
+2020-03-02 10:21:15,841  uid=1000 (user), gid=1000 (user)
+2020-03-02 10:21:15,902 xpra X11 seamless server is ready`, 3},
+		{"socket fallback", `2022-07-21 09:00:00,100 xpra 4.4 starting
+2022-07-21 09:00:00,200 created unix domain socket '/home/user/.Xoz/test/host-100'
+2022-07-21 09:00:00,300 xpra X11 shadow server, running`, 1},
+		{"not ready", `2016-01-12 14:55:01,230 Warning: cannot load dbus helper
+2016-01-12 14:55:01,451 xpra X11 version 0.15.10 64-bit`, -1},
+	}
+
+	for _, d := range data {
+		ready := -1
+		for i, line := range strings.Split(d.output, "\n") {
+			if IsReadyLine(line, testReadyPatterns) {
+				ready = i
+				break
+			}
+		}
+		if ready != d.ready {
+			t.Errorf("%s: expecting ready at line %d and got %d", d.name, d.ready, ready)
+		}
+	}
+}
+
+func TestIsClientDisconnectedLine(t *testing.T) {
+	for line, expected := range map[string]bool{
+		"2020-03-02 10:25:01,113 xpra client 1 disconnected.":       true,
+		"2021-11-08 18:02:44,510 xpra client 12 disconnected.":      true,
+		"2020-03-02 10:21:16,004 New unix-domain connection":        false,
+		"2020-03-02 10:21:16,210 xpra client 1 connected":           false,
+		"2020-03-02 10:21:15,902 xpra X11 seamless server is ready": false,
+	} {
+		if IsClientDisconnectedLine(line) != expected {
+			t.Errorf("expected IsClientDisconnectedLine(%q) to be %v", line, expected)
+		}
+	}
+}
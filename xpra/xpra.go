@@ -2,6 +2,7 @@ package xpra
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -76,7 +77,13 @@ func getDefaultArgs(config *oz.XServerConf) []string {
 }
 
 func (x *Xpra) Stop(cred *syscall.Credential) ([]byte, error) {
-	cmd := exec.Command("/usr/bin/xpra",
+	return x.StopContext(context.Background(), cred)
+}
+
+// StopContext runs xpra stop like Stop, the command being killed if ctx is
+// done before it completes.
+func (x *Xpra) StopContext(ctx context.Context, cred *syscall.Credential) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "/usr/bin/xpra",
 		"--socket-dir="+x.WorkDir,
 		"stop",
 		fmt.Sprintf(":%d", x.Display),
@@ -88,6 +95,27 @@ func (x *Xpra) Stop(cred *syscall.Credential) ([]byte, error) {
 	return cmd.Output()
 }
 
+// SetClipboard enables or disables clipboard sharing on a running server
+// through the xpra control interface.
+func (x *Xpra) SetClipboard(enabled bool, cred *syscall.Credential) ([]byte, error) {
+	direction := "disabled"
+	if enabled {
+		direction = "both"
+	}
+	cmd := exec.Command("/usr/bin/xpra",
+		"--socket-dir="+x.WorkDir,
+		"control",
+		fmt.Sprintf(":%d", x.Display),
+		"clipboard-direction",
+		direction,
+	)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: cred,
+	}
+	cmd.Env = []string{"TMPDIR=" + x.WorkDir}
+	return cmd.CombinedOutput()
+}
+
 func GetPath(u *user.User, name string) string {
 	return path.Join(u.HomeDir, ".Xoz", name)
 }